@@ -18,6 +18,7 @@ import (
 	"time"
 
 	pb "github.com/datanadhi/echopost/logagentpb"
+	t "github.com/datanadhi/echopost/tools"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -42,9 +43,18 @@ func main() {
 	baseDir := flag.String("datanadhi", "./.datanadhi", "path to datanadhi folder")
 	count := flag.Int("count", 10, "number of logs to send")
 	interval := flag.Duration("interval", 300*time.Millisecond, "interval between sends")
+	priority := flag.Int("priority", 0, "record priority (0 = normal, 1 = high)")
+	stream := flag.Bool("stream", false, "send all logs over a single StreamLogs call")
+	abstract := flag.Bool("socket-abstract", false, "connect to an agent started with -socket-abstract")
+	wait := flag.Duration("wait", 10*time.Second, "how long to wait for the agent socket to appear")
 	flag.Parse()
 
 	socket := fmt.Sprintf("unix:%s/data-nadhi-agent.sock", *baseDir)
+	if *abstract {
+		socket = fmt.Sprintf("unix-abstract:%s/data-nadhi-agent.sock", *baseDir)
+	} else if err := t.WaitForSocket(*baseDir+"/data-nadhi-agent.sock", *wait); err != nil {
+		log.Fatalf("agent socket not ready: %v", err)
+	}
 	conn, err := grpc.Dial(socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		log.Fatalf("failed to connect to agent: %v", err)
@@ -54,6 +64,11 @@ func main() {
 	client := pb.NewLogAgentClient(conn)
 	logJSON("client_connected", map[string]any{"socket": socket})
 
+	if *stream {
+		streamLogs(client, *count, int32(*priority))
+		return
+	}
+
 	for i := 0; i < *count; i++ {
 		// Prepare a simple JSON payload
 		jsonPayload := fmt.Sprintf(`{"msg":"log message %d","level":"INFO", "nested": {"something": "not important"}}`, i)
@@ -61,6 +76,7 @@ func main() {
 		req := &pb.LogRequest{
 			JsonData:  jsonPayload,
 			Pipelines: []string{"test-pipeline"},
+			Priority:  int32(*priority),
 		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
@@ -76,13 +92,46 @@ func main() {
 		}
 
 		logJSON("send_success", map[string]any{
-			"index":   i,
-			"success": resp.Success,
-			"message": resp.Message,
+			"index":              i,
+			"success":            resp.Success,
+			"message":            resp.Message,
+			"backpressure_ratio": resp.BackpressureRatio,
+			"queue_depth":        resp.QueueDepth,
+			"max_queue_depth":    resp.MaxQueueDepth,
 		})
 
-		time.Sleep(*interval)
+		// Honour the agent's backpressure hint
+		time.Sleep(t.BackpressureDelay(resp, *interval))
 	}
 
 	logJSON("client_done", map[string]any{"sent_count": *count})
 }
+
+// streamLogs sends count logs over one client stream and prints the summary.
+func streamLogs(client pb.LogAgentClient, count int, priority int32) {
+	stream, err := client.StreamLogs(context.Background())
+	if err != nil {
+		log.Fatalf("failed to open stream: %v", err)
+	}
+
+	for i := 0; i < count; i++ {
+		req := &pb.LogRequest{
+			JsonData:  fmt.Sprintf(`{"msg":"streamed log message %d","level":"INFO"}`, i),
+			Pipelines: []string{"test-pipeline"},
+			Priority:  priority,
+		}
+		if err := stream.Send(req); err != nil {
+			logJSON("stream_send_error", map[string]any{"index": i, "error": err.Error()})
+			break
+		}
+	}
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		log.Fatalf("stream failed: %v", err)
+	}
+	logJSON("stream_done", map[string]any{
+		"received_count": resp.ReceivedCount,
+		"failed_count":   resp.FailedCount,
+	})
+}
@@ -26,6 +26,12 @@ type LogRequest struct {
 	JsonData      string                 `protobuf:"bytes,1,opt,name=json_data,json=jsonData,proto3" json:"json_data,omitempty"` // raw JSON string
 	Pipelines     []string               `protobuf:"bytes,2,rep,name=pipelines,proto3" json:"pipelines,omitempty"`
 	ApiKey        string                 `protobuf:"bytes,3,opt,name=api_key,json=apiKey,proto3" json:"api_key,omitempty"`
+	Priority      int32                  `protobuf:"varint,4,opt,name=priority,proto3" json:"priority,omitempty"`                       // 0 = normal, 1 = high (uploaded first)
+	RequestId     string                 `protobuf:"bytes,5,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`     // client-chosen ID; retries with the same ID are stored once
+	ChunkId       string                 `protobuf:"bytes,6,opt,name=chunk_id,json=chunkId,proto3" json:"chunk_id,omitempty"`           // groups the parts of a payload split across calls
+	ChunkIndex    int32                  `protobuf:"varint,7,opt,name=chunk_index,json=chunkIndex,proto3" json:"chunk_index,omitempty"` // 0-based position of this part
+	ChunkTotal    int32                  `protobuf:"varint,8,opt,name=chunk_total,json=chunkTotal,proto3" json:"chunk_total,omitempty"` // number of parts; > 1 marks a chunked payload
+	Level         string                 `protobuf:"bytes,9,opt,name=level,proto3" json:"level,omitempty"`                              // DEBUG, INFO, WARN or ERROR; defaults to the payload's level/severity/log_level
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -81,12 +87,58 @@ func (x *LogRequest) GetApiKey() string {
 	return ""
 }
 
+func (x *LogRequest) GetPriority() int32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+func (x *LogRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *LogRequest) GetChunkId() string {
+	if x != nil {
+		return x.ChunkId
+	}
+	return ""
+}
+
+func (x *LogRequest) GetChunkIndex() int32 {
+	if x != nil {
+		return x.ChunkIndex
+	}
+	return 0
+}
+
+func (x *LogRequest) GetChunkTotal() int32 {
+	if x != nil {
+		return x.ChunkTotal
+	}
+	return 0
+}
+
+func (x *LogRequest) GetLevel() string {
+	if x != nil {
+		return x.Level
+	}
+	return ""
+}
+
 type LogResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
-	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Success           bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	Message           string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	BackpressureRatio float64                `protobuf:"fixed64,3,opt,name=backpressure_ratio,json=backpressureRatio,proto3" json:"backpressure_ratio,omitempty"` // stored records / max records (0 = no limit configured)
+	RetryAfterMs      int64                  `protobuf:"varint,4,opt,name=retry_after_ms,json=retryAfterMs,proto3" json:"retry_after_ms,omitempty"`               // suggested delay before the next send once the ratio exceeds 0.8
+	QueueDepth        int64                  `protobuf:"varint,5,opt,name=queue_depth,json=queueDepth,proto3" json:"queue_depth,omitempty"`                       // records waiting in the agent after this call
+	MaxQueueDepth     int64                  `protobuf:"varint,6,opt,name=max_queue_depth,json=maxQueueDepth,proto3" json:"max_queue_depth,omitempty"`            // configured record limit (0 = no limit)
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
 }
 
 func (x *LogResponse) Reset() {
@@ -133,21 +185,241 @@ func (x *LogResponse) GetMessage() string {
 	return ""
 }
 
+func (x *LogResponse) GetBackpressureRatio() float64 {
+	if x != nil {
+		return x.BackpressureRatio
+	}
+	return 0
+}
+
+func (x *LogResponse) GetRetryAfterMs() int64 {
+	if x != nil {
+		return x.RetryAfterMs
+	}
+	return 0
+}
+
+func (x *LogResponse) GetQueueDepth() int64 {
+	if x != nil {
+		return x.QueueDepth
+	}
+	return 0
+}
+
+func (x *LogResponse) GetMaxQueueDepth() int64 {
+	if x != nil {
+		return x.MaxQueueDepth
+	}
+	return 0
+}
+
+type StreamLogResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ReceivedCount int64                  `protobuf:"varint,1,opt,name=received_count,json=receivedCount,proto3" json:"received_count,omitempty"`
+	FailedCount   int64                  `protobuf:"varint,2,opt,name=failed_count,json=failedCount,proto3" json:"failed_count,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamLogResponse) Reset() {
+	*x = StreamLogResponse{}
+	mi := &file_logagent_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamLogResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamLogResponse) ProtoMessage() {}
+
+func (x *StreamLogResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_logagent_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamLogResponse.ProtoReflect.Descriptor instead.
+func (*StreamLogResponse) Descriptor() ([]byte, []int) {
+	return file_logagent_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *StreamLogResponse) GetReceivedCount() int64 {
+	if x != nil {
+		return x.ReceivedCount
+	}
+	return 0
+}
+
+func (x *StreamLogResponse) GetFailedCount() int64 {
+	if x != nil {
+		return x.FailedCount
+	}
+	return 0
+}
+
+type ConnectRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ProcessName   string                 `protobuf:"bytes,1,opt,name=process_name,json=processName,proto3" json:"process_name,omitempty"`
+	SdkVersion    string                 `protobuf:"bytes,2,opt,name=sdk_version,json=sdkVersion,proto3" json:"sdk_version,omitempty"`
+	Environment   string                 `protobuf:"bytes,3,opt,name=environment,proto3" json:"environment,omitempty"` // e.g. production, staging
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConnectRequest) Reset() {
+	*x = ConnectRequest{}
+	mi := &file_logagent_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConnectRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConnectRequest) ProtoMessage() {}
+
+func (x *ConnectRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_logagent_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConnectRequest.ProtoReflect.Descriptor instead.
+func (*ConnectRequest) Descriptor() ([]byte, []int) {
+	return file_logagent_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ConnectRequest) GetProcessName() string {
+	if x != nil {
+		return x.ProcessName
+	}
+	return ""
+}
+
+func (x *ConnectRequest) GetSdkVersion() string {
+	if x != nil {
+		return x.SdkVersion
+	}
+	return ""
+}
+
+func (x *ConnectRequest) GetEnvironment() string {
+	if x != nil {
+		return x.Environment
+	}
+	return ""
+}
+
+type ConnectResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	ConnectionId  uint64                 `protobuf:"varint,2,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"` // agent-assigned ID of the connection, for debugging
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConnectResponse) Reset() {
+	*x = ConnectResponse{}
+	mi := &file_logagent_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConnectResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConnectResponse) ProtoMessage() {}
+
+func (x *ConnectResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_logagent_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConnectResponse.ProtoReflect.Descriptor instead.
+func (*ConnectResponse) Descriptor() ([]byte, []int) {
+	return file_logagent_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ConnectResponse) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *ConnectResponse) GetConnectionId() uint64 {
+	if x != nil {
+		return x.ConnectionId
+	}
+	return 0
+}
+
 var File_logagent_proto protoreflect.FileDescriptor
 
 const file_logagent_proto_rawDesc = "" +
 	"\n" +
-	"\x0elogagent.proto\x12\blogagent\"`\n" +
+	"\x0elogagent.proto\x12\blogagent\"\x8e\x02\n" +
 	"\n" +
 	"LogRequest\x12\x1b\n" +
 	"\tjson_data\x18\x01 \x01(\tR\bjsonData\x12\x1c\n" +
 	"\tpipelines\x18\x02 \x03(\tR\tpipelines\x12\x17\n" +
-	"\aapi_key\x18\x03 \x01(\tR\x06apiKey\"A\n" +
+	"\aapi_key\x18\x03 \x01(\tR\x06apiKey\x12\x1a\n" +
+	"\bpriority\x18\x04 \x01(\x05R\bpriority\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x05 \x01(\tR\trequestId\x12\x19\n" +
+	"\bchunk_id\x18\x06 \x01(\tR\achunkId\x12\x1f\n" +
+	"\vchunk_index\x18\a \x01(\x05R\n" +
+	"chunkIndex\x12\x1f\n" +
+	"\vchunk_total\x18\b \x01(\x05R\n" +
+	"chunkTotal\x12\x14\n" +
+	"\x05level\x18\t \x01(\tR\x05level\"\xdf\x01\n" +
 	"\vLogResponse\x12\x18\n" +
 	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
-	"\amessage\x18\x02 \x01(\tR\amessage2B\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12-\n" +
+	"\x12backpressure_ratio\x18\x03 \x01(\x01R\x11backpressureRatio\x12$\n" +
+	"\x0eretry_after_ms\x18\x04 \x01(\x03R\fretryAfterMs\x12\x1f\n" +
+	"\vqueue_depth\x18\x05 \x01(\x03R\n" +
+	"queueDepth\x12&\n" +
+	"\x0fmax_queue_depth\x18\x06 \x01(\x03R\rmaxQueueDepth\"]\n" +
+	"\x11StreamLogResponse\x12%\n" +
+	"\x0ereceived_count\x18\x01 \x01(\x03R\rreceivedCount\x12!\n" +
+	"\ffailed_count\x18\x02 \x01(\x03R\vfailedCount\"v\n" +
+	"\x0eConnectRequest\x12!\n" +
+	"\fprocess_name\x18\x01 \x01(\tR\vprocessName\x12\x1f\n" +
+	"\vsdk_version\x18\x02 \x01(\tR\n" +
+	"sdkVersion\x12 \n" +
+	"\venvironment\x18\x03 \x01(\tR\venvironment\"P\n" +
+	"\x0fConnectResponse\x12\x18\n" +
+	"\asuccess\x18\x01 \x01(\bR\asuccess\x12#\n" +
+	"\rconnection_id\x18\x02 \x01(\x04R\fconnectionId2\xc7\x01\n" +
 	"\bLogAgent\x126\n" +
-	"\aSendLog\x12\x14.logagent.LogRequest\x1a\x15.logagent.LogResponseB\x1dZ\x1bdata-nadhi-agent/logagentpbb\x06proto3"
+	"\aSendLog\x12\x14.logagent.LogRequest\x1a\x15.logagent.LogResponse\x12A\n" +
+	"\n" +
+	"StreamLogs\x12\x14.logagent.LogRequest\x1a\x1b.logagent.StreamLogResponse(\x01\x12@\n" +
+	"\aConnect\x12\x18.logagent.ConnectRequest\x1a\x19.logagent.ConnectResponse(\x01B*Z(github.com/datanadhi/echopost/logagentpbb\x06proto3"
 
 var (
 	file_logagent_proto_rawDescOnce sync.Once
@@ -161,16 +433,23 @@ func file_logagent_proto_rawDescGZIP() []byte {
 	return file_logagent_proto_rawDescData
 }
 
-var file_logagent_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_logagent_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_logagent_proto_goTypes = []any{
-	(*LogRequest)(nil),  // 0: logagent.LogRequest
-	(*LogResponse)(nil), // 1: logagent.LogResponse
+	(*LogRequest)(nil),        // 0: logagent.LogRequest
+	(*LogResponse)(nil),       // 1: logagent.LogResponse
+	(*StreamLogResponse)(nil), // 2: logagent.StreamLogResponse
+	(*ConnectRequest)(nil),    // 3: logagent.ConnectRequest
+	(*ConnectResponse)(nil),   // 4: logagent.ConnectResponse
 }
 var file_logagent_proto_depIdxs = []int32{
 	0, // 0: logagent.LogAgent.SendLog:input_type -> logagent.LogRequest
-	1, // 1: logagent.LogAgent.SendLog:output_type -> logagent.LogResponse
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
+	0, // 1: logagent.LogAgent.StreamLogs:input_type -> logagent.LogRequest
+	3, // 2: logagent.LogAgent.Connect:input_type -> logagent.ConnectRequest
+	1, // 3: logagent.LogAgent.SendLog:output_type -> logagent.LogResponse
+	2, // 4: logagent.LogAgent.StreamLogs:output_type -> logagent.StreamLogResponse
+	4, // 5: logagent.LogAgent.Connect:output_type -> logagent.ConnectResponse
+	3, // [3:6] is the sub-list for method output_type
+	0, // [0:3] is the sub-list for method input_type
 	0, // [0:0] is the sub-list for extension type_name
 	0, // [0:0] is the sub-list for extension extendee
 	0, // [0:0] is the sub-list for field type_name
@@ -187,7 +466,7 @@ func file_logagent_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_logagent_proto_rawDesc), len(file_logagent_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   5,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
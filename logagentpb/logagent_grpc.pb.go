@@ -20,7 +20,9 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	LogAgent_SendLog_FullMethodName = "/logagent.LogAgent/SendLog"
+	LogAgent_SendLog_FullMethodName    = "/logagent.LogAgent/SendLog"
+	LogAgent_StreamLogs_FullMethodName = "/logagent.LogAgent/StreamLogs"
+	LogAgent_Connect_FullMethodName    = "/logagent.LogAgent/Connect"
 )
 
 // LogAgentClient is the client API for LogAgent service.
@@ -29,6 +31,14 @@ const (
 type LogAgentClient interface {
 	// SDK sends one log message
 	SendLog(ctx context.Context, in *LogRequest, opts ...grpc.CallOption) (*LogResponse, error)
+	// SDK streams many log messages over one call; a single summary is returned
+	StreamLogs(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[LogRequest, StreamLogResponse], error)
+	// SDK registers its process on its connection and keeps the stream open;
+	// while it is open, every log sent over the same connection is tagged with
+	// the metadata of the latest request. The agent sends the response headers
+	// once the first request is registered, and the response when the SDK
+	// closes the stream.
+	Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ConnectRequest, ConnectResponse], error)
 }
 
 type logAgentClient struct {
@@ -49,12 +59,46 @@ func (c *logAgentClient) SendLog(ctx context.Context, in *LogRequest, opts ...gr
 	return out, nil
 }
 
+func (c *logAgentClient) StreamLogs(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[LogRequest, StreamLogResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LogAgent_ServiceDesc.Streams[0], LogAgent_StreamLogs_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[LogRequest, StreamLogResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LogAgent_StreamLogsClient = grpc.ClientStreamingClient[LogRequest, StreamLogResponse]
+
+func (c *logAgentClient) Connect(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ConnectRequest, ConnectResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LogAgent_ServiceDesc.Streams[1], LogAgent_Connect_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ConnectRequest, ConnectResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LogAgent_ConnectClient = grpc.ClientStreamingClient[ConnectRequest, ConnectResponse]
+
 // LogAgentServer is the server API for LogAgent service.
 // All implementations must embed UnimplementedLogAgentServer
 // for forward compatibility.
 type LogAgentServer interface {
 	// SDK sends one log message
 	SendLog(context.Context, *LogRequest) (*LogResponse, error)
+	// SDK streams many log messages over one call; a single summary is returned
+	StreamLogs(grpc.ClientStreamingServer[LogRequest, StreamLogResponse]) error
+	// SDK registers its process on its connection and keeps the stream open;
+	// while it is open, every log sent over the same connection is tagged with
+	// the metadata of the latest request. The agent sends the response headers
+	// once the first request is registered, and the response when the SDK
+	// closes the stream.
+	Connect(grpc.ClientStreamingServer[ConnectRequest, ConnectResponse]) error
 	mustEmbedUnimplementedLogAgentServer()
 }
 
@@ -68,6 +112,12 @@ type UnimplementedLogAgentServer struct{}
 func (UnimplementedLogAgentServer) SendLog(context.Context, *LogRequest) (*LogResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SendLog not implemented")
 }
+func (UnimplementedLogAgentServer) StreamLogs(grpc.ClientStreamingServer[LogRequest, StreamLogResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamLogs not implemented")
+}
+func (UnimplementedLogAgentServer) Connect(grpc.ClientStreamingServer[ConnectRequest, ConnectResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
 func (UnimplementedLogAgentServer) mustEmbedUnimplementedLogAgentServer() {}
 func (UnimplementedLogAgentServer) testEmbeddedByValue()                  {}
 
@@ -107,6 +157,20 @@ func _LogAgent_SendLog_Handler(srv interface{}, ctx context.Context, dec func(in
 	return interceptor(ctx, in, info, handler)
 }
 
+func _LogAgent_StreamLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LogAgentServer).StreamLogs(&grpc.GenericServerStream[LogRequest, StreamLogResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LogAgent_StreamLogsServer = grpc.ClientStreamingServer[LogRequest, StreamLogResponse]
+
+func _LogAgent_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LogAgentServer).Connect(&grpc.GenericServerStream[ConnectRequest, ConnectResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LogAgent_ConnectServer = grpc.ClientStreamingServer[ConnectRequest, ConnectResponse]
+
 // LogAgent_ServiceDesc is the grpc.ServiceDesc for LogAgent service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -119,6 +183,17 @@ var LogAgent_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _LogAgent_SendLog_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamLogs",
+			Handler:       _LogAgent_StreamLogs_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Connect",
+			Handler:       _LogAgent_Connect_Handler,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "logagent.proto",
 }
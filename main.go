@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
-	t "github.com/datanadhi/echopost/tools"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	t "github.com/datanadhi/echopost/tools"
 	flow "github.com/datanadhi/flowhttp/client"
 )
 
@@ -17,12 +25,206 @@ import (
 // This binary runs a local gRPC service that receives logs, stores them in Pebble,
 // and periodically pushes them to the main server when health checks pass.
 func main() {
+	// Tag every log line of this run with a session ID and uptime
+	sessionID := t.NewSessionID()
+	t.StartLogSession(sessionID)
+
 	// Command-line flags
 	baseDir := flag.String("datanadhi", "./.datanadhi", "path to datanadhi folder")
 	apiKey := flag.String("api-key", "", "API key used when flushing Pebble logs")
+	apiKeyFile := flag.String("api-key-file", "", "path to a file containing the API key (keeps it out of ps output)")
+	apiKeyPattern := flag.String("api-key-pattern", t.ApiKeyPattern.String(), "regex the API key must match (empty disables the check)")
 	serverHost := flag.String("health-url", "http://data-nadhi-server:5000", "Main server health check URL")
+	httpProxy := flag.String("http-proxy", "", "HTTP(S) proxy URL for reaching the main server (defaults to HTTP_PROXY/HTTPS_PROXY)")
+	metricsPort := flag.Int("metrics-port", 0, "serve Prometheus metrics on localhost:<port>/metrics (0 = disabled)")
+	purgeFrom := flag.String("purge-range-from", "", "one-shot mode: purge logs received at or after this RFC3339 time")
+	purgeTo := flag.String("purge-range-to", "", "one-shot mode: purge logs received at or before this RFC3339 time")
+	exportNDJSON := flag.Bool("export-ndjson", false, "one-shot mode: export all Pebble records as NDJSON and exit")
+	exportCSV := flag.Bool("export-csv", false, "one-shot mode: export all Pebble records as CSV and exit")
+	exportColumns := flag.String("export-columns", "", "comma-separated payload fields (dot notation) written as -export-csv columns after received_at and pipelines")
+	exportFile := flag.String("export-file", "", "write the -export-ndjson or -export-csv output to this path instead of stdout")
+	cloudMetadata := flag.String("cloud-metadata", "none", "instance metadata attached to logs: none|auto|aws|gcp (detection adds up to 3s to startup)")
+	syncPipelines := flag.String("sync-pipelines", "", "comma-separated pipelines whose records are fsynced on write")
+	syncDeletes := flag.Bool("sync-deletes", false, "fsync Pebble deletes after records are uploaded")
+	maxRecordsPerCycle := flag.Int("max-records-per-cycle", 0, "maximum records uploaded per drain cycle (0 = unlimited)")
+	cbFailureThreshold := flag.Int("cb-failure-threshold", 5, "consecutive health check failures before probes are paused (0 = disabled)")
+	cbRecoveryTimeout := flag.Duration("cb-recovery-timeout", 30*time.Second, "how long health probes stay paused once the breaker opens")
+	pipelineEndpoints := flag.String("pipeline-endpoints", "", "JSON file mapping pipeline name to upload URL")
+	startupGrace := flag.Duration("startup-grace-period", 0, "poll the main server quickly for this long after startup (0 = disabled)")
+	healthCheckInterval := flag.Duration("health-check-interval", 5*time.Second, "delay between health checks while the main server is unhealthy")
+	postFlushInterval := flag.Duration("post-flush-interval", 10*time.Second, "delay after a successful drain before the next health check")
+	healthCheckTimeout := flag.Duration("health-check-url-timeout", 5*time.Second, "timeout for each health check request")
+	sampleRate := flag.Float64("sample-rate", 1.0, "fraction of incoming logs to keep, (0.0-1.0]")
+	pipelineSampleRates := flag.String("pipeline-sample-rates", "", "JSON file mapping pipeline name to sample rate")
+	logTZ := flag.String("agent-log-tz", "", "IANA time zone for agent log timestamps (default UTC)")
+	logTimeFormat := flag.String("agent-log-time-format", "rfc3339nano", "agent log timestamp format: rfc3339|rfc3339nano|unix")
+	uploadRateLimit := flag.Float64("upload-rate-limit", 0, "maximum records uploaded per second while draining (0 = unlimited)")
+	flattenPayload := flag.Bool("flatten-payload", false, "flatten nested JSON payloads into dot-separated top-level keys")
+	flattenDepth := flag.Int("flatten-depth", 3, "maximum nesting depth flattened by -flatten-payload")
+	pebbleEncoding := flag.String("pebble-encoding", t.EncodingJSON, "encoding of records stored in Pebble: json or msgpack")
+	serverTLSCA := flag.String("server-tls-ca", "", "PEM CA bundle used to verify the main server's certificate")
+	serverTLSSkipVerify := flag.Bool("server-tls-skip-verify", false, "skip verification of the main server's certificate (insecure)")
+	serverTLSClientCert := flag.String("server-tls-client-cert", "", "PEM client certificate for mutual TLS with the main server")
+	serverTLSClientKey := flag.String("server-tls-client-key", "", "PEM private key for -server-tls-client-cert")
+	pprofPort := flag.Int("pprof-port", 0, "serve pprof and expvar on localhost:<port>/debug/ (0 = disabled)")
+	pprofToken := flag.String("pprof-token", "", "bearer token required by the pprof server (empty = no auth)")
+	autoTuneBatch := flag.Bool("auto-tune-batch", false, "coalesce SendLog writes into Pebble batches with a latency-tuned window")
+	logLevel := flag.String("agent-log-level", "INFO", "minimum agent log level: DEBUG|INFO|WARN|ERROR")
+	httpKeepalive := flag.Duration("http-keepalive-interval", 0, "TCP keepalive interval for connections to the main server (0 = Go default)")
+	httpKeepaliveProbes := flag.Int("http-keepalive-probes", 0, "unanswered keepalive probes before a connection is dropped (0 = OS default)")
+	uploadDenyFields := flag.String("upload-deny-fields", "", "comma-separated payload fields (dot notation for nested) removed before upload")
+	adminPort := flag.Int("admin-port", 0, "serve admin endpoints (/status) on localhost:<port> (0 = disabled)")
+	processConcurrency := flag.Int("process-concurrency", 1, "parallel uploads while draining Pebble")
+	sendConcurrency := flag.Int("send-concurrency", 1, "requests in flight at once when a record is uploaded to several endpoints (1 = one at a time)")
+	fieldRemap := flag.String("field-remap", "", "JSON file mapping payload field names to the names uploaded to the server")
+	extraHeaders := flag.String("extra-headers", "", "JSON file of HTTP headers added to every upload (name: value)")
+	tailPort := flag.Int("tail-port", 0, "stream received logs as SSE on localhost:<port>/tail, protected by -pprof-token (0 = disabled)")
+	bloomBitsPerKey := flag.Int("bloom-bits-per-key", 10, "bloom filter bits per key in Pebble sstables (0 = disabled)")
+	inMemoryFallback := flag.Bool("inmemory-fallback", false, "buffer logs in memory when Pebble writes fail (e.g. disk full)")
+	fallbackBufferSize := flag.Int("fallback-buffer-size", 10000, "maximum logs held by -inmemory-fallback; the oldest are dropped beyond this")
+	validateServer := flag.Bool("validate-server", false, "check server connectivity and API key with a test log before starting")
+	perPipelineLogs := flag.Bool("per-pipeline-logs", false, "also write success/failure logs per pipeline in the session directory")
+	encryptUploadsKey := flag.String("encrypt-uploads-key", "", "hex-encoded 32-byte key; encrypts upload bodies with AES-256-GCM")
+	watchdogInterval := flag.Duration("watchdog-interval", 0, "expected heartbeat interval of background components; the agent stops if one is silent for 3x this (0 = disabled)")
+	processTriggerSizeMB := flag.Int("process-trigger-size-mb", 0, "start uploading as soon as Pebble exceeds this size (MB) while the server is healthy (0 = disabled)")
+	pipelineApiKeys := flag.String("pipeline-api-keys", "", "JSON file mapping pipeline name to the API key used for its uploads")
+	pausePolicy := flag.String("pause-policy", t.PausePolicyNone, "SendLog behaviour while uploading: none, block (wait up to -max-pause-wait) or reject (Unavailable)")
+	maxPauseWait := flag.Duration("max-pause-wait", 5*time.Second, "longest a SendLog call blocks while uploading with -pause-policy=block")
+	walAlertMB := flag.Int("wal-alert-threshold-mb", 0, "log wal_size_alert when the Pebble WAL exceeds this size in MB (0 = disabled)")
+	walForceFlush := flag.Bool("wal-force-flush", false, "flush the memtable immediately when the WAL size alert fires")
+	healthSuccessConsecutive := flag.Int("health-success-consecutive", 1, "successful health checks in a row required before uploading")
+	errorSummaryWindow := flag.Duration("error-summary-window", t.DefaultErrorSummaryWindow, "batch pebble_write_error, trigger_post_error and health_check_error into one error_summary per window (0 = log each error)")
+	quiet := flag.Bool("quiet", false, "suppress all agent log output (see -quiet-except)")
+	quietExcept := flag.String("quiet-except", "", "comma-separated events still logged with -quiet (e.g. agent_started,pebble_empty_exiting)")
+	enrichHostname := flag.Bool("enrich-hostname", false, "add the hostname to every record's metadata")
+	enrichPID := flag.Bool("enrich-pid", false, "add the agent's PID to every record's metadata")
+	enrichTraceID := flag.Bool("enrich-trace-id", false, "add a random trace_id to every record's metadata")
+	enrichStatic := flag.String("enrich-static", "", "comma-separated key=value pairs added to every record's metadata")
+	instanceID := flag.String("instance-id", "", "stable ID of this agent instance (default: generated once and kept in <datanadhi>/.agent-id)")
+	maxRecords := flag.Int64("max-records", 0, "record count at which SendLog reports full backpressure to SDKs (0 = no hint)")
+	sessionRetention := flag.Duration("session-retention", 7*24*time.Hour, "remove session directories older than this at startup (0 = keep all)")
+	logFieldPrefix := flag.String("log-field-prefix", "", "prefix added to every agent log field except time, e.g. dn_")
+	recordAgeInterval := flag.Duration("record-age-interval", 5*time.Minute, "how often to scan Pebble and report the record age histogram (0 = disabled)")
+	recordAgeBuckets := flag.String("record-age-buckets", "1m,5m,1h,24h", "comma-separated upper bounds of the record age histogram buckets")
+	dialTimeout := flag.Duration("dial-timeout", 5*time.Second, "TCP connect timeout for requests to the main server")
+	requestTimeout := flag.Duration("request-timeout", 30*time.Second, "timeout of each upload request, including reading the response")
+	maxGRPCConnsWarn := flag.Int("max-grpc-connections-warn", 100, "log gRPC connection opens and closes while more than this many are open (0 = never)")
+	maxPipelinesPerRequest := flag.Int("max-pipelines-per-request", 10, "reject LogRequests naming more pipelines than this (0 = no limit)")
+	diskFreeThresholdMB := flag.Int64("disk-free-threshold-mb", 100, "refuse new logs while the Pebble filesystem has less free space than this (0 = no check)")
+	idempotency := flag.Bool("idempotency", false, "store SendLog requests carrying an already seen request_id only once")
+	socketAbstract := flag.Bool("socket-abstract", false, "bind the gRPC socket in the Linux abstract namespace (no socket file; ignored on other platforms)")
+	verifyWrites := flag.Bool("verify-writes", false, "read every SendLog write back from Pebble and reject it if the stored bytes differ")
+	handoffFrom := flag.String("handoff-from", "", "admin address (host:port) of an older agent on the same -datanadhi to pause, drain and replace before starting")
+	handoffFromSocket := flag.String("handoff-from-socket", "", "like -handoff-from, but find the older agent by its gRPC socket path and use the admin socket next to it")
+	maxPayloadBytes := flag.Int("max-payload-bytes", 4<<20, "largest json_data accepted per log, greater than 0 and less than 100 MiB; larger gRPC messages are refused before unmarshalling")
+	chunkTimeout := flag.Duration("chunk-timeout", 5*time.Minute, "delete parts of a chunked payload that is still incomplete after this long")
+	recordTTL := flag.Duration("record-ttl", 0, "drop records received longer ago than this instead of uploading them (0 = keep until sent)")
+	pipelineTTL := flag.String("pipeline-ttl", "", "JSON file of per-pipeline TTLs (pipeline: duration such as \"15m\"); their records are dropped once expired")
+	minUploadLevel := flag.String("min-upload-level", "", "drop records below this level (DEBUG|INFO|WARN|ERROR) instead of uploading them (empty = upload all)")
+	migrateKeys := flag.Bool("migrate-keys", false, "rewrite Pebble record keys in older formats (without priority or pipeline) to the current pipeline-prefixed format before starting")
+	defaultRPCDeadline := flag.Duration("default-rpc-deadline", 5*time.Second, "deadline applied to SendLog and other unary calls whose client sets none or a longer one (0 = off)")
+	logFile := flag.String("agent-log-file", "", "append agent logs to this file instead of stdout")
+	logRotateInterval := flag.Duration("agent-log-rotate-interval", time.Hour, "rename -agent-log-file to agent-YYYY-MM-DDTHH.log and start a new one this often (0 = never)")
+	logRotateMaxFiles := flag.Int("agent-log-rotate-max-files", 24, "rotated agent log files to keep; older ones are deleted (0 = keep all)")
+	preloadPipelines := flag.Bool("preload-pipelines", false, "fetch the server's pipeline list (GET /pipelines) and warn on logs for unknown pipelines; reloaded on SIGHUP")
+	pipelineRefreshInterval := flag.Duration("pipeline-refresh-interval", 0, "refetch the -preload-pipelines list this often (0 = only at startup and on SIGHUP)")
+	listSessions := flag.Bool("list-sessions", false, "one-shot mode: print each session under -datanadhi with its Pebble record count as JSON lines and exit (counts are null while an agent is running)")
+	flushInterval := flag.Duration("flush-interval", time.Second, "how often Pebble is flushed to disk")
+	flushThresholdRecords := flag.Int("flush-threshold-records", 0, "also flush Pebble to disk every time this many records have been stored, between the -flush-interval flushes (0 = interval only)")
+	h2c := flag.Bool("h2c", false, "use cleartext HTTP/2 (h2c, prior knowledge) for the main server, e.g. behind a TLS-terminating sidecar; requires an http:// -health-url")
+	grpcKeepaliveTime := flag.Duration("grpc-keepalive-time", time.Minute, "ping SDK connections idle for this long to detect dead clients (0 = gRPC default, 2h)")
+	grpcKeepaliveTimeout := flag.Duration("grpc-keepalive-timeout", 20*time.Second, "close an SDK connection whose keepalive ping is not answered within this")
+	grpcMaxConnAge := flag.Duration("grpc-max-conn-age", 0, "ask SDK clients to reconnect after a connection has been open this long (0 = never)")
+	compactionStyle := flag.String("compaction-style", t.CompactionStyleLevel, "Pebble compaction tuning: level (lower space use) or universal (lower write amplification, more disk space)")
+	tokenEndpoint := flag.String("token-endpoint", "", "renew the API key by POSTing -refresh-token to this URL for a short-lived access token")
+	refreshToken := flag.String("refresh-token", "", "long-lived refresh token sent to -token-endpoint")
+	tokenRefreshInterval := flag.Duration("token-refresh-interval", 10*time.Minute, "how often the access token is renewed from -token-endpoint")
+	httpIngestPort := flag.Int("http-ingest-port", 0, "also accept logs as POST localhost:<port>/logs for clients that cannot use gRPC (0 = disabled)")
+	bloomFPAlert := flag.Float64("bloom-fp-alert", t.DefaultBloomFPAlert, "log bloom_filter_degraded when the estimated bloom filter false positive rate exceeds this fraction")
 	flag.Parse()
 
+	// Configure agent log output before anything is logged
+	if err := t.SetMinLogLevel(*logLevel); err != nil {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "agent-log-level", "error": err.Error()})
+		os.Exit(2)
+	}
+	if *logTZ != "" {
+		loc, err := time.LoadLocation(*logTZ)
+		if err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "agent-log-tz", "error": err.Error()})
+			os.Exit(2)
+		}
+		t.SetLogTimezone(loc)
+	}
+	if err := t.SetLogTimeFormat(*logTimeFormat); err != nil {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "agent-log-time-format", "error": err.Error()})
+		os.Exit(2)
+	}
+	t.SetLogFieldPrefix(*logFieldPrefix)
+	if *logFile != "" {
+		if err := t.OpenLogFile(*logFile); err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "agent-log-file", "error": err.Error()})
+			os.Exit(2)
+		}
+	}
+	if *quiet {
+		t.SetQuietMode(splitList(*quietExcept))
+	}
+	if err := t.ValidatePebbleEncoding(*pebbleEncoding); err != nil {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "pebble-encoding", "error": err.Error()})
+		os.Exit(2)
+	}
+	if err := t.ValidateCompactionStyle(*compactionStyle); err != nil {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "compaction-style", "error": err.Error()})
+		os.Exit(2)
+	}
+	if *handoffFrom != "" && *handoffFromSocket != "" {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "handoff-from-socket", "error": "cannot be combined with -handoff-from"})
+		os.Exit(2)
+	}
+	if *bloomFPAlert <= 0 || *bloomFPAlert > 1 {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "bloom-fp-alert", "error": "must be in (0, 1]"})
+		os.Exit(2)
+	}
+	if err := t.ValidateSampleRate(*sampleRate); err != nil {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "sample-rate", "error": err.Error()})
+		os.Exit(2)
+	}
+	if err := t.ValidatePausePolicy(*pausePolicy); err != nil {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "pause-policy", "error": err.Error()})
+		os.Exit(2)
+	}
+	if *minUploadLevel != "" {
+		if _, err := t.ParseLogLevel(*minUploadLevel); err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "min-upload-level", "error": err.Error()})
+			os.Exit(2)
+		}
+	}
+
+	proxyURL, err := t.ParseProxyURL(*httpProxy)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "http_proxy_error", map[string]any{"error": err.Error()})
+		return
+	}
+
+	serverTLS, err := t.LoadServerTLSConfig(*serverTLSCA, *serverTLSSkipVerify, *serverTLSClientCert, *serverTLSClientKey)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "server-tls", "error": err.Error()})
+		os.Exit(2)
+	}
+	uploadKey, err := t.ParseEncryptionKey(*encryptUploadsKey)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "encrypt-uploads-key", "error": err.Error()})
+		os.Exit(2)
+	}
+	if *h2c && (serverTLS != nil || !strings.HasPrefix(*serverHost, "http://")) {
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "h2c", "error": "-h2c needs an http:// -health-url and no -server-tls-* settings"})
+		os.Exit(2)
+	}
+	if *serverTLSSkipVerify {
+		t.LogJsonLevel(t.LevelWarn, "server_tls_insecure", map[string]any{"warning": "server certificate verification is disabled"})
+	}
+
 	// Context for cancellation (graceful shutdown)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -35,59 +237,483 @@ func main() {
 		cancel()
 	}()
 
+	// One-shot session listing (read-only, safe next to a running agent)
+	if *listSessions {
+		runListSessions(*baseDir)
+		return
+	}
+
+	// Take over from an older agent on the same base directory; this must
+	// finish before the checkpoint check touches its Pebble directory
+	if *handoffFrom != "" {
+		if err := t.HandoffFrom(ctx, *handoffFrom, *baseDir); err != nil {
+			t.LogJsonLevel(t.LevelError, "handoff_error", map[string]any{"from": *handoffFrom, "error": err.Error()})
+			os.Exit(1)
+		}
+	}
+	if *handoffFromSocket != "" {
+		if err := t.HandoffFromSocket(ctx, *handoffFromSocket, *baseDir); err != nil {
+			t.LogJsonLevel(t.LevelError, "handoff_error", map[string]any{"from": *handoffFromSocket, "error": err.Error()})
+			os.Exit(1)
+		}
+	}
+
+	// Restore Pebble from a complete checkpoint if the last shutdown failed to
+	// close it and the DB no longer opens
+	if err := t.StartupRecoveryCheck(*baseDir); err != nil {
+		t.LogJsonLevel(t.LevelError, "checkpoint_recovery_error", map[string]any{"error": err.Error()})
+		return
+	}
+
+	// Rewrite old-format record keys before anything reads Pebble
+	if *migrateKeys {
+		if err := runMigrateKeys(*baseDir); err != nil {
+			t.LogJsonLevel(t.LevelError, "migrate_keys_error", map[string]any{"error": err.Error()})
+			os.Exit(1)
+		}
+	}
+
+	// One-shot purge mode: delete a time window from Pebble and exit
+	if *purgeFrom != "" || *purgeTo != "" {
+		runPurgeRange(ctx, *baseDir, *purgeFrom, *purgeTo)
+		return
+	}
+
+	// One-shot export mode: dump Pebble as NDJSON or CSV (read-only) and exit
+	if *exportNDJSON {
+		runExport(ctx, *baseDir, *exportFile, func(config *t.ServerConfig, w io.Writer) (int, error) {
+			return config.ExportToNDJSON(ctx, w)
+		})
+		return
+	}
+	if *exportCSV {
+		runExport(ctx, *baseDir, *exportFile, func(config *t.ServerConfig, w io.Writer) (int, error) {
+			return config.ExportToCSV(ctx, w, splitList(*exportColumns))
+		})
+		return
+	}
+
+	// The offline modes above never upload, so the key is only read here
+	key, err := resolveApiKey(*apiKey, *apiKeyFile)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "api_key_error", map[string]any{"error": err.Error()})
+		os.Exit(2)
+	}
+	if err := t.SetApiKeyPattern(*apiKeyPattern); err != nil {
+		t.LogJsonLevel(t.LevelError, "api_key_error", map[string]any{"error": "invalid -api-key-pattern: " + err.Error()})
+		os.Exit(2)
+	}
+
 	wg := sync.WaitGroup{}
 
 	// Initialize server configuration
 	config := t.ServerConfig{
-		ApiKey:     *apiKey,
-		ServerHost: *serverHost,
-		Files:      t.Files{},
+		ApiKey:              key,
+		ServerHost:          *serverHost,
+		SessionID:           sessionID,
+		BuildInfo:           t.ReadBuildInfo(),
+		HTTPProxy:           proxyURL,
+		ServerTLS:           serverTLS,
+		H2C:                 *h2c,
+		UploadEncryptionKey: uploadKey,
+		Files:               t.Files{},
+		SocketAbstract:      *socketAbstract,
+		HTTPIngestPort:      *httpIngestPort,
+
+		TokenEndpoint:        *tokenEndpoint,
+		RefreshToken:         *refreshToken,
+		TokenRefreshInterval: *tokenRefreshInterval,
+
+		HTTPKeepaliveInterval: *httpKeepalive,
+		HTTPKeepaliveProbes:   *httpKeepaliveProbes,
+
+		DialTimeout:    *dialTimeout,
+		RequestTimeout: *requestTimeout,
+
+		SyncPipelines: splitList(*syncPipelines),
+		SyncDeletes:   *syncDeletes,
+		VerifyWrites:  *verifyWrites,
+
+		MaxRecords:         *maxRecords,
+		MaxRecordsPerCycle: *maxRecordsPerCycle,
+		ProcessConcurrency: *processConcurrency,
+		SendConcurrency:    *sendConcurrency,
+		UploadDenyList:     splitList(*uploadDenyFields),
+		PerPipelineLogs:    *perPipelineLogs,
+
+		MinUploadLevel: *minUploadLevel,
+
+		PreloadPipelineList:     *preloadPipelines,
+		PipelineRefreshInterval: *pipelineRefreshInterval,
+
+		HealthCheckInterval: *healthCheckInterval,
+		PostFlushInterval:   *postFlushInterval,
+		HealthCheckTimeout:  *healthCheckTimeout,
+
+		HealthSuccessConsecutive: *healthSuccessConsecutive,
+
+		SampleRate:      *sampleRate,
+		UploadRateLimit: *uploadRateLimit,
+
+		FlattenPayload: *flattenPayload,
+		FlattenDepth:   *flattenDepth,
+
+		InMemoryFallback:   *inMemoryFallback,
+		FallbackBufferSize: *fallbackBufferSize,
+
+		PebbleEncoding:        *pebbleEncoding,
+		CompactionStyle:       *compactionStyle,
+		AutoTuneBatch:         *autoTuneBatch,
+		IdempotencyEnabled:    *idempotency,
+		BloomFilterBitsPerKey: *bloomBitsPerKey,
+		BloomFPAlert:          *bloomFPAlert,
+
+		DiskFreeThresholdMB: *diskFreeThresholdMB,
+
+		WALSizeAlertThresholdMB: *walAlertMB,
+		WALForceFlushOnAlert:    *walForceFlush,
+
+		SessionRetention:     *sessionRetention,
+		HandoffMode:          *handoffFrom != "" || *handoffFromSocket != "",
+		RecordAgeInterval:    *recordAgeInterval,
+		WatchdogInterval:     *watchdogInterval,
+		ProcessTriggerSizeMB: *processTriggerSizeMB,
+
+		FlushInterval:         *flushInterval,
+		FlushThresholdRecords: *flushThresholdRecords,
+
+		ErrorSummaryWindow: *errorSummaryWindow,
+
+		ChunkTimeout: *chunkTimeout,
+		RecordTTL:    *recordTTL,
+
+		MaxGRPCConnectionsWarn: *maxGRPCConnsWarn,
+		MaxPayloadBytes:        *maxPayloadBytes,
+		MaxPipelinesPerRequest: *maxPipelinesPerRequest,
+
+		DefaultRPCDeadline: *defaultRPCDeadline,
+
+		GRPCKeepaliveTime:    *grpcKeepaliveTime,
+		GRPCKeepaliveTimeout: *grpcKeepaliveTimeout,
+		GRPCMaxConnectionAge: *grpcMaxConnAge,
+
+		PausePolicy:  *pausePolicy,
+		MaxPauseWait: *maxPauseWait,
+	}
+	if *pipelineEndpoints != "" {
+		if err := t.LoadJSONFile(*pipelineEndpoints, &config.PipelineEndpoints); err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "pipeline-endpoints", "error": err.Error()})
+			os.Exit(2)
+		}
+	}
+	if *pipelineApiKeys != "" {
+		if err := t.LoadJSONFile(*pipelineApiKeys, &config.PipelineApiKeys); err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "pipeline-api-keys", "error": err.Error()})
+			os.Exit(2)
+		}
+	}
+	if *fieldRemap != "" {
+		if err := t.LoadJSONFile(*fieldRemap, &config.FieldRemap); err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "field-remap", "error": err.Error()})
+			os.Exit(2)
+		}
+	}
+	if *extraHeaders != "" {
+		if err := t.LoadJSONFile(*extraHeaders, &config.ExtraHeaders); err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "extra-headers", "error": err.Error()})
+			os.Exit(2)
+		}
+	}
+	if *pipelineTTL != "" {
+		ttls, err := t.LoadPipelineTTLs(*pipelineTTL)
+		if err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "pipeline-ttl", "error": err.Error()})
+			os.Exit(2)
+		}
+		config.PipelineTTLs = ttls
+	}
+	if *pipelineSampleRates != "" {
+		if err := t.LoadJSONFile(*pipelineSampleRates, &config.PipelineSampleRates); err != nil {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "pipeline-sample-rates", "error": err.Error()})
+			os.Exit(2)
+		}
+		for pipeline, rate := range config.PipelineSampleRates {
+			if err := t.ValidateSampleRate(rate); err != nil {
+				t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "pipeline-sample-rates", "pipeline": pipeline, "error": err.Error()})
+				os.Exit(2)
+			}
+		}
+	}
+	if config.WatchdogInterval > 0 && config.WatchdogInterval < time.Second {
+		// The Pebble flusher beats once per second
+		t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "watchdog-interval", "error": "must be at least 1s"})
+		os.Exit(2)
+	}
+	if *enrichHostname {
+		config.EnrichHooks = append(config.EnrichHooks, t.WithHostname())
+	}
+	if *enrichPID {
+		config.EnrichHooks = append(config.EnrichHooks, t.WithPID())
+	}
+	if *enrichTraceID {
+		config.EnrichHooks = append(config.EnrichHooks, t.WithRandomTraceID())
+	}
+	for _, pair := range splitList(*enrichStatic) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "enrich-static", "error": fmt.Sprintf("invalid pair %q, want key=value", pair)})
+			os.Exit(2)
+		}
+		config.EnrichHooks = append(config.EnrichHooks, t.WithStaticField(key, value))
+	}
+	for _, bucket := range splitList(*recordAgeBuckets) {
+		d, err := time.ParseDuration(bucket)
+		if err != nil || d <= 0 {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "record-age-buckets", "error": fmt.Sprintf("invalid bucket %q", bucket)})
+			os.Exit(2)
+		}
+		config.RecordAgeHistogramBuckets = append(config.RecordAgeHistogramBuckets, d)
+	}
+	if *cbFailureThreshold > 0 {
+		config.HealthBreaker = t.NewCircuitBreaker(*cbFailureThreshold, *cbRecoveryTimeout, 1)
+	}
+
+	// Fetch the first access token; its format is up to the token endpoint
+	if config.TokenEndpoint != "" {
+		if config.RefreshToken == "" || config.TokenRefreshInterval <= 0 {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"flag": "token-endpoint", "error": "needs -refresh-token and a positive -token-refresh-interval"})
+			os.Exit(2)
+		}
+		if err := config.RefreshApiKey(ctx, config.NewHTTPClient(config.HealthCheckTimeout)); err != nil {
+			t.LogJsonLevel(t.LevelError, "token_refresh_error", map[string]any{"error": err.Error()})
+			os.Exit(1)
+		}
+		t.LogJsonLevel(t.LevelInfo, "token_refreshed", map[string]any{"next_refresh": config.TokenRefreshInterval.String()})
+	} else if err := t.ValidateApiKey(config.ApiKey); err != nil {
+		// Refuse to start without an API key, or with one the server will reject anyway
+		t.LogJsonLevel(t.LevelError, "api_key_error", map[string]any{"error": err.Error()})
+		os.Exit(2)
+	}
+	for pipeline, pipelineKey := range config.PipelineApiKeys {
+		if err := t.ValidateApiKey(pipelineKey); err != nil {
+			t.LogJsonLevel(t.LevelError, "api_key_error", map[string]any{"pipeline": pipeline, "error": err.Error()})
+			os.Exit(2)
+		}
+	}
+
+	// Fail fast on a wrong server URL, API key or pipeline setup
+	if *validateServer {
+		if err := config.ValidateServer(config.NewHTTPClient(config.HealthCheckTimeout)); err != nil {
+			reason := "unknown"
+			var vErr *t.ValidationError
+			if errors.As(err, &vErr) {
+				reason = vErr.Reason
+			}
+			fmt.Fprintf(os.Stderr, "server validation failed: %v\n", err)
+			t.LogJsonLevel(t.LevelError, "server_validation_failed", map[string]any{"reason": reason, "error": err.Error()})
+			os.Exit(2)
+		}
+		t.LogJsonLevel(t.LevelInfo, "server_validation_success", map[string]any{"server": config.ServerHost})
+	}
+
+	// Detect which machine we're running on so records can be attributed
+	if md, ok := detectCloudMetadata(ctx, *cloudMetadata); ok {
+		config.CloudMetadata = md
+	}
+
+	// Stable instance ID, persisted on first run unless given explicitly
+	config.InstanceID = *instanceID
+	if config.InstanceID == "" {
+		id, err := t.LoadOrCreateInstanceID(*baseDir)
+		if err != nil {
+			t.LogJsonLevel(t.LevelError, "instance_id_error", map[string]any{"error": err.Error()})
+			return
+		}
+		config.InstanceID = id
 	}
 
 	// Setup local files and Pebble DB
 	if fileErr := config.CreateRequiredFiles(*baseDir); fileErr != nil {
-		t.LogJson("file_setup_error", map[string]any{"error": fileErr.Error()})
+		if errors.Is(fileErr, t.ErrAgentAlreadyRunning) {
+			os.Exit(1)
+		}
+		t.LogJsonLevel(t.LevelError, "file_setup_error", map[string]any{"error": fileErr.Error()})
 		return
 	}
 	defer config.CloseFiles()
 	defer config.DisableAcceptingFlag()
 
-	t.LogJson("agent_started", map[string]any{"socket": config.SocketPath})
+	// Report every inconsistent setting at once instead of failing mid-operation
+	if errs := config.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			t.LogJsonLevel(t.LevelError, "config_error", map[string]any{"error": err.Error()})
+		}
+		config.DisableAcceptingFlag()
+		config.CloseFiles()
+		os.Exit(2)
+	}
+
+	config.ConfigSources = configSources(flag.CommandLine)
+	config.DumpConfig()
+
+	logAgentStarted(&config)
+
+	// Summarise high-volume errors instead of logging each one
+	if config.ErrorSummaryWindow > 0 {
+		t.StartErrorAggregator(ctx, &wg, t.NewErrorAggregator(config.ErrorSummaryWindow))
+	}
+
+	// Rotate the agent log file if one is used
+	if *logFile != "" {
+		t.StartLogRotator(ctx, &wg, *logFile, *logRotateInterval, *logRotateMaxFiles)
+	}
+
+	// Batch SendLog writes if requested (must run before the gRPC server)
+	config.StartWriteCoalescer(ctx, &wg)
+
+	// Drop retried SendLog requests if requested (must run before the gRPC server)
+	config.StartRequestDedup(ctx, &wg)
+
+	// Remove parts of chunked payloads that never complete
+	config.StartChunkReaper(ctx, &wg)
+
+	// Live tail of received logs (must run before the gRPC server)
+	if *tailPort > 0 {
+		if err := config.StartTailServer(ctx, &wg, *tailPort, *pprofToken); err != nil {
+			return
+		}
+	}
 
 	// Start local gRPC server for receiving logs from SDKs
 	if err := config.StartGRPCServer(ctx, &wg); err != nil {
-		t.LogJson("grpc_start_error", map[string]any{"error": err.Error()})
+		t.LogJsonLevel(t.LevelError, "grpc_start_error", map[string]any{"error": err.Error()})
 		return
 	}
 
+	// Accept logs over HTTP as well if requested
+	if config.HTTPIngestPort > 0 {
+		if err := config.StartHTTPIngestServer(ctx, &wg); err != nil {
+			return
+		}
+	}
+
+	// Expose Prometheus metrics if requested
+	if *metricsPort > 0 {
+		if err := t.StartMetricsServer(ctx, &wg, *metricsPort); err != nil {
+			return
+		}
+	}
+
+	// Always serve the admin endpoints next to the gRPC socket, so a newer
+	// agent can take over with -handoff-from-socket
+	if err := config.StartAdminSocket(ctx, &wg, cancel); err != nil {
+		return
+	}
+
+	// Expose admin endpoints if requested
+	if *adminPort > 0 {
+		if err := config.StartAdminServer(ctx, &wg, *adminPort, cancel); err != nil {
+			return
+		}
+	}
+
+	// Expose pprof / expvar for profiling if requested
+	if *pprofPort > 0 {
+		if err := t.StartPprofServer(ctx, &wg, *pprofPort, *pprofToken); err != nil {
+			return
+		}
+	}
+
+	// Stop the agent if a background component hangs, so it can be restarted
+	if config.WatchdogInterval > 0 {
+		config.StartWatchdog(ctx, &wg, cancel)
+	}
+
 	// Start background Pebble DB flusher
 	config.FlushPebbleDBOnInterval(ctx, &wg)
 
-	client := flow.NewClient(5 * time.Second)
+	// Periodically report how old the buffered records are
+	if config.RecordAgeInterval > 0 {
+		config.StartRecordAgeReporter(ctx, &wg)
+	}
+
+	// Pause ingestion while Pebble is stalling writes
+	config.StartWriteStallDetector(ctx, &wg)
+
+	// Report how well the bloom filters still rule out sstables
+	config.StartBloomFilterMonitor(ctx, &wg)
+
+	// Pause ingestion while the disk is nearly full
+	if config.DiskFreeThresholdMB > 0 {
+		config.StartDiskMonitor(ctx, &wg)
+	}
+
+	client := config.NewHTTPClient(config.HealthCheckTimeout)
+
+	// Renew the short-lived API key from -token-endpoint
+	config.StartTokenRefresher(ctx, &wg, client)
+
+	// Fetch the server's pipeline list for SendLog warnings, reloading on SIGHUP
+	if config.PreloadPipelineList {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		config.StartPipelineRefresher(ctx, &wg, client, hupCh)
+	}
+
+	// Give a main server that is still booting a chance to come up before
+	// settling into the normal (slower) health check cadence
+	if *startupGrace > 0 {
+		waitForStartupHealth(ctx, &config, client, *startupGrace)
+	}
+
+	runMainLoop(ctx, &config, client)
+
+	// Stop all background tasks and exit
+	cancel()
+	waitWithTimeout(&wg, 30*time.Second)
+	config.LogSessionSummary()
+}
+
+// runMainLoop alternates between health checks and uploads until ctx is
+// cancelled or the server is healthy and Pebble has been drained. It waits
+// HealthCheckInterval after a failed or unconfirmed check and
+// PostFlushInterval after each upload pass.
+func runMainLoop(ctx context.Context, config *t.ServerConfig, client *flow.Client) {
+	// Consecutive successful health checks; processing starts once it
+	// reaches HealthSuccessConsecutive
+	healthyStreak := 0
 
 mainRoutine:
 	for {
-		switch {
-		case ctx.Err() != nil:
+		if ctx.Err() != nil {
 			break mainRoutine
+		}
+		if result := config.HealthCheckWithDetails(client); result.IsHealthy {
+			healthyStreak++
+		} else {
+			healthyStreak = 0
+			t.LogJsonLevel(t.LevelWarn, "health_check_result", result.ToMap())
+		}
+
+		switch {
 		// When main server is reachable (healthy)
-		case config.IsHealthSuccess(client):
+		case healthyStreak >= max(config.HealthSuccessConsecutive, 1):
 			_ = config.DisableAcceptingFlag()
-			t.LogJson("main_healthy_not_accepting_logs", nil)
+			t.LogJsonLevel(t.LevelInfo, "main_healthy_not_accepting_logs", nil)
 
 			// Flush any buffered data before attempting upload
 			t.FlushPebbleDB(config.Db)
 			time.Sleep(100 * time.Millisecond)
 
-			// If Pebble is empty, exit the agent
-			if t.PebbleIsEmpty(config.Db) {
-				t.LogJson("pebble_empty_exiting", nil)
+			// If Pebble (and the in-memory fallback) is empty, exit the agent
+			if t.PebbleIsEmpty(config.Db) && config.FallbackBufferLen() == 0 {
+				t.LogJsonLevel(t.LevelInfo, "pebble_empty_exiting", nil)
 				break mainRoutine
 			}
 
 			// Push pending logs to the main server
 			if err := config.ProcessPebble(ctx); err != nil {
-				t.LogJson("pebble_process_error", map[string]any{"error": err.Error()})
+				t.LogJsonLevel(t.LevelError, "pebble_process_error", map[string]any{"error": err.Error(), "error_class": t.ClassifyNetError(err)})
 				if ctx.Err() != nil {
 					break mainRoutine
 				}
@@ -100,26 +726,383 @@ mainRoutine:
 			}
 
 			// Wait before next health check
-			time.Sleep(10 * time.Second)
+			waitForNextCycle(ctx, config, config.PostFlushInterval)
 			continue
 
+		// Healthy, but not yet for enough checks in a row
+		case healthyStreak > 0:
+			t.LogJsonLevel(t.LevelInfo, "main_healthy_unconfirmed", map[string]any{
+				"consecutive_successes": healthyStreak,
+				"required":              config.HealthSuccessConsecutive,
+			})
+			t.FlushPebbleDB(config.Db)
+			waitForNextCycle(ctx, config, config.HealthCheckInterval)
+
 		// When main server is unhealthy or unreachable
 		case config.AcceptingFlag == nil:
 			_ = config.EnableAcceptingFlag()
-			t.LogJson("main_unhealthy_accepting_logs", nil)
+			t.LogJsonLevel(t.LevelWarn, "main_unhealthy_accepting_logs", nil)
 
 			// Keep flushing Pebble periodically to persist data
 			t.FlushPebbleDB(config.Db)
-			time.Sleep(5 * time.Second)
+			waitForNextCycle(ctx, config, config.HealthCheckInterval)
 
 		// Default state (e.g., still unhealthy)
 		default:
 			t.FlushPebbleDB(config.Db)
-			time.Sleep(5 * time.Second)
+			waitForNextCycle(ctx, config, config.HealthCheckInterval)
 		}
 	}
+}
 
-	// Stop all background tasks and exit
-	cancel()
-	wg.Wait()
+// logAgentStarted emits the startup banner: the build info plus the socket
+// and instance ID of this agent.
+func logAgentStarted(config *t.ServerConfig) {
+	fields := config.BuildInfo.ToMap()
+	fields["socket"] = config.SocketPath
+	fields["instance_id"] = config.InstanceID
+	t.LogJsonLevel(t.LevelInfo, "agent_started", fields)
+}
+
+// waitForNextCycle sleeps for d, returning early when ctx is cancelled or the
+// flusher signals that Pebble has grown past -process-trigger-size-mb.
+func waitForNextCycle(ctx context.Context, config *t.ServerConfig, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-config.ProcessNow():
+	case <-timer.C:
+	}
+}
+
+// waitWithTimeout waits for background goroutines to finish, but gives up after
+// timeout so a stuck component cannot keep the agent alive forever.
+func waitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.LogJsonLevel(t.LevelError, "goroutine_leak_detected", map[string]any{
+			"timeout":    timeout.String(),
+			"goroutines": runtime.NumGoroutine(),
+		})
+	}
+}
+
+// runPurgeRange opens Pebble directly (no session, no gRPC server) and removes
+// all records received within the given RFC3339 window.
+func runPurgeRange(ctx context.Context, baseDir, fromRaw, toRaw string) {
+	from, err := time.Parse(time.RFC3339, fromRaw)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "purge_range_error", map[string]any{"error": "invalid -purge-range-from: " + err.Error()})
+		return
+	}
+	to, err := time.Parse(time.RFC3339, toRaw)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "purge_range_error", map[string]any{"error": "invalid -purge-range-to: " + err.Error()})
+		return
+	}
+
+	config := t.ServerConfig{}
+	if err := config.OpenDB(baseDir, false); err != nil {
+		t.LogJsonLevel(t.LevelError, "purge_range_error", map[string]any{"error": err.Error()})
+		return
+	}
+	defer config.Db.Close()
+
+	count, err := config.PurgeTimeRange(ctx, from, to)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "purge_range_error", map[string]any{"error": err.Error()})
+		return
+	}
+	t.FlushPebbleDB(config.Db)
+	t.LogJsonLevel(t.LevelInfo, "purge_range_done", map[string]any{
+		"from":          from.UTC().Format(time.RFC3339),
+		"to":            to.UTC().Format(time.RFC3339),
+		"deleted_count": count,
+	})
+}
+
+// runListSessions prints one JSON line per session directory under baseDir.
+func runListSessions(baseDir string) {
+	sessions, err := t.ListSessions(baseDir)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "list_sessions_error", map[string]any{"error": err.Error()})
+		os.Exit(1)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, s := range sessions {
+		_ = enc.Encode(s)
+	}
+}
+
+// runMigrateKeys opens Pebble directly and moves every record with a key in
+// an older format (legacy or priority) to the current key format.
+func runMigrateKeys(baseDir string) error {
+	config := t.ServerConfig{}
+	if err := config.OpenDB(baseDir, false); err != nil {
+		return err
+	}
+	defer config.Db.Close()
+
+	for _, from := range []t.KeyFormat{t.KeyFormatLegacy, t.KeyFormatPriority} {
+		count, err := t.MigrateKeyFormat(config.Db.DB(), from, t.CurrentKeyFormat)
+		if err != nil {
+			return err
+		}
+		t.LogJsonLevel(t.LevelInfo, "migrate_keys_done", map[string]any{
+			"from":           from.String(),
+			"to":             t.CurrentKeyFormat.String(),
+			"migrated_count": count,
+		})
+	}
+	// A saved ProcessPebble cursor refers to the old keys
+	if err := os.Remove(filepath.Join(baseDir, t.ProcessCursorFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// resolveApiKey returns the API key from either -api-key or -api-key-file.
+// Supplying both is ambiguous and rejected.
+func resolveApiKey(inline, path string) (string, error) {
+	if path == "" {
+		return inline, nil
+	}
+	if inline != "" {
+		return "", fmt.Errorf("-api-key and -api-key-file are mutually exclusive")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read api key file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// runExport opens Pebble read-only and writes every record to stdout or to
+// the given file using export.
+func runExport(ctx context.Context, baseDir, path string, export func(*t.ServerConfig, io.Writer) (int, error)) {
+	config := t.ServerConfig{}
+	if err := config.OpenDB(baseDir, true); err != nil {
+		t.LogJsonLevel(t.LevelError, "export_error", map[string]any{"error": err.Error()})
+		return
+	}
+	defer config.Db.Close()
+
+	out := os.Stdout
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			t.LogJsonLevel(t.LevelError, "export_error", map[string]any{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+
+	count, err := export(&config, out)
+	if err != nil {
+		t.LogJsonLevel(t.LevelError, "export_error", map[string]any{"error": err.Error(), "exported_count": count})
+		return
+	}
+	if path != "" {
+		t.LogJsonLevel(t.LevelInfo, "export_done", map[string]any{"path": path, "exported_count": count})
+	}
+}
+
+// detectCloudMetadata resolves instance metadata for the requested provider.
+// Detection is opt-in (the default mode is "none") and best-effort, bounded to a
+// few seconds so an unreachable metadata endpoint cannot hold up startup for long.
+func detectCloudMetadata(ctx context.Context, mode string) (t.CloudMetadata, bool) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var md t.CloudMetadata
+	var err error
+	switch mode {
+	case "none":
+		return md, false
+	case "aws":
+		md, err = t.DetectAWSMetadata(ctx)
+	case "gcp":
+		md, err = t.DetectGCPMetadata(ctx)
+	case "auto":
+		md, err = t.DetectCloudMetadata(ctx)
+	default:
+		err = fmt.Errorf("unknown -cloud-metadata mode %q", mode)
+	}
+	if err != nil {
+		t.LogJsonLevel(t.LevelWarn, "cloud_metadata_error", map[string]any{"mode": mode, "error": err.Error(), "error_class": t.ClassifyNetError(err)})
+		return md, false
+	}
+
+	t.LogJsonLevel(t.LevelInfo, "cloud_metadata_detected", map[string]any{"provider": md.Provider, "instance_id": md.InstanceID})
+	return md, true
+}
+
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(raw string) []string {
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// waitForStartupHealth polls the main server starting at 1s intervals and
+// backing off exponentially (capped at 5s) until it is healthy or the grace
+// period expires. Logs are stored in Pebble throughout.
+func waitForStartupHealth(ctx context.Context, config *t.ServerConfig, client *flow.Client, grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	delay := time.Second
+
+	for time.Now().Before(deadline) {
+		if config.IsHealthSuccess(client) {
+			t.LogJsonLevel(t.LevelInfo, "startup_grace_healthy", nil)
+			return
+		}
+
+		wait := min(delay, time.Until(deadline))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, 5*time.Second)
+	}
+
+	t.LogJsonLevel(t.LevelWarn, "startup_grace_timeout", map[string]any{"grace_period": grace.String()})
+}
+
+// configSources reports where each field logged by DumpConfig came from.
+// Fields are attributed to the flags set on fs; values read from a file
+// are "file", and a proxy picked up from HTTP(S)_PROXY is "env".
+func configSources(fs *flag.FlagSet) map[string]string {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	fieldFlags := map[string][]string{
+		"server_host":           {"health-url"},
+		"http_proxy":            {"http-proxy"},
+		"server_tls":            {"server-tls-ca", "server-tls-skip-verify", "server-tls-client-cert", "server-tls-client-key"},
+		"h2c":                   {"h2c"},
+		"encrypt_uploads":       {"encrypt-uploads-key"},
+		"http_keepalive":        {"http-keepalive-interval"},
+		"http_keepalive_probes": {"http-keepalive-probes"},
+		"dial_timeout":          {"dial-timeout"},
+		"request_timeout":       {"request-timeout"},
+		"instance_id":           {"instance-id"},
+		"db_path":               {"datanadhi"},
+		"session_retention":     {"session-retention"},
+		"socket_path":           {"datanadhi"},
+		"socket_abstract":       {"socket-abstract"},
+		"http_ingest_port":      {"http-ingest-port"},
+		"token_endpoint":        {"token-endpoint"},
+		"refresh_token":         {"refresh-token"},
+		"token_refresh":         {"token-refresh-interval"},
+		"cloud_metadata":        {"cloud-metadata"},
+		"sync_pipelines":        {"sync-pipelines"},
+		"sync_deletes":          {"sync-deletes"},
+		"max_records":           {"max-records"},
+		"max_records_per_cycle": {"max-records-per-cycle"},
+		"process_concurrency":   {"process-concurrency"},
+		"send_concurrency":      {"send-concurrency"},
+		"extra_headers":         {"extra-headers"},
+		"upload_deny_fields":    {"upload-deny-fields"},
+		"preload_pipelines":     {"preload-pipelines"},
+		"pipeline_refresh":      {"pipeline-refresh-interval"},
+		"min_upload_level":      {"min-upload-level"},
+		"per_pipeline_logs":     {"per-pipeline-logs"},
+		"health_breaker":        {"cb-failure-threshold", "cb-recovery-timeout"},
+		"health_check_interval": {"health-check-interval"},
+		"post_flush_interval":   {"post-flush-interval"},
+		"health_check_timeout":  {"health-check-url-timeout"},
+		"health_successes":      {"health-success-consecutive"},
+		"enrich_hooks":          {"enrich-hostname", "enrich-pid", "enrich-trace-id", "enrich-static"},
+		"sample_rate":           {"sample-rate"},
+		"upload_rate_limit":     {"upload-rate-limit"},
+		"flatten_payload":       {"flatten-payload"},
+		"flatten_depth":         {"flatten-depth"},
+		"pebble_encoding":       {"pebble-encoding"},
+		"compaction_style":      {"compaction-style"},
+		"bloom_bits_per_key":    {"bloom-bits-per-key"},
+		"bloom_fp_alert":        {"bloom-fp-alert"},
+		"auto_tune_batch":       {"auto-tune-batch"},
+		"handoff_mode":          {"handoff-from", "handoff-from-socket"},
+		"verify_writes":         {"verify-writes"},
+		"idempotency":           {"idempotency"},
+		"inmemory_fallback":     {"inmemory-fallback"},
+		"fallback_buffer_size":  {"fallback-buffer-size"},
+		"watchdog_interval":     {"watchdog-interval"},
+		"record_age_interval":   {"record-age-interval"},
+		"record_age_buckets":    {"record-age-buckets"},
+		"wal_alert_mb":          {"wal-alert-threshold-mb"},
+		"disk_free_mb":          {"disk-free-threshold-mb"},
+		"wal_force_flush":       {"wal-force-flush"},
+		"process_trigger_mb":    {"process-trigger-size-mb"},
+		"flush_interval":        {"flush-interval"},
+		"flush_threshold":       {"flush-threshold-records"},
+		"grpc_conns_warn":       {"max-grpc-connections-warn"},
+		"max_pipelines":         {"max-pipelines-per-request"},
+		"chunk_timeout":         {"chunk-timeout"},
+		"record_ttl":            {"record-ttl"},
+		"pipeline_ttl":          {"pipeline-ttl"},
+		"max_payload_bytes":     {"max-payload-bytes"},
+		"default_rpc_deadline":  {"default-rpc-deadline"},
+		"grpc_ka_time":          {"grpc-keepalive-time"},
+		"grpc_ka_timeout":       {"grpc-keepalive-timeout"},
+		"grpc_max_conn_age":     {"grpc-max-conn-age"},
+		"pause_policy":          {"pause-policy"},
+		"error_summary_window":  {"error-summary-window"},
+		"max_pause_wait":        {"max-pause-wait"},
+	}
+
+	sources := map[string]string{}
+	for field, names := range fieldFlags {
+		for _, name := range names {
+			if set[name] {
+				sources[field] = "flag"
+			}
+		}
+	}
+
+	switch {
+	case set["api-key-file"]:
+		sources["api_key"] = "file"
+	case set["api-key"]:
+		sources["api_key"] = "flag"
+	}
+	if !set["instance-id"] {
+		sources["instance_id"] = "file"
+	}
+	if set["pipeline-endpoints"] {
+		sources["pipeline_endpoints"] = "file"
+	}
+	if set["pipeline-api-keys"] {
+		sources["pipeline_api_keys"] = "file"
+	}
+	if set["pipeline-sample-rates"] {
+		sources["pipeline_sample_rates"] = "file"
+	}
+	if set["field-remap"] {
+		sources["field_remap"] = "file"
+	}
+	if set["extra-headers"] {
+		sources["extra_headers"] = "file"
+	}
+	if set["pipeline-ttl"] {
+		sources["pipeline_ttl"] = "file"
+	}
+	if !set["http-proxy"] && (os.Getenv("HTTP_PROXY") != "" || os.Getenv("HTTPS_PROXY") != "") {
+		sources["http_proxy"] = "env"
+	}
+	return sources
 }
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/datanadhi/echopost/tools"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// runMainEnv makes the test binary run the agent's main instead of the tests,
+// for tests that need a real agent process.
+const runMainEnv = "ECHOPOST_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestResolveApiKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("  abcdefghijklmnopqrstuvwxyz012345\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		inline  string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "inline", inline: "inline-key", want: "inline-key"},
+		{name: "none", want: ""},
+		{name: "file is trimmed", path: keyFile, want: "abcdefghijklmnopqrstuvwxyz012345"},
+		{name: "both set", inline: "inline-key", path: keyFile, wantErr: true},
+		{name: "unreadable file", path: filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveApiKey(tt.inline, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveApiKey error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveApiKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudMetadataNoneSkipsDetection(t *testing.T) {
+	start := time.Now()
+	if _, ok := detectCloudMetadata(context.Background(), "none"); ok {
+		t.Fatal("metadata detected with -cloud-metadata=none")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("mode none took %v, want no network round trip", d)
+	}
+}
+
+// healthyAfter returns a server that answers 503 until d has passed, then 200.
+func healthyAfter(tb testing.TB, d time.Duration) *httptest.Server {
+	start := time.Now()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Since(start) < d {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStartupGraceWaitsForServer(t *testing.T) {
+	srv := healthyAfter(t, 2*time.Second)
+	config := &tools.ServerConfig{ServerHost: srv.URL}
+
+	start := time.Now()
+	waitForStartupHealth(context.Background(), config, config.NewHTTPClient(time.Second), 5*time.Second)
+	elapsed := time.Since(start)
+
+	// Polls at 0s, 1s and 3s: the third one is the first after 2s
+	if elapsed < 2*time.Second || elapsed >= 5*time.Second {
+		t.Fatalf("returned after %v, want between 2s and the 5s grace period", elapsed)
+	}
+	if !config.IsHealthSuccess(config.NewHTTPClient(time.Second)) {
+		t.Fatal("server not healthy after the grace wait returned")
+	}
+}
+
+func TestStartupGraceTimesOut(t *testing.T) {
+	srv := healthyAfter(t, time.Hour)
+	config := &tools.ServerConfig{ServerHost: srv.URL}
+
+	start := time.Now()
+	waitForStartupHealth(context.Background(), config, config.NewHTTPClient(time.Second), 1500*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("returned after %v, want about the 1.5s grace period", elapsed)
+	}
+}
+
+// countingServer answers every request with status and counts them.
+func countingServer(tb testing.TB, status int) (*httptest.Server, *atomic.Int32) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(status)
+	}))
+	tb.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// loopConfig returns a config for runMainLoop with its files under a temp dir.
+func loopConfig(tb testing.TB, serverHost string) *tools.ServerConfig {
+	config := &tools.ServerConfig{
+		ServerHost:          serverHost,
+		HealthCheckInterval: 50 * time.Millisecond,
+		PostFlushInterval:   50 * time.Millisecond,
+		HealthCheckTimeout:  time.Second,
+	}
+	if err := config.CreateRequiredFiles(tb.TempDir()); err != nil {
+		tb.Fatalf("create agent files: %v", err)
+	}
+	tb.Cleanup(config.CloseFiles)
+	return config
+}
+
+func TestMainLoopUsesHealthCheckInterval(t *testing.T) {
+	srv, hits := countingServer(t, http.StatusServiceUnavailable)
+	config := loopConfig(t, srv.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 525*time.Millisecond)
+	defer cancel()
+	runMainLoop(ctx, config, config.NewHTTPClient(config.HealthCheckTimeout))
+
+	// One check at the start and one every 50ms after
+	if n := hits.Load(); n < 8 || n > 12 {
+		t.Errorf("health checks in 525ms = %d, want about 11", n)
+	}
+}
+
+func TestMainLoopExitsOnceDrained(t *testing.T) {
+	srv, _ := countingServer(t, http.StatusOK)
+	config := loopConfig(t, srv.URL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runMainLoop(context.Background(), config, config.NewHTTPClient(config.HealthCheckTimeout))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("main loop kept running with a healthy server and empty Pebble")
+	}
+}
+
+func TestConfigSources(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("HTTPS_PROXY", "http://proxy.corp:3128")
+
+	fs := flag.NewFlagSet("echopost", flag.ContinueOnError)
+	for _, name := range []string{"api-key-file", "health-url", "pipeline-endpoints", "instance-id", "max-records"} {
+		fs.String(name, "", "")
+	}
+	args := []string{"-api-key-file", "/run/secrets/key", "-health-url", "https://ingest.example", "-pipeline-endpoints", "endpoints.json"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	got := configSources(fs)
+	want := map[string]string{
+		"api_key":            "file",
+		"server_host":        "flag",
+		"pipeline_endpoints": "file",
+		"instance_id":        "file", // persisted in baseDir when -instance-id is not given
+		"http_proxy":         "env",
+	}
+	for field, source := range want {
+		if got[field] != source {
+			t.Errorf("source of %s = %q, want %q", field, got[field], source)
+		}
+	}
+	// Unset flags are left out, so DumpConfig reports them as "default"
+	if source, ok := got["max_records"]; ok {
+		t.Errorf("source of max_records = %q, want none", source)
+	}
+}
+
+func TestAgentStartedBanner(t *testing.T) {
+	var buf bytes.Buffer
+	prevWriter, prevLevel := tools.LogWriter, tools.MinLogLevel
+	tools.LogWriter, tools.MinLogLevel = &buf, tools.LevelInfo
+	t.Cleanup(func() { tools.LogWriter, tools.MinLogLevel = prevWriter, prevLevel })
+
+	config := &tools.ServerConfig{InstanceID: "agent-1", BuildInfo: tools.ReadBuildInfo()}
+	config.SocketPath = "/tmp/echopost.sock"
+	logAgentStarted(config)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("decode banner %q: %v", buf.String(), err)
+	}
+	if entry["event"] != "agent_started" {
+		t.Fatalf("event = %v, want agent_started", entry["event"])
+	}
+	for _, field := range []string{"version", "go_version", "os", "arch", "module", "vcs_revision", "vcs_time", "vcs_modified", "socket", "instance_id"} {
+		if _, ok := entry[field]; !ok {
+			t.Errorf("agent_started lacks %s: %v", field, entry)
+		}
+	}
+	if entry["go_version"] != runtime.Version() || entry["os"] != runtime.GOOS || entry["arch"] != runtime.GOARCH {
+		t.Errorf("runtime fields = %v %v %v", entry["go_version"], entry["os"], entry["arch"])
+	}
+	if entry["socket"] != config.SocketPath || entry["instance_id"] != "agent-1" {
+		t.Errorf("socket / instance_id = %v / %v", entry["socket"], entry["instance_id"])
+	}
+}
+
+func TestWaitForNextCycleWakesOnSizeTrigger(t *testing.T) {
+	srv, _ := countingServer(t, http.StatusOK)
+	config := loopConfig(t, srv.URL)
+	config.ProcessTriggerSizeMB = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	config.FlushPebbleDBOnInterval(ctx, &wg)
+	if !config.IsHealthSuccess(config.NewHTTPClient(time.Second)) {
+		t.Fatal("health check failed")
+	}
+
+	// 2 MiB of records pushes Pebble past the 1 MB trigger
+	var ndjson bytes.Buffer
+	blob := strings.Repeat("x", 64<<10)
+	for i := 0; i < 32; i++ {
+		fmt.Fprintf(&ndjson, `{"key":"1/%d_%d","record":{"schema_version":1,"payload":{"blob":%q},"pipelines":["p1"]}}`+"\n", time.Now().UnixNano(), i, blob)
+	}
+	if _, err := config.ImportFromNDJSON(ctx, &ndjson); err != nil {
+		t.Fatalf("fill pebble: %v", err)
+	}
+
+	start := time.Now()
+	waitForNextCycle(ctx, config, time.Hour)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("waited %v, want the size trigger to end the wait within a flush interval", elapsed)
+	}
+}
+
+// scriptedHealthServer answers the nth health check with statuses[n] and every
+// later one with 503. It records how many checks had been made when the first
+// upload arrived (-1 until then).
+func scriptedHealthServer(tb testing.TB, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var checks atomic.Int32
+	var checksBeforeUpload atomic.Int32
+	checksBeforeUpload.Store(-1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			checksBeforeUpload.CompareAndSwap(-1, checks.Load())
+			return
+		}
+		n := int(checks.Add(1)) - 1
+		if n >= len(statuses) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(statuses[n])
+	}))
+	tb.Cleanup(srv.Close)
+	return srv, &checksBeforeUpload
+}
+
+func TestMainLoopWaitsForConsecutiveHealthySuccesses(t *testing.T) {
+	ok, fail := http.StatusOK, http.StatusServiceUnavailable
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		want     int32
+	}{
+		{"two successes then failures", []int{ok, ok, fail, fail}, 2},
+		{"streak reset by a failure", []int{ok, fail, ok, ok}, 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, checksBeforeUpload := scriptedHealthServer(t, tc.statuses...)
+			config := loopConfig(t, srv.URL)
+			config.HealthSuccessConsecutive = 2
+			record := fmt.Sprintf(`{"key":"1/%d_0","record":{"schema_version":1,"payload":{},"pipelines":["p1"]}}`, time.Now().UnixNano())
+			if _, err := config.ImportFromNDJSON(context.Background(), strings.NewReader(record)); err != nil {
+				t.Fatalf("store record: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			runMainLoop(ctx, config, config.NewHTTPClient(config.HealthCheckTimeout))
+
+			if got := checksBeforeUpload.Load(); got != tc.want {
+				t.Errorf("upload started after %d health checks, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSecondAgentOnSameBaseDirExits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the agent lock relies on flock")
+	}
+	dir := t.TempDir()
+	first := &tools.ServerConfig{}
+	if err := first.CreateRequiredFiles(dir); err != nil {
+		t.Fatalf("first agent: %v", err)
+	}
+	defer first.CloseFiles()
+
+	cmd := exec.Command(os.Args[0], "-datanadhi", dir, "-cloud-metadata", "none", "-api-key", strings.Repeat("a1", 16))
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("second agent exited with %v, want exit status 1\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte(`"event":"agent_already_running"`)) {
+		t.Errorf("second agent output lacks agent_already_running:\n%s", out)
+	}
+}
+
+func TestUnknownCompactionStyleRejected(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-datanadhi", t.TempDir(), "-cloud-metadata", "none", "-compaction-style", "tiered")
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Fatalf("agent with -compaction-style tiered exited with %v, want exit status 2\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte(`"event":"config_error"`)) || !bytes.Contains(out, []byte(`"flag":"compaction-style"`)) {
+		t.Errorf("output lacks a compaction-style config_error:\n%s", out)
+	}
+}
+
+func TestMissingApiKeyExits(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-datanadhi", t.TempDir(), "-cloud-metadata", "none")
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Fatalf("agent without an API key exited with %v, want exit status 2\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte(`api key is empty`)) {
+		t.Errorf("output does not report the empty API key:\n%s", out)
+	}
+}
+
+func TestZeroMaxPayloadBytesRejected(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-datanadhi", t.TempDir(), "-cloud-metadata", "none", "-api-key", strings.Repeat("a1", 16), "-max-payload-bytes", "0")
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Fatalf("agent with -max-payload-bytes 0 exited with %v, want exit status 2\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte(`"event":"config_error"`)) || !bytes.Contains(out, []byte(`max_payload_bytes: must be greater than 0`)) {
+		t.Errorf("output lacks a max_payload_bytes config_error:\n%s", out)
+	}
+}
+
+func TestPurgeRangeMode(t *testing.T) {
+	var buf bytes.Buffer
+	prevWriter, prevLevel := tools.LogWriter, tools.MinLogLevel
+	tools.LogWriter, tools.MinLogLevel = &buf, tools.LevelInfo
+	t.Cleanup(func() { tools.LogWriter, tools.MinLogLevel = prevWriter, prevLevel })
+
+	dir := t.TempDir()
+	from := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	seed := &tools.ServerConfig{}
+	if err := seed.OpenDB(dir, false); err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	var kept []string
+	for i, ts := range []time.Time{from.Add(-time.Second), from, from.Add(30 * time.Minute), to, to.Add(time.Second)} {
+		key := fmt.Sprintf("1/p1/%d_%d", ts.UnixNano(), i)
+		if ts.Before(from) || ts.After(to) {
+			kept = append(kept, key)
+		}
+		if err := seed.Db.Set([]byte(key), []byte(`{}`), pebble.NoSync); err != nil {
+			t.Fatalf("store %s: %v", key, err)
+		}
+	}
+	tools.FlushPebbleDB(seed.Db)
+	if err := seed.Db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	runPurgeRange(context.Background(), dir, from.Format(time.RFC3339), to.Format(time.RFC3339))
+
+	var done map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &done); err != nil {
+		t.Fatalf("decode %q: %v", buf.String(), err)
+	}
+	if done["event"] != "purge_range_done" || done["deleted_count"] != float64(3) {
+		t.Errorf("purge output = %v, want purge_range_done with 3 records deleted", done)
+	}
+
+	check := &tools.ServerConfig{}
+	if err := check.OpenDB(dir, true); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer check.Db.Close()
+	iter, closeIter, err := tools.WrapIter(check.Db, tools.RecordIterOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeIter()
+	var got []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key()))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(kept) {
+		t.Errorf("keys after purge = %v, want %v", got, kept)
+	}
+
+	buf.Reset()
+	runPurgeRange(context.Background(), dir, "yesterday", to.Format(time.RFC3339))
+	if !strings.Contains(buf.String(), `"event":"purge_range_error"`) || !strings.Contains(buf.String(), "-purge-range-from") {
+		t.Errorf("invalid -purge-range-from output = %s", buf.String())
+	}
+}
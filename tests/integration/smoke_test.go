@@ -0,0 +1,114 @@
+//go:build integration
+
+// Package integration holds end-to-end tests that run a full agent through
+// the test harness: logs go in over gRPC, land in Pebble and are uploaded to
+// the harness's fake Data Nadhi server. They are slower than the unit tests
+// and only build with the integration tag:
+//
+//	go test -tags integration ./...
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+const (
+	smokeLogs     = 100
+	smokeTimeout  = 10 * time.Second       // how long the server may wait for every log once it is up
+	smokeDowntime = 5 * time.Second        // how long the server is unavailable in the reconnect scenario
+	drainInterval = 200 * time.Millisecond // pause between upload passes, like -post-flush-interval
+)
+
+func TestSmokeHealthyServer(t *testing.T) {
+	agent := startSmokeAgent(t)
+	sendSmokeLogs(t, agent)
+	waitForAllUploaded(t, agent)
+}
+
+func TestSmokeReconnectAfterDowntime(t *testing.T) {
+	agent := startSmokeAgent(t)
+	agent.SetServerStatus(http.StatusServiceUnavailable)
+	sendSmokeLogs(t, agent)
+
+	// Keep uploading while the server is down: every pass fails and the
+	// records must stay in Pebble
+	deadline := time.Now().Add(smokeDowntime)
+	for time.Now().Before(deadline) {
+		if err := agent.Drain(); err == nil {
+			t.Fatal("upload pass succeeded while the server was down")
+		}
+		if n := agent.RecordCount(); n != smokeLogs {
+			t.Fatalf("records during downtime = %d, want all %d kept", n, smokeLogs)
+		}
+		time.Sleep(drainInterval)
+	}
+
+	agent.SetServerStatus(http.StatusOK)
+	waitForAllUploaded(t, agent)
+}
+
+// startSmokeAgent starts a harness agent in a temp directory; it is shut
+// down when the test ends.
+func startSmokeAgent(t *testing.T) *testharness.AgentHandle {
+	t.Helper()
+	return testharness.StartTestAgent(t, testharness.Options{})
+}
+
+// sendSmokeLogs sends smokeLogs logs over gRPC, numbered by their "seq" field.
+func sendSmokeLogs(t *testing.T, agent *testharness.AgentHandle) {
+	t.Helper()
+	for i := 0; i < smokeLogs; i++ {
+		resp, err := agent.SendLog(&pb.LogRequest{
+			JsonData:  fmt.Sprintf(`{"seq":%d,"msg":"smoke log %d"}`, i, i),
+			Pipelines: []string{"smoke-pipeline"},
+		})
+		if err != nil || !resp.Success {
+			t.Fatalf("SendLog %d = %+v, %v", i, resp, err)
+		}
+	}
+}
+
+// waitForAllUploaded runs upload passes until Pebble is empty, then checks
+// the server saw every log. A record is only deleted once the server
+// accepted it, so an empty Pebble means every upload succeeded.
+func waitForAllUploaded(t *testing.T, agent *testharness.AgentHandle) {
+	t.Helper()
+	deadline := time.Now().Add(smokeTimeout)
+	for agent.RecordCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d records still in Pebble after %s", agent.RecordCount(), smokeTimeout)
+		}
+		_ = agent.Drain()
+		time.Sleep(drainInterval)
+	}
+
+	seen := map[int]bool{}
+	for _, req := range agent.CapturedServerRequests() {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("read captured body: %v", err)
+		}
+		var body struct {
+			LogData struct {
+				Seq int `json:"seq"`
+			} `json:"log_data"`
+		}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatalf("decode captured body %q: %v", data, err)
+		}
+		seen[body.LogData.Seq] = true
+	}
+	for i := 0; i < smokeLogs; i++ {
+		if !seen[i] {
+			t.Errorf("log %d never reached the server", i)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StartAdminServer exposes operational endpoints on localhost:<port>:
+//
+//	GET /status                    session ID, uptime and ingestion state as JSON
+//	POST /dry-process?enable=true  make the next ProcessPebble a dry run
+//	POST /flush-and-wait?timeout=  upload every stored record, then respond (see FlushAndWait)
+//	POST /pause                    refuse new logs ahead of a handoff (see HandoffFrom)
+//	POST /shutdown                 stop the agent through shutdown
+//
+// The server runs in the background and is shut down when ctx is cancelled.
+func (c *ServerConfig) StartAdminServer(ctx context.Context, wg *sync.WaitGroup, port int, shutdown context.CancelFunc) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		LogJsonLevel(LevelError, "admin_listen_error", map[string]any{"error": err.Error()})
+		return err
+	}
+	c.serveAdmin(ctx, wg, lis, shutdown)
+	LogJsonLevel(LevelInfo, "admin_server_started", map[string]any{"addr": lis.Addr().String()})
+	return nil
+}
+
+// AdminSocketPath returns the Unix socket on which an agent whose gRPC socket
+// is socketPath serves its admin endpoints (see StartAdminSocket).
+func AdminSocketPath(socketPath string) string {
+	return socketPath + ".admin"
+}
+
+// StartAdminSocket serves the StartAdminServer endpoints on
+// AdminSocketPath(SocketPath), whether or not -admin-port is set, so a newer
+// agent can always find this one by its socket path for a handoff (see
+// HandoffFromSocket). The socket is only accessible to the agent's user, and
+// is removed when ctx is cancelled.
+func (c *ServerConfig) StartAdminSocket(ctx context.Context, wg *sync.WaitGroup, shutdown context.CancelFunc) error {
+	path := AdminSocketPath(c.SocketPath)
+	_ = os.Remove(path)
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		LogJsonLevel(LevelError, "admin_listen_error", map[string]any{"socket": path, "error": err.Error()})
+		return err
+	}
+	_ = os.Chmod(path, 0600)
+	c.serveAdmin(ctx, wg, lis, shutdown)
+	LogJsonLevel(LevelInfo, "admin_socket_started", map[string]any{"socket": path})
+	return nil
+}
+
+// serveAdmin serves the admin endpoints on lis until ctx is cancelled.
+func (c *ServerConfig) serveAdmin(ctx context.Context, wg *sync.WaitGroup, lis net.Listener, shutdown context.CancelFunc) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", c.handleStatus)
+	mux.HandleFunc("POST /dry-process", c.handleDryProcess)
+	mux.HandleFunc("POST /flush-and-wait", c.handleFlushAndWait)
+	mux.HandleFunc("POST /pause", c.handlePause)
+	mux.HandleFunc("POST /shutdown", func(w http.ResponseWriter, r *http.Request) {
+		LogJsonLevel(LevelInfo, "admin_shutdown_requested", map[string]any{"remote": r.RemoteAddr})
+		writeJSON(w, http.StatusOK, map[string]any{"shutting_down": true})
+		shutdown()
+	})
+	srv := &http.Server{Handler: mux}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogJsonLevel(LevelError, "admin_server_error", map[string]any{"error": err.Error()})
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+		LogJsonLevel(LevelInfo, "admin_server_stopped", map[string]any{"addr": lis.Addr().String()})
+	}()
+}
+
+// handleStatus reports the agent's identity and ingestion state.
+func (c *ServerConfig) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"session_id":          c.SessionID,
+		"instance_id":         c.InstanceID,
+		"started_at":          startTime.UTC().Format(time.RFC3339),
+		"uptime_ms":           time.Since(startTime).Milliseconds(),
+		"write_stalled":       c.pebbleBackpressure.Load(),
+		"disk_low":            c.diskLow.Load(),
+		"handoff_paused":      c.handoffPaused.Load(),
+		"fallback_buffer_len": c.FallbackBufferLen(),
+		"record_count":        c.RecordCount(),
+		"build":               c.BuildInfo.ToMap(),
+	})
+}
+
+// handleDryProcess sets or clears DryRunProcess. The flag is cleared again by
+// the ProcessPebble call that performs the dry run.
+func (c *ServerConfig) handleDryProcess(w http.ResponseWriter, r *http.Request) {
+	enable, err := strconv.ParseBool(r.URL.Query().Get("enable"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "enable must be true or false"})
+		return
+	}
+	c.DryRunProcess.Store(enable)
+	LogJsonLevel(LevelInfo, "dry_process_set", map[string]any{"enabled": enable})
+	writeJSON(w, http.StatusOK, map[string]any{"dry_process": enable})
+}
+
+// defaultFlushWaitTimeout is used by /flush-and-wait when no timeout is given.
+const defaultFlushWaitTimeout = 30 * time.Second
+
+// handleFlushAndWait runs FlushAndWait and responds once it finishes:
+// 200 when Pebble is drained, 504 when the timeout passed first.
+func (c *ServerConfig) handleFlushAndWait(w http.ResponseWriter, r *http.Request) {
+	timeout := defaultFlushWaitTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "timeout must be a positive duration"})
+			return
+		}
+		timeout = d
+	}
+
+	start := time.Now()
+	err := c.FlushAndWait(r.Context(), timeout)
+	body := map[string]any{
+		"flushed":      err == nil,
+		"duration_ms":  time.Since(start).Milliseconds(),
+		"record_count": c.RecordCount(),
+	}
+	if err != nil {
+		body["error"] = err.Error()
+		writeJSON(w, http.StatusGatewayTimeout, body)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// handlePause stops the agent from accepting logs so a new agent can take
+// over its base directory. The pause lasts until the agent exits.
+func (c *ServerConfig) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !c.handoffPaused.Swap(true) {
+		LogJsonLevel(LevelInfo, "ingestion_paused_for_handoff", map[string]any{"remote": r.RemoteAddr})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"paused": true, "record_count": c.RecordCount()})
+}
+
+// Sizes of the in-memory tail kept for /tail subscribers.
+const (
+	tailBufferSize = 1000
+	tailReplaySize = 100
+)
+
+// tailHub keeps the most recent records received over gRPC and fans new ones
+// out to /tail subscribers. It lives only in memory; nothing is read from Pebble.
+type tailHub struct {
+	mu   sync.Mutex
+	buf  []logRecord
+	next int
+	subs map[chan logRecord]struct{}
+}
+
+// newTailHub returns an empty hub with a ring buffer of tailBufferSize records.
+func newTailHub() *tailHub {
+	return &tailHub{
+		buf:  make([]logRecord, 0, tailBufferSize),
+		subs: map[chan logRecord]struct{}{},
+	}
+}
+
+// publish records rec in the ring buffer and forwards it to every subscriber.
+// Slow subscribers miss records instead of blocking ingestion.
+func (h *tailHub) publish(rec logRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.buf) < tailBufferSize {
+		h.buf = append(h.buf, rec)
+	} else {
+		h.buf[h.next] = rec
+	}
+	h.next = (h.next + 1) % tailBufferSize
+
+	for ch := range h.subs {
+		select {
+		case ch <- rec:
+		default:
+		}
+	}
+}
+
+// subscribe returns up to tailReplaySize recent records (oldest first), a
+// channel of new records and a function that ends the subscription.
+func (h *tailHub) subscribe() ([]logRecord, chan logRecord, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Once the ring is full, the oldest record sits at h.next
+	ordered := append([]logRecord{}, h.buf...)
+	if len(h.buf) == tailBufferSize {
+		ordered = append(append(ordered[:0], h.buf[h.next:]...), h.buf[:h.next]...)
+	}
+	recent := ordered[max(len(ordered)-tailReplaySize, 0):]
+
+	ch := make(chan logRecord, tailReplaySize)
+	h.subs[ch] = struct{}{}
+	tailSubscribers.Inc()
+
+	return recent, ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs, ch)
+		tailSubscribers.Dec()
+	}
+}
+
+// StartTailServer serves GET /tail on localhost:<port> as Server-Sent Events.
+// Each subscriber first receives the last 100 records received over gRPC, then
+// every new one. Requests must carry the bearer token when one is set.
+// It must be called before the gRPC server starts.
+func (c *ServerConfig) StartTailServer(ctx context.Context, wg *sync.WaitGroup, port int, token string) error {
+	c.tail = newTailHub()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tail", func(w http.ResponseWriter, r *http.Request) {
+		c.handleTail(ctx, w, r)
+	})
+
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		LogJsonLevel(LevelError, "tail_listen_error", map[string]any{"error": err.Error()})
+		return err
+	}
+	srv := &http.Server{Handler: requireBearerToken(token, mux)}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogJsonLevel(LevelError, "tail_server_error", map[string]any{"error": err.Error()})
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+		LogJsonLevel(LevelInfo, "tail_server_stopped", nil)
+	}()
+
+	LogJsonLevel(LevelInfo, "tail_server_started", map[string]any{"addr": lis.Addr().String(), "token_required": token != ""})
+	return nil
+}
+
+// handleTail streams records to one SSE client until it disconnects or the
+// agent shuts down.
+func (c *ServerConfig) handleTail(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	recent, ch, unsubscribe := c.tail.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, rec := range recent {
+		writeSSE(w, rec)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case rec := <-ch:
+			writeSSE(w, rec)
+			flusher.Flush()
+		}
+	}
+}
+
+// writeSSE writes rec as a single SSE data event.
+func writeSSE(w http.ResponseWriter, rec logRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// writeJSON writes v as a JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,225 @@
+package tools
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAdminStatusReportsSession(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.SessionID = NewSessionID()
+	c.InstanceID = "agent-7"
+
+	rec := httptest.NewRecorder()
+	c.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /status = %d", rec.Code)
+	}
+	var status map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode /status: %v", err)
+	}
+	if status["session_id"] != c.SessionID || status["instance_id"] != "agent-7" {
+		t.Errorf("/status = %v, want session_id %s and instance_id agent-7", status, c.SessionID)
+	}
+	if _, ok := status["uptime_ms"].(float64); !ok {
+		t.Errorf("/status uptime_ms = %v, want a number", status["uptime_ms"])
+	}
+}
+
+// startTail runs StartTailServer on a free port and returns its /tail URL.
+func startTail(t *testing.T, c *ServerConfig, token string) string {
+	t.Helper()
+	logs := CaptureLogs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	if err := c.StartTailServer(ctx, &wg, 0, token); err != nil {
+		t.Fatalf("StartTailServer: %v", err)
+	}
+	started := logs.Events("tail_server_started")
+	if len(started) != 1 {
+		t.Fatalf("tail_server_started entries = %d, want 1", len(started))
+	}
+	return "http://" + started[0]["addr"].(string) + "/tail"
+}
+
+// readSSE sends the payload of every SSE data event read from r to events.
+func readSSE(r io.Reader, events chan<- map[string]any) {
+	defer close(events)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var rec logRecord
+		if json.Unmarshal([]byte(data), &rec) == nil {
+			events <- rec.Payload
+		}
+	}
+}
+
+func TestTailStreamsRecentAndLiveRecords(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	url := startTail(t, c, "tail-token")
+	s := &server{config: c}
+	send := func(n int) {
+		req := &pb.LogRequest{JsonData: fmt.Sprintf(`{"n":%d}`, n), Pipelines: []string{"p1"}}
+		if _, err := s.SendLog(context.Background(), req); err != nil {
+			t.Fatalf("SendLog: %v", err)
+		}
+	}
+	for i := 0; i < 150; i++ {
+		send(i)
+	}
+
+	if resp, err := http.Get(url); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET /tail without token = %v, %v; want 401", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer tail-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /tail: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+	events := make(chan map[string]any, 200)
+	go readSSE(resp.Body, events)
+
+	next := func(timeout time.Duration) map[string]any {
+		t.Helper()
+		select {
+		case payload, ok := <-events:
+			if !ok {
+				t.Fatal("tail stream ended")
+			}
+			return payload
+		case <-time.After(timeout):
+			t.Fatalf("no tail event within %v", timeout)
+			return nil
+		}
+	}
+	// The replay holds the last tailReplaySize records, oldest first
+	for i := 150 - tailReplaySize; i < 150; i++ {
+		if payload := next(time.Second); payload["n"] != float64(i) {
+			t.Fatalf("replayed record = %v, want n=%d", payload, i)
+		}
+	}
+	if got := testutil.ToFloat64(tailSubscribers); got != 1 {
+		t.Errorf("tail subscribers = %v, want 1", got)
+	}
+
+	for i := 150; i < 155; i++ {
+		send(i)
+		if payload := next(100 * time.Millisecond); payload["n"] != float64(i) {
+			t.Fatalf("live record = %v, want n=%d", payload, i)
+		}
+	}
+
+	cancel()
+	if !waitFor(time.Second, func() bool { return testutil.ToFloat64(tailSubscribers) == 0 }) {
+		t.Errorf("tail subscribers after disconnect = %v, want 0", testutil.ToFloat64(tailSubscribers))
+	}
+}
+
+func TestTailHubKeepsLastRecords(t *testing.T) {
+	h := newTailHub()
+	for i := 0; i < tailBufferSize+10; i++ {
+		h.publish(logRecord{Payload: map[string]any{"n": i}})
+	}
+	recent, _, unsubscribe := h.subscribe()
+	defer unsubscribe()
+	if len(recent) != tailReplaySize {
+		t.Fatalf("replay = %d records, want %d", len(recent), tailReplaySize)
+	}
+	for i, rec := range recent {
+		if want := tailBufferSize + 10 - tailReplaySize + i; rec.Payload["n"] != want {
+			t.Fatalf("replay[%d] = %v, want n=%d", i, rec.Payload["n"], want)
+		}
+	}
+}
+
+func TestDryProcessSendsNothing(t *testing.T) {
+	logs := CaptureLogs(t)
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	sendNumbered(t, c, 0, 3)
+
+	rec := httptest.NewRecorder()
+	c.handleDryProcess(rec, httptest.NewRequest(http.MethodPost, "/dry-process?enable=true", nil))
+	if rec.Code != http.StatusOK || !c.DryRunProcess.Load() {
+		t.Fatalf("POST /dry-process?enable=true = %d, DryRunProcess = %v", rec.Code, c.DryRunProcess.Load())
+	}
+
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("dry ProcessPebble: %v", err)
+	}
+	if n := len(upload.logData()); n != 0 {
+		t.Fatalf("uploads during a dry run = %d, want 0", n)
+	}
+	if n := len(storedKeys(t, c)); n != 3 {
+		t.Fatalf("records after a dry run = %d, want all 3 kept", n)
+	}
+	records := logs.Events("dry_process_record")
+	if len(records) != 3 || fmt.Sprint(records[0]["payload_keys"]) != "[n]" || fmt.Sprint(records[0]["pipelines"]) != "[p1]" {
+		t.Errorf("dry_process_record entries = %v", records)
+	}
+	if done := logs.Events("dry_process_complete"); len(done) != 1 || done[0]["record_count"] != float64(3) {
+		t.Errorf("dry_process_complete entries = %v, want record_count 3", done)
+	}
+
+	// The flag only covers one pass
+	if c.DryRunProcess.Load() {
+		t.Fatal("DryRunProcess still set after the dry run")
+	}
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	if n := len(upload.logData()); n != 3 {
+		t.Errorf("uploads after the dry run = %d, want 3", n)
+	}
+}
+
+func TestDryProcessRequiresEnable(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.DryRunProcess.Store(true)
+	for target, want := range map[string]int{
+		"/dry-process":              http.StatusBadRequest,
+		"/dry-process?enable=maybe": http.StatusBadRequest,
+		"/dry-process?enable=false": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		c.handleDryProcess(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		if rec.Code != want {
+			t.Errorf("POST %s = %d, want %d", target, rec.Code, want)
+		}
+	}
+	if c.DryRunProcess.Load() {
+		t.Error("enable=false left the dry run pending")
+	}
+}
@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Admission policies applied to SendLog while ProcessPebble runs.
+const (
+	PausePolicyNone   = "none"
+	PausePolicyBlock  = "block"
+	PausePolicyReject = "reject"
+)
+
+// defaultMaxPauseWait bounds a blocked SendLog when MaxPauseWait is unset.
+const defaultMaxPauseWait = 5 * time.Second
+
+// ValidatePausePolicy rejects values of -pause-policy other than none, block or reject.
+func ValidatePausePolicy(policy string) error {
+	switch policy {
+	case "", PausePolicyNone, PausePolicyBlock, PausePolicyReject:
+		return nil
+	}
+	return fmt.Errorf("unknown pause policy %q (want none, block or reject)", policy)
+}
+
+// pauseIngestion marks ingestion as paused for the duration of a ProcessPebble
+// call. It is a no-op unless PausePolicy is block or reject.
+func (c *ServerConfig) pauseIngestion() {
+	if c.PausePolicy != PausePolicyBlock && c.PausePolicy != PausePolicyReject {
+		return
+	}
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.IngestionPaused.Load() {
+		return
+	}
+	c.resumed = make(chan struct{})
+	c.IngestionPaused.Store(true)
+}
+
+// resumeIngestion clears IngestionPaused and releases every blocked SendLog.
+func (c *ServerConfig) resumeIngestion() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if !c.IngestionPaused.Load() {
+		return
+	}
+	c.IngestionPaused.Store(false)
+	close(c.resumed)
+}
+
+// beginWrite admits a write with admitIngestion and holds off Reset until
+// release is called, so the session is never swapped under a write in
+// flight. The check happens under the gate: once Reset has set resetting and
+// waited for the gate, every later write is refused.
+func (c *ServerConfig) beginWrite(ctx context.Context) (release func(), err error) {
+	c.writeGate.RLock()
+	if err := c.admitIngestion(ctx); err != nil {
+		c.writeGate.RUnlock()
+		return nil, err
+	}
+	return c.writeGate.RUnlock, nil
+}
+
+// admitIngestion refuses writes once the agent is paused for a handoff or
+// while Reset runs, and otherwise applies PausePolicy to an incoming write.
+// With "reject" a paused agent returns Unavailable immediately; with "block"
+// the call waits up to MaxPauseWait for ProcessPebble to finish before
+// returning Unavailable.
+func (c *ServerConfig) admitIngestion(ctx context.Context) error {
+	if c.handoffPaused.Load() {
+		return status.Error(codes.Unavailable, "agent is handing off to a new instance, retry later")
+	}
+	if c.resetting.Load() {
+		return status.Error(codes.Unavailable, "agent is resetting, retry later")
+	}
+	if !c.IngestionPaused.Load() {
+		return nil
+	}
+	if c.PausePolicy == PausePolicyReject {
+		return status.Error(codes.Unavailable, "ingestion paused while uploading, retry later")
+	}
+
+	c.pauseMu.Lock()
+	resumed := c.resumed
+	c.pauseMu.Unlock()
+
+	wait := c.MaxPauseWait
+	if wait <= 0 {
+		wait = defaultMaxPauseWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	case <-timer.C:
+		return status.Error(codes.Unavailable, "ingestion paused while uploading, retry later")
+	}
+}
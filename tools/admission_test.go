@@ -0,0 +1,186 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// blockingUpload is an upload server that holds every request until release
+// is closed, keeping ProcessPebble (and the ingestion pause) running.
+func blockingUpload(t *testing.T) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	return srv, release
+}
+
+func TestValidatePausePolicy(t *testing.T) {
+	for _, policy := range []string{"", PausePolicyNone, PausePolicyBlock, PausePolicyReject} {
+		if err := ValidatePausePolicy(policy); err != nil {
+			t.Errorf("ValidatePausePolicy(%q) = %v", policy, err)
+		}
+	}
+	if err := ValidatePausePolicy("queue"); err == nil {
+		t.Error("ValidatePausePolicy accepted an unknown policy")
+	}
+}
+
+func TestPausePolicyBlockWaitsForProcessPebble(t *testing.T) {
+	upload, release := blockingUpload(t)
+	c := newTestConfig(t, upload.URL)
+	c.PausePolicy = PausePolicyBlock
+	c.MaxPauseWait = 10 * time.Second
+	putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{}, Pipelines: []string{"p1"}})
+
+	processed := make(chan error, 1)
+	go func() { processed <- c.ProcessPebble(context.Background()) }()
+	if !waitFor(2*time.Second, c.IngestionPaused.Load) {
+		t.Fatal("ProcessPebble did not pause ingestion")
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		resp, err := (&server{config: c}).SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}})
+		if err == nil && !resp.Success {
+			err = status.Error(codes.Unknown, resp.Message)
+		}
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("SendLog returned %v while ProcessPebble was running, want it to block", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-processed; err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("SendLog after ProcessPebble: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("SendLog still blocked after ProcessPebble finished")
+	}
+	if c.IngestionPaused.Load() {
+		t.Error("IngestionPaused still set after ProcessPebble")
+	}
+	if n := len(storedKeys(t, c)); n != 1 {
+		t.Errorf("records after the blocked write = %d, want 1", n)
+	}
+}
+
+func TestPausePolicyBlockTimesOut(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.PausePolicy = PausePolicyBlock
+	c.MaxPauseWait = 50 * time.Millisecond
+	c.pauseIngestion()
+	defer c.resumeIngestion()
+
+	start := time.Now()
+	_, err := (&server{config: c}).SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("SendLog = %v, want Unavailable after MaxPauseWait", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("SendLog gave up after %v, before MaxPauseWait", elapsed)
+	}
+}
+
+func TestPausePolicyRejectFailsFast(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.PausePolicy = PausePolicyReject
+	c.pauseIngestion()
+
+	s := &server{config: c}
+	if _, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("SendLog while paused = %v, want Unavailable", err)
+	}
+	c.resumeIngestion()
+	if resp, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}}); err != nil || !resp.Success {
+		t.Fatalf("SendLog after resume = %+v, %v", resp, err)
+	}
+}
+
+func TestPausePolicyNoneNeverPauses(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.pauseIngestion()
+	if c.IngestionPaused.Load() {
+		t.Fatal("ingestion paused without a pause policy")
+	}
+}
+
+func TestStreamLogsAppliesPausePolicy(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.PausePolicy = PausePolicyReject
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	if err := c.StartGRPCServer(ctx, &wg); err != nil {
+		t.Fatalf("StartGRPCServer: %v", err)
+	}
+	client := dialAgent(t, c)
+
+	send := func(n int) (*pb.StreamLogResponse, error) {
+		stream, err := client.StreamLogs(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			if err := stream.Send(&pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}}); err != nil {
+				break // the server ended the stream; CloseAndRecv reports why
+			}
+		}
+		return stream.CloseAndRecv()
+	}
+
+	c.pauseIngestion()
+	if _, err := send(3); status.Code(err) != codes.Unavailable {
+		t.Fatalf("stream opened while paused = %v, want Unavailable", err)
+	}
+
+	// A pause that starts mid-stream refuses the next batch commit
+	stream, err := client.StreamLogs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.resumeIngestion()
+	if err := stream.Send(&pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the handler to be past its admission check before pausing
+	time.Sleep(100 * time.Millisecond)
+	c.pauseIngestion()
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("stream committed during a pause = %v, want Unavailable", err)
+	}
+	if !PebbleIsEmpty(c.Db) {
+		t.Fatal("batch committed while ingestion was paused")
+	}
+
+	c.resumeIngestion()
+	if resp, err := send(3); err != nil || resp.ReceivedCount != 3 {
+		t.Fatalf("stream after resume = %+v, %v", resp, err)
+	}
+	if n := len(storedKeys(t, c)); n != 3 {
+		t.Errorf("records after resume = %d, want 3", n)
+	}
+}
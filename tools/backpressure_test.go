@@ -0,0 +1,88 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+)
+
+func TestBackpressureHint(t *testing.T) {
+	c := &ServerConfig{MaxRecords: 100}
+	for _, tc := range []struct {
+		count          int64
+		wantRetryAfter int64
+	}{
+		{0, 0},
+		{80, 0}, // the slowdown starts past 80%
+		{90, 500},
+		{100, 1000},
+		{150, 1000}, // capped at one second
+	} {
+		c.recordCount.Store(tc.count)
+		ratio, retryAfter := c.backpressureHint()
+		if ratio != float64(tc.count)/100 || retryAfter != tc.wantRetryAfter {
+			t.Errorf("hint at %d/100 = %v, %dms; want %v, %dms", tc.count, ratio, retryAfter, float64(tc.count)/100, tc.wantRetryAfter)
+		}
+	}
+
+	if ratio, retryAfter := (&ServerConfig{}).backpressureHint(); ratio != 0 || retryAfter != 0 {
+		t.Errorf("hint without MaxRecords = %v, %d; want none", ratio, retryAfter)
+	}
+}
+
+func TestSendLogReportsBackpressure(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.MaxRecords = 10
+	s := &server{config: c}
+
+	var resp *pb.LogResponse
+	for i := 0; i < 9; i++ {
+		var err error
+		resp, err = s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}})
+		if err != nil || !resp.Success {
+			t.Fatalf("SendLog %d = %+v, %v", i, resp, err)
+		}
+		if i == 6 && (resp.BackpressureRatio > backpressureSlowdownRatio || resp.RetryAfterMs != 0) {
+			t.Errorf("response at 70%% = ratio %v, retry after %dms; want no slowdown", resp.BackpressureRatio, resp.RetryAfterMs)
+		}
+	}
+
+	// 9 of 10 records stored: past the 80% slowdown point
+	if resp.BackpressureRatio <= 0.8 || resp.RetryAfterMs <= 0 {
+		t.Fatalf("response at 90%% = ratio %v, retry after %dms; want a slowdown", resp.BackpressureRatio, resp.RetryAfterMs)
+	}
+	if resp.QueueDepth != 9 || resp.MaxQueueDepth != 10 {
+		t.Errorf("queue depth = %d/%d, want 9/10", resp.QueueDepth, resp.MaxQueueDepth)
+	}
+
+	// An SDK sending every 10ms waits the longer suggested delay instead
+	interval := 10 * time.Millisecond
+	delay := BackpressureDelay(resp, interval)
+	if want := time.Duration(resp.RetryAfterMs) * time.Millisecond; delay != want {
+		t.Errorf("BackpressureDelay = %v, want the suggested %v", delay, want)
+	}
+	if got := BackpressureDelay(&pb.LogResponse{}, interval); got != interval {
+		t.Errorf("BackpressureDelay without a hint = %v, want the %v interval", got, interval)
+	}
+}
+
+func TestSendLogReportsQueueDepth(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	for i, resp := range sendNumbered(t, c, 0, 5) {
+		if resp.QueueDepth != int64(i+1) || resp.MaxQueueDepth != 0 {
+			t.Errorf("response %d queue depth = %d/%d, want %d with no limit", i, resp.QueueDepth, resp.MaxQueueDepth, i+1)
+		}
+	}
+
+	// Uploaded records no longer count
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	if resp := sendNumbered(t, c, 5, 6)[0]; resp.QueueDepth != 1 {
+		t.Errorf("queue depth after an upload = %d, want 1", resp.QueueDepth)
+	}
+}
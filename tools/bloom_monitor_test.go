@@ -0,0 +1,113 @@
+package tools
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newBloomConfig opens an agent whose sstables carry bloom filters of
+// bitsPerKey bits, holding n records flushed to disk. It returns the keys
+// of the records.
+func newBloomConfig(t *testing.T, bitsPerKey, n int) (*ServerConfig, []string) {
+	t.Helper()
+	c := &ServerConfig{ServerHost: "http://unused.invalid", BloomFilterBitsPerKey: bitsPerKey}
+	if err := c.CreateRequiredFiles(t.TempDir()); err != nil {
+		t.Fatalf("create agent files: %v", err)
+	}
+	t.Cleanup(c.CloseFiles)
+
+	prefix := pipelineKeyPrefix(PriorityNormal, "p1")
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	var keys []string
+	for i := 0; i < n; i++ {
+		key := keyAt(prefix, start.Add(time.Duration(i)*time.Second), 0)
+		putRecord(t, c, key, logRecord{Payload: map[string]any{"n": i}})
+		keys = append(keys, key)
+	}
+	FlushPebbleDB(c.Db)
+	return c, keys
+}
+
+// runBloomMonitor runs the monitor loop on c, returning the channel that
+// drives its checks.
+func runBloomMonitor(t *testing.T, c *ServerConfig) chan<- time.Time {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	ticks := make(chan time.Time)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.runBloomFilterMonitor(ctx, ticks)
+	}()
+	return ticks
+}
+
+func TestBloomFilterMonitorLogsStats(t *testing.T) {
+	logs := CaptureLogs(t)
+	c, keys := newBloomConfig(t, 10, 2000)
+	ticks := runBloomMonitor(t, c)
+	ticks <- time.Now() // first sample, taken before any lookup
+
+	// Look up every stored key and, next to each, one that was never written
+	for _, key := range keys {
+		if _, err := c.Db.Get([]byte(key)); err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+		_, _ = c.Db.Get([]byte(key[:len(key)-1] + "5"))
+	}
+	ticks <- time.Now()
+
+	var stats []map[string]any
+	if !waitFor(2*time.Second, func() bool {
+		stats = nil
+		for _, e := range logs.Events("bloom_filter_stats") {
+			if e["level"] == "INFO" {
+				stats = append(stats, e)
+			}
+		}
+		return len(stats) > 0
+	}) {
+		t.Fatal("no bloom_filter_stats logged after lookups")
+	}
+	e := stats[0]
+	if rate, ok := e["useful_hit_rate"].(float64); !ok || rate <= 0 || rate > 1 {
+		t.Errorf("useful_hit_rate = %v, want a rate above 0", e["useful_hit_rate"])
+	}
+	if rate, ok := e["false_positive_rate"].(float64); !ok || rate < 0 || rate > DefaultBloomFPAlert {
+		t.Errorf("false_positive_rate = %v with 10 bits per key, want below %v", e["false_positive_rate"], DefaultBloomFPAlert)
+	}
+	if n := len(logs.Events("bloom_filter_degraded")); n != 0 {
+		t.Errorf("bloom_filter_degraded logged %d times for a healthy filter", n)
+	}
+}
+
+func TestBloomFilterMonitorReportsDegradedFilter(t *testing.T) {
+	logs := CaptureLogs(t)
+	c, keys := newBloomConfig(t, 1, 2000)
+	c.BloomFPAlert = 0.05
+	before := testutil.ToFloat64(bloomFilterDegradedTotal)
+	ticks := runBloomMonitor(t, c)
+	ticks <- time.Now()
+
+	// One bit per key lets most absent keys through the filter
+	for _, key := range keys {
+		_, _ = c.Db.Get([]byte(key[:len(key)-1] + "5"))
+	}
+	ticks <- time.Now()
+
+	if !waitFor(2*time.Second, func() bool { return len(logs.Events("bloom_filter_degraded")) > 0 }) {
+		t.Fatalf("no bloom_filter_degraded logged; stats = %v", logs.Events("bloom_filter_stats"))
+	}
+	if got := testutil.ToFloat64(bloomFilterDegradedTotal) - before; got != 1 {
+		t.Errorf("echopost_bloom_filter_degraded_total grew by %v, want 1", got)
+	}
+}
@@ -0,0 +1,68 @@
+package tools
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Version is the agent version, set at build time with
+// -ldflags "-X github.com/datanadhi/echopost/tools.Version=v1.2.3".
+// When empty, the module version from the build info is used.
+var Version string
+
+// BuildInfo describes the running binary. It is logged at startup and
+// reported by the admin /status endpoint.
+type BuildInfo struct {
+	Version     string
+	GoVersion   string
+	OS          string
+	Arch        string
+	Module      string
+	VCSRevision string
+	VCSTime     string
+	VCSModified bool
+}
+
+// ReadBuildInfo collects BuildInfo from the runtime and runtime/debug.
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Module = bi.Main.Path
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.VCSRevision = s.Value
+		case "vcs.time":
+			info.VCSTime = s.Value
+		case "vcs.modified":
+			info.VCSModified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// ToMap flattens the build info into log fields.
+func (b BuildInfo) ToMap() map[string]any {
+	return map[string]any{
+		"version":      b.Version,
+		"go_version":   b.GoVersion,
+		"os":           b.OS,
+		"arch":         b.Arch,
+		"module":       b.Module,
+		"vcs_revision": b.VCSRevision,
+		"vcs_time":     b.VCSTime,
+		"vcs_modified": b.VCSModified,
+	}
+}
@@ -0,0 +1,28 @@
+package tools
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestReadBuildInfo(t *testing.T) {
+	info := ReadBuildInfo()
+	if info.GoVersion != runtime.Version() || info.OS != runtime.GOOS || info.Arch != runtime.GOARCH {
+		t.Errorf("runtime fields = %+v", info)
+	}
+	if info.Module != "github.com/datanadhi/echopost" {
+		t.Errorf("Module = %q, want github.com/datanadhi/echopost", info.Module)
+	}
+	if info.Version == "" {
+		t.Error("Version is empty without -X tools.Version; want the module version")
+	}
+}
+
+func TestReadBuildInfoPrefersLdflagsVersion(t *testing.T) {
+	prev := Version
+	t.Cleanup(func() { Version = prev })
+	Version = "v9.8.7"
+	if got := ReadBuildInfo().Version; got != "v9.8.7" {
+		t.Errorf("Version = %q, want the -X value v9.8.7", got)
+	}
+}
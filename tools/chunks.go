@@ -0,0 +1,203 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Chunk keys are "chunk_<ChunkID>_<ChunkIndex>". The prefix sorts after every
+// record key (records start with a digit), so record scans stop before it.
+const (
+	chunkKeyPrefix     = "chunk_"
+	chunkKeyUpperBound = "chunk`" // chunkKeyPrefix with its last byte incremented
+
+	maxChunkTotal       = 1000
+	defaultChunkTimeout = 5 * time.Minute
+)
+
+// chunkEntry is one stored part of a chunked payload.
+type chunkEntry struct {
+	Data     string    `json:"data"`
+	StoredAt time.Time `json:"stored_at"`
+}
+
+// RecordIterOptions bounds an iterator to record keys, skipping the chunk_
+// keys of partially received payloads.
+func RecordIterOptions() *pebble.IterOptions {
+	return &pebble.IterOptions{UpperBound: []byte(chunkKeyPrefix)}
+}
+
+// chunkKey returns the Pebble key of one part of a chunked payload.
+func chunkKey(id string, index int32) []byte {
+	return []byte(fmt.Sprintf("%s%s_%d", chunkKeyPrefix, id, index))
+}
+
+// chunkTimeout returns how long parts of an incomplete payload are kept.
+func (c *ServerConfig) chunkTimeout() time.Duration {
+	if c.ChunkTimeout > 0 {
+		return c.ChunkTimeout
+	}
+	return defaultChunkTimeout
+}
+
+// storeChunk keeps one part of a payload sent across several SendLog calls.
+// Once every index from 0 to ChunkTotal-1 is stored, the parts are joined in
+// order and written as a single record, and the chunk keys are deleted in the
+// same batch. Parts of a payload that never completes are removed by
+// StartChunkReaper after ChunkTimeout.
+func (c *ServerConfig) storeChunk(ctx context.Context, req *pb.LogRequest) (*pb.LogResponse, error) {
+	if req.ChunkId == "" || req.ChunkTotal > maxChunkTotal || req.ChunkIndex < 0 || req.ChunkIndex >= req.ChunkTotal {
+		return nil, status.Error(codes.InvalidArgument, "invalid_chunk")
+	}
+
+	// Serialises the completeness check so a payload is assembled only once
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+
+	data, _ := json.Marshal(chunkEntry{Data: req.JsonData, StoredAt: time.Now().UTC()})
+	if err := c.Db.Set(chunkKey(req.ChunkId, req.ChunkIndex), data, pebble.NoSync); err != nil {
+		logAggregatedError(LevelError, "pebble_write_error", map[string]any{"error": err.Error()})
+		return &pb.LogResponse{Success: false, Message: "Db write failed"}, nil
+	}
+
+	var parts strings.Builder
+	for i := int32(0); i < req.ChunkTotal; i++ {
+		chunk, err := c.readChunk(chunkKey(req.ChunkId, i))
+		if errors.Is(err, pebble.ErrNotFound) {
+			LogJsonLevel(LevelDebug, "chunk_stored", map[string]any{"chunk_id": req.ChunkId, "chunk_index": req.ChunkIndex})
+			return &pb.LogResponse{Success: true, Message: "chunk_stored"}, nil
+		}
+		if err != nil {
+			return &pb.LogResponse{Success: false, Message: "Db read failed"}, nil
+		}
+		parts.WriteString(chunk.Data)
+	}
+
+	full := &pb.LogRequest{
+		JsonData:  parts.String(),
+		Pipelines: req.Pipelines,
+		ApiKey:    req.ApiKey,
+		Priority:  req.Priority,
+		Level:     req.Level,
+	}
+	if c.sampledOut(full.Pipelines) {
+		if err := c.deleteChunks(req.ChunkId, req.ChunkTotal); err != nil {
+			return &pb.LogResponse{Success: false, Message: "Db write failed"}, nil
+		}
+		return &pb.LogResponse{Success: true, Message: "sampled_out"}, nil
+	}
+
+	rec := c.newLogRecord(ctx, full)
+	recData, _ := c.encodeRecord(rec)
+	key := c.recordKey(rec)
+
+	batch := c.Db.NewBatch()
+	defer batch.Close()
+	_ = batch.Set([]byte(key), recData, nil)
+	for i := int32(0); i < req.ChunkTotal; i++ {
+		_ = batch.Delete(chunkKey(req.ChunkId, i), nil)
+	}
+	if err := c.Db.Commit(batch, c.writeOptionsFor(full.Pipelines)); err != nil {
+		logAggregatedError(LevelError, "pebble_write_error", map[string]any{"error": err.Error()})
+		return &pb.LogResponse{Success: false, Message: "Db write failed"}, nil
+	}
+
+	c.recordsStored(1)
+	LogJsonLevel(LevelDebug, "chunks_assembled", map[string]any{"chunk_id": req.ChunkId, "chunk_total": req.ChunkTotal, "key": key})
+	if c.tail != nil {
+		c.tail.publish(rec)
+	}
+	return &pb.LogResponse{Success: true, Message: "stored"}, nil
+}
+
+// readChunk loads one stored part.
+func (c *ServerConfig) readChunk(key []byte) (chunkEntry, error) {
+	var chunk chunkEntry
+	data, err := c.Db.Get(key)
+	if err != nil {
+		return chunk, err
+	}
+	err = json.Unmarshal(data, &chunk)
+	return chunk, err
+}
+
+// deleteChunks removes every part of a chunked payload.
+func (c *ServerConfig) deleteChunks(id string, total int32) error {
+	batch := c.Db.NewBatch()
+	defer batch.Close()
+	for i := int32(0); i < total; i++ {
+		_ = batch.Delete(chunkKey(id, i), nil)
+	}
+	return c.Db.Commit(batch, pebble.NoSync)
+}
+
+// StartChunkReaper periodically deletes parts of incomplete chunked payloads
+// that have been stored for longer than ChunkTimeout.
+func (c *ServerConfig) StartChunkReaper(ctx context.Context, wg *sync.WaitGroup) {
+	interval := max(c.chunkTimeout()/2, time.Second)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.expireChunks(time.Now()); err != nil {
+					LogJsonLevel(LevelError, "chunk_expire_error", map[string]any{"error": err.Error()})
+				}
+			}
+		}
+	}()
+}
+
+// expireChunks deletes chunk keys stored more than ChunkTimeout before now.
+func (c *ServerConfig) expireChunks(now time.Time) error {
+	c.chunkMu.Lock()
+	defer c.chunkMu.Unlock()
+
+	iter, closeIter, err := WrapIter(c.Db, &pebble.IterOptions{
+		LowerBound: []byte(chunkKeyPrefix),
+		UpperBound: []byte(chunkKeyUpperBound),
+	})
+	if err != nil {
+		return err
+	}
+	defer closeIter()
+
+	var expired [][]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		var chunk chunkEntry
+		if err := json.Unmarshal(iter.Value(), &chunk); err != nil || now.Sub(chunk.StoredAt) > c.chunkTimeout() {
+			expired = append(expired, append([]byte(nil), iter.Key()...))
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	batch := c.Db.NewBatch()
+	defer batch.Close()
+	for _, key := range expired {
+		_ = batch.Delete(key, nil)
+	}
+	if err := c.Db.Commit(batch, pebble.NoSync); err != nil {
+		return err
+	}
+	LogJsonLevel(LevelWarn, "chunks_expired", map[string]any{"count": len(expired), "timeout": c.chunkTimeout().String()})
+	return nil
+}
@@ -0,0 +1,159 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storedChunkKeys returns the keys of every stored part of a chunked payload.
+func storedChunkKeys(t *testing.T, c *ServerConfig) []string {
+	t.Helper()
+	iter, closeIter, err := WrapIter(c.Db, &pebble.IterOptions{
+		LowerBound: []byte(chunkKeyPrefix),
+		UpperBound: []byte(chunkKeyUpperBound),
+	})
+	if err != nil {
+		t.Fatalf("open iterator: %v", err)
+	}
+	defer closeIter()
+
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return keys
+}
+
+// sendChunk sends part index of a payload split into total parts.
+func sendChunk(t *testing.T, s *server, id, part string, index, total int32) *pb.LogResponse {
+	t.Helper()
+	resp, err := s.SendLog(context.Background(), &pb.LogRequest{
+		JsonData:   part,
+		Pipelines:  []string{"p1"},
+		ChunkId:    id,
+		ChunkIndex: index,
+		ChunkTotal: total,
+	})
+	if err != nil {
+		t.Fatalf("SendLog chunk %d: %v", index, err)
+	}
+	return resp
+}
+
+func TestChunkedPayloadAssembledInOrder(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	s := &server{config: c}
+
+	payload := `{"msg":"` + strings.Repeat("x", 500) + `","n":1}`
+	var parts []string
+	for i := 0; i < 5; i++ {
+		parts = append(parts, payload[i*len(payload)/5:(i+1)*len(payload)/5])
+	}
+
+	// Parts arrive out of order; the payload is stored once the last one is in
+	for n, index := range []int32{3, 0, 4, 1, 2} {
+		resp := sendChunk(t, s, "big-1", parts[index], index, 5)
+		want := "chunk_stored"
+		if n == 4 {
+			want = "stored"
+		}
+		if !resp.Success || resp.Message != want {
+			t.Fatalf("chunk %d = %+v, want %s", index, resp, want)
+		}
+		if n < 4 {
+			if keys := storedKeys(t, c); len(keys) != 0 {
+				t.Fatalf("records after %d of 5 chunks = %v, want none", n+1, keys)
+			}
+		}
+	}
+
+	if keys := storedChunkKeys(t, c); len(keys) != 0 {
+		t.Errorf("chunk keys after assembly = %v, want them deleted", keys)
+	}
+	if c.RecordCount() != 1 {
+		t.Errorf("RecordCount = %d, want 1", c.RecordCount())
+	}
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	data := upload.logData()
+	if len(data) != 1 || data[0]["msg"] != strings.Repeat("x", 500) || data[0]["n"] != float64(1) {
+		t.Errorf("uploaded payloads = %v, want the assembled payload", data)
+	}
+}
+
+func TestPendingChunksAreNotUploaded(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	s := &server{config: c}
+	sendChunk(t, s, "partial", `{"msg":`, 0, 2)
+	sendNumbered(t, c, 0, 1)
+
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	if n := len(upload.logData()); n != 1 {
+		t.Errorf("uploads = %d, want only the complete record", n)
+	}
+	if keys := storedChunkKeys(t, c); len(keys) != 1 {
+		t.Errorf("chunk keys after ProcessPebble = %v, want the pending part kept", keys)
+	}
+}
+
+func TestInvalidChunkFields(t *testing.T) {
+	s := &server{config: newTestConfig(t, "http://unused.invalid")}
+	for _, req := range []*pb.LogRequest{
+		{ChunkId: "", ChunkIndex: 0, ChunkTotal: 2},
+		{ChunkId: "a", ChunkIndex: 2, ChunkTotal: 2},
+		{ChunkId: "a", ChunkIndex: -1, ChunkTotal: 2},
+		{ChunkId: "a", ChunkIndex: 0, ChunkTotal: maxChunkTotal + 1},
+	} {
+		req.JsonData, req.Pipelines = `{}`, []string{"p1"}
+		if _, err := s.SendLog(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("SendLog(id %q, index %d, total %d) = %v, want InvalidArgument", req.ChunkId, req.ChunkIndex, req.ChunkTotal, err)
+		}
+	}
+}
+
+func TestIncompleteChunksExpire(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.ChunkTimeout = time.Minute
+	s := &server{config: c}
+	sendChunk(t, s, "stale", `{"a":`, 0, 3)
+	sendChunk(t, s, "stale", `1,"b"`, 1, 3)
+
+	if err := c.expireChunks(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storedChunkKeys(t, c); len(keys) != 2 {
+		t.Fatalf("chunk keys before the timeout = %v, want 2", keys)
+	}
+	if err := c.expireChunks(time.Now().Add(time.Minute + time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storedChunkKeys(t, c); len(keys) != 0 {
+		t.Fatalf("chunk keys after the timeout = %v, want none", keys)
+	}
+	if e := logs.Events("chunks_expired"); len(e) != 1 || e[0]["count"] != float64(2) {
+		t.Errorf("chunks_expired entries = %v, want count 2", e)
+	}
+
+	// The last part alone no longer completes the payload
+	if resp := sendChunk(t, s, "stale", `:2}`, 2, 3); resp.Message != "chunk_stored" {
+		t.Errorf("last chunk after expiry = %+v, want chunk_stored", resp)
+	}
+	if keys := storedKeys(t, c); len(keys) != 0 {
+		t.Errorf("records = %v, want none assembled from expired parts", keys)
+	}
+}
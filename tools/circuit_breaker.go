@@ -0,0 +1,134 @@
+package tools
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // Calls go through normally
+	CircuitOpen                         // Calls are short-circuited until RecoveryTimeout elapses
+	CircuitHalfOpen                     // A single probe is allowed to test recovery
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops the agent from probing a server that keeps failing.
+//
+// After FailureThreshold consecutive failures the breaker opens and Allow
+// returns false until RecoveryTimeout has passed. It then lets one probe
+// through (half-open); SuccessThreshold consecutive successes close it again,
+// while any failure re-opens it.
+type CircuitBreaker struct {
+	FailureThreshold int
+	RecoveryTimeout  time.Duration
+	SuccessThreshold int
+
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker returns a closed breaker. A successThreshold below 1 is treated as 1.
+func NewCircuitBreaker(failureThreshold int, recoveryTimeout time.Duration, successThreshold int) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		RecoveryTimeout:  recoveryTimeout,
+		SuccessThreshold: max(successThreshold, 1),
+	}
+}
+
+// State returns the current breaker state.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a call may be made right now.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.RecoveryTimeout {
+			return false
+		}
+		b.transition(CircuitHalfOpen)
+		b.probing = true
+		return true
+	case CircuitHalfOpen:
+		// Only one probe in flight at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// RecordSuccess reports a successful call.
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != CircuitHalfOpen {
+		return
+	}
+	b.probing = false
+	b.successes++
+	if b.successes >= b.SuccessThreshold {
+		b.transition(CircuitClosed)
+	}
+}
+
+// RecordFailure reports a failed call.
+func (b *CircuitBreaker) RecordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitHalfOpen:
+		b.transition(CircuitOpen)
+	case CircuitClosed:
+		b.failures++
+		if b.FailureThreshold > 0 && b.failures >= b.FailureThreshold {
+			b.transition(CircuitOpen)
+		}
+	}
+}
+
+// transition moves to a new state and resets the counters. Caller holds mu.
+func (b *CircuitBreaker) transition(to CircuitState) {
+	if b.state == to {
+		return
+	}
+	LogJsonLevel(LevelWarn, "circuit_breaker_state", map[string]any{"from": b.state.String(), "to": to.String()})
+
+	b.state = to
+	b.failures = 0
+	b.successes = 0
+	b.probing = false
+	if to == CircuitOpen {
+		b.openedAt = time.Now()
+	}
+}
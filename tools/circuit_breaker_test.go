@@ -0,0 +1,103 @@
+package tools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b := NewCircuitBreaker(3, 50*time.Millisecond, 2)
+
+	// Closed: failures below the threshold keep calls flowing
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("closed breaker refused call %d", i)
+		}
+		b.RecordFailure()
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("state after 2 failures = %v, want closed", b.State())
+	}
+	// A success resets the consecutive failure count
+	b.RecordSuccess()
+	b.RecordFailure()
+	b.RecordFailure()
+	if b.State() != CircuitClosed {
+		t.Fatalf("state after success then 2 failures = %v, want closed", b.State())
+	}
+
+	// Closed -> Open on the third consecutive failure
+	b.RecordFailure()
+	if b.State() != CircuitOpen {
+		t.Fatalf("state after 3 failures = %v, want open", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("open breaker allowed a call before the recovery timeout")
+	}
+
+	// Open -> HalfOpen after the recovery timeout, with a single probe
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("breaker refused the probe after the recovery timeout")
+	}
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("state after recovery timeout = %v, want half_open", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("half-open breaker allowed a second concurrent probe")
+	}
+
+	// HalfOpen -> Open on a failed probe
+	b.RecordFailure()
+	if b.State() != CircuitOpen {
+		t.Fatalf("state after failed probe = %v, want open", b.State())
+	}
+
+	// HalfOpen -> Closed after SuccessThreshold successful probes
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("probe %d refused", i)
+		}
+		if i == 0 && b.State() != CircuitHalfOpen {
+			t.Fatalf("state during probing = %v, want half_open", b.State())
+		}
+		b.RecordSuccess()
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("state after 2 successful probes = %v, want closed", b.State())
+	}
+}
+
+func TestCircuitBreakerZeroThresholdNeverOpens(t *testing.T) {
+	b := NewCircuitBreaker(0, time.Minute, 1)
+	for i := 0; i < 100; i++ {
+		b.RecordFailure()
+	}
+	if !b.Allow() || b.State() != CircuitClosed {
+		t.Fatalf("breaker with threshold 0 is %v", b.State())
+	}
+}
+
+func TestOpenBreakerSkipsHealthRequests(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	c := &ServerConfig{ServerHost: srv.URL, HealthBreaker: NewCircuitBreaker(2, time.Hour, 1)}
+	client := c.NewHTTPClient(time.Second)
+
+	for i := 0; i < 5; i++ {
+		if c.IsHealthSuccess(client) {
+			t.Fatalf("health check %d succeeded against a failing server", i)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("server received %d health probes, want 2 before the breaker opened", n)
+	}
+}
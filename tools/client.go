@@ -2,12 +2,156 @@ package tools
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	flow "github.com/datanadhi/flowhttp/client"
 )
 
+// ClassifyNetError maps an upstream network error to a coarse category so
+// deployments can tell DNS, refused, timeout and TLS problems apart in logs:
+// "dns_failure", "connection_refused", "timeout", "tls_error" or "unknown".
+func ClassifyNetError(err error) string {
+	var (
+		dnsErr       *net.DNSError
+		netErr       net.Error
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &dnsErr):
+		return "dns_failure"
+	case errors.As(err, &verifyErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return "tls_error"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseProxyURL validates the value of the -http-proxy flag.
+// An empty string is allowed and means "use the environment".
+func ParseProxyURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q, expected scheme://host[:port]", raw)
+	}
+	return u, nil
+}
+
+// LoadServerTLSConfig builds the TLS settings for connections to the main server
+// from the -server-tls-* flags. It returns nil when none are set, leaving Go's
+// defaults in place. certPath and keyPath must be given together for mutual TLS.
+func LoadServerTLSConfig(caPath string, skipVerify bool, certPath, keyPath string) (*tls.Config, error) {
+	if caPath == "" && !skipVerify && certPath == "" && keyPath == "" {
+		return nil, nil
+	}
+	if (certPath == "") != (keyPath == "") {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caPath != "" {
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+		cfg.RootCAs = pool
+	}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// NewHTTPClient builds the client used for all upstream calls to the main server.
+// Requests go through HTTPProxy when set, otherwise HTTP_PROXY / HTTPS_PROXY
+// from the environment are honoured. ServerTLS, when set, replaces the default
+// TLS settings, and HTTPKeepaliveInterval enables TCP keepalive probes. With
+// H2C set the transport speaks only cleartext HTTP/2, so concurrent uploads
+// (ProcessConcurrency) are multiplexed over a single connection.
+// timeout bounds each whole request; DialTimeout, when set, bounds only the
+// TCP connect.
+func (c *ServerConfig) NewHTTPClient(timeout time.Duration) *flow.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if c.HTTPProxy != nil {
+		transport.Proxy = http.ProxyURL(c.HTTPProxy)
+	}
+	if c.ServerTLS != nil {
+		transport.TLSClientConfig = c.ServerTLS
+	}
+	if c.H2C {
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+	}
+	if c.DialTimeout > 0 || c.HTTPKeepaliveInterval > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		if c.DialTimeout > 0 {
+			dialer.Timeout = c.DialTimeout
+		}
+		if c.HTTPKeepaliveInterval > 0 {
+			// Probe idle connections before NAT gateways silently drop them
+			dialer.KeepAliveConfig = net.KeepAliveConfig{
+				Enable:   true,
+				Idle:     c.HTTPKeepaliveInterval,
+				Interval: c.HTTPKeepaliveInterval,
+				Count:    c.HTTPKeepaliveProbes,
+			}
+			transport.DisableKeepAlives = false
+			transport.MaxIdleConns = 10
+			transport.IdleConnTimeout = 90 * time.Second
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	client := flow.NewClient(timeout)
+	client.Transport = transport
+	return client
+}
+
 // logToFile writes the given record to either the success or failure log file.
 // extras can contain any additional context like response payload or status codes.
 func (c *ServerConfig) logToFile(rec logRecord, isSuccess bool, extras map[string]any) {
@@ -23,35 +167,321 @@ func (c *ServerConfig) logToFile(rec logRecord, isSuccess bool, extras map[strin
 	} else if !isSuccess && c.failureLog != nil {
 		_, _ = c.failureLog.Write(append(data, '\n'))
 	}
+
+	if c.PerPipelineLogs {
+		for _, p := range rec.Pipelines {
+			if f := c.pipelineLogFile(p, isSuccess); f != nil {
+				_, _ = f.Write(append(data, '\n'))
+			}
+		}
+	}
+}
+
+// unsafeFileChars matches characters not allowed in per-pipeline log file names.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// pipelineLogFile returns the cached pipeline-<name>-success.log or
+// pipeline-<name>-failure.log in the session directory, opening it on first use.
+func (c *ServerConfig) pipelineLogFile(pipeline string, isSuccess bool) *os.File {
+	kind := "failure"
+	if isSuccess {
+		kind = "success"
+	}
+	name := fmt.Sprintf("pipeline-%s-%s.log", unsafeFileChars.ReplaceAllString(pipeline, "_"), kind)
+
+	c.pipelineLogsMu.Lock()
+	defer c.pipelineLogsMu.Unlock()
+
+	if f, ok := c.pipelineLogs[name]; ok {
+		return f
+	}
+	if c.sessionPath == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(c.sessionPath, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		LogJsonLevel(LevelError, "pipeline_log_open_error", map[string]any{"pipeline": pipeline, "error": err.Error()})
+		return nil
+	}
+	if c.pipelineLogs == nil {
+		c.pipelineLogs = map[string]*os.File{}
+	}
+	c.pipelineLogs[name] = f
+	return f
+}
+
+// uploadRoute is one outbound request for a record: the endpoint, the API key
+// sent with it and the subset of the record's pipelines that are delivered there.
+type uploadRoute struct {
+	url       string
+	apiKey    string
+	pipelines []string
+}
+
+// routeRecord groups a record's pipelines by target endpoint and API key.
+// Pipelines without an entry in PipelineEndpoints go to the default
+// ServerHost/log endpoint; pipelines without an entry in PipelineApiKeys use
+// ApiKey. Routes are returned in the order their first pipeline appears.
+func (c *ServerConfig) routeRecord(pipelines []string) []uploadRoute {
+	defaultURL := fmt.Sprintf("%s/log", c.ServerHost)
+	if len(pipelines) == 0 || (len(c.PipelineEndpoints) == 0 && len(c.PipelineApiKeys) == 0) {
+		return []uploadRoute{{url: defaultURL, apiKey: c.CurrentApiKey(), pipelines: pipelines}}
+	}
+
+	var routes []uploadRoute
+	index := map[[2]string]int{}
+	for _, p := range pipelines {
+		url, ok := c.PipelineEndpoints[p]
+		if !ok {
+			url = defaultURL
+		}
+		apiKey, ok := c.PipelineApiKeys[p]
+		if !ok {
+			apiKey = c.CurrentApiKey()
+		}
+		target := [2]string{url, apiKey}
+		if i, seen := index[target]; seen {
+			routes[i].pipelines = append(routes[i].pipelines, p)
+			continue
+		}
+		index[target] = len(routes)
+		routes = append(routes, uploadRoute{url: url, apiKey: apiKey, pipelines: []string{p}})
+	}
+	return routes
 }
 
 // sendToServer pushes a single log record to the Data Nadhi server.
 // It returns true if the record should be deleted from Pebble after sending,
-// or false if it should be retried later.
+// or false if it should be retried later. Records below MinUploadLevel are
+// not sent and reported as removable.
+//
+// When the record's pipelines map to different endpoints or API keys it is
+// fanned out, one request per endpoint and key. The record is only removed
+// once every endpoint has accepted or permanently rejected it. Pipelines whose
+// endpoint did so are added to rec.Delivered, and a retry only sends the
+// record to the endpoints of the remaining pipelines.
+func (c *ServerConfig) sendToServer(rec *logRecord, client *flow.Client) (bool, error) {
+	if c.belowMinUploadLevel(rec.Level) {
+		LogJsonLevel(LevelDebug, "upload_skipped_level", map[string]any{"level": rec.Level, "min_level": c.MinUploadLevel})
+		c.stats.dropped.Add(1)
+		return true, nil
+	}
+	pending := rec.pendingPipelines()
+	if len(rec.Pipelines) > 0 && len(pending) == 0 {
+		return true, nil
+	}
+	out := *rec
+	if len(c.UploadDenyList) > 0 || len(c.FieldRemap) > 0 {
+		out.Payload = c.outboundPayload(rec.Payload)
+	}
+
+	routes := c.routeRecord(pending)
+	if c.SendConcurrency > 1 && len(routes) > 1 {
+		return c.postRoutesConcurrently(rec, out, routes, client)
+	}
+	remove := true
+	for _, route := range routes {
+		ok, err := c.postRecord(route, out, client)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			remove = false
+			continue
+		}
+		rec.Delivered = append(rec.Delivered, route.pipelines...)
+	}
+	return remove, nil
+}
+
+// postRoutesConcurrently is the fan-out of sendToServer with up to
+// SendConcurrency requests in flight. Every route is tried; the first
+// network error is returned after all of them finished.
+func (c *ServerConfig) postRoutesConcurrently(rec *logRecord, out logRecord, routes []uploadRoute, client *flow.Client) (bool, error) {
+	type result struct {
+		ok  bool
+		err error
+	}
+	results := make([]result, len(routes))
+	sem := make(chan struct{}, c.SendConcurrency)
+	var wg sync.WaitGroup
+	for i, route := range routes {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i].ok, results[i].err = c.postRecord(route, out, client)
+		}()
+	}
+	wg.Wait()
+
+	remove := true
+	var firstErr error
+	for i, r := range results {
+		if r.err != nil && firstErr == nil {
+			firstErr = r.err
+		}
+		if !r.ok {
+			remove = false
+			continue
+		}
+		rec.Delivered = append(rec.Delivered, routes[i].pipelines...)
+	}
+	if firstErr != nil {
+		return false, firstErr
+	}
+	return remove, nil
+}
+
+// belowMinUploadLevel reports whether a record level ranks below
+// MinUploadLevel. Records without a level or with an unknown one are uploaded.
+func (c *ServerConfig) belowMinUploadLevel(level string) bool {
+	if c.MinUploadLevel == "" || level == "" {
+		return false
+	}
+	min, err := ParseLogLevel(c.MinUploadLevel)
+	if err != nil {
+		return false
+	}
+	l, err := ParseLogLevel(level)
+	return err == nil && l < min
+}
+
+// outboundPayload returns a deep copy of payload prepared for upload: fields in
+// UploadDenyList are removed first, then top-level keys are renamed per FieldRemap.
+// The record stored in Pebble is never modified.
+func (c *ServerConfig) outboundPayload(payload map[string]any) map[string]any {
+	out, _ := deepCopyValue(payload).(map[string]any)
+	for _, path := range c.UploadDenyList {
+		deleteField(out, path)
+	}
+	remapFields(out, c.FieldRemap)
+	return out
+}
+
+// remapFields renames keys of m in place for every "from": "to" pair.
+// A rename whose target already exists is skipped and logged, so no value is lost.
+func remapFields(m map[string]any, remap map[string]string) {
+	froms := make([]string, 0, len(remap))
+	for from := range remap {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+
+	for _, from := range froms {
+		to := remap[from]
+		v, ok := m[from]
+		if !ok || from == to {
+			continue
+		}
+		if _, exists := m[to]; exists {
+			LogJsonLevel(LevelWarn, "field_remap_collision", map[string]any{"from": from, "to": to})
+			continue
+		}
+		m[to] = v
+		delete(m, from)
+	}
+}
+
+// deleteField removes path from m, descending into nested maps on each dot.
+func deleteField(m map[string]any, path string) {
+	if _, ok := m[path]; ok {
+		delete(m, path)
+		return
+	}
+	head, rest, found := strings.Cut(path, ".")
+	if !found {
+		return
+	}
+	if nested, ok := m[head].(map[string]any); ok {
+		deleteField(nested, rest)
+	}
+}
+
+// deepCopyValue copies JSON-like values so edits never reach the stored record.
+func deepCopyValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[k] = deepCopyValue(item)
+		}
+		return out
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = deepCopyValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// uploadBody returns the request body and headers for an upload of jsonBody
+// authenticated with apiKey. ExtraHeaders are included, except any that would
+// replace the API key or Content-Encoding. With UploadEncryptionKey set the
+// body is AES-256-GCM encrypted and marked with Content-Encoding: aes256gcm.
+func (c *ServerConfig) uploadBody(jsonBody []byte, apiKey string) ([]byte, map[string]string, error) {
+	headers := make(map[string]string, len(c.ExtraHeaders)+2)
+	for name, value := range c.ExtraHeaders {
+		switch http.CanonicalHeaderKey(name) {
+		case "Datanadhi-Api-Key", "Content-Encoding":
+			continue
+		}
+		headers[name] = value
+	}
+	headers["DATANADHI-API-KEY"] = apiKey
+	if len(c.UploadEncryptionKey) == 0 {
+		return jsonBody, headers, nil
+	}
+	sealed, err := EncryptPayload(jsonBody, c.UploadEncryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers["Content-Encoding"] = UploadContentEncoding
+	return sealed, headers, nil
+}
+
+// postRecord sends the record to a single endpoint.
 //
 // Rules:
 // - 2xx  → success, remove from Pebble
 // - 3xx–5xx (≤500) → permanent failure, log and remove from Pebble
 // - >500 → transient server error, keep in Pebble for retry
-func (c *ServerConfig) sendToServer(rec logRecord, client *flow.Client) (bool, error) {
-	triggerURL := fmt.Sprintf("%s/log", c.ServerHost)
-
+func (c *ServerConfig) postRecord(route uploadRoute, rec logRecord, client *flow.Client) (bool, error) {
 	// Prepare request body
 	payload := map[string]any{
-		"pipelines": rec.Pipelines,
+		"pipelines": route.pipelines,
 		"log_data":  rec.Payload,
 	}
+	if len(rec.Metadata) > 0 {
+		payload["metadata"] = rec.Metadata
+	}
+	if rec.Level != "" {
+		payload["level"] = rec.Level
+	}
 	jsonBody, err := json.Marshal(payload)
 	if err != nil {
-		LogJson("json_marshal_error", map[string]any{"error": err.Error()})
+		LogJsonLevel(LevelError, "json_marshal_error", map[string]any{"error": err.Error()})
 		return false, nil
 	}
 
 	// Send request
-	headers := map[string]string{"DATANADHI-API-KEY": c.ApiKey}
-	resp, err := client.Post(triggerURL, nil, headers, bytes.NewBuffer(jsonBody), "application/json")
+	body, headers, err := c.uploadBody(jsonBody, route.apiKey)
+	if err != nil {
+		LogJsonLevel(LevelError, "upload_encrypt_error", map[string]any{"error": err.Error()})
+		return false, nil
+	}
+	resp, err := client.Post(route.url, nil, headers, bytes.NewReader(body), "application/json")
 	if err != nil {
-		LogJson("trigger_post_error", map[string]any{"error": err.Error()})
+		uploadRequestsTotal.WithLabelValues(route.url, "error").Inc()
+		logAggregatedError(LevelError, "trigger_post_error", map[string]any{
+			"endpoint":    route.url,
+			"error":       err.Error(),
+			"error_class": ClassifyNetError(err),
+		})
 		return false, err
 	}
 	if resp != nil {
@@ -60,24 +490,39 @@ func (c *ServerConfig) sendToServer(rec logRecord, client *flow.Client) (bool, e
 
 	// Successful response — mark record as delivered
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		c.logToFile(rec, true, map[string]any{})
+		uploadRequestsTotal.WithLabelValues(route.url, "success").Inc()
+		c.stats.sent.Add(1)
+		c.stats.bytesSent.Add(int64(len(body)))
+		c.logToFile(rec, true, map[string]any{"endpoint": route.url})
 		return true, nil
 	}
 
 	// Non-retryable error (e.g. 401, 404, 422, etc.)
 	if resp.StatusCode >= 300 && resp.StatusCode <= 500 {
+		uploadRequestsTotal.WithLabelValues(route.url, "failure").Inc()
+		c.stats.failed.Add(1)
 		respString, _ := resp.String()
-		c.logToFile(rec, false, map[string]any{
+		serverErr := parseServerError(respString)
+
+		failure := map[string]any{
+			"endpoint":     route.url,
 			"response":     respString,
 			"responseCode": resp.StatusCode,
-		})
-		LogJson("trigger_client_error_final", map[string]any{"status": resp.StatusCode})
+		}
+		fields := map[string]any{"endpoint": route.url, "status": resp.StatusCode}
+		for k, v := range serverErr {
+			failure[k] = v
+			fields[k] = v
+		}
+		c.logToFile(rec, false, failure)
+		LogJsonLevel(LevelError, "trigger_client_error_final", fields)
 		return true, nil
 	}
 
 	// Transient server error (e.g. 502, 503, 504)
 	if resp.StatusCode > 500 {
-		LogJson("trigger_server_error", map[string]any{"status": resp.StatusCode})
+		uploadRequestsTotal.WithLabelValues(route.url, "retry").Inc()
+		LogJsonLevel(LevelError, "trigger_server_error", map[string]any{"endpoint": route.url, "status": resp.StatusCode})
 		return false, fmt.Errorf("server_error, status %d", resp.StatusCode)
 	}
 
@@ -85,13 +530,175 @@ func (c *ServerConfig) sendToServer(rec logRecord, client *flow.Client) (bool, e
 	return true, nil
 }
 
+// parseServerError extracts structured details from an error response body.
+// A JSON object such as {"error": "invalid_pipeline", "detail": "..."} is
+// returned with each top-level key prefixed by "server_" (server_error,
+// server_detail) so it cannot clash with log fields; any other body is
+// returned as {"response": body}.
+func parseServerError(body string) map[string]any {
+	var parsed map[string]any
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil || parsed == nil {
+		return map[string]any{"response": body}
+	}
+	out := make(map[string]any, len(parsed))
+	for k, v := range parsed {
+		out["server_"+k] = v
+	}
+	return out
+}
+
+// PreloadPipelines fetches the pipelines configured for ApiKey from
+// GET ServerHost/pipelines, which answers {"pipelines": ["name", ...]}, and
+// stores them in KnownPipelines. The request is bounded by the client's
+// timeout; ctx is only checked before it is sent.
+func (c *ServerConfig) PreloadPipelines(ctx context.Context, client *flow.Client) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(c.ServerHost+"/pipelines", nil, map[string]string{"DATANADHI-API-KEY": c.CurrentApiKey()})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /pipelines returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Pipelines []string `json:"pipelines"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode /pipelines response: %w", err)
+	}
+
+	set := make(map[string]bool, len(body.Pipelines))
+	for _, p := range body.Pipelines {
+		set[p] = true
+	}
+	c.knownPipelinesMu.Lock()
+	c.KnownPipelines, c.knownPipelineSet = body.Pipelines, set
+	c.knownPipelinesMu.Unlock()
+	return body.Pipelines, nil
+}
+
+// StartPipelineRefresher loads KnownPipelines when PreloadPipelineList is set,
+// then reloads it every PipelineRefreshInterval and whenever refresh receives
+// a signal (SIGHUP in main). A failed load keeps the previous list.
+func (c *ServerConfig) StartPipelineRefresher(ctx context.Context, wg *sync.WaitGroup, client *flow.Client, refresh <-chan os.Signal) {
+	if !c.PreloadPipelineList {
+		return
+	}
+	load := func(reason string) {
+		names, err := c.PreloadPipelines(ctx, client)
+		if err != nil {
+			LogJsonLevel(LevelWarn, "pipeline_preload_error", map[string]any{"reason": reason, "error": err.Error()})
+			return
+		}
+		LogJsonLevel(LevelInfo, "pipelines_loaded", map[string]any{"reason": reason, "count": len(names)})
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var tick <-chan time.Time
+		if c.PipelineRefreshInterval > 0 {
+			ticker := time.NewTicker(c.PipelineRefreshInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		load("startup")
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				load("interval")
+			case <-refresh:
+				load("signal")
+			}
+		}
+	}()
+}
+
+// healthBodyLimit bounds the response body kept in a HealthCheckResult.
+const healthBodyLimit = 1024
+
+// errHealthBreakerOpen is the HealthCheckResult error when HealthBreaker
+// skipped the request.
+var errHealthBreakerOpen = errors.New("health check skipped, circuit breaker open")
+
+// HealthCheckResult describes one health check of the main server.
+type HealthCheckResult struct {
+	StatusCode int           // HTTP status (0 when no response was received)
+	Latency    time.Duration // Time until the response headers or the error
+	Error      error         // Network error, or errHealthBreakerOpen
+	Body       string        // Start of the response body, at most healthBodyLimit bytes
+	IsHealthy  bool          // True on HTTP 200
+}
+
+// ToMap returns the result as log fields.
+func (r HealthCheckResult) ToMap() map[string]any {
+	fields := map[string]any{
+		"status_code": r.StatusCode,
+		"latency_ms":  r.Latency.Milliseconds(),
+		"healthy":     r.IsHealthy,
+	}
+	if r.Error != nil {
+		fields["error"] = r.Error.Error()
+		fields["error_class"] = ClassifyNetError(r.Error)
+	}
+	if r.Body != "" {
+		fields["body"] = r.Body
+	}
+	return fields
+}
+
 // IsHealthSuccess performs a simple health check on the main server.
 // Returns true if the server responds with HTTP 200.
+// When HealthBreaker is open the request is skipped and false is returned.
 func (c *ServerConfig) IsHealthSuccess(client *flow.Client) bool {
+	return c.HealthCheckWithDetails(client).IsHealthy
+}
+
+// HealthCheckWithDetails is IsHealthSuccess returning the status code,
+// latency, error and body of the check, for diagnosing a failing server.
+func (c *ServerConfig) HealthCheckWithDetails(client *flow.Client) HealthCheckResult {
+	if c.HealthBreaker != nil && !c.HealthBreaker.Allow() {
+		c.serverHealthy.Store(false)
+		return HealthCheckResult{Error: errHealthBreakerOpen}
+	}
+
+	result := c.checkHealth(client)
+	c.serverHealthy.Store(result.IsHealthy)
+	if c.HealthBreaker != nil {
+		if result.IsHealthy {
+			c.HealthBreaker.RecordSuccess()
+		} else {
+			c.HealthBreaker.RecordFailure()
+		}
+	}
+	return result
+}
+
+// checkHealth issues the actual health request.
+func (c *ServerConfig) checkHealth(client *flow.Client) HealthCheckResult {
+	start := time.Now()
 	req, err := client.Get(c.ServerHost, nil, nil)
+	result := HealthCheckResult{Latency: time.Since(start), Error: err}
+	healthCheckLatency.Observe(result.Latency.Seconds())
 	if err != nil {
-		LogJson("health_check_error", map[string]any{"error": err.Error()})
-		return false
+		healthCheckStatusCode.Set(0)
+		class := ClassifyNetError(err)
+		healthCheckErrorsTotal.WithLabelValues(class).Inc()
+		logAggregatedError(LevelWarn, "health_check_error", map[string]any{"error": err.Error(), "error_class": class})
+		return result
 	}
-	return req.StatusCode == 200
+	defer req.Body.Close()
+
+	healthCheckStatusCode.Set(float64(req.StatusCode))
+	body, _ := io.ReadAll(io.LimitReader(req.Body, healthBodyLimit))
+	result.StatusCode, result.Body = req.StatusCode, string(body)
+	result.IsHealthy = req.StatusCode == 200
+	return result
 }
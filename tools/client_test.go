@@ -0,0 +1,855 @@
+package tools
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// recordingProxy is a forward HTTP proxy that answers every request itself
+// and remembers the absolute URLs it was asked for.
+type recordingProxy struct {
+	*httptest.Server
+	mu   sync.Mutex
+	urls []string
+}
+
+func newRecordingProxy(t *testing.T) *recordingProxy {
+	t.Helper()
+	p := &recordingProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.urls = append(p.urls, r.URL.String())
+		p.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *recordingProxy) requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.urls...)
+}
+
+func TestHTTPProxyCarriesUpstreamRequests(t *testing.T) {
+	proxy := newRecordingProxy(t)
+	proxyURL, err := ParseProxyURL(proxy.URL)
+	if err != nil {
+		t.Fatalf("ParseProxyURL: %v", err)
+	}
+	c := &ServerConfig{ServerHost: "http://upstream.invalid:5000", HTTPProxy: proxyURL}
+	client := c.NewHTTPClient(time.Second)
+
+	if !c.IsHealthSuccess(client) {
+		t.Fatal("health check through the proxy failed")
+	}
+	rec := logRecord{Payload: map[string]any{"msg": "hi"}, Pipelines: []string{"p1"}}
+	if ok, err := c.sendToServer(&rec, client); err != nil || !ok {
+		t.Fatalf("sendToServer = %v, %v", ok, err)
+	}
+
+	got := proxy.requests()
+	want := []string{"http://upstream.invalid:5000/", "http://upstream.invalid:5000/log"}
+	if len(got) != len(want) {
+		t.Fatalf("proxy saw %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("proxy request %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseProxyURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    *url.URL
+		wantErr bool
+	}{
+		{raw: "", want: nil},
+		{raw: "http://proxy.corp:3128", want: &url.URL{Scheme: "http", Host: "proxy.corp:3128"}},
+		{raw: "http://user:pw@proxy.corp:3128", want: &url.URL{Scheme: "http", Host: "proxy.corp:3128", User: url.UserPassword("user", "pw")}},
+		{raw: "proxy.corp:3128", wantErr: true},
+		{raw: "http://", wantErr: true},
+		{raw: "://bad", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseProxyURL(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseProxyURL(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && got.String() != tt.want.String()) {
+			t.Errorf("ParseProxyURL(%q) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+// timeoutErr is a net.Error that reports a timeout, like a dial or read deadline.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestClassifyNetError(t *testing.T) {
+	opErr := func(err error) error {
+		return &url.Error{Op: "Post", URL: "http://upstream.invalid/log", Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "nil", err: nil, want: ""},
+		{name: "dns", err: opErr(&net.DNSError{Err: "no such host", Name: "upstream.invalid", IsNotFound: true}), want: "dns_failure"},
+		{name: "refused", err: opErr(&os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}), want: "connection_refused"},
+		{name: "net timeout", err: opErr(timeoutErr{}), want: "timeout"},
+		{name: "deadline", err: fmt.Errorf("health check: %w", context.DeadlineExceeded), want: "timeout"},
+		{name: "unknown authority", err: opErr(x509.UnknownAuthorityError{}), want: "tls_error"},
+		{name: "hostname", err: opErr(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "upstream.invalid"}), want: "tls_error"},
+		{name: "tls record", err: opErr(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), want: "tls_error"},
+		{name: "other", err: errors.New("something else"), want: "unknown"},
+	}
+	for _, tt := range tests {
+		if got := ClassifyNetError(tt.err); got != tt.want {
+			t.Errorf("%s: ClassifyNetError(%v) = %q, want %q", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyNetErrorRealFailures(t *testing.T) {
+	// A listener that is closed straight away leaves a port nothing listens on
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	client := &http.Client{Timeout: time.Second}
+	if _, err := client.Get("http://" + addr); ClassifyNetError(err) != "connection_refused" {
+		t.Errorf("closed port: ClassifyNetError(%v) = %q", err, ClassifyNetError(err))
+	}
+
+	c := &ServerConfig{ServerHost: "http://" + addr}
+	before := testutil.ToFloat64(healthCheckErrorsTotal.WithLabelValues("connection_refused"))
+	if c.IsHealthSuccess(c.NewHTTPClient(time.Second)) {
+		t.Fatal("health check against a closed port succeeded")
+	}
+	if got := testutil.ToFloat64(healthCheckErrorsTotal.WithLabelValues("connection_refused")) - before; got != 1 {
+		t.Errorf("connection_refused health errors grew by %v, want 1", got)
+	}
+
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(tlsSrv.Close)
+	if _, err := client.Get(tlsSrv.URL); ClassifyNetError(err) != "tls_error" {
+		t.Errorf("untrusted certificate: ClassifyNetError(%v) = %q", err, ClassifyNetError(err))
+	}
+}
+
+// writePEM writes der as a PEM block of the given type to a file in dir.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newClientCert creates a self-signed client certificate and returns the
+// paths of its PEM encoded certificate and key, and the parsed certificate.
+func newClientCert(t *testing.T) (certPath, keyPath string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "echopost-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = x509.ParseCertificate(der)
+	dir := t.TempDir()
+	return writePEM(t, dir, "client.crt", "CERTIFICATE", der), writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER), cert
+}
+
+// newTLSUpstream starts an HTTPS server answering 200 to everything and
+// returns it with the path of its CA certificate in PEM form.
+func newTLSUpstream(t *testing.T, clientCA *x509.Certificate) (*httptest.Server, string) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	// Rejected handshakes are expected here; keep them out of the test output
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA)
+		srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, writePEM(t, t.TempDir(), "ca.crt", "CERTIFICATE", srv.Certificate().Raw)
+}
+
+func TestServerTLS(t *testing.T) {
+	srv, caPath := newTLSUpstream(t, nil)
+	certPath, keyPath, clientCert := newClientCert(t)
+	mtls, mtlsCA := newTLSUpstream(t, clientCert)
+
+	tests := []struct {
+		name       string
+		host       string
+		caPath     string
+		skipVerify bool
+		certPath   string
+		keyPath    string
+		healthy    bool
+	}{
+		{name: "default roots reject test CA", host: srv.URL},
+		{name: "server-tls-ca", host: srv.URL, caPath: caPath, healthy: true},
+		{name: "server-tls-skip-verify", host: srv.URL, skipVerify: true, healthy: true},
+		{name: "mtls without client cert", host: mtls.URL, caPath: mtlsCA},
+		{name: "mtls with client cert", host: mtls.URL, caPath: mtlsCA, certPath: certPath, keyPath: keyPath, healthy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := LoadServerTLSConfig(tt.caPath, tt.skipVerify, tt.certPath, tt.keyPath)
+			if err != nil {
+				t.Fatalf("LoadServerTLSConfig: %v", err)
+			}
+			c := &ServerConfig{ServerHost: tt.host, ServerTLS: tlsConfig}
+			client := c.NewHTTPClient(5 * time.Second)
+			defer client.CloseIdleConnections()
+			if got := c.IsHealthSuccess(client); got != tt.healthy {
+				t.Errorf("IsHealthSuccess = %v, want %v", got, tt.healthy)
+			}
+		})
+	}
+}
+
+func TestLoadServerTLSConfigErrors(t *testing.T) {
+	certPath, keyPath, _ := newClientCert(t)
+	notPEM := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err := LoadServerTLSConfig("", false, "", ""); cfg != nil || err != nil {
+		t.Errorf("no flags: got %v, %v, want nil, nil", cfg, err)
+	}
+	for name, args := range map[string][3]string{
+		"missing CA":         {filepath.Join(t.TempDir(), "missing.crt"), "", ""},
+		"CA without certs":   {notPEM, "", ""},
+		"cert without key":   {"", certPath, ""},
+		"key without cert":   {"", "", keyPath},
+		"key does not match": {"", certPath, notPEM},
+	} {
+		if _, err := LoadServerTLSConfig(args[0], false, args[1], args[2]); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestHTTPKeepaliveReusesIdleConnection(t *testing.T) {
+	var newConns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond) // a slow upstream
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	c := &ServerConfig{ServerHost: srv.URL, HTTPKeepaliveInterval: 100 * time.Millisecond, HTTPKeepaliveProbes: 3}
+	client := c.NewHTTPClient(5 * time.Second)
+	defer client.CloseIdleConnections()
+
+	for i := 0; i < 3; i++ {
+		if !c.IsHealthSuccess(client) {
+			t.Fatalf("health check %d failed", i)
+		}
+		// Idle for several keepalive intervals between uploads
+		time.Sleep(300 * time.Millisecond)
+	}
+	if got := newConns.Load(); got != 1 {
+		t.Errorf("connections opened = %d, want 1 kept alive across idle periods", got)
+	}
+}
+
+// uploadCapture is an upload server that keeps every request body and
+// answers with status.
+type uploadCapture struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []map[string]any
+}
+
+func newUploadCapture(t *testing.T, status int) *uploadCapture {
+	t.Helper()
+	u := &uploadCapture{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+			u.mu.Lock()
+			u.bodies = append(u.bodies, body)
+			u.mu.Unlock()
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *uploadCapture) logData() []map[string]any {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var out []map[string]any
+	for _, body := range u.bodies {
+		data, _ := body["log_data"].(map[string]any)
+		out = append(out, data)
+	}
+	return out
+}
+
+func TestUploadDenyListStripsFields(t *testing.T) {
+	// The server fails the upload so the stored record can be checked after it
+	upload := newUploadCapture(t, http.StatusServiceUnavailable)
+	c := newTestConfig(t, upload.URL)
+	c.UploadDenyList = []string{"client_ip", "source.path", "missing.field"}
+	payload := map[string]any{
+		"msg":       "login",
+		"client_ip": "10.0.0.7",
+		"source":    map[string]any{"path": "/home/alice/app.log", "line": float64(42)},
+	}
+	putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: payload, Pipelines: []string{"p1"}})
+
+	_ = c.ProcessPebble(context.Background())
+
+	sent := upload.logData()
+	if len(sent) != 1 {
+		t.Fatalf("uploads = %d, want 1", len(sent))
+	}
+	want := map[string]any{"msg": "login", "source": map[string]any{"line": float64(42)}}
+	if !reflect.DeepEqual(sent[0], want) {
+		t.Errorf("uploaded log_data = %v, want %v", sent[0], want)
+	}
+
+	keys := storedKeys(t, c)
+	if len(keys) != 1 {
+		t.Fatalf("stored records = %d, want 1", len(keys))
+	}
+	data, err := c.Db.Get([]byte(keys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored logRecord
+	if err := decodeRecord(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Payload, payload) {
+		t.Errorf("stored payload = %v, want it untouched: %v", stored.Payload, payload)
+	}
+}
+
+func TestFieldRemapNormalizesUploads(t *testing.T) {
+	logs := CaptureLogs(t)
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	c.FieldRemap = map[string]string{"msg": "message", "log_message": "message", "secret": "token"}
+	c.UploadDenyList = []string{"secret"}
+
+	payloads := []map[string]any{
+		{"msg": "from sdk a", "level": "INFO"},
+		{"log_message": "from sdk b"},
+		{"msg": "kept", "message": "collides"},
+		{"secret": "s3cret"},
+	}
+	for _, payload := range payloads {
+		putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: payload, Pipelines: []string{"p1"}})
+	}
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+
+	want := []map[string]any{
+		{"message": "from sdk a", "level": "INFO"},
+		{"message": "from sdk b"},
+		// A rename onto an existing field is skipped, so nothing is lost
+		{"msg": "kept", "message": "collides"},
+		// Deny-listed fields are removed before remapping
+		{},
+	}
+	if got := upload.logData(); !reflect.DeepEqual(got, want) {
+		t.Errorf("uploaded log_data = %v, want %v", got, want)
+	}
+	if collisions := logs.Events("field_remap_collision"); len(collisions) != 1 || collisions[0]["from"] != "msg" || collisions[0]["to"] != "message" {
+		t.Errorf("field_remap_collision entries = %v, want one for msg -> message", collisions)
+	}
+}
+
+// readLines returns the lines of the file at path, or nil if it does not exist.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestPerPipelineLogs(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	c.PerPipelineLogs = true
+
+	putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"msg": "both"}, Pipelines: []string{"orders", "team/billing"}})
+	putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"msg": "orders only"}, Pipelines: []string{"orders"}})
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	c.logToFile(logRecord{Pipelines: []string{"orders"}}, false, map[string]any{"status": 400})
+
+	for name, want := range map[string]int{
+		"agent-success.log":                 2,
+		"agent-failure.log":                 1,
+		"pipeline-orders-success.log":       2,
+		"pipeline-orders-failure.log":       1,
+		"pipeline-team_billing-success.log": 1, // unsafe characters are replaced
+		"pipeline-team_billing-failure.log": 0,
+	} {
+		if got := len(readLines(t, filepath.Join(c.sessionPath, name))); got != want {
+			t.Errorf("%s has %d lines, want %d", name, got, want)
+		}
+	}
+
+	c.CloseFiles()
+	if c.pipelineLogs != nil {
+		t.Errorf("CloseFiles left %d pipeline logs open", len(c.pipelineLogs))
+	}
+}
+
+func TestPerPipelineLogsDisabled(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.logToFile(logRecord{Pipelines: []string{"orders"}}, true, nil)
+
+	matches, err := filepath.Glob(filepath.Join(c.sessionPath, "pipeline-*.log"))
+	if err != nil || len(matches) != 0 {
+		t.Errorf("pipeline logs without -per-pipeline-logs: %v, %v", matches, err)
+	}
+}
+
+func TestServerErrorBodiesAreParsed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want map[string]any
+	}{
+		{
+			name: "json",
+			body: `{"error":"invalid_pipeline","detail":"pipeline 'foo' not found"}`,
+			want: map[string]any{"server_error": "invalid_pipeline", "server_detail": "pipeline 'foo' not found"},
+		},
+		{
+			name: "text",
+			body: "bad request",
+			want: map[string]any{"response": "bad request"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := CaptureLogs(t)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = io.WriteString(w, tc.body)
+			}))
+			t.Cleanup(srv.Close)
+			c := newTestConfig(t, srv.URL)
+			putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{}, Pipelines: []string{"foo"}})
+			if err := c.ProcessPebble(context.Background()); err != nil {
+				t.Fatalf("ProcessPebble: %v", err)
+			}
+
+			entries := logs.Events("trigger_client_error_final")
+			if len(entries) != 1 {
+				t.Fatalf("trigger_client_error_final entries = %d, want 1", len(entries))
+			}
+			lines := readLines(t, filepath.Join(c.sessionPath, "agent-failure.log"))
+			if len(lines) != 1 {
+				t.Fatalf("failure log has %d lines, want 1", len(lines))
+			}
+			var failure struct {
+				Context map[string]any `json:"context"`
+			}
+			if err := json.Unmarshal([]byte(lines[0]), &failure); err != nil {
+				t.Fatalf("decode failure log %q: %v", lines[0], err)
+			}
+			for k, v := range tc.want {
+				if entries[0][k] != v {
+					t.Errorf("log field %s = %v, want %v", k, entries[0][k], v)
+				}
+				if failure.Context[k] != v {
+					t.Errorf("failure log field %s = %v, want %v", k, failure.Context[k], v)
+				}
+			}
+			if _, ok := entries[0]["server_error"]; ok != (tc.name == "json") {
+				t.Errorf("server_error present = %v for a %s body", ok, tc.name)
+			}
+		})
+	}
+}
+
+func TestParseServerError(t *testing.T) {
+	for body, want := range map[string]map[string]any{
+		`{"error":"x","code":7}`: {"server_error": "x", "server_code": float64(7)},
+		`["not","an","object"]`:  {"response": `["not","an","object"]`},
+		`null`:                   {"response": "null"},
+		``:                       {"response": ""},
+	} {
+		if got := parseServerError(body); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseServerError(%q) = %v, want %v", body, got, want)
+		}
+	}
+}
+
+// pipelineServer serves GET /pipelines with the current list, or 500 while
+// it is nil.
+type pipelineServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	pipelines []string
+	apiKeys   []string
+}
+
+func newPipelineServer(t *testing.T, pipelines ...string) *pipelineServer {
+	t.Helper()
+	s := &pipelineServer{pipelines: pipelines}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/pipelines" {
+			http.NotFound(w, r)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.apiKeys = append(s.apiKeys, r.Header.Get("DATANADHI-API-KEY"))
+		if s.pipelines == nil {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"pipelines": s.pipelines})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *pipelineServer) set(pipelines ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pipelines = pipelines
+}
+
+func TestPreloadPipelinesWarnsOnUnknownPipelines(t *testing.T) {
+	logs := CaptureLogs(t)
+	srv := newPipelineServer(t, "orders", "audit")
+	c := newTestConfig(t, srv.URL)
+	c.ApiKey = "test-key"
+
+	names, err := c.PreloadPipelines(context.Background(), c.NewHTTPClient(time.Second))
+	if err != nil {
+		t.Fatalf("PreloadPipelines: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"orders", "audit"}) || !reflect.DeepEqual(c.KnownPipelines, names) {
+		t.Fatalf("PreloadPipelines = %v, KnownPipelines = %v; want [orders audit]", names, c.KnownPipelines)
+	}
+	if srv.apiKeys[0] != "test-key" {
+		t.Errorf("GET /pipelines API key = %q, want test-key", srv.apiKeys[0])
+	}
+
+	s := &server{config: c}
+	for _, pipelines := range [][]string{{"orders"}, {"audit", "missing"}} {
+		resp, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: pipelines})
+		if err != nil || !resp.Success {
+			t.Fatalf("SendLog to %v = %+v, %v; want it accepted", pipelines, resp, err)
+		}
+	}
+	warnings := logs.Events("unknown_pipeline")
+	if len(warnings) != 1 || warnings[0]["pipeline"] != "missing" {
+		t.Errorf("unknown_pipeline entries = %v, want one for missing", warnings)
+	}
+	if keys := storedKeys(t, c); len(keys) != 2 {
+		t.Errorf("records stored = %d, want 2", len(keys))
+	}
+}
+
+func TestPipelineRefresherReloadsOnSignal(t *testing.T) {
+	logs := CaptureLogs(t)
+	srv := newPipelineServer(t, "orders")
+	c := newTestConfig(t, srv.URL)
+	c.PreloadPipelineList = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	known := func() []string {
+		c.knownPipelinesMu.RLock()
+		defer c.knownPipelinesMu.RUnlock()
+		return c.KnownPipelines
+	}
+	refresh := make(chan os.Signal, 1)
+	c.StartPipelineRefresher(ctx, &wg, c.NewHTTPClient(time.Second), refresh)
+	if !waitFor(2*time.Second, func() bool { return reflect.DeepEqual(known(), []string{"orders"}) }) {
+		t.Fatalf("KnownPipelines after startup = %v, want [orders]", known())
+	}
+
+	srv.set("orders", "billing")
+	refresh <- syscall.SIGHUP
+	if !waitFor(2*time.Second, func() bool { return reflect.DeepEqual(known(), []string{"orders", "billing"}) }) {
+		t.Fatalf("KnownPipelines after SIGHUP = %v, want [orders billing]", known())
+	}
+
+	// A failed reload keeps the last list
+	srv.set()
+	refresh <- syscall.SIGHUP
+	if !waitFor(2*time.Second, func() bool { return len(logs.Events("pipeline_preload_error")) == 1 }) {
+		t.Fatal("no pipeline_preload_error after a SIGHUP with the server failing")
+	}
+	if got := known(); !reflect.DeepEqual(got, []string{"orders", "billing"}) {
+		t.Errorf("KnownPipelines after a failed reload = %v, want [orders billing]", got)
+	}
+}
+
+func TestH2CUploadsOverHTTP2(t *testing.T) {
+	var mu sync.Mutex
+	protos := map[string]int{}
+	var uploads int
+	srv := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		protos[r.Proto]++
+		if r.Method == http.MethodPost {
+			uploads++
+		}
+	}), &http2.Server{}))
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	c := newTestConfig(t, srv.URL)
+	c.H2C = true
+	c.ProcessConcurrency = 4
+	if !c.IsHealthSuccess(c.NewHTTPClient(time.Second)) {
+		t.Fatal("health check against the h2c server failed")
+	}
+	sendNumbered(t, c, 0, 20)
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	if !PebbleIsEmpty(c.Db) {
+		t.Error("records left in Pebble after uploading to the h2c server")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if uploads != 20 {
+		t.Errorf("uploads = %d, want 20", uploads)
+	}
+	if len(protos) != 1 || protos["HTTP/2.0"] == 0 {
+		t.Errorf("request protocols = %v, want only HTTP/2.0", protos)
+	}
+}
+
+func TestExtraHeadersSentWithUploads(t *testing.T) {
+	got := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+	}))
+	t.Cleanup(srv.Close)
+	c := newTestConfig(t, srv.URL)
+	c.ApiKey = "real-key"
+	c.ExtraHeaders = map[string]string{
+		"X-Tenant":          "acme",
+		"datanadhi-api-key": "spoofed",
+		"Content-Encoding":  "gzip",
+	}
+	putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{}, Pipelines: []string{"p1"}})
+
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	h := <-got
+	if h.Get("X-Tenant") != "acme" {
+		t.Errorf("X-Tenant = %q, want acme", h.Get("X-Tenant"))
+	}
+	if v := h.Values("Datanadhi-Api-Key"); len(v) != 1 || v[0] != "real-key" {
+		t.Errorf("API key headers = %v, want only the configured key", v)
+	}
+	if v := h.Get("Content-Encoding"); v != "" {
+		t.Errorf("Content-Encoding = %q, want it left unset", v)
+	}
+}
+
+func TestSendConcurrencyPostsFanOutAtOnce(t *testing.T) {
+	// Each endpoint only answers once the other one was reached, so the
+	// record is only delivered if both requests are in flight together
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	both := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(both)
+	}()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		select {
+		case <-both:
+		case <-time.After(2 * time.Second):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	a, b := httptest.NewServer(handler), httptest.NewServer(handler)
+	t.Cleanup(a.Close)
+	t.Cleanup(b.Close)
+
+	c := newTestConfig(t, "http://unused.invalid")
+	c.SendConcurrency = 2
+	c.PipelineEndpoints = map[string]string{"a": a.URL + "/log", "b": b.URL + "/log"}
+	putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{}, Pipelines: []string{"a", "b"}})
+
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	if keys := storedKeys(t, c); len(keys) != 0 {
+		t.Errorf("records left = %d, want the record delivered to both endpoints", len(keys))
+	}
+}
+
+func TestHealthCheckWithDetails(t *testing.T) {
+	statusServer := func(status int, body string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, body)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name    string
+		host    string
+		status  int
+		body    string
+		healthy bool
+		netErr  bool
+	}{
+		{name: "healthy", host: statusServer(http.StatusOK, "ok"), status: http.StatusOK, body: "ok", healthy: true},
+		{name: "not found", host: statusServer(http.StatusNotFound, "no such route"), status: http.StatusNotFound, body: "no such route"},
+		{name: "unavailable", host: statusServer(http.StatusServiceUnavailable, strings.Repeat("x", 2*healthBodyLimit)), status: http.StatusServiceUnavailable, body: strings.Repeat("x", healthBodyLimit)},
+		{name: "connection refused", host: down.URL, netErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ServerConfig{ServerHost: tt.host}
+			client := c.NewHTTPClient(time.Second)
+			defer client.CloseIdleConnections()
+			observed := healthLatencyCount(t)
+
+			r := c.HealthCheckWithDetails(client)
+			if r.StatusCode != tt.status || r.Body != tt.body || r.IsHealthy != tt.healthy || (r.Error != nil) != tt.netErr {
+				t.Errorf("result = {status %d, body %d bytes, healthy %v, error %v}, want {%d, %d bytes, %v, error %v}",
+					r.StatusCode, len(r.Body), r.IsHealthy, r.Error, tt.status, len(tt.body), tt.healthy, tt.netErr)
+			}
+			if r.Latency <= 0 {
+				t.Errorf("Latency = %v, want it measured", r.Latency)
+			}
+			if got := testutil.ToFloat64(healthCheckStatusCode); got != float64(tt.status) {
+				t.Errorf("echopost_health_check_status_code = %v, want %d", got, tt.status)
+			}
+			if got := healthLatencyCount(t) - observed; got != 1 {
+				t.Errorf("echopost_health_check_latency_seconds observations grew by %d, want 1", got)
+			}
+
+			fields := r.ToMap()
+			if fields["status_code"] != tt.status || fields["healthy"] != tt.healthy {
+				t.Errorf("ToMap = %v", fields)
+			}
+			if _, ok := fields["error"]; ok != tt.netErr {
+				t.Errorf("ToMap error field = %v, want present %v", fields["error"], tt.netErr)
+			}
+		})
+	}
+}
+
+// healthLatencyCount returns the number of observations in the health check
+// latency histogram.
+func healthLatencyCount(t *testing.T) int {
+	t.Helper()
+	m := regexp.MustCompile(`\nechopost_health_check_latency_seconds_count (\d+)\n`).FindStringSubmatch(scrapeMetrics(t))
+	if m == nil {
+		t.Fatal("echopost_health_check_latency_seconds_count not exported")
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
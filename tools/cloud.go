@@ -0,0 +1,147 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Metadata endpoints are link-local and must never go through a proxy.
+const (
+	awsMetadataBase = "http://169.254.169.254/latest"
+	gcpMetadataBase = "http://metadata.google.internal/computeMetadata/v1"
+)
+
+// CloudMetadata identifies the machine the agent is running on.
+// It is detected once at startup and attached to every stored record.
+type CloudMetadata struct {
+	Provider   string // "aws", "gcp" or "host" when no cloud was detected
+	InstanceID string // Cloud instance ID, or the hostname for "host"
+	ProjectID  string // GCP project ID (empty on AWS)
+	Region     string // Cloud region, e.g. us-east-1
+	Zone       string // Availability zone, e.g. us-east-1a
+}
+
+// ToMap returns the non-empty fields, ready to be merged into a record's metadata.
+func (m CloudMetadata) ToMap() map[string]string {
+	out := map[string]string{}
+	fields := map[string]string{
+		"cloud_provider":    m.Provider,
+		"cloud_instance_id": m.InstanceID,
+		"cloud_project_id":  m.ProjectID,
+		"cloud_region":      m.Region,
+		"cloud_zone":        m.Zone,
+	}
+	for k, v := range fields {
+		if v != "" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// errMetadataStatus marks a metadata endpoint that answered with a non-200 status,
+// as opposed to one that could not be reached at all.
+var errMetadataStatus = errors.New("unexpected metadata status")
+
+// metadataClient is used only for metadata endpoints: short timeout, no proxy.
+var metadataClient = &http.Client{
+	Timeout:   time.Second,
+	Transport: &http.Transport{Proxy: nil},
+}
+
+// DetectCloudMetadata tries AWS, then GCP, and falls back to the hostname.
+func DetectCloudMetadata(ctx context.Context) (CloudMetadata, error) {
+	if md, err := DetectAWSMetadata(ctx); err == nil {
+		return md, nil
+	}
+	if md, err := DetectGCPMetadata(ctx); err == nil {
+		return md, nil
+	}
+	return HostMetadata()
+}
+
+// DetectAWSMetadata queries the EC2 instance metadata service.
+// IMDSv2 is used when a session token can be obtained, IMDSv1 otherwise.
+func DetectAWSMetadata(ctx context.Context) (CloudMetadata, error) {
+	headers := map[string]string{}
+	token, err := metadataRequest(ctx, http.MethodPut, awsMetadataBase+"/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	switch {
+	case err == nil:
+		headers["X-aws-ec2-metadata-token"] = token
+	case !errors.Is(err, errMetadataStatus):
+		// IMDS unreachable, no point trying IMDSv1
+		return CloudMetadata{}, err
+	}
+
+	instanceID, err := metadataRequest(ctx, http.MethodGet, awsMetadataBase+"/meta-data/instance-id", headers)
+	if err != nil {
+		return CloudMetadata{}, err
+	}
+	region, _ := metadataRequest(ctx, http.MethodGet, awsMetadataBase+"/meta-data/placement/region", headers)
+	zone, _ := metadataRequest(ctx, http.MethodGet, awsMetadataBase+"/meta-data/placement/availability-zone", headers)
+
+	return CloudMetadata{Provider: "aws", InstanceID: instanceID, Region: region, Zone: zone}, nil
+}
+
+// DetectGCPMetadata queries the GCE metadata server.
+// The zone is returned as "projects/<num>/zones/<zone>"; the region is derived from it.
+func DetectGCPMetadata(ctx context.Context) (CloudMetadata, error) {
+	headers := map[string]string{"Metadata-Flavor": "Google"}
+
+	instanceID, err := metadataRequest(ctx, http.MethodGet, gcpMetadataBase+"/instance/id", headers)
+	if err != nil {
+		return CloudMetadata{}, err
+	}
+	projectID, _ := metadataRequest(ctx, http.MethodGet, gcpMetadataBase+"/project/project-id", headers)
+	zonePath, _ := metadataRequest(ctx, http.MethodGet, gcpMetadataBase+"/instance/zone", headers)
+
+	zone := zonePath[strings.LastIndex(zonePath, "/")+1:]
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+
+	return CloudMetadata{Provider: "gcp", InstanceID: instanceID, ProjectID: projectID, Region: region, Zone: zone}, nil
+}
+
+// HostMetadata is the fallback when the agent is not running on a known cloud.
+func HostMetadata() (CloudMetadata, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return CloudMetadata{}, err
+	}
+	return CloudMetadata{Provider: "host", InstanceID: hostname}, nil
+}
+
+// metadataRequest performs a single metadata call and returns the trimmed body.
+func metadataRequest(ctx context.Context, method, url string, headers map[string]string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s returned %d", errMetadataStatus, url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
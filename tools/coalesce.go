@@ -0,0 +1,188 @@
+package tools
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Bounds and sampling for the coalesce window used with AutoTuneBatch.
+const (
+	minCoalesceWindow  = 100 * time.Microsecond
+	maxCoalesceWindow  = 50 * time.Millisecond
+	maxCoalesceBatch   = 1000
+	coalesceSampleSize = 100
+)
+
+// coalescedWrite is one SendLog write waiting to be committed in a batch.
+type coalescedWrite struct {
+	key  []byte
+	data []byte
+	sync bool
+	done chan error
+}
+
+// writeCoalescer groups concurrent SendLog writes into one Pebble batch per
+// window. The window is tuned from observed commit latency: it doubles while
+// the average over the last coalesceSampleSize commits exceeds 1ms, and halves
+// (down to minCoalesceWindow) while it stays below 100µs.
+type writeCoalescer struct {
+	db      *PebbleManager
+	writes  chan *coalescedWrite
+	stopped chan struct{}
+
+	mu      sync.Mutex
+	window  time.Duration
+	samples int
+	total   time.Duration
+}
+
+// StartWriteCoalescer enables batched SendLog writes when AutoTuneBatch is set.
+// It must be called after the DB is open and before the gRPC server starts.
+func (c *ServerConfig) StartWriteCoalescer(ctx context.Context, wg *sync.WaitGroup) {
+	if !c.AutoTuneBatch {
+		return
+	}
+	c.coalescer = &writeCoalescer{
+		db:      c.Db,
+		writes:  make(chan *coalescedWrite),
+		stopped: make(chan struct{}),
+		window:  minCoalesceWindow,
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.coalescer.run(ctx)
+	}()
+}
+
+// CurrentCoalesceWindow returns the tuned coalesce window, or 0 when
+// AutoTuneBatch is disabled.
+func (c *ServerConfig) CurrentCoalesceWindow() time.Duration {
+	if c.coalescer == nil {
+		return 0
+	}
+	c.coalescer.mu.Lock()
+	defer c.coalescer.mu.Unlock()
+	return c.coalescer.window
+}
+
+// storeRecord writes one record, through the coalescer when it is running.
+func (c *ServerConfig) storeRecord(key, data []byte, opts *pebble.WriteOptions) error {
+	if c.coalescer == nil {
+		return c.Db.Set(key, data, opts)
+	}
+	return c.coalescer.write(key, data, opts == pebble.Sync)
+}
+
+// write hands a record to the coalescer and waits for its batch to commit.
+// Once the coalescer has stopped, records are written directly.
+func (w *writeCoalescer) write(key, data []byte, syncWrite bool) error {
+	req := &coalescedWrite{key: key, data: data, sync: syncWrite, done: make(chan error, 1)}
+	select {
+	case w.writes <- req:
+		return <-req.done
+	case <-w.stopped:
+		opts := pebble.NoSync
+		if syncWrite {
+			opts = pebble.Sync
+		}
+		return w.db.Set(key, data, opts)
+	}
+}
+
+// run collects writes for one window at a time and commits them together.
+// Every accepted write is committed before run returns.
+func (w *writeCoalescer) run(ctx context.Context) {
+	defer close(w.stopped)
+
+	for {
+		var pending []*coalescedWrite
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-w.writes:
+			pending = append(pending, req)
+		}
+
+		timer := time.NewTimer(w.currentWindow())
+	collect:
+		for len(pending) < maxCoalesceBatch {
+			select {
+			case req := <-w.writes:
+				pending = append(pending, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		w.commit(pending)
+	}
+}
+
+// commit writes pending as one batch and reports the result to each writer.
+func (w *writeCoalescer) commit(pending []*coalescedWrite) {
+	batch := w.db.NewBatch()
+	defer func() { _ = batch.Close() }()
+
+	opts := pebble.NoSync
+	var err error
+	for _, req := range pending {
+		if req.sync {
+			opts = pebble.Sync
+		}
+		if err = batch.Set(req.key, req.data, nil); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		start := time.Now()
+		err = w.db.Commit(batch, opts)
+		w.observe(time.Since(start))
+	}
+
+	for _, req := range pending {
+		req.done <- err
+	}
+}
+
+// observe records a commit latency and retunes the window every
+// coalesceSampleSize samples.
+func (w *writeCoalescer) observe(latency time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.samples++
+	w.total += latency
+	if w.samples < coalesceSampleSize {
+		return
+	}
+
+	avg := w.total / time.Duration(w.samples)
+	w.samples, w.total = 0, 0
+
+	previous := w.window
+	switch {
+	case avg > time.Millisecond && w.window < maxCoalesceWindow:
+		w.window = min(w.window*2, maxCoalesceWindow)
+	case avg < 100*time.Microsecond && w.window > minCoalesceWindow:
+		w.window = max(w.window/2, minCoalesceWindow)
+	}
+	if w.window != previous {
+		LogJsonLevel(LevelDebug, "coalesce_window_changed", map[string]any{
+			"avg_latency_us": avg.Microseconds(),
+			"window_us":      w.window.Microseconds(),
+		})
+	}
+}
+
+// currentWindow returns the window used for the next batch.
+func (w *writeCoalescer) currentWindow() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.window
+}
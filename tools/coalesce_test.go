@@ -0,0 +1,176 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// slowSyncFS delays every file sync by the current value of delay, making
+// synced Pebble commits as slow as on a busy disk.
+type slowSyncFS struct {
+	vfs.FS
+	delay *atomic.Int64 // nanoseconds
+}
+
+func (fs slowSyncFS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	return slowSyncFile{f, fs.delay}, err
+}
+
+func (fs slowSyncFS) ReuseForWrite(oldname, newname string) (vfs.File, error) {
+	f, err := fs.FS.ReuseForWrite(oldname, newname)
+	return slowSyncFile{f, fs.delay}, err
+}
+
+type slowSyncFile struct {
+	vfs.File
+	delay *atomic.Int64
+}
+
+func (f slowSyncFile) Sync() error {
+	time.Sleep(time.Duration(f.delay.Load()))
+	return f.File.Sync()
+}
+
+func (f slowSyncFile) SyncData() error {
+	time.Sleep(time.Duration(f.delay.Load()))
+	return f.File.SyncData()
+}
+
+func (f slowSyncFile) SyncTo(length int64) (bool, error) {
+	time.Sleep(time.Duration(f.delay.Load()))
+	return f.File.SyncTo(length)
+}
+
+// newCoalescingConfig opens Pebble on a slowSyncFS and starts the write
+// coalescer. Raise delay to slow down synced commits.
+func newCoalescingConfig(tb testing.TB, delay *atomic.Int64) *ServerConfig {
+	tb.Helper()
+	dir := tb.TempDir()
+	db, err := OpenPebbleManager(func() (PebbleDB, error) {
+		return pebble.Open(dir, &pebble.Options{FS: slowSyncFS{vfs.Default, delay}})
+	})
+	if err != nil {
+		tb.Fatalf("open pebble: %v", err)
+	}
+
+	c := &ServerConfig{Db: db, AutoTuneBatch: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	tb.Cleanup(func() {
+		cancel()
+		wg.Wait()
+		_ = db.Close()
+	})
+	c.StartWriteCoalescer(ctx, &wg)
+	return c
+}
+
+// writeUntil stores records from 16 concurrent writers until cond holds or
+// timeout passes, and reports whether cond held.
+func writeUntil(t *testing.T, c *ServerConfig, opts *pebble.WriteOptions, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	var done atomic.Bool
+	var n atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				key := fmt.Sprintf("%s%d", priorityPrefix(PriorityNormal), n.Add(1))
+				if err := c.storeRecord([]byte(key), []byte(`{}`), opts); err != nil {
+					t.Errorf("storeRecord: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	ok := waitFor(timeout, cond)
+	done.Store(true)
+	wg.Wait()
+	return ok
+}
+
+func TestCoalesceWindowTuning(t *testing.T) {
+	w := &writeCoalescer{window: minCoalesceWindow}
+	feed := func(latency time.Duration) {
+		for i := 0; i < coalesceSampleSize; i++ {
+			w.observe(latency)
+		}
+	}
+
+	feed(2 * time.Millisecond)
+	if got := w.currentWindow(); got != 2*minCoalesceWindow {
+		t.Fatalf("window after slow commits = %v, want %v", got, 2*minCoalesceWindow)
+	}
+	for i := 0; i < 20; i++ {
+		feed(2 * time.Millisecond)
+	}
+	if got := w.currentWindow(); got != maxCoalesceWindow {
+		t.Fatalf("window after sustained slow commits = %v, want the %v cap", got, maxCoalesceWindow)
+	}
+
+	feed(500 * time.Microsecond)
+	if got := w.currentWindow(); got != maxCoalesceWindow {
+		t.Fatalf("window after commits between the thresholds = %v, want it unchanged", got)
+	}
+
+	for i := 0; i < 20; i++ {
+		feed(50 * time.Microsecond)
+	}
+	if got := w.currentWindow(); got != minCoalesceWindow {
+		t.Fatalf("window after sustained fast commits = %v, want the %v floor", got, minCoalesceWindow)
+	}
+}
+
+func TestAutoTuneBatchConverges(t *testing.T) {
+	var delay atomic.Int64
+	delay.Store(int64(2 * time.Millisecond))
+	c := newCoalescingConfig(t, &delay)
+	if got := c.CurrentCoalesceWindow(); got != minCoalesceWindow {
+		t.Fatalf("initial window = %v, want %v", got, minCoalesceWindow)
+	}
+
+	// Slow synced commits widen the window
+	grown := 8 * minCoalesceWindow
+	if !writeUntil(t, c, pebble.Sync, 20*time.Second, func() bool { return c.CurrentCoalesceWindow() >= grown }) {
+		t.Fatalf("window under slow commits = %v, want at least %v", c.CurrentCoalesceWindow(), grown)
+	}
+
+	// Fast unsynced commits shrink it back to the minimum
+	delay.Store(0)
+	if !writeUntil(t, c, pebble.NoSync, 20*time.Second, func() bool { return c.CurrentCoalesceWindow() == minCoalesceWindow }) {
+		t.Fatalf("window under fast commits = %v, want %v", c.CurrentCoalesceWindow(), minCoalesceWindow)
+	}
+}
+
+// BenchmarkAutoTuneBatch writes synced records from parallel writers while
+// every WAL sync takes 1ms, and reports the coalesce window it settled on.
+func BenchmarkAutoTuneBatch(b *testing.B) {
+	var delay atomic.Int64
+	delay.Store(int64(time.Millisecond))
+	c := newCoalescingConfig(b, &delay)
+
+	var n atomic.Int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := fmt.Sprintf("%s%d", priorityPrefix(PriorityNormal), n.Add(1))
+			if err := c.storeRecord([]byte(key), []byte(`{}`), pebble.Sync); err != nil {
+				b.Errorf("storeRecord: %v", err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(c.CurrentCoalesceWindow().Microseconds()), "window-µs")
+}
@@ -0,0 +1,62 @@
+package tools
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Values of CompactionStyle (-compaction-style).
+const (
+	CompactionStyleLevel     = "level"
+	CompactionStyleUniversal = "universal"
+)
+
+// Settings of the universal compaction style. Pebble only implements leveled
+// compaction, so universal is approximated with the options closest to
+// RocksDB's universal compaction: L0 may hold more overlapping sorted runs
+// before they are merged down, and a smaller level multiplier with larger
+// files means each record is rewritten fewer times.
+const (
+	universalL0CompactionThreshold = 8         // L0 read amplification before compacting (Pebble default 4)
+	universalL0StopWritesThreshold = 48        // L0 read amplification before writes stop (Pebble default 12)
+	universalLBaseMaxBytes         = 256 << 20 // Size of the level L0 compacts into (Pebble default 64 MB)
+	universalTargetFileSize        = 8 << 20   // Sstable size in L0, doubling on each lower level (Pebble default 2 MB)
+	universalLevelMultiplier       = 4         // Size ratio between levels, the size amplification knob (Pebble default 10)
+)
+
+// ValidateCompactionStyle rejects values of -compaction-style other than level or universal.
+func ValidateCompactionStyle(style string) error {
+	switch style {
+	case "", CompactionStyleLevel, CompactionStyleUniversal:
+		return nil
+	}
+	return fmt.Errorf("unknown compaction style %q (want level or universal)", style)
+}
+
+// applyCompactionStyle tunes opts for the configured CompactionStyle.
+//
+// level (default) keeps Pebble's defaults: few overlapping files, so reads and
+// the ProcessPebble scan stay cheap and disk usage stays close to the live
+// data, but each record is rewritten about once per level as it moves down.
+//
+// universal suits bursty append-only ingestion where the drain keeps up:
+// records are rewritten fewer times (lower write amplification, less disk
+// I/O while the server is down), at the cost of more space held by
+// overlapping and not yet compacted files (higher space amplification) and
+// scans that merge more runs. Records are usually deleted soon after they
+// are written, so the extra space is mostly transient. The key comparer is
+// unchanged, so a DB written with one style opens with the other.
+func (c *ServerConfig) applyCompactionStyle(opts *pebble.Options) {
+	if c.CompactionStyle != CompactionStyleUniversal {
+		return
+	}
+	opts.L0CompactionThreshold = universalL0CompactionThreshold
+	opts.L0StopWritesThreshold = universalL0StopWritesThreshold
+	opts.LBaseMaxBytes = universalLBaseMaxBytes
+	opts.Experimental.LevelMultiplier = universalLevelMultiplier
+	if len(opts.Levels) == 0 {
+		opts.Levels = []pebble.LevelOptions{{}}
+	}
+	opts.Levels[0].TargetFileSize = universalTargetFileSize
+}
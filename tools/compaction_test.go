@@ -0,0 +1,84 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestValidateCompactionStyle(t *testing.T) {
+	for _, tc := range []struct {
+		style   string
+		wantErr bool
+	}{
+		{"", false},
+		{CompactionStyleLevel, false},
+		{CompactionStyleUniversal, false},
+		{"tiered", true},
+	} {
+		err := ValidateCompactionStyle(tc.style)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ValidateCompactionStyle(%q) = %v, want error %v", tc.style, err, tc.wantErr)
+		}
+	}
+}
+
+func TestApplyCompactionStyle(t *testing.T) {
+	level := &pebble.Options{}
+	(&ServerConfig{CompactionStyle: CompactionStyleLevel}).applyCompactionStyle(level)
+	if level.L0CompactionThreshold != 0 || level.Experimental.LevelMultiplier != 0 || level.Levels != nil {
+		t.Errorf("level style changed Pebble defaults: %+v", level)
+	}
+
+	universal := &pebble.Options{Levels: []pebble.LevelOptions{{BlockSize: 8 << 10}}}
+	(&ServerConfig{CompactionStyle: CompactionStyleUniversal}).applyCompactionStyle(universal)
+	universal.EnsureDefaults()
+	if got := universal.L0CompactionThreshold; got != universalL0CompactionThreshold {
+		t.Errorf("L0CompactionThreshold = %d, want %d", got, universalL0CompactionThreshold)
+	}
+	if got := universal.L0StopWritesThreshold; got != universalL0StopWritesThreshold {
+		t.Errorf("L0StopWritesThreshold = %d, want %d", got, universalL0StopWritesThreshold)
+	}
+	if got := universal.LBaseMaxBytes; got != universalLBaseMaxBytes {
+		t.Errorf("LBaseMaxBytes = %d, want %d", got, universalLBaseMaxBytes)
+	}
+	if got := universal.Experimental.LevelMultiplier; got != universalLevelMultiplier {
+		t.Errorf("LevelMultiplier = %d, want %d", got, universalLevelMultiplier)
+	}
+	if got := universal.Level(0).TargetFileSize; got != universalTargetFileSize {
+		t.Errorf("L0 TargetFileSize = %d, want %d", got, universalTargetFileSize)
+	}
+	if got := universal.Level(1).TargetFileSize; got != 2*universalTargetFileSize {
+		t.Errorf("L1 TargetFileSize = %d, want %d", got, 2*universalTargetFileSize)
+	}
+	if got := universal.Levels[0].BlockSize; got != 8<<10 {
+		t.Errorf("existing level options overwritten: BlockSize = %d", got)
+	}
+}
+
+// TestCompactionStyleSwitchKeepsRecords writes records with universal
+// compaction and reopens the DB with level compaction.
+func TestCompactionStyleSwitchKeepsRecords(t *testing.T) {
+	dir := t.TempDir()
+	c := &ServerConfig{CompactionStyle: CompactionStyleUniversal}
+	if err := c.OpenDB(dir, false); err != nil {
+		t.Fatalf("open DB with universal compaction: %v", err)
+	}
+	rec := logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"msg": "kept"}, Pipelines: []string{"p1"}}
+	for i := 0; i < 10; i++ {
+		putRecord(t, c, newRecordKey(PriorityNormal, rec.Pipelines), rec)
+	}
+	if err := c.Db.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	c.CloseFiles()
+
+	c = &ServerConfig{CompactionStyle: CompactionStyleLevel}
+	if err := c.OpenDB(dir, false); err != nil {
+		t.Fatalf("reopen DB with level compaction: %v", err)
+	}
+	t.Cleanup(c.CloseFiles)
+	if got := len(storedKeys(t, c)); got != 10 {
+		t.Errorf("%d records after switching compaction style, want 10", got)
+	}
+}
@@ -1,12 +1,25 @@
 package tools
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"golang.org/x/net/http/httpguts"
 )
 
 // Files holds all the file handles and paths used by the agent.
@@ -16,17 +29,431 @@ type Files struct {
 	AcceptingFlag     *os.File // File handle for the accepting flag
 	successLog        *os.File // File handle for successful log writes
 	failureLog        *os.File // File handle for failed log writes
-	SocketPath        string   // Path for the agent's Unix socket
+	SocketPath        string   // Path for the agent's Unix socket (the abstract name when SocketAbstract is set)
 	dbPath            string   // Path for the Pebble DB directory
+	sessionPath       string   // Directory of the current session's log files
+	recordCountPath   string   // Snapshot of the Pebble record count
+	processCursorPath string   // Last key deleted by an unfinished ProcessPebble pass
+	agentLock         *os.File // Holds the flock on agent.lock while the agent runs
+
+	pipelineLogsMu sync.Mutex          // Guards pipelineLogs
+	pipelineLogs   map[string]*os.File // Per-pipeline success/failure logs, keyed by file name
 }
 
 // ServerConfig contains runtime configuration and references for the running agent.
 // It holds API credentials, the target server host, and file/database handles.
 type ServerConfig struct {
-	ApiKey     string     // API key used for authenticating with the main server
-	ServerHost string     // Base URL of the main Data Nadhi server
-	Db         *pebble.DB // Local Pebble database instance
-	Files                 // Embedded struct for managing all file paths and handles
+	ApiKey     string         // API key used for authenticating with the main server; read through CurrentApiKey
+	ServerHost string         // Base URL of the main Data Nadhi server
+	HTTPProxy  *url.URL       // Optional proxy for upstream calls (falls back to HTTP(S)_PROXY env)
+	Db         *PebbleManager // Local Pebble database instance
+	Files                     // Embedded struct for managing all file paths and handles
+
+	SocketAbstract bool // Bind the gRPC socket in the Linux abstract namespace instead of the filesystem
+	HTTPIngestPort int  // Also accept logs over HTTP on localhost:<port>/logs (0 = disabled)
+
+	TokenEndpoint        string        // POST RefreshToken here for a short-lived ApiKey (empty = static ApiKey)
+	RefreshToken         string        // Long-lived token exchanged at TokenEndpoint
+	TokenRefreshInterval time.Duration // How often ApiKey is renewed from TokenEndpoint
+	apiKeyMu             sync.RWMutex  // Guards ApiKey and apiKeyExpiry, see RefreshApiKey
+	apiKeyExpiry         time.Time     // When the current access token expires (zero = unknown)
+
+	ServerTLS           *tls.Config // Optional CA, verification and client cert settings for the main server
+	UploadEncryptionKey []byte      // AES-256 key; when set upload bodies are encrypted with AES-256-GCM
+	H2C                 bool        // Talk HTTP/2 without TLS (prior knowledge) to an http:// ServerHost
+
+	HTTPKeepaliveInterval time.Duration // TCP keepalive idle time and probe interval upstream (0 = Go default)
+	HTTPKeepaliveProbes   int           // Unanswered keepalive probes before a connection is dropped (0 = OS default)
+
+	DialTimeout    time.Duration // TCP connect timeout for upstream requests (0 = 30s)
+	RequestTimeout time.Duration // Whole-request timeout for uploads in ProcessPebble (0 = 5s)
+
+	CloudMetadata CloudMetadata // Instance identity attached to every stored record
+	SyncPipelines []string      // Pipelines whose records are written with pebble.Sync
+	SyncDeletes   bool          // Fsync the delete batch after records are uploaded
+	VerifyWrites  bool          // Read each SendLog write back and reject it if the bytes differ
+
+	MaxRecords         int64           // Expected Pebble capacity used for the SendLog backpressure hint (0 = none)
+	MaxRecordsPerCycle int             // Upper bound on records sent per ProcessPebble call (0 = unlimited)
+	ProcessConcurrency int             // Parallel uploads per ProcessPebble call (0 or 1 = sequential)
+	SendConcurrency    int             // Requests in flight at once when a record fans out to several endpoints (1 = one at a time)
+	HealthBreaker      *CircuitBreaker // Optional breaker that throttles health probes to a failing server
+
+	PipelineEndpoints map[string]string // Per-pipeline upload URLs; others go to ServerHost/log
+	PipelineApiKeys   map[string]string // Per-pipeline API keys; others use ApiKey
+	PerPipelineLogs   bool              // Also write pipeline-<name>-success/failure.log per pipeline
+	UploadDenyList    []string          // Payload fields (dot notation) stripped before upload
+	FieldRemap        map[string]string // Top-level payload keys renamed before upload ("from": "to")
+	ExtraHeaders      map[string]string // Headers added to every upload; the API key and Content-Encoding are never overridden
+
+	MinUploadLevel string // Records below this level (DEBUG < INFO < WARN < ERROR) are dropped instead of uploaded ("" = all)
+
+	PreloadPipelineList     bool            // Fetch ServerHost/pipelines and warn on unknown pipelines in SendLog
+	PipelineRefreshInterval time.Duration   // How often KnownPipelines is refetched (0 = only at startup and on SIGHUP)
+	KnownPipelines          []string        // Pipelines last returned by PreloadPipelines; read through knownPipelinesMu
+	knownPipelineSet        map[string]bool // KnownPipelines as a set for SendLog lookups
+	knownPipelinesMu        sync.RWMutex
+
+	HealthCheckInterval time.Duration // Sleep between health checks while the server is unhealthy
+	PostFlushInterval   time.Duration // Sleep after a successful drain before the next health check
+	HealthCheckTimeout  time.Duration // Timeout of the HTTP client used for health checks
+
+	HealthSuccessConsecutive int // Successful health checks in a row before uploading starts (0 or 1 = first success)
+
+	EnrichHooks []EnrichFunc // Run in order on every new record to add metadata
+
+	SampleRate          float64            // Fraction of records kept, in (0, 1]; unset (0) keeps all
+	PipelineSampleRates map[string]float64 // Per-pipeline overrides of SampleRate, each in (0, 1]
+
+	UploadRateLimit float64 // Max records uploaded per second during a drain (0 = unlimited)
+
+	FlattenPayload bool // Flatten nested payload objects into dot-separated keys
+	FlattenDepth   int  // Maximum nesting depth flattened when FlattenPayload is set
+
+	PebbleEncoding string // Encoding of new records in Pebble: "json" (default) or "msgpack"
+
+	CompactionStyle string // Pebble compaction tuning: "level" (default) or "universal" (see applyCompactionStyle)
+
+	// BloomFilterBitsPerKey sizes the bloom filter written into each sstable
+	// (0 = no filter). Filters only speed up point lookups such as the seek in
+	// PebbleIsEmpty; ProcessPebble's full scans do not use them. 10 bits per
+	// key (~1% false positives) is the recommended value; see BenchmarkBloomFilter.
+	BloomFilterBitsPerKey int
+	BloomFPAlert          float64 // Estimated false positive rate above which bloom_filter_degraded is logged (0 = DefaultBloomFPAlert)
+
+	InMemoryFallback   bool           // Buffer records in memory when a Pebble write fails
+	FallbackBufferSize int            // Bound of the in-memory fallback buffer (0 = 10,000)
+	fallback           fallbackBuffer // Records waiting for Pebble or upload after failed writes
+
+	AutoTuneBatch bool            // Coalesce SendLog writes into batches with a latency-tuned window
+	coalescer     *writeCoalescer // Running coalescer when AutoTuneBatch is set
+	tail          *tailHub        // Recent records for /tail, set by StartTailServer
+
+	IdempotencyEnabled bool          // Store each LogRequest.RequestId at most once (see StartRequestDedup)
+	dedup              *requestDedup // Recently seen request IDs, set by StartRequestDedup
+
+	ErrorSummaryWindow time.Duration // Window of the error_summary aggregator (0 = log each error)
+
+	ChunkTimeout time.Duration // Parts of an incomplete chunked payload are deleted after this (0 = 5m)
+	chunkMu      sync.Mutex    // Serialises chunk completeness checks and expiry
+
+	RecordTTL    time.Duration            // Records received longer ago than this are dropped instead of uploaded (0 = keep until sent)
+	PipelineTTLs map[string]time.Duration // Records keyed by these pipelines get an expiring key (see MakeExpiringKey) and are dropped once it expires
+	expiringSeq  atomic.Int64             // Last seq used by MakeExpiringKey
+
+	MaxPayloadBytes        int // Largest json_data accepted; also bounds gRPC messages. Validate requires 0 < n < 100 MiB; an unvalidated 0 leaves gRPC's 4 MiB default
+	MaxPipelinesPerRequest int // LogRequests naming more pipelines are rejected (0 = no limit)
+	MaxGRPCConnectionsWarn int // Log gRPC connection opens/closes while more than this many are open (0 = off)
+
+	DefaultRPCDeadline time.Duration // Deadline applied to unary RPCs arriving without a shorter one (0 = none)
+
+	GRPCKeepaliveTime    time.Duration // Ping an SDK connection idle for this long (0 = gRPC default, 2h)
+	GRPCKeepaliveTimeout time.Duration // Close the connection if a ping is not answered within this (0 = 20s)
+	GRPCMaxConnectionAge time.Duration // Ask clients to reconnect after this long (0 = never)
+
+	PausePolicy     string        // SendLog behaviour during ProcessPebble: none, block or reject
+	MaxPauseWait    time.Duration // Longest a blocked SendLog waits for ProcessPebble (0 = 5s)
+	IngestionPaused atomic.Bool   // True while ProcessPebble runs and PausePolicy is block or reject
+	pauseMu         sync.Mutex    // Guards resumed
+	resumed         chan struct{} // Closed when the current pause ends
+
+	DryRunProcess atomic.Bool // Next ProcessPebble only logs the records it would send (set via POST /dry-process)
+	processMu     sync.Mutex  // Serialises ProcessPebble calls
+
+	FlushInterval         time.Duration // How often FlushPebbleDBOnInterval flushes Pebble (0 = 1s)
+	FlushThresholdRecords int           // Also flush Pebble each time this many more records are stored (0 = interval only)
+	flushNow              chan struct{} // Buffered trigger read by the flusher, see flushNowChan
+	flushNowOnce          sync.Once
+
+	ProcessTriggerSizeMB int           // Signal ProcessNow when Pebble exceeds this size and the server is healthy (0 = off)
+	processNow           chan struct{} // Buffered trigger read by the main loop, created by FlushPebbleDBOnInterval
+	serverHealthy        atomic.Bool   // Result of the last IsHealthSuccess call
+
+	DiskFreeThresholdMB int64 // Refuse new logs while the Pebble filesystem has less free space (0 = no check)
+
+	WALSizeAlertThresholdMB int  // Log wal_size_alert when the live WAL exceeds this size (0 = off)
+	WALForceFlushOnAlert    bool // Flush the memtable immediately when the WAL alert fires
+
+	RecordAgeInterval         time.Duration   // How often record_age_histogram is reported (0 = never)
+	RecordAgeHistogramBuckets []time.Duration // Upper bounds of the record age buckets (empty = 1m, 5m, 1h, 24h)
+
+	WatchdogInterval time.Duration // Heartbeat check interval; a component silent for 3x this cancels the agent (0 = off)
+	watchdog         *Watchdog     // Running watchdog, set by StartWatchdog
+
+	SessionRetention time.Duration // Session directories older than this are removed at startup (0 = keep all)
+
+	HandoffMode   bool         // Started with -handoff-from after taking over from an older agent
+	handoffPaused atomic.Bool  // Set by POST /pause; SendLog is refused until the agent exits
+	resetting     atomic.Bool  // Set while Reset swaps the session; SendLog is refused
+	writeGate     sync.RWMutex // Read-held by each admitted write; Reset takes it to wait for them
+
+	InstanceID    string            // Stable ID of this agent installation (-instance-id or baseDir/.agent-id)
+	SessionID     string            // Random ID of this agent run, also attached to every log entry
+	BuildInfo     BuildInfo         // Version and build details of the running binary
+	ConfigSources map[string]string // Where each DumpConfig field came from: flag, env, file or default
+
+	recordCount        atomic.Int64 // Records currently in Pebble, see RecordCount
+	pebbleBackpressure atomic.Bool  // Set while ingestion should be refused (e.g. write stall)
+	diskLow            atomic.Bool  // Set by the disk monitor while free space is below DiskFreeThresholdMB
+	writeStalls        atomic.Int64 // Number of Pebble write stalls seen since open
+	writeStallActive   atomic.Bool  // True between WriteStallBegin and WriteStallEnd
+
+	stats sessionStats // Counts reported by LogSessionSummary
+}
+
+// DumpConfig logs the effective configuration as an agent_config event.
+// Each field carries its value and source (from ConfigSources, "default" when
+// unset). API keys are masked and proxy credentials are redacted.
+func (c *ServerConfig) DumpConfig() {
+	proxy := ""
+	if c.HTTPProxy != nil {
+		proxy = c.HTTPProxy.Redacted()
+	}
+	breaker := map[string]any{"enabled": c.HealthBreaker != nil}
+	if c.HealthBreaker != nil {
+		breaker["failure_threshold"] = c.HealthBreaker.FailureThreshold
+		breaker["recovery_timeout"] = c.HealthBreaker.RecoveryTimeout.String()
+	}
+
+	pipelineKeys := make(map[string]string, len(c.PipelineApiKeys))
+	for pipeline, key := range c.PipelineApiKeys {
+		pipelineKeys[pipeline] = maskSecret(key)
+	}
+	// Header values may carry credentials, so only the names are shown
+	extraHeaders := slices.Sorted(maps.Keys(c.ExtraHeaders))
+	pipelineTTLs := make(map[string]string, len(c.PipelineTTLs))
+	for pipeline, ttl := range c.PipelineTTLs {
+		pipelineTTLs[pipeline] = ttl.String()
+	}
+
+	values := map[string]any{
+		"api_key":               maskSecret(c.CurrentApiKey()),
+		"token_endpoint":        c.TokenEndpoint,
+		"refresh_token":         maskSecret(c.RefreshToken),
+		"token_refresh":         c.TokenRefreshInterval.String(),
+		"server_host":           c.ServerHost,
+		"http_proxy":            proxy,
+		"server_tls":            c.ServerTLS != nil,
+		"h2c":                   c.H2C,
+		"encrypt_uploads":       len(c.UploadEncryptionKey) > 0,
+		"http_keepalive":        c.HTTPKeepaliveInterval.String(),
+		"http_keepalive_probes": c.HTTPKeepaliveProbes,
+		"dial_timeout":          c.DialTimeout.String(),
+		"request_timeout":       c.RequestTimeout.String(),
+		"instance_id":           c.InstanceID,
+		"db_path":               c.dbPath,
+		"session_retention":     c.SessionRetention.String(),
+		"socket_path":           c.SocketPath,
+		"socket_abstract":       c.SocketAbstract,
+		"http_ingest_port":      c.HTTPIngestPort,
+		"cloud_metadata":        c.CloudMetadata.ToMap(),
+		"sync_pipelines":        c.SyncPipelines,
+		"sync_deletes":          c.SyncDeletes,
+		"max_records":           c.MaxRecords,
+		"max_records_per_cycle": c.MaxRecordsPerCycle,
+		"process_concurrency":   c.ProcessConcurrency,
+		"send_concurrency":      c.SendConcurrency,
+		"health_breaker":        breaker,
+		"pipeline_endpoints":    c.PipelineEndpoints,
+		"pipeline_api_keys":     pipelineKeys,
+		"upload_deny_fields":    c.UploadDenyList,
+		"preload_pipelines":     c.PreloadPipelineList,
+		"pipeline_refresh":      c.PipelineRefreshInterval.String(),
+		"min_upload_level":      c.MinUploadLevel,
+		"per_pipeline_logs":     c.PerPipelineLogs,
+		"field_remap":           c.FieldRemap,
+		"extra_headers":         extraHeaders,
+		"health_check_interval": c.HealthCheckInterval.String(),
+		"post_flush_interval":   c.PostFlushInterval.String(),
+		"health_check_timeout":  c.HealthCheckTimeout.String(),
+		"health_successes":      c.HealthSuccessConsecutive,
+		"enrich_hooks":          len(c.EnrichHooks),
+		"sample_rate":           c.SampleRate,
+		"pipeline_sample_rates": c.PipelineSampleRates,
+		"upload_rate_limit":     c.UploadRateLimit,
+		"flatten_payload":       c.FlattenPayload,
+		"flatten_depth":         c.FlattenDepth,
+		"pebble_encoding":       c.PebbleEncoding,
+		"compaction_style":      c.CompactionStyle,
+		"bloom_bits_per_key":    c.BloomFilterBitsPerKey,
+		"bloom_fp_alert":        c.BloomFPAlert,
+		"auto_tune_batch":       c.AutoTuneBatch,
+		"handoff_mode":          c.HandoffMode,
+		"verify_writes":         c.VerifyWrites,
+		"idempotency":           c.IdempotencyEnabled,
+		"inmemory_fallback":     c.InMemoryFallback,
+		"fallback_buffer_size":  c.fallbackSize(),
+		"watchdog_interval":     c.WatchdogInterval.String(),
+		"record_age_interval":   c.RecordAgeInterval.String(),
+		"record_age_buckets":    durationStrings(c.RecordAgeHistogramBuckets),
+		"wal_alert_mb":          c.WALSizeAlertThresholdMB,
+		"disk_free_mb":          c.DiskFreeThresholdMB,
+		"wal_force_flush":       c.WALForceFlushOnAlert,
+		"process_trigger_mb":    c.ProcessTriggerSizeMB,
+		"flush_interval":        c.flushInterval().String(),
+		"flush_threshold":       c.FlushThresholdRecords,
+		"grpc_conns_warn":       c.MaxGRPCConnectionsWarn,
+		"max_pipelines":         c.MaxPipelinesPerRequest,
+		"chunk_timeout":         c.chunkTimeout().String(),
+		"record_ttl":            c.RecordTTL.String(),
+		"pipeline_ttl":          pipelineTTLs,
+		"max_payload_bytes":     c.MaxPayloadBytes,
+		"default_rpc_deadline":  c.DefaultRPCDeadline.String(),
+		"grpc_ka_time":          c.GRPCKeepaliveTime.String(),
+		"grpc_ka_timeout":       c.GRPCKeepaliveTimeout.String(),
+		"grpc_max_conn_age":     c.GRPCMaxConnectionAge.String(),
+		"pause_policy":          c.PausePolicy,
+		"error_summary_window":  c.ErrorSummaryWindow.String(),
+		"max_pause_wait":        c.MaxPauseWait.String(),
+	}
+
+	fields := make(map[string]any, len(values))
+	for name, v := range values {
+		source := c.ConfigSources[name]
+		if source == "" {
+			source = "default"
+		}
+		fields[name] = map[string]any{"value": v, "source": source}
+	}
+	LogJsonLevel(LevelInfo, "agent_config", fields)
+}
+
+// durationStrings formats durations for DumpConfig.
+func durationStrings(ds []time.Duration) []string {
+	out := make([]string, len(ds))
+	for i, d := range ds {
+		out[i] = d.String()
+	}
+	return out
+}
+
+// maskSecret hides all but the last 4 characters of a secret, e.g. "****abcd".
+func maskSecret(secret string) string {
+	if len(secret) <= 4 {
+		return strings.Repeat("*", len(secret))
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// LoadJSONFile decodes a JSON config file (e.g. -pipeline-endpoints) into v.
+func LoadJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// ApiKeyPattern is the format an API key must match to be accepted.
+// It can be overridden (or disabled with nil) via SetApiKeyPattern.
+var ApiKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]{32,}$`)
+
+// SetApiKeyPattern replaces ApiKeyPattern. An empty pattern disables the format check.
+func SetApiKeyPattern(pattern string) error {
+	if pattern == "" {
+		ApiKeyPattern = nil
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	ApiKeyPattern = re
+	return nil
+}
+
+// ValidateApiKey checks that the key is present and matches ApiKeyPattern.
+// The key itself is never included in the returned error.
+func ValidateApiKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("api key is empty")
+	}
+	if ApiKeyPattern != nil && !ApiKeyPattern.MatchString(key) {
+		return fmt.Errorf("api key does not match expected format %s", ApiKeyPattern.String())
+	}
+	return nil
+}
+
+// maxPayloadBytesLimit bounds MaxPayloadBytes in Validate.
+const maxPayloadBytesLimit = 100 << 20
+
+// Validate checks the configuration for values that would otherwise only fail
+// mid-operation, and returns every problem found rather than stopping at the
+// first. Each error is prefixed with the DumpConfig key of the field. It is
+// called once CreateRequiredFiles has set SocketPath.
+func (c *ServerConfig) Validate() []error {
+	var errs []error
+	fail := func(key string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", key, err))
+	}
+
+	if c.TokenEndpoint == "" {
+		if err := ValidateApiKey(c.ApiKey); err != nil {
+			fail("api_key", err)
+		}
+	} else if c.CurrentApiKey() == "" {
+		fail("api_key", errors.New("no access token from the token endpoint"))
+	}
+	if u, err := url.Parse(c.ServerHost); err != nil {
+		fail("server_host", err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("server_host", fmt.Errorf("%q is not an absolute http(s) URL", c.ServerHost))
+	}
+
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"health_check_interval", c.HealthCheckInterval},
+		{"post_flush_interval", c.PostFlushInterval},
+		{"health_check_timeout", c.HealthCheckTimeout},
+		{"flush_interval", c.FlushInterval},
+	} {
+		if d.value <= 0 {
+			fail(d.key, fmt.Errorf("must be positive, got %s", d.value))
+		}
+	}
+
+	if c.MaxPayloadBytes <= 0 || c.MaxPayloadBytes >= maxPayloadBytesLimit {
+		fail("max_payload_bytes", fmt.Errorf("must be greater than 0 and less than %d, got %d", maxPayloadBytesLimit, c.MaxPayloadBytes))
+	}
+	if c.ProcessConcurrency < 0 {
+		fail("process_concurrency", fmt.Errorf("must not be negative, got %d", c.ProcessConcurrency))
+	}
+	if c.SendConcurrency < 1 {
+		fail("send_concurrency", fmt.Errorf("must be at least 1, got %d", c.SendConcurrency))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.ExtraHeaders)) {
+		if !httpguts.ValidHeaderFieldName(name) {
+			fail("extra_headers", fmt.Errorf("%q is not a valid header name", name))
+		}
+	}
+	for _, pipeline := range slices.Sorted(maps.Keys(c.PipelineTTLs)) {
+		if ttl := c.PipelineTTLs[pipeline]; ttl <= 0 {
+			fail("pipeline_ttl", fmt.Errorf("pipeline %q: must be positive, got %s", pipeline, ttl))
+		}
+	}
+
+	if !c.abstractSocket() {
+		if err := checkDirWritable(filepath.Dir(c.SocketPath)); err != nil {
+			fail("socket_path", err)
+		}
+	}
+	return errs
+}
+
+// checkDirWritable creates and removes a temporary file in dir.
+func checkDirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
 }
 
 // CreateRequiredFiles sets up the local file structure required for the agent session.
@@ -34,14 +461,30 @@ type ServerConfig struct {
 func (c *ServerConfig) CreateRequiredFiles(baseDir string) error {
 	var err error
 
+	// Refuse to share baseDir (and its Pebble DB) with another running agent
+	if err = c.acquireAgentLock(baseDir); err != nil {
+		return err
+	}
+
+	// Remove session folders left behind by earlier runs
+	if c.SessionRetention > 0 {
+		removed, err := c.CleanupOldSessions(baseDir, c.SessionRetention)
+		if err != nil {
+			LogJsonLevel(LevelError, "session_cleanup_error", map[string]any{"error": err.Error()})
+		} else if removed > 0 {
+			LogJsonLevel(LevelInfo, "old_sessions_removed", map[string]any{"count": removed, "retention": c.SessionRetention.String()})
+		}
+	}
+
 	// Create session folder with timestamped name
 	sessionPath := filepath.Join(
 		baseDir,
-		fmt.Sprintf("session-%s", time.Now().UTC().Format("2006-01-02T15-04-05Z")),
+		fmt.Sprintf("session-%s", time.Now().UTC().Format(sessionDirFormat)),
 	)
 	if err = os.MkdirAll(sessionPath, 0755); err != nil {
 		return err
 	}
+	c.sessionPath = sessionPath
 
 	// Prepare paths for control flag and logs
 	c.acceptingFlagPath = filepath.Join(baseDir, "agent-status.lock")
@@ -60,16 +503,168 @@ func (c *ServerConfig) CreateRequiredFiles(baseDir string) error {
 
 	// Prepare Unix socket and Pebble DB directories
 	c.SocketPath = filepath.Join(baseDir, "data-nadhi-agent.sock")
-	c.dbPath = filepath.Join(baseDir, "pebble")
+
+	// Check the record count snapshot before opening Pebble touches its files
+	c.recordCountPath = filepath.Join(baseDir, "pebble-record-count.json")
+	count, fresh := loadRecordCount(c.recordCountPath, filepath.Join(baseDir, "pebble"))
+	c.processCursorPath = filepath.Join(baseDir, ProcessCursorFile)
 
 	// Initialize Pebble database
-	c.Db, err = pebble.Open(c.dbPath, &pebble.Options{})
+	if err = c.OpenDB(baseDir, false); err != nil {
+		return err
+	}
+	return c.restoreRecordCount(count, fresh)
+}
+
+// ErrAgentAlreadyRunning is returned by CreateRequiredFiles when another
+// agent holds the lock on the same base directory.
+var ErrAgentAlreadyRunning = errors.New("another agent is already running with this base directory")
+
+// acquireAgentLock takes an exclusive advisory lock on baseDir/agent.lock.
+func (c *ServerConfig) acquireAgentLock(baseDir string) error {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(baseDir, "agent.lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		if errors.Is(err, ErrAgentAlreadyRunning) {
+			LogJsonLevel(LevelError, "agent_already_running", map[string]any{"lock_path": path})
+		}
+		return err
+	}
+	c.agentLock = f
+	return nil
+}
+
+// releaseAgentLock drops the lock taken by acquireAgentLock, if any.
+func (c *ServerConfig) releaseAgentLock() {
+	if c.agentLock == nil {
+		return
+	}
+	_ = unlockFile(c.agentLock)
+	_ = c.agentLock.Close()
+	c.agentLock = nil
+}
+
+// CleanupOldSessions removes session-* directories under baseDir whose
+// modification time is older than maxAge, and returns how many were removed.
+// The current session directory, if already created, is never removed.
+func (c *ServerConfig) CleanupOldSessions(baseDir string, maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(baseDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "session-") {
+			continue
+		}
+		path := filepath.Join(baseDir, entry.Name())
+		if path == c.sessionPath {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// instanceIDFile is the file under baseDir holding the persisted instance ID.
+const instanceIDFile = ".agent-id"
+
+// LoadOrCreateInstanceID returns the agent instance ID stored in
+// baseDir/.agent-id. On first run a random UUID is generated and written
+// there, so the ID stays the same across restarts.
+func LoadOrCreateInstanceID(baseDir string) (string, error) {
+	path := filepath.Join(baseDir, instanceIDFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return "", err
+	}
+	id := newUUIDv4()
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// OpenDB opens the Pebble database under baseDir without creating a session.
+// One-shot modes (purge, export) use this directly; readOnly should be set
+// whenever the DB is only inspected. A closed Db is restarted in place, which
+// keeps the pointer background goroutines hold valid across Reset.
+func (c *ServerConfig) OpenDB(baseDir string, readOnly bool) error {
+	c.dbPath = filepath.Join(baseDir, "pebble")
+	open := func() (PebbleDB, error) {
+		opts := &pebble.Options{
+			ReadOnly:      readOnly,
+			EventListener: c.pebbleEventListener(),
+		}
+		if c.BloomFilterBitsPerKey > 0 {
+			// A single LevelOptions entry applies to every level
+			opts.Levels = []pebble.LevelOptions{{FilterPolicy: bloom.FilterPolicy(c.BloomFilterBitsPerKey)}}
+		}
+		c.applyCompactionStyle(opts)
+		return pebble.Open(c.dbPath, opts)
+	}
+	if c.Db != nil {
+		return c.Db.restart(open)
+	}
+
+	var err error
+	c.Db, err = OpenPebbleManager(open)
 	return err
 }
 
+// pebbleEventListener hooks Pebble events the agent reacts to.
+// Write stalls are recorded here and acted upon by StartWriteStallDetector.
+func (c *ServerConfig) pebbleEventListener() *pebble.EventListener {
+	return &pebble.EventListener{
+		WriteStallBegin: func(info pebble.WriteStallBeginInfo) {
+			c.writeStalls.Add(1)
+			c.writeStallActive.Store(true)
+			pebbleWriteStallsTotal.Inc()
+		},
+		WriteStallEnd: func() {
+			c.writeStallActive.Store(false)
+		},
+	}
+}
+
 // CloseFiles safely closes all open file handles and cleans up temporary artifacts.
 // Removes the Unix socket and deletes the Pebble directory if it's empty.
 func (c *ServerConfig) CloseFiles() {
+	c.closeFiles(false)
+}
+
+// closeFiles is CloseFiles; keepSocket leaves the socket file of a gRPC
+// server that keeps running in place.
+func (c *ServerConfig) closeFiles(keepSocket bool) {
+	defer c.releaseAgentLock()
+
 	files := []*os.File{c.AcceptingFlag, c.successLog, c.failureLog}
 
 	for _, f := range files {
@@ -78,17 +673,164 @@ func (c *ServerConfig) CloseFiles() {
 		}
 	}
 
-	// Remove the Unix socket file
-	_ = os.Remove(c.SocketPath)
+	c.pipelineLogsMu.Lock()
+	for _, f := range c.pipelineLogs {
+		_ = f.Close()
+	}
+	c.pipelineLogs = nil
+	c.pipelineLogsMu.Unlock()
+
+	// Remove the Unix socket file (abstract sockets vanish with the listener)
+	if !keepSocket && !c.abstractSocket() {
+		_ = os.Remove(c.SocketPath)
+	}
 
 	// Close Pebble DB and delete it if it's empty
 	shouldRemovePebble := PebbleIsEmpty(c.Db)
 	if c.Db != nil {
-		_ = c.Db.Close()
+		// Checkpoint first so a failed close still leaves a consistent copy
+		// for StartupRecoveryCheck to restore on the next start.
+		checkpointPath := checkpointDir(c.dbPath)
+		checkpointed := false
+		if !shouldRemovePebble {
+			_ = os.RemoveAll(checkpointPath)
+			// NoSync writes are only in the WAL buffer until it is flushed
+			err := c.Db.Checkpoint(checkpointPath, pebble.WithFlushedWAL())
+			if err == nil {
+				err = markCheckpointComplete(checkpointPath)
+			}
+			if err != nil {
+				LogJsonLevel(LevelError, "checkpoint_error", map[string]any{"error": err.Error()})
+				_ = os.RemoveAll(checkpointPath)
+			} else {
+				checkpointed = true
+			}
+		}
+
+		if err := c.Db.Close(); err != nil {
+			LogJsonLevel(LevelError, "pebble_close_error", map[string]any{"error": err.Error(), "checkpoint_kept": checkpointed})
+			return
+		}
+		if checkpointed {
+			_ = os.RemoveAll(checkpointPath)
+		}
 		if shouldRemovePebble {
 			_ = os.RemoveAll(c.dbPath)
+			if c.recordCountPath != "" {
+				_ = os.Remove(c.recordCountPath)
+			}
+		} else if c.recordCountPath != "" {
+			// Written after close so it is newer than every Pebble file
+			if err := c.SnapshotRecordCount(c.recordCountPath); err != nil {
+				LogJsonLevel(LevelError, "record_count_snapshot_error", map[string]any{"error": err.Error()})
+			}
+		}
+	}
+}
+
+// resetFlushTimeout bounds the upload of stored records in Reset.
+const resetFlushTimeout = 30 * time.Second
+
+// Reset closes the current session and starts a fresh one in baseDir without
+// restarting the process, for embedded agents and tests. Ingestion is refused
+// with Unavailable while it runs. Stored records are uploaded first with
+// FlushAndWait; if that fails, Reset resumes ingestion and returns the error,
+// leaving the session as it was. Otherwise the files and the now empty Pebble
+// DB are closed and removed, and CreateRequiredFiles opens a new session and
+// DB. The gRPC server keeps running on its socket, and the accepting flag is
+// cleared until the main loop sets it again.
+//
+// Writes admitted before Reset started (see beginWrite) are waited for, so
+// their records are part of the upload rather than lost with the old DB.
+func (c *ServerConfig) Reset(ctx context.Context, baseDir string) error {
+	c.resetting.Store(true)
+	defer c.resetting.Store(false)
+
+	// Writes that start from here on see resetting and are refused
+	c.writeGate.Lock()
+	c.writeGate.Unlock()
+
+	if err := c.FlushAndWait(ctx, resetFlushTimeout); err != nil {
+		return fmt.Errorf("flush before reset: %w", err)
+	}
+
+	// Keep ProcessPebble off the files and DB while they are swapped
+	c.processMu.Lock()
+	defer c.processMu.Unlock()
+
+	_ = c.DisableAcceptingFlag()
+	c.closeFiles(true)
+	c.resetProcessCursor()
+	if err := c.CreateRequiredFiles(baseDir); err != nil {
+		return fmt.Errorf("start new session: %w", err)
+	}
+	LogJsonLevel(LevelInfo, "agent_reset", map[string]any{"session_path": c.sessionPath})
+	return nil
+}
+
+// checkpointDir is where CloseFiles leaves a Pebble checkpoint until close succeeds.
+func checkpointDir(dbPath string) string {
+	return dbPath + "-checkpoint"
+}
+
+// checkpointCompleteFile is written into a checkpoint once Checkpoint has
+// returned. A checkpoint without it was cut short and is never restored.
+const checkpointCompleteFile = "CHECKPOINT_COMPLETE"
+
+// markCheckpointComplete writes and fsyncs the completion marker in dir.
+func markCheckpointComplete(dir string) error {
+	f, err := os.Create(filepath.Join(dir, checkpointCompleteFile))
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// StartupRecoveryCheck deals with a checkpoint left behind by an interrupted
+// close. It is a no-op when no checkpoint exists. An incomplete checkpoint
+// (no completion marker) is deleted. A complete one is only restored when
+// the main DB under baseDir fails to open; if the main DB opens, it is at
+// least as recent as the checkpoint, which is deleted instead.
+func StartupRecoveryCheck(baseDir string) error {
+	dbPath := filepath.Join(baseDir, "pebble")
+	checkpointPath := checkpointDir(dbPath)
+	if _, err := os.Stat(checkpointPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(checkpointPath, checkpointCompleteFile)); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		LogJsonLevel(LevelWarn, "checkpoint_discarded", map[string]any{"path": checkpointPath, "reason": "incomplete"})
+		return os.RemoveAll(checkpointPath)
+	}
+
+	db, openErr := pebble.Open(dbPath, &pebble.Options{ReadOnly: true})
+	if openErr == nil {
+		if err := db.Close(); err != nil {
+			return err
+		}
+		LogJsonLevel(LevelInfo, "checkpoint_discarded", map[string]any{"path": checkpointPath, "reason": "main_db_ok"})
+		return os.RemoveAll(checkpointPath)
 	}
+
+	if err := os.RemoveAll(dbPath); err != nil {
+		return err
+	}
+	if err := os.Rename(checkpointPath, dbPath); err != nil {
+		return err
+	}
+	_ = os.Remove(filepath.Join(dbPath, checkpointCompleteFile))
+	LogJsonLevel(LevelInfo, "checkpoint_recovery", map[string]any{"path": dbPath, "open_error": openErr.Error()})
+	return nil
 }
 
 // EnableAcceptingFlag creates the lock file to indicate the agent is accepting logs.
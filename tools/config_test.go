@@ -0,0 +1,390 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateApiKey(t *testing.T) {
+	valid := strings.Repeat("a1", 16)
+	tests := []struct {
+		name    string
+		pattern string
+		key     string
+		wantErr bool
+	}{
+		{name: "default pattern", pattern: ApiKeyPattern.String(), key: valid},
+		{name: "empty", pattern: ApiKeyPattern.String(), key: "", wantErr: true},
+		{name: "too short", pattern: ApiKeyPattern.String(), key: valid[:31], wantErr: true},
+		{name: "not alphanumeric", pattern: ApiKeyPattern.String(), key: valid + "-", wantErr: true},
+		{name: "custom pattern", pattern: `^key-[0-9]+$`, key: "key-42"},
+		{name: "check disabled", pattern: "", key: "anything goes"},
+		{name: "empty with check disabled", pattern: "", key: "", wantErr: true},
+	}
+	saved := ApiKeyPattern
+	t.Cleanup(func() { ApiKeyPattern = saved })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetApiKeyPattern(tt.pattern); err != nil {
+				t.Fatalf("SetApiKeyPattern(%q): %v", tt.pattern, err)
+			}
+			err := ValidateApiKey(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateApiKey(%q) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			}
+			if err != nil && tt.key != "" && strings.Contains(err.Error(), tt.key) {
+				t.Errorf("error leaks the key: %v", err)
+			}
+		})
+	}
+}
+
+func TestSetApiKeyPatternRejectsBadRegex(t *testing.T) {
+	saved := ApiKeyPattern
+	t.Cleanup(func() { ApiKeyPattern = saved })
+	if err := SetApiKeyPattern("(["); err == nil {
+		t.Fatal("SetApiKeyPattern accepted an invalid regex")
+	}
+}
+
+// failingCloseDB closes the real DB but reports an error, like a close that
+// failed after Pebble had already written everything out.
+type failingCloseDB struct{ PebbleDB }
+
+func (d failingCloseDB) Close() error {
+	_ = d.PebbleDB.Close()
+	return errors.New("injected close failure")
+}
+
+// interruptedClose stores n records under baseDir and closes the DB with a
+// failing Close, so CloseFiles leaves its checkpoint behind.
+func interruptedClose(t *testing.T, baseDir string, n int) {
+	t.Helper()
+	c := &ServerConfig{}
+	if err := c.OpenDB(baseDir, false); err != nil {
+		t.Fatalf("open pebble: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		putRecord(t, c, keyAt(priorityPrefix(PriorityNormal), time.Unix(0, int64(i+1)), i), logRecord{Payload: map[string]any{"n": i}})
+	}
+	c.Db.Wrap(func(db PebbleDB) PebbleDB { return failingCloseDB{db} })
+	c.CloseFiles()
+
+	if _, err := os.Stat(filepath.Join(checkpointDir(c.dbPath), checkpointCompleteFile)); err != nil {
+		t.Fatalf("checkpoint not kept with its completion marker: %v", err)
+	}
+}
+
+// recordsIn opens the DB under baseDir read-only and returns its record keys.
+func recordsIn(t *testing.T, baseDir string) []string {
+	t.Helper()
+	c := &ServerConfig{}
+	if err := c.OpenDB(baseDir, true); err != nil {
+		t.Fatalf("open pebble: %v", err)
+	}
+	defer func() { _ = c.Db.Close() }()
+	return storedKeys(t, c)
+}
+
+// corruptDB makes the Pebble DB under baseDir fail to open.
+func corruptDB(t *testing.T, baseDir string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(baseDir, "pebble", "CURRENT"), []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartupRecoveryKeepsHealthyDB(t *testing.T) {
+	baseDir := t.TempDir()
+	interruptedClose(t, baseDir, 3)
+
+	// Written after the checkpoint: restoring it would lose this record
+	c := &ServerConfig{}
+	if err := c.OpenDB(baseDir, false); err != nil {
+		t.Fatalf("reopen pebble: %v", err)
+	}
+	putRecord(t, c, keyAt(priorityPrefix(PriorityNormal), time.Unix(0, 100), 0), logRecord{})
+	_ = c.Db.Close()
+
+	if err := StartupRecoveryCheck(baseDir); err != nil {
+		t.Fatalf("StartupRecoveryCheck: %v", err)
+	}
+	if _, err := os.Stat(checkpointDir(filepath.Join(baseDir, "pebble"))); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not discarded next to a healthy DB: %v", err)
+	}
+	if n := len(recordsIn(t, baseDir)); n != 4 {
+		t.Errorf("records = %d, want the 4 in the main DB", n)
+	}
+}
+
+func TestStartupRecoveryRestoresCompleteCheckpoint(t *testing.T) {
+	baseDir := t.TempDir()
+	interruptedClose(t, baseDir, 3)
+	corruptDB(t, baseDir)
+
+	if err := StartupRecoveryCheck(baseDir); err != nil {
+		t.Fatalf("StartupRecoveryCheck: %v", err)
+	}
+	dbPath := filepath.Join(baseDir, "pebble")
+	if _, err := os.Stat(checkpointDir(dbPath)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint still present after restore: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dbPath, checkpointCompleteFile)); !os.IsNotExist(err) {
+		t.Errorf("completion marker left in the restored DB: %v", err)
+	}
+	if n := len(recordsIn(t, baseDir)); n != 3 {
+		t.Errorf("records after restore = %d, want 3", n)
+	}
+}
+
+func TestStartupRecoveryIgnoresIncompleteCheckpoint(t *testing.T) {
+	baseDir := t.TempDir()
+	interruptedClose(t, baseDir, 3)
+	// A crash during Checkpoint leaves the directory without the marker
+	dbPath := filepath.Join(baseDir, "pebble")
+	if err := os.Remove(filepath.Join(checkpointDir(dbPath), checkpointCompleteFile)); err != nil {
+		t.Fatal(err)
+	}
+	corruptDB(t, baseDir)
+
+	if err := StartupRecoveryCheck(baseDir); err != nil {
+		t.Fatalf("StartupRecoveryCheck: %v", err)
+	}
+	if _, err := os.Stat(checkpointDir(dbPath)); !os.IsNotExist(err) {
+		t.Errorf("incomplete checkpoint not deleted: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dbPath, "CURRENT"))
+	if err != nil || string(data) != "garbage\n" {
+		t.Errorf("main DB replaced by an incomplete checkpoint (CURRENT %q, %v)", data, err)
+	}
+}
+
+func TestStartupRecoveryWithoutCheckpoint(t *testing.T) {
+	if err := StartupRecoveryCheck(t.TempDir()); err != nil {
+		t.Fatalf("StartupRecoveryCheck: %v", err)
+	}
+}
+
+func TestDumpConfigMasksSecretsAndReportsSources(t *testing.T) {
+	logs := CaptureLogs(t)
+	const key = "abcdefghijklmnopqrstuvwxyz01wxyz"
+	c := &ServerConfig{
+		ApiKey:          key,
+		RefreshToken:    "refresh-secret-1234",
+		PipelineApiKeys: map[string]string{"audit": "pipelinekeyAUDIT"},
+		ServerHost:      "https://ingest.example",
+		ConfigSources:   map[string]string{"api_key": "file", "server_host": "flag"},
+	}
+	c.DumpConfig()
+
+	entries := logs.Events("agent_config")
+	if len(entries) != 1 {
+		t.Fatalf("agent_config entries = %d, want 1", len(entries))
+	}
+	raw, _ := json.Marshal(entries[0])
+	for _, secret := range []string{key, "refresh-secret-1234", "pipelinekeyAUDIT"} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("agent_config leaks %q: %s", secret, raw)
+		}
+	}
+
+	field := func(name string) map[string]any {
+		f, _ := entries[0][name].(map[string]any)
+		return f
+	}
+	tests := []struct {
+		name, value, source string
+	}{
+		{"api_key", "****wxyz", "file"},
+		{"refresh_token", "****1234", "default"},
+		{"server_host", "https://ingest.example", "flag"},
+	}
+	for _, tt := range tests {
+		if f := field(tt.name); f["value"] != tt.value || f["source"] != tt.source {
+			t.Errorf("%s = %v, want value %q from %q", tt.name, f, tt.value, tt.source)
+		}
+	}
+	if keys, _ := field("pipeline_api_keys")["value"].(map[string]any); keys["audit"] != "****UDIT" {
+		t.Errorf("pipeline_api_keys = %v, want audit masked as ****UDIT", keys)
+	}
+}
+
+func TestMaskSecret(t *testing.T) {
+	for secret, want := range map[string]string{"": "", "abc": "***", "abcd": "****", "abcde": "****bcde"} {
+		if got := maskSecret(secret); got != want {
+			t.Errorf("maskSecret(%q) = %q, want %q", secret, got, want)
+		}
+	}
+}
+
+func TestLoadOrCreateInstanceID(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "datanadhi") // created on first run
+	first, err := LoadOrCreateInstanceID(dir)
+	if err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	if !uuidV4Pattern.MatchString(first) {
+		t.Errorf("instance ID %q is not a UUIDv4", first)
+	}
+	second, err := LoadOrCreateInstanceID(dir)
+	if err != nil || second != first {
+		t.Fatalf("second run = %q, %v; want the persisted %q", second, err, first)
+	}
+
+	other, err := LoadOrCreateInstanceID(t.TempDir())
+	if err != nil || other == first {
+		t.Errorf("another base dir got %q, %v; want a new ID", other, err)
+	}
+}
+
+func TestLoadOrCreateInstanceIDReusesFileContents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, instanceIDFile)
+	if err := os.WriteFile(path, []byte("  edge-node-7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := LoadOrCreateInstanceID(dir); err != nil || id != "edge-node-7" {
+		t.Errorf("LoadOrCreateInstanceID = %q, %v; want the trimmed file contents", id, err)
+	}
+
+	// An empty file is replaced by a generated ID
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := LoadOrCreateInstanceID(dir)
+	if err != nil || !uuidV4Pattern.MatchString(id) {
+		t.Fatalf("LoadOrCreateInstanceID on an empty file = %q, %v", id, err)
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != id {
+		t.Errorf(".agent-id = %q, want %q", data, id)
+	}
+}
+
+// makeSession creates baseDir/name with the given age.
+func makeSession(t *testing.T, baseDir, name string, age time.Duration) string {
+	t.Helper()
+	path := filepath.Join(baseDir, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "agent-success.log"), []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCleanupOldSessions(t *testing.T) {
+	baseDir := t.TempDir()
+	old := []string{
+		makeSession(t, baseDir, "session-old-1", 8*24*time.Hour),
+		makeSession(t, baseDir, "session-old-2", 30*24*time.Hour),
+		makeSession(t, baseDir, "session-old-3", 200*time.Hour),
+	}
+	recent := makeSession(t, baseDir, "session-recent", time.Hour)
+	other := makeSession(t, baseDir, "backup-old", 30*24*time.Hour) // not a session
+	current := makeSession(t, baseDir, "session-current", 30*24*time.Hour)
+
+	c := &ServerConfig{}
+	c.sessionPath = current
+	removed, err := c.CleanupOldSessions(baseDir, 7*24*time.Hour)
+	if err != nil || removed != len(old) {
+		t.Fatalf("CleanupOldSessions = %d, %v; want %d", removed, err, len(old))
+	}
+	for _, path := range old {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s not removed: %v", path, err)
+		}
+	}
+	for _, path := range []string{recent, other, current} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s removed: %v", path, err)
+		}
+	}
+
+	if removed, err := c.CleanupOldSessions(filepath.Join(baseDir, "missing"), time.Hour); removed != 0 || err != nil {
+		t.Errorf("CleanupOldSessions on a missing dir = %d, %v", removed, err)
+	}
+}
+
+func TestCreateRequiredFilesRemovesOldSessions(t *testing.T) {
+	logs := CaptureLogs(t)
+	baseDir := t.TempDir()
+	makeSession(t, baseDir, "session-crashed-1", 10*24*time.Hour)
+	makeSession(t, baseDir, "session-crashed-2", 10*24*time.Hour)
+
+	c := &ServerConfig{SessionRetention: 7 * 24 * time.Hour}
+	if err := c.CreateRequiredFiles(baseDir); err != nil {
+		t.Fatalf("CreateRequiredFiles: %v", err)
+	}
+	defer c.CloseFiles()
+
+	sessions, _ := filepath.Glob(filepath.Join(baseDir, "session-*"))
+	if len(sessions) != 1 || sessions[0] != c.sessionPath {
+		t.Errorf("sessions after startup = %v, want only the new %s", sessions, c.sessionPath)
+	}
+	entries := logs.Events("old_sessions_removed")
+	if len(entries) != 1 || entries[0]["count"] != float64(2) {
+		t.Errorf("old_sessions_removed entries = %v, want count 2", entries)
+	}
+}
+
+func TestValidateReportsEachInvalidField(t *testing.T) {
+	valid := func() *ServerConfig {
+		c := &ServerConfig{
+			ApiKey:              strings.Repeat("a1", 16),
+			ServerHost:          "http://localhost:5000",
+			HealthCheckInterval: time.Second,
+			PostFlushInterval:   time.Second,
+			HealthCheckTimeout:  time.Second,
+			FlushInterval:       time.Second,
+			MaxPayloadBytes:     4 << 20,
+			SendConcurrency:     1,
+			ExtraHeaders:        map[string]string{"X-Tenant": "acme"},
+			PipelineTTLs:        map[string]time.Duration{"orders": time.Minute},
+		}
+		c.SocketPath = filepath.Join(t.TempDir(), "agent.sock")
+		return c
+	}
+	if errs := valid().Validate(); len(errs) != 0 {
+		t.Fatalf("Validate on a valid config = %v", errs)
+	}
+
+	tests := []struct {
+		key    string
+		mutate func(c *ServerConfig)
+	}{
+		{"api_key", func(c *ServerConfig) { c.ApiKey = "" }},
+		{"server_host", func(c *ServerConfig) { c.ServerHost = "localhost:5000" }},
+		{"health_check_interval", func(c *ServerConfig) { c.HealthCheckInterval = 0 }},
+		{"post_flush_interval", func(c *ServerConfig) { c.PostFlushInterval = -time.Second }},
+		{"health_check_timeout", func(c *ServerConfig) { c.HealthCheckTimeout = 0 }},
+		{"flush_interval", func(c *ServerConfig) { c.FlushInterval = 0 }},
+		{"max_payload_bytes", func(c *ServerConfig) { c.MaxPayloadBytes = 0 }},
+		{"max_payload_bytes", func(c *ServerConfig) { c.MaxPayloadBytes = -1 }},
+		{"max_payload_bytes", func(c *ServerConfig) { c.MaxPayloadBytes = maxPayloadBytesLimit }},
+		{"process_concurrency", func(c *ServerConfig) { c.ProcessConcurrency = -1 }},
+		{"send_concurrency", func(c *ServerConfig) { c.SendConcurrency = 0 }},
+		{"extra_headers", func(c *ServerConfig) { c.ExtraHeaders["Bad Header"] = "x" }},
+		{"pipeline_ttl", func(c *ServerConfig) { c.PipelineTTLs["orders"] = 0 }},
+		{"socket_path", func(c *ServerConfig) { c.SocketPath = filepath.Join(t.TempDir(), "missing", "agent.sock") }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.key, func(t *testing.T) {
+			c := valid()
+			tc.mutate(c)
+			errs := c.Validate()
+			if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), tc.key+": ") {
+				t.Errorf("Validate = %v, want one %s error", errs, tc.key)
+			}
+		})
+	}
+}
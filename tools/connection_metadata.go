@@ -0,0 +1,119 @@
+package tools
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// connIDKey is the context key of the ID connStatsHandler gives each gRPC
+// connection. Clients on the Unix socket all share the same peer address, so
+// the ID, not the address, tells their connections apart.
+type connIDKey struct{}
+
+// nextConnID numbers gRPC connections in the order they are accepted.
+var nextConnID atomic.Uint64
+
+// connMetadata holds the metadata registered with Connect, keyed by connection
+// ID. Entries are removed when the Connect stream ends.
+var connMetadata sync.Map
+
+// connIDFromContext returns the connection ID of an RPC context.
+func connIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey{}).(uint64)
+	return id, ok
+}
+
+// connectionMetadata returns the metadata registered on the connection an RPC
+// arrived on, or nil when none is.
+func connectionMetadata(ctx context.Context) map[string]string {
+	id, ok := connIDFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	md, ok := connMetadata.Load(id)
+	if !ok {
+		return nil
+	}
+	return md.(map[string]string)
+}
+
+// Connect registers the calling SDK process on its connection for as long as
+// the stream stays open. Records received over the same connection meanwhile,
+// by SendLog or StreamLogs, carry the non-empty fields of the latest request
+// in their metadata. The response headers are sent once the first request is
+// registered, so SDKs can wait for them before logging. When the SDK closes
+// the stream the metadata is dropped and the response carries the connection
+// ID; a broken connection or an agent shutdown drops it as well. One Connect
+// stream per connection is expected.
+func (s *server) Connect(stream pb.LogAgent_ConnectServer) error {
+	id, ok := connIDFromContext(stream.Context())
+	if !ok {
+		return stream.SendAndClose(&pb.ConnectResponse{Success: false})
+	}
+
+	// Recv runs apart from the handler so an agent shutdown can end the
+	// stream; it returns once the handler has
+	done := make(chan error, 1)
+	go func() {
+		defer connMetadata.Delete(id)
+		done <- s.registerConnection(stream, id)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		LogJsonLevel(LevelInfo, "connection_unregistered", map[string]any{"connection_id": id})
+		return stream.SendAndClose(&pb.ConnectResponse{Success: true, ConnectionId: id})
+	case <-s.stopping:
+		return status.Error(codes.Unavailable, "agent is shutting down")
+	}
+}
+
+// registerConnection stores the metadata of each request received on a
+// Connect stream under the connection id, until the client closes the stream
+// (nil) or the stream fails.
+func (s *server) registerConnection(stream pb.LogAgent_ConnectServer, id uint64) error {
+	for registered := false; ; registered = true {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		md := map[string]string{}
+		for k, v := range map[string]string{
+			"process_name": req.ProcessName,
+			"sdk_version":  req.SdkVersion,
+			"environment":  req.Environment,
+		} {
+			if v != "" {
+				md[k] = v
+			}
+		}
+		connMetadata.Store(id, md)
+
+		fields := clientIdentity(stream.Context())
+		fields["connection_id"] = id
+		for k, v := range md {
+			fields[k] = v
+		}
+		LogJsonLevel(LevelInfo, "connection_registered", fields)
+		if !registered {
+			if err := stream.SendHeader(metadata.MD{}); err != nil {
+				return err
+			}
+		}
+	}
+}
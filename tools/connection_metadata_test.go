@@ -0,0 +1,164 @@
+package tools_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// connectFields are the upload metadata keys Connect sets.
+var connectFields = []string{"process_name", "sdk_version", "environment"}
+
+// openConnect opens a Connect stream on client, sends req and waits until the
+// agent has registered it.
+func openConnect(t *testing.T, client pb.LogAgentClient, req *pb.ConnectRequest) pb.LogAgent_ConnectClient {
+	t.Helper()
+	stream, err := client.Connect(context.Background())
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := stream.Send(req); err != nil {
+		t.Fatalf("Connect Send: %v", err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("Connect Header: %v", err)
+	}
+	return stream
+}
+
+func TestConnectTagsRecordsWhileStreamIsOpen(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+	conn, err := agent.Dial()
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	other := pb.NewLogAgentClient(conn)
+
+	send := func(client pb.LogAgentClient, from string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if resp, err := client.SendLog(ctx, &pb.LogRequest{JsonData: `{"from":"` + from + `"}`, Pipelines: []string{"p1"}}); err != nil || !resp.Success {
+			t.Fatalf("SendLog from %s = %+v, %v", from, resp, err)
+		}
+	}
+
+	disconnect, err := agent.Connect(&pb.ConnectRequest{ProcessName: "billing", SdkVersion: "1.4.0", Environment: "prod"})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if resp, err := agent.SendLog(&pb.LogRequest{JsonData: `{"from":"connected"}`, Pipelines: []string{"p1"}}); err != nil || !resp.Success {
+			t.Fatalf("SendLog = %+v, %v", resp, err)
+		}
+	}
+	if _, err := agent.StreamLogs([]*pb.LogRequest{{JsonData: `{"from":"connected"}`, Pipelines: []string{"p1"}}}); err != nil {
+		t.Fatalf("StreamLogs: %v", err)
+	}
+	send(other, "other")
+
+	resp, err := disconnect()
+	if err != nil || !resp.Success || resp.ConnectionId == 0 {
+		t.Fatalf("closing the Connect stream = %+v, %v; want success and a connection ID", resp, err)
+	}
+	if resp, err := agent.SendLog(&pb.LogRequest{JsonData: `{"from":"disconnected"}`, Pipelines: []string{"p1"}}); err != nil || !resp.Success {
+		t.Fatalf("SendLog after the Connect stream closed = %+v, %v", resp, err)
+	}
+
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	bodies := uploadedBodies(t, agent)
+	if len(bodies) != 6 {
+		t.Fatalf("uploaded %d records, want 6", len(bodies))
+	}
+	want := map[string]string{"process_name": "billing", "sdk_version": "1.4.0", "environment": "prod"}
+	for _, body := range bodies {
+		from := body.LogData["from"]
+		for _, key := range connectFields {
+			got, ok := body.Metadata[key]
+			switch {
+			case from == "connected" && got != want[key]:
+				t.Errorf("metadata %s of a record sent while connected = %v, want %s", key, got, want[key])
+			case from != "connected" && ok:
+				t.Errorf("record from %v carries metadata %s = %v, want none", from, key, got)
+			}
+		}
+	}
+}
+
+func TestConnectLatestRequestReplacesMetadata(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+	logs := tools.CaptureLogs(t)
+	conn, err := agent.Dial()
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewLogAgentClient(conn)
+
+	stream := openConnect(t, client, &pb.ConnectRequest{ProcessName: "billing", SdkVersion: "1.4.0"})
+	if err := stream.Send(&pb.ConnectRequest{ProcessName: "billing", SdkVersion: "1.5.0"}); err != nil {
+		t.Fatalf("Connect Send: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(logs.Events("connection_registered")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(logs.Events("connection_registered")); n != 2 {
+		t.Fatalf("connection_registered logged %d times, want 2", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := client.SendLog(ctx, &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}}); err != nil {
+		t.Fatalf("SendLog: %v", err)
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		t.Fatalf("Connect CloseAndRecv: %v", err)
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	bodies := uploadedBodies(t, agent)
+	if len(bodies) != 1 || bodies[0].Metadata["sdk_version"] != "1.5.0" {
+		t.Fatalf("uploaded %+v, want one record with sdk_version 1.5.0", bodies)
+	}
+	if len(logs.Events("connection_unregistered")) != 1 {
+		t.Error("closing the Connect stream did not log connection_unregistered")
+	}
+}
+
+func TestShutdownEndsOpenConnectStream(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+	conn, err := agent.Dial()
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	defer conn.Close()
+	stream := openConnect(t, pb.NewLogAgentClient(conn), &pb.ConnectRequest{ProcessName: "billing"})
+
+	// GracefulStop waits for open streams, so the agent only stops once
+	// Connect has returned
+	stopped := make(chan struct{})
+	go func() {
+		agent.Shutdown()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop while a Connect stream was open")
+	}
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("Connect stream after shutdown = %v, want Unavailable", err)
+	}
+}
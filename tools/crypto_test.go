@@ -0,0 +1,126 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptDecryptRoundtrip(t *testing.T) {
+	key := testKey(t)
+	for _, plaintext := range [][]byte{{}, []byte(`{"msg":"hello"}`), bytes.Repeat([]byte("x"), 1<<20)} {
+		sealed, err := EncryptPayload(plaintext, key)
+		if err != nil {
+			t.Fatalf("EncryptPayload: %v", err)
+		}
+		if len(sealed) != 12+len(plaintext)+16 {
+			t.Errorf("sealed length = %d, want nonce + plaintext + tag = %d", len(sealed), 12+len(plaintext)+16)
+		}
+		got, err := DecryptPayload(sealed, key)
+		if err != nil {
+			t.Fatalf("DecryptPayload: %v", err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("roundtrip changed a %d byte payload", len(plaintext))
+		}
+	}
+}
+
+func TestEncryptPayloadUsesFreshNonces(t *testing.T) {
+	key := testKey(t)
+	a, _ := EncryptPayload([]byte("same"), key)
+	b, _ := EncryptPayload([]byte("same"), key)
+	if bytes.Equal(a[:12], b[:12]) || bytes.Equal(a, b) {
+		t.Error("two encryptions of the same plaintext share a nonce")
+	}
+}
+
+func TestDecryptPayloadRejectsTampering(t *testing.T) {
+	key := testKey(t)
+	sealed, _ := EncryptPayload([]byte(`{"msg":"hello"}`), key)
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := DecryptPayload(tampered, key); err == nil {
+		t.Error("tampered ciphertext decrypted")
+	}
+	if _, err := DecryptPayload(sealed, testKey(t)); err == nil {
+		t.Error("ciphertext decrypted with the wrong key")
+	}
+	if _, err := DecryptPayload(sealed[:5], key); err == nil {
+		t.Error("ciphertext shorter than the nonce decrypted")
+	}
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	valid := hex.EncodeToString(testKey(t))
+	if key, err := ParseEncryptionKey(valid); err != nil || len(key) != 32 {
+		t.Errorf("ParseEncryptionKey(valid) = %d bytes, %v", len(key), err)
+	}
+	if key, err := ParseEncryptionKey(""); key != nil || err != nil {
+		t.Errorf("ParseEncryptionKey(\"\") = %v, %v; want encryption disabled", key, err)
+	}
+	for _, bad := range []string{"zz" + valid[2:], valid[:62], valid + "00"} {
+		if _, err := ParseEncryptionKey(bad); err == nil {
+			t.Errorf("ParseEncryptionKey(%q) accepted", bad)
+		}
+	}
+}
+
+func TestUploadsAreEncrypted(t *testing.T) {
+	key := testKey(t)
+	var mu sync.Mutex
+	var encoding string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		encoding = r.Header.Get("Content-Encoding")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	t.Cleanup(srv.Close)
+
+	c := newTestConfig(t, srv.URL)
+	c.UploadEncryptionKey = key
+	putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"msg": "secret value"}, Pipelines: []string{"p1"}})
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if encoding != UploadContentEncoding {
+		t.Errorf("Content-Encoding = %q, want %q", encoding, UploadContentEncoding)
+	}
+	if strings.Contains(string(body), "secret value") {
+		t.Fatal("upload body carries the plaintext")
+	}
+	plaintext, err := DecryptPayload(body, key)
+	if err != nil {
+		t.Fatalf("server-side decrypt: %v", err)
+	}
+	var upload map[string]any
+	if err := json.Unmarshal(plaintext, &upload); err != nil {
+		t.Fatalf("decrypted body is not JSON: %v", err)
+	}
+	if data, _ := upload["log_data"].(map[string]any); data["msg"] != "secret value" {
+		t.Errorf("decrypted upload = %v", upload)
+	}
+}
@@ -0,0 +1,99 @@
+package tools
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds of the SendLog request ID cache used when IdempotencyEnabled is set.
+const (
+	dedupMaxSize       = 10000
+	dedupTTL           = 5 * time.Minute
+	dedupSweepInterval = 30 * time.Second
+)
+
+// requestDedup remembers recently seen LogRequest IDs so an SDK retry of a
+// call that was already stored is not written twice. Entries expire after
+// dedupTTL; when more than dedupMaxSize are held, the sweeper evicts the
+// least recently seen ones.
+type requestDedup struct {
+	seen sync.Map // request ID -> time.Time first seen
+	size atomic.Int64
+	full chan struct{} // Wakes the sweeper early once size passes dedupMaxSize
+}
+
+// StartRequestDedup enables request ID deduplication when IdempotencyEnabled is
+// set. It must be called before the gRPC server starts.
+func (c *ServerConfig) StartRequestDedup(ctx context.Context, wg *sync.WaitGroup) {
+	if !c.IdempotencyEnabled {
+		return
+	}
+	c.dedup = &requestDedup{full: make(chan struct{}, 1)}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(dedupSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-c.dedup.full:
+			}
+			c.dedup.sweep(time.Now())
+		}
+	}()
+}
+
+// claim records id and reports whether it was not already present. Concurrent
+// calls with the same id return true for exactly one of them; a repeated id
+// is marked as seen again so it is evicted last.
+func (d *requestDedup) claim(id string) bool {
+	now := time.Now()
+	if prev, loaded := d.seen.LoadOrStore(id, now); loaded {
+		d.seen.CompareAndSwap(id, prev, now)
+		return false
+	}
+	if d.size.Add(1) > dedupMaxSize {
+		select {
+		case d.full <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// forget removes id so a retry after a failed write is processed again.
+func (d *requestDedup) forget(id string) {
+	if _, ok := d.seen.LoadAndDelete(id); ok {
+		d.size.Add(-1)
+	}
+}
+
+// sweep drops expired IDs, then the oldest ones beyond dedupMaxSize.
+func (d *requestDedup) sweep(now time.Time) {
+	type entry struct {
+		id   string
+		seen time.Time
+	}
+	var live []entry
+	d.seen.Range(func(k, v any) bool {
+		if now.Sub(v.(time.Time)) > dedupTTL {
+			d.forget(k.(string))
+		} else {
+			live = append(live, entry{k.(string), v.(time.Time)})
+		}
+		return true
+	})
+	if excess := len(live) - dedupMaxSize; excess > 0 {
+		sort.Slice(live, func(i, j int) bool { return live[i].seen.Before(live[j].seen) })
+		for _, e := range live[:excess] {
+			d.forget(e.id)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+)
+
+// newDedupConfig returns a test agent with request deduplication running.
+func newDedupConfig(t *testing.T) *ServerConfig {
+	t.Helper()
+	c := newTestConfig(t, "http://unused.invalid")
+	c.IdempotencyEnabled = true
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	c.StartRequestDedup(ctx, &wg)
+	return c
+}
+
+func TestDuplicateRequestIDStoredOnce(t *testing.T) {
+	c := newDedupConfig(t)
+	s := &server{config: c}
+
+	const callers = 20
+	var duplicates atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}, RequestId: "req-1"})
+			if err != nil || !resp.Success {
+				t.Errorf("SendLog = %+v, %v", resp, err)
+				return
+			}
+			if resp.Message == "idempotent_duplicate" {
+				duplicates.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(storedKeys(t, c)); n != 1 {
+		t.Errorf("records stored for one request ID = %d, want 1", n)
+	}
+	if got := duplicates.Load(); got != callers-1 {
+		t.Errorf("idempotent_duplicate responses = %d, want %d", got, callers-1)
+	}
+
+	// Other IDs, and requests without one, are stored normally
+	for _, id := range []string{"req-2", "", ""} {
+		if _, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}, RequestId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(storedKeys(t, c)); n != 4 {
+		t.Errorf("records stored = %d, want 4", n)
+	}
+}
+
+func TestDuplicateRequestIDWithoutIdempotency(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	s := &server{config: c}
+	for i := 0; i < 2; i++ {
+		if _, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}, RequestId: "req-1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(storedKeys(t, c)); n != 2 {
+		t.Errorf("records stored = %d, want 2 with idempotency off", n)
+	}
+}
+
+func TestFailedWriteForgetsRequestID(t *testing.T) {
+	c := newDedupConfig(t)
+	full := &atomic.Bool{}
+	full.Store(true)
+	c.Db.Wrap(func(db PebbleDB) PebbleDB { return diskFullDB{db, full} })
+	s := &server{config: c}
+	req := &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}, RequestId: "req-1"}
+
+	if resp, err := s.SendLog(context.Background(), req); err == nil && resp.Success {
+		t.Fatalf("SendLog on a full disk = %+v, want a failure", resp)
+	}
+	full.Store(false)
+	resp, err := s.SendLog(context.Background(), req)
+	if err != nil || !resp.Success || resp.Message == "idempotent_duplicate" {
+		t.Fatalf("retry after the failed write = %+v, %v; want it stored", resp, err)
+	}
+	if n := len(storedKeys(t, c)); n != 1 {
+		t.Errorf("records stored = %d, want 1", n)
+	}
+}
+
+func TestRequestDedupSweep(t *testing.T) {
+	d := &requestDedup{full: make(chan struct{}, 1)}
+	d.claim("expired")
+	d.seen.Store("expired", time.Now().Add(-2*dedupTTL))
+	for i := 0; i < dedupMaxSize+5; i++ {
+		d.claim(fmt.Sprint(i))
+	}
+	select {
+	case <-d.full:
+	default:
+		t.Error("sweeper not woken past dedupMaxSize")
+	}
+
+	d.sweep(time.Now())
+	if got := d.size.Load(); got != dedupMaxSize {
+		t.Fatalf("size after sweep = %d, want %d", got, dedupMaxSize)
+	}
+	if _, ok := d.seen.Load("expired"); ok {
+		t.Error("expired ID kept")
+	}
+	// The oldest IDs beyond the bound are evicted first
+	if _, ok := d.seen.Load(fmt.Sprint(dedupMaxSize + 4)); !ok {
+		t.Error("newest ID evicted")
+	}
+	if !d.claim("expired") {
+		t.Error("an evicted ID is still treated as a duplicate")
+	}
+}
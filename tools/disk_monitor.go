@@ -0,0 +1,67 @@
+package tools
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// diskMonitorInterval is how often StartDiskMonitor checks free space.
+const diskMonitorInterval = 10 * time.Second
+
+// diskStatter reports the bytes available to the agent on the filesystem
+// holding path. It is an interface so the monitor can run against a fake.
+type diskStatter interface {
+	FreeBytes(path string) (uint64, error)
+}
+
+// statfsStatter is the real diskStatter, backed by statfs where available.
+type statfsStatter struct{}
+
+// StartDiskMonitor checks free space on the Pebble directory every 10s.
+// Below DiskFreeThresholdMB it sets diskLow, so SendLog refuses new logs with
+// ResourceExhausted, and logs disk_low; the flag is cleared once space
+// recovers. Free bytes are exported as echopost_disk_free_bytes.
+func (c *ServerConfig) StartDiskMonitor(ctx context.Context, wg *sync.WaitGroup) {
+	c.startDiskMonitor(ctx, wg, statfsStatter{}, diskMonitorInterval)
+}
+
+// startDiskMonitor runs the monitor loop with the given statter and interval.
+func (c *ServerConfig) startDiskMonitor(ctx context.Context, wg *sync.WaitGroup, statter diskStatter, interval time.Duration) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			c.checkDiskFree(statter)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// checkDiskFree updates diskLow and the free-space gauge from one statfs call.
+func (c *ServerConfig) checkDiskFree(statter diskStatter) {
+	free, err := statter.FreeBytes(c.dbPath)
+	if err != nil {
+		LogJsonLevel(LevelError, "disk_stat_error", map[string]any{"error": err.Error(), "path": c.dbPath})
+		return
+	}
+	diskFreeBytes.Set(float64(free))
+
+	low := free < uint64(c.DiskFreeThresholdMB)<<20
+	freeMB := free >> 20
+	if low && !c.diskLow.Load() {
+		c.diskLow.Store(true)
+		LogJsonLevel(LevelWarn, "disk_low", map[string]any{"free_mb": freeMB, "threshold_mb": c.DiskFreeThresholdMB})
+	} else if !low && c.diskLow.Load() {
+		c.diskLow.Store(false)
+		LogJsonLevel(LevelInfo, "disk_recovered", map[string]any{"free_mb": freeMB})
+	}
+}
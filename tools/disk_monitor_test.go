@@ -0,0 +1,113 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeStatter reports free bytes, or err when set, instead of calling statfs.
+type fakeStatter struct {
+	free atomic.Uint64
+	err  atomic.Pointer[error]
+}
+
+func (f *fakeStatter) FreeBytes(string) (uint64, error) {
+	if err := f.err.Load(); err != nil {
+		return 0, *err
+	}
+	return f.free.Load(), nil
+}
+
+func TestDiskMonitorPausesIngestionWhenLow(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.DiskFreeThresholdMB = 100
+	statter := &fakeStatter{}
+	statter.free.Store(500 << 20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	c.startDiskMonitor(ctx, &wg, statter, 10*time.Millisecond)
+	s := &server{config: c}
+	send := func() error {
+		_, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}})
+		return err
+	}
+
+	if !waitFor(time.Second, func() bool { return testutil.ToFloat64(diskFreeBytes) == 500<<20 }) {
+		t.Fatalf("echopost_disk_free_bytes = %v, want 500 MiB", testutil.ToFloat64(diskFreeBytes))
+	}
+	if err := send(); err != nil {
+		t.Fatalf("SendLog with free space: %v", err)
+	}
+
+	statter.free.Store(50 << 20)
+	if !waitFor(time.Second, c.diskLow.Load) {
+		t.Fatal("diskLow not set below the threshold")
+	}
+	if err := send(); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("SendLog on a low disk = %v, want ResourceExhausted", err)
+	}
+	entries := logs.Events("disk_low")
+	if len(entries) != 1 || entries[0]["free_mb"] != float64(50) || entries[0]["threshold_mb"] != float64(100) {
+		t.Errorf("disk_low entries = %v, want one with free_mb 50", entries)
+	}
+
+	statter.free.Store(200 << 20)
+	if !waitFor(time.Second, func() bool { return !c.diskLow.Load() }) {
+		t.Fatal("diskLow not cleared once space recovered")
+	}
+	if err := send(); err != nil {
+		t.Fatalf("SendLog after recovery: %v", err)
+	}
+	if n := len(logs.Events("disk_recovered")); n != 1 {
+		t.Errorf("disk_recovered entries = %d, want 1", n)
+	}
+	if n := len(logs.Events("disk_low")); n != 1 {
+		t.Errorf("disk_low logged %d times, want only on the transition", n)
+	}
+}
+
+func TestDiskMonitorKeepsStateOnStatError(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.DiskFreeThresholdMB = 100
+	statter := &fakeStatter{}
+	statter.free.Store(10 << 20)
+	c.checkDiskFree(statter)
+
+	err := errors.New("statfs: input/output error")
+	statter.err.Store(&err)
+	c.checkDiskFree(statter)
+	if !c.diskLow.Load() {
+		t.Error("a failed stat cleared diskLow")
+	}
+	if n := len(logs.Events("disk_stat_error")); n != 1 {
+		t.Errorf("disk_stat_error entries = %d, want 1", n)
+	}
+}
+
+func TestStatfsStatterReportsFreeSpace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("statfs is not available")
+	}
+	free, err := statfsStatter{}.FreeBytes(t.TempDir())
+	if err != nil || free == 0 {
+		t.Errorf("FreeBytes = %d, %v; want free space", free, err)
+	}
+}
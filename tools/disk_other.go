@@ -0,0 +1,10 @@
+//go:build !unix
+
+package tools
+
+import "errors"
+
+// FreeBytes is not implemented where statfs is unavailable.
+func (statfsStatter) FreeBytes(string) (uint64, error) {
+	return 0, errors.New("disk free space is not supported on this platform")
+}
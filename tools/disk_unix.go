@@ -0,0 +1,14 @@
+//go:build unix
+
+package tools
+
+import "syscall"
+
+// FreeBytes returns the space available to unprivileged users on path's filesystem.
+func (statfsStatter) FreeBytes(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
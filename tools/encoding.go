@@ -0,0 +1,53 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Supported on-disk encodings for records stored in Pebble.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// ValidatePebbleEncoding rejects values of -pebble-encoding other than json or msgpack.
+func ValidatePebbleEncoding(name string) error {
+	switch name {
+	case EncodingJSON, EncodingMsgpack:
+		return nil
+	}
+	return fmt.Errorf("unknown pebble encoding %q (want json or msgpack)", name)
+}
+
+// encodeRecord serializes rec with the configured PebbleEncoding (JSON by default).
+// Msgpack reuses the json struct tags so both encodings carry the same fields.
+func (c *ServerConfig) encodeRecord(rec logRecord) ([]byte, error) {
+	if c.PebbleEncoding != EncodingMsgpack {
+		return json.Marshal(rec)
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(rec); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeRecord reads a stored record in either encoding. JSON records always
+// start with '{', while msgpack maps start with a map header byte, so records
+// written before -pebble-encoding changed remain readable.
+func decodeRecord(data []byte, rec *logRecord) error {
+	if len(data) > 0 && data[0] == '{' {
+		return json.Unmarshal(data, rec)
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(rec)
+}
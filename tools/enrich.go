@@ -0,0 +1,55 @@
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strconv"
+)
+
+// EnrichFunc adds deployment-specific metadata to a record before it is
+// stored. Hooks in ServerConfig.EnrichHooks run in order for every record.
+type EnrichFunc func(rec *logRecord)
+
+// setMetadata sets key in rec.Metadata, creating the map if needed.
+func (rec *logRecord) setMetadata(key, value string) {
+	if rec.Metadata == nil {
+		rec.Metadata = map[string]string{}
+	}
+	rec.Metadata[key] = value
+}
+
+// WithHostname adds the machine's hostname as "hostname". The name is looked
+// up once; if it cannot be determined the hook does nothing.
+func WithHostname() EnrichFunc {
+	hostname, err := os.Hostname()
+	return func(rec *logRecord) {
+		if err == nil {
+			rec.setMetadata("hostname", hostname)
+		}
+	}
+}
+
+// WithPID adds the agent's process ID as "pid".
+func WithPID() EnrichFunc {
+	pid := strconv.Itoa(os.Getpid())
+	return func(rec *logRecord) {
+		rec.setMetadata("pid", pid)
+	}
+}
+
+// WithRandomTraceID adds a random 128-bit hex "trace_id" to each record.
+func WithRandomTraceID() EnrichFunc {
+	return func(rec *logRecord) {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		rec.setMetadata("trace_id", hex.EncodeToString(b[:]))
+	}
+}
+
+// WithStaticField adds the same key/value pair to every record.
+func WithStaticField(key, value string) EnrichFunc {
+	return func(rec *logRecord) {
+		rec.setMetadata(key, value)
+	}
+}
@@ -0,0 +1,83 @@
+package tools
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// storedRecords decodes every record in Pebble, in key order.
+func storedRecords(t *testing.T, c *ServerConfig) []logRecord {
+	t.Helper()
+	var recs []logRecord
+	for _, key := range storedKeys(t, c) {
+		data, err := c.Db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		var rec logRecord
+		if err := decodeRecord(data, &rec); err != nil {
+			t.Fatalf("decode %s: %v", key, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestEnrichHooksRunInOrderBeforeStoring(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	var order []string
+	c.EnrichHooks = []EnrichFunc{
+		func(rec *logRecord) {
+			order = append(order, "custom")
+			rec.setMetadata("test_field", "test_value")
+		},
+		WithStaticField("static_field", "static_value"),
+		func(rec *logRecord) {
+			order = append(order, "last")
+			rec.setMetadata("seen", rec.Metadata["test_field"])
+		},
+	}
+	sendNumbered(t, c, 0, 1)
+
+	recs := storedRecords(t, c)
+	if len(recs) != 1 {
+		t.Fatalf("stored records = %d, want 1", len(recs))
+	}
+	md := recs[0].Metadata
+	if md["test_field"] != "test_value" || md["static_field"] != "static_value" {
+		t.Errorf("stored metadata = %v, want test_field and static_field", md)
+	}
+	if md["seen"] != "test_value" {
+		t.Errorf("the last hook saw test_field = %q, want the earlier hooks to have run first", md["seen"])
+	}
+	if len(order) != 2 || order[0] != "custom" || order[1] != "last" {
+		t.Errorf("hooks ran as %v", order)
+	}
+}
+
+func TestBuiltinEnrichHooks(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.EnrichHooks = []EnrichFunc{WithHostname(), WithPID(), WithRandomTraceID(), WithStaticField("region", "eu-west-1")}
+	sendNumbered(t, c, 0, 2)
+
+	recs := storedRecords(t, c)
+	if len(recs) != 2 {
+		t.Fatalf("stored records = %d, want 2", len(recs))
+	}
+	hostname, _ := os.Hostname()
+	traceID := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	for _, rec := range recs {
+		md := rec.Metadata
+		if md["hostname"] != hostname || md["pid"] != strconv.Itoa(os.Getpid()) || md["region"] != "eu-west-1" {
+			t.Errorf("metadata = %v", md)
+		}
+		if !traceID.MatchString(md["trace_id"]) {
+			t.Errorf("trace_id = %q, want 32 hex digits", md["trace_id"])
+		}
+	}
+	if recs[0].Metadata["trace_id"] == recs[1].Metadata["trace_id"] {
+		t.Error("two records share a trace_id")
+	}
+}
@@ -0,0 +1,90 @@
+package tools
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultErrorSummaryWindow is the aggregation window used when none is configured.
+const DefaultErrorSummaryWindow = 5 * time.Second
+
+// ErrorAggregator counts high-volume error events and emits one
+// error_summary entry per window instead of one line per error.
+type ErrorAggregator struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// errorAggregator is the running aggregator, or nil when errors are logged individually.
+var errorAggregator atomic.Pointer[ErrorAggregator]
+
+// NewErrorAggregator returns an aggregator that summarises every window
+// (DefaultErrorSummaryWindow when window <= 0).
+func NewErrorAggregator(window time.Duration) *ErrorAggregator {
+	if window <= 0 {
+		window = DefaultErrorSummaryWindow
+	}
+	return &ErrorAggregator{window: window, counts: make(map[string]int)}
+}
+
+// StartErrorAggregator installs a as the package aggregator and emits its
+// summary every window. A final summary is emitted when ctx is cancelled,
+// after which errors are logged individually again.
+func StartErrorAggregator(ctx context.Context, wg *sync.WaitGroup, a *ErrorAggregator) {
+	errorAggregator.Store(a)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(a.window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				errorAggregator.CompareAndSwap(a, nil)
+				a.flush()
+				return
+			case <-ticker.C:
+				a.flush()
+			}
+		}
+	}()
+}
+
+// add counts one occurrence of event.
+func (a *ErrorAggregator) add(event string) {
+	a.mu.Lock()
+	a.counts[event]++
+	a.mu.Unlock()
+}
+
+// flush emits error_summary for the events seen since the last flush, if any.
+func (a *ErrorAggregator) flush() {
+	a.mu.Lock()
+	counts := a.counts
+	a.counts = make(map[string]int)
+	a.mu.Unlock()
+
+	if len(counts) == 0 {
+		return
+	}
+	LogJsonLevel(LevelError, "error_summary", map[string]any{
+		"event_counts": counts,
+		"window":       a.window.String(),
+	})
+}
+
+// logAggregatedError logs event, or only counts it while an aggregator is running.
+func logAggregatedError(level LogLevel, event string, fields map[string]any) {
+	if a := errorAggregator.Load(); a != nil {
+		a.add(event)
+		return
+	}
+	LogJsonLevel(level, event, fields)
+}
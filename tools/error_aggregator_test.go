@@ -0,0 +1,100 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestErrorAggregatorEmitsOneSummaryPerWindow(t *testing.T) {
+	logs := CaptureLogs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	StartErrorAggregator(ctx, &wg, NewErrorAggregator(200*time.Millisecond))
+
+	// 100 errors over one second, spread across five windows
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		event := "pebble_write_error"
+		if i%2 == 1 {
+			event = "trigger_post_error"
+		}
+		logAggregatedError(LevelError, event, map[string]any{"error": "boom"})
+		time.Sleep(10 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	cancel()
+	wg.Wait()
+
+	if n := len(logs.Events("pebble_write_error")) + len(logs.Events("trigger_post_error")); n != 0 {
+		t.Fatalf("%d errors were logged individually while aggregating", n)
+	}
+	summaries := logs.Events("error_summary")
+	// One per elapsed window, plus the final summary on shutdown
+	if maxSummaries := int(elapsed/(200*time.Millisecond)) + 1; len(summaries) == 0 || len(summaries) > maxSummaries {
+		t.Fatalf("error_summary entries = %d, want between 1 and %d", len(summaries), maxSummaries)
+	}
+	totals := map[string]float64{}
+	for _, s := range summaries {
+		counts, _ := s["event_counts"].(map[string]any)
+		for event, n := range counts {
+			totals[event] += n.(float64)
+		}
+	}
+	if totals["pebble_write_error"] != 50 || totals["trigger_post_error"] != 50 {
+		t.Errorf("summarised counts = %v, want 50 of each event", totals)
+	}
+}
+
+func TestErrorAggregatorSkipsEmptyWindows(t *testing.T) {
+	logs := CaptureLogs(t)
+	a := NewErrorAggregator(0)
+	if a.window != DefaultErrorSummaryWindow {
+		t.Errorf("window = %v, want the %v default", a.window, DefaultErrorSummaryWindow)
+	}
+	a.flush()
+	if n := len(logs.Events("error_summary")); n != 0 {
+		t.Errorf("error_summary emitted for an empty window")
+	}
+}
+
+func TestHealthCheckErrorsAreAggregated(t *testing.T) {
+	logs := CaptureLogs(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close() // every check fails to connect
+	c := &ServerConfig{ServerHost: srv.URL}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	StartErrorAggregator(ctx, &wg, NewErrorAggregator(time.Hour))
+	client := c.NewHTTPClient(time.Second)
+	for i := 0; i < 3; i++ {
+		c.IsHealthSuccess(client)
+	}
+	cancel()
+	wg.Wait()
+
+	if n := len(logs.Events("health_check_error")); n != 0 {
+		t.Errorf("health_check_error logged %d times while aggregating", n)
+	}
+	summaries := logs.Events("error_summary")
+	if len(summaries) != 1 {
+		t.Fatalf("error_summary entries = %d, want the one final summary", len(summaries))
+	}
+	if counts, _ := summaries[0]["event_counts"].(map[string]any); counts["health_check_error"] != float64(3) {
+		t.Errorf("event_counts = %v, want 3 health_check_error", summaries[0]["event_counts"])
+	}
+
+	// Once stopped, errors are logged individually again
+	c.IsHealthSuccess(client)
+	if n := len(logs.Events("health_check_error")); n != 1 {
+		t.Errorf("health_check_error after the aggregator stopped = %d, want 1", n)
+	}
+}
@@ -0,0 +1,135 @@
+package tools
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+	flow "github.com/datanadhi/flowhttp/client"
+)
+
+// defaultFallbackBufferSize is used when InMemoryFallback is set without a size.
+const defaultFallbackBufferSize = 10000
+
+// fallbackEntry is a record that could not be written to Pebble.
+type fallbackEntry struct {
+	key []byte
+	rec logRecord
+}
+
+// fallbackBuffer holds records in memory while Pebble writes fail (e.g. disk
+// full). It is bounded: once full, the oldest record is dropped for each new one.
+// The zero value is ready to use.
+type fallbackBuffer struct {
+	mu      sync.Mutex
+	entries []fallbackEntry
+}
+
+// push appends e, dropping the oldest entries beyond size. It returns the number dropped.
+func (b *fallbackBuffer) push(e fallbackEntry, size int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = append(b.entries, e)
+	return b.trim(size)
+}
+
+// takeAll removes and returns every buffered entry, oldest first.
+func (b *fallbackBuffer) takeAll() []fallbackEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := b.entries
+	b.entries = nil
+	return entries
+}
+
+// requeue puts entries back in front of anything buffered since takeAll.
+func (b *fallbackBuffer) requeue(entries []fallbackEntry, size int) {
+	if len(entries) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = append(append([]fallbackEntry{}, entries...), b.entries...)
+	b.trim(size)
+}
+
+// trim drops the oldest entries beyond size. The caller must hold mu.
+func (b *fallbackBuffer) trim(size int) int {
+	dropped := len(b.entries) - size
+	if dropped <= 0 {
+		return 0
+	}
+	b.entries = append([]fallbackEntry{}, b.entries[dropped:]...)
+	return dropped
+}
+
+// len returns the number of buffered entries.
+func (b *fallbackBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// fallbackSize returns the configured buffer bound.
+func (c *ServerConfig) fallbackSize() int {
+	if c.FallbackBufferSize > 0 {
+		return c.FallbackBufferSize
+	}
+	return defaultFallbackBufferSize
+}
+
+// FallbackBufferLen returns the number of records held in memory because
+// Pebble writes failed.
+func (c *ServerConfig) FallbackBufferLen() int {
+	return c.fallback.len()
+}
+
+// bufferInMemory keeps a record whose Pebble write failed.
+func (c *ServerConfig) bufferInMemory(key []byte, rec logRecord, writeErr error) {
+	dropped := c.fallback.push(fallbackEntry{key: key, rec: rec}, c.fallbackSize())
+	c.stats.dropped.Add(int64(dropped))
+	LogJsonLevel(LevelWarn, "pebble_fallback_write", map[string]any{
+		"error":          writeErr.Error(),
+		"buffered":       c.fallback.len(),
+		"dropped_oldest": dropped,
+	})
+}
+
+// retryFallbackWrites moves buffered records back into Pebble, stopping at the
+// first write that still fails.
+func (c *ServerConfig) retryFallbackWrites() {
+	entries := c.fallback.takeAll()
+	for i, e := range entries {
+		data, err := c.encodeRecord(e.rec)
+		if err == nil {
+			err = c.Db.Set(e.key, data, pebble.NoSync)
+		}
+		if err != nil {
+			c.fallback.requeue(entries[i:], c.fallbackSize())
+			if i > 0 {
+				LogJsonLevel(LevelInfo, "pebble_fallback_recovered", map[string]any{"count": i})
+			}
+			return
+		}
+		c.recordsStored(1)
+	}
+	if len(entries) > 0 {
+		LogJsonLevel(LevelInfo, "pebble_fallback_recovered", map[string]any{"count": len(entries)})
+	}
+}
+
+// drainFallback uploads buffered records before Pebble is processed.
+// Records that are not confirmed stay buffered.
+func (c *ServerConfig) drainFallback(client *flow.Client) error {
+	entries := c.fallback.takeAll()
+	for i := range entries {
+		remove, err := c.sendToServer(&entries[i].rec, client)
+		if err != nil {
+			c.fallback.requeue(entries[i:], c.fallbackSize())
+			return err
+		}
+		if !remove {
+			c.fallback.requeue(entries[i:i+1], c.fallbackSize())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// errDiskFull stands in for the ENOSPC a full disk returns.
+var errDiskFull = errors.New("write wal: no space left on device")
+
+// diskFullDB fails every Set while full is true, like Pebble on a full disk.
+type diskFullDB struct {
+	PebbleDB
+	full *atomic.Bool
+}
+
+func (d diskFullDB) Set(key, value []byte, opts *pebble.WriteOptions) error {
+	if d.full.Load() {
+		return errDiskFull
+	}
+	return d.PebbleDB.Set(key, value, opts)
+}
+
+// newFullDiskConfig returns an agent with InMemoryFallback set whose Pebble
+// writes fail until the returned flag is cleared.
+func newFullDiskConfig(t *testing.T, serverHost string, bufferSize int) (*ServerConfig, *atomic.Bool) {
+	t.Helper()
+	c := newTestConfig(t, serverHost)
+	c.InMemoryFallback = true
+	c.FallbackBufferSize = bufferSize
+	full := &atomic.Bool{}
+	full.Store(true)
+	c.Db.Wrap(func(db PebbleDB) PebbleDB { return diskFullDB{db, full} })
+	return c, full
+}
+
+func sendNumbered(t *testing.T, c *ServerConfig, from, to int) []*pb.LogResponse {
+	t.Helper()
+	s := &server{config: c}
+	var resps []*pb.LogResponse
+	for i := from; i < to; i++ {
+		resp, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: fmt.Sprintf(`{"n":%d}`, i), Pipelines: []string{"p1"}})
+		if err != nil {
+			t.Fatalf("SendLog %d: %v", i, err)
+		}
+		resps = append(resps, resp)
+	}
+	return resps
+}
+
+func TestFallbackBuffersWritesOnFullDisk(t *testing.T) {
+	logs := CaptureLogs(t)
+	upload := newUploadCapture(t, http.StatusOK)
+	c, _ := newFullDiskConfig(t, upload.URL, 3)
+
+	for _, resp := range sendNumbered(t, c, 0, 5) {
+		if !resp.Success || resp.Message != "buffered_in_memory" {
+			t.Fatalf("SendLog on a full disk = %+v, want buffered_in_memory", resp)
+		}
+	}
+	if got := c.FallbackBufferLen(); got != 3 {
+		t.Fatalf("FallbackBufferLen = %d, want the bound of 3", got)
+	}
+	if !PebbleIsEmpty(c.Db) {
+		t.Fatal("records reached Pebble on a full disk")
+	}
+	writes := logs.Events("pebble_fallback_write")
+	if len(writes) != 5 || writes[3]["dropped_oldest"] != float64(1) {
+		t.Errorf("pebble_fallback_write entries = %v, want 5 with the oldest dropped past 3", writes)
+	}
+
+	// The buffer is uploaded before Pebble, oldest surviving record first
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	var got []any
+	for _, data := range upload.logData() {
+		got = append(got, data["n"])
+	}
+	if want := []any{float64(2), float64(3), float64(4)}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("uploaded records = %v, want %v", got, want)
+	}
+	if c.FallbackBufferLen() != 0 {
+		t.Errorf("FallbackBufferLen after upload = %d, want 0", c.FallbackBufferLen())
+	}
+}
+
+func TestFallbackKeepsRecordsWhenUploadFails(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusServiceUnavailable)
+	c, _ := newFullDiskConfig(t, upload.URL, 10)
+	sendNumbered(t, c, 0, 2)
+
+	_ = c.ProcessPebble(context.Background())
+	if got := c.FallbackBufferLen(); got != 2 {
+		t.Errorf("FallbackBufferLen after a failed upload = %d, want 2", got)
+	}
+	if !c.hasPendingRecords() {
+		t.Error("buffered records are not reported as pending")
+	}
+}
+
+func TestFallbackMovesToPebbleOnceDiskRecovers(t *testing.T) {
+	c, full := newFullDiskConfig(t, "http://unused.invalid", 10)
+	sendNumbered(t, c, 0, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	c.FlushPebbleDBOnInterval(ctx, &wg)
+
+	// Still full: the flusher retries but nothing moves
+	time.Sleep(1200 * time.Millisecond)
+	if got := c.FallbackBufferLen(); got != 4 {
+		t.Fatalf("FallbackBufferLen while the disk is full = %d, want 4", got)
+	}
+
+	full.Store(false)
+	if !waitFor(3*time.Second, func() bool { return c.FallbackBufferLen() == 0 }) {
+		t.Fatalf("FallbackBufferLen = %d after the disk recovered, want 0", c.FallbackBufferLen())
+	}
+	if keys := storedKeys(t, c); len(keys) != 4 {
+		t.Errorf("records in Pebble = %d, want 4", len(keys))
+	}
+	if c.RecordCount() != 4 {
+		t.Errorf("RecordCount = %d, want 4", c.RecordCount())
+	}
+}
+
+func TestAdminStatusReportsFallbackBuffer(t *testing.T) {
+	c, _ := newFullDiskConfig(t, "http://unused.invalid", 10)
+	sendNumbered(t, c, 0, 3)
+
+	rec := httptest.NewRecorder()
+	c.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode /status: %v", err)
+	}
+	if status["fallback_buffer_len"] != float64(3) {
+		t.Errorf("/status fallback_buffer_len = %v, want 3", status["fallback_buffer_len"])
+	}
+}
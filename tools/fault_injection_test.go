@@ -0,0 +1,102 @@
+package tools_test
+
+import (
+	"errors"
+	"testing"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+// startFaultyAgent starts a harness agent with a FaultInjectingDB in front of Pebble.
+func startFaultyAgent(t *testing.T) (*testharness.AgentHandle, *tools.FaultInjectingDB) {
+	t.Helper()
+	var faults *tools.FaultInjectingDB
+	agent := startAgent(t, testharness.Options{
+		WrapDB: func(db tools.PebbleDB) tools.PebbleDB {
+			faults = tools.NewFaultInjectingDB(db)
+			return faults
+		},
+	})
+	return agent, faults
+}
+
+func TestSendLogSetErrorIsReported(t *testing.T) {
+	agent, faults := startFaultyAgent(t)
+
+	faults.InjectSetError()
+	resp, err := agent.SendLog(&pb.LogRequest{JsonData: `{"msg":"lost"}`, Pipelines: []string{"p1"}})
+	if err != nil {
+		t.Fatalf("SendLog: %v", err)
+	}
+	if resp.Success || resp.Message != "Db write failed" {
+		t.Fatalf("response = %+v, want a failed write", resp)
+	}
+
+	// The fault is one-shot: the next write is stored
+	resp, err = agent.SendLog(&pb.LogRequest{JsonData: `{"msg":"kept"}`, Pipelines: []string{"p1"}})
+	if err != nil || !resp.Success {
+		t.Fatalf("SendLog after fault = %+v, %v", resp, err)
+	}
+	if n := agent.RecordCount(); n != 1 {
+		t.Fatalf("records = %d, want 1", n)
+	}
+}
+
+func TestProcessPebbleIterErrorKeepsRecords(t *testing.T) {
+	agent, faults := startFaultyAgent(t)
+	sendLogs(t, agent, 3, "p1")
+
+	faults.InjectIterError()
+	if err := agent.Drain(); !errors.Is(err, tools.ErrInjected) {
+		t.Fatalf("Drain error = %v, want ErrInjected", err)
+	}
+	if n := agent.RecordCount(); n != 3 {
+		t.Fatalf("records after failed drain = %d, want 3", n)
+	}
+	if n := len(agent.CapturedServerRequests()); n != 0 {
+		t.Fatalf("server requests after failed drain = %d, want 0", n)
+	}
+
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if n := agent.RecordCount(); n != 0 {
+		t.Fatalf("records after drain = %d, want 0", n)
+	}
+}
+
+func TestFlushErrorDoesNotLoseRecords(t *testing.T) {
+	logs := tools.CaptureLogs(t)
+	agent, faults := startFaultyAgent(t)
+	sendLogs(t, agent, 5, "p1")
+
+	faults.InjectFlushError()
+	tools.FlushPebbleDB(agent.Config.Db)
+	if n := len(logs.Events("pebble_flush_error")); n != 1 {
+		t.Fatalf("pebble_flush_error entries = %d, want 1", n)
+	}
+
+	// The fault is one-shot: flush again, then reopen the DB from disk so
+	// only what Pebble persisted is counted, not the memtable
+	tools.FlushPebbleDB(agent.Config.Db)
+	agent.Shutdown()
+	reopened := startAgent(t, testharness.Options{Dir: agent.Dir()})
+	if n := reopened.RecordCount(); n != 5 {
+		t.Fatalf("records after reopening = %d, want 5", n)
+	}
+
+	if err := reopened.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	seen := map[any]bool{}
+	for _, body := range uploadedBodies(t, reopened) {
+		seen[body.LogData["n"]] = true
+	}
+	for i := 0; i < 5; i++ {
+		if !seen[float64(i)] {
+			t.Errorf("record %d was not uploaded after the failed flush", i)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlushAndWaitDrainsPebble(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	sendNumbered(t, c, 0, 20)
+
+	if err := c.FlushAndWait(context.Background(), 5*time.Second); err != nil {
+		t.Fatalf("FlushAndWait: %v", err)
+	}
+	if !PebbleIsEmpty(c.Db) {
+		t.Error("Pebble not empty after FlushAndWait returned")
+	}
+	if n := len(upload.logData()); n != 20 {
+		t.Errorf("uploads = %d, want 20", n)
+	}
+}
+
+func TestFlushAndWaitRetriesTransientFailures(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	c := newTestConfig(t, srv.URL)
+	sendNumbered(t, c, 0, 5)
+
+	if err := c.FlushAndWait(context.Background(), 5*time.Second); err != nil {
+		t.Fatalf("FlushAndWait after 3 failed uploads: %v", err)
+	}
+	if !PebbleIsEmpty(c.Db) {
+		t.Error("Pebble not empty after FlushAndWait returned")
+	}
+}
+
+func TestFlushAndWaitTimesOut(t *testing.T) {
+	logs := CaptureLogs(t)
+	upload := newUploadCapture(t, http.StatusServiceUnavailable)
+	c := newTestConfig(t, upload.URL)
+	sendNumbered(t, c, 0, 3)
+
+	start := time.Now()
+	err := c.FlushAndWait(context.Background(), 500*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("FlushAndWait against a failing server = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("FlushAndWait returned after %v, want close to the 500ms timeout", elapsed)
+	}
+	if n := len(storedKeys(t, c)); n != 3 {
+		t.Errorf("records after the timeout = %d, want 3 kept", n)
+	}
+	if e := logs.Events("flush_and_wait_timeout"); len(e) != 1 || e[0]["record_count"] != float64(3) {
+		t.Errorf("flush_and_wait_timeout entries = %v", e)
+	}
+}
+
+func TestAdminFlushAndWait(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int // upload server status
+		query  string
+		want   int
+	}{
+		{"drained", http.StatusOK, "?timeout=5s", http.StatusOK},
+		{"default timeout", http.StatusOK, "", http.StatusOK},
+		{"timeout", http.StatusServiceUnavailable, "?timeout=300ms", http.StatusGatewayTimeout},
+		{"bad timeout", http.StatusOK, "?timeout=soon", http.StatusBadRequest},
+		{"negative timeout", http.StatusOK, "?timeout=-1s", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(t, newUploadCapture(t, tt.status).URL)
+			sendNumbered(t, c, 0, 2)
+
+			rec := httptest.NewRecorder()
+			c.handleFlushAndWait(rec, httptest.NewRequest(http.MethodPost, "/flush-and-wait"+tt.query, nil))
+			if rec.Code != tt.want {
+				t.Fatalf("POST /flush-and-wait%s = %d, want %d (%s)", tt.query, rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusBadRequest {
+				return
+			}
+			var body map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			drained := tt.want == http.StatusOK
+			wantCount := float64(2)
+			if drained {
+				wantCount = 0
+			}
+			if body["flushed"] != drained || body["record_count"] != wantCount {
+				t.Errorf("response = %v, want flushed %v and record_count %v", body, drained, wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package tools_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+// sendLogBenchCalls is the number of SendLog calls per benchmark iteration.
+const sendLogBenchCalls = 10_000
+
+// BenchmarkSendLog10k sends 10,000 SendLog calls over the Unix socket per
+// iteration and reports the per-call latency percentiles seen by the client.
+func BenchmarkSendLog10k(b *testing.B) {
+	agent := testharness.StartTestAgent(b, testharness.Options{})
+	req := &pb.LogRequest{JsonData: `{"msg":"benchmark","level":"INFO"}`, Pipelines: []string{"bench"}}
+
+	latencies := make([]time.Duration, 0, sendLogBenchCalls)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		latencies = latencies[:0]
+		for j := 0; j < sendLogBenchCalls; j++ {
+			start := time.Now()
+			if _, err := agent.SendLog(req); err != nil {
+				b.Fatalf("SendLog: %v", err)
+			}
+			latencies = append(latencies, time.Since(start))
+		}
+	}
+	b.StopTimer()
+
+	slices.Sort(latencies)
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*sendLogBenchCalls), "ns/call")
+	b.ReportMetric(float64(latencies[len(latencies)/2].Microseconds()), "p50-µs")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-µs")
+}
@@ -0,0 +1,137 @@
+package tools_test
+
+import (
+	"strings"
+	"testing"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// jsonOfSize returns a JSON object exactly n bytes long (n >= 8).
+func jsonOfSize(n int) string {
+	return `{"m":"` + strings.Repeat("a", n-8) + `"}`
+}
+
+func TestMaxPayloadBytesBoundary(t *testing.T) {
+	const limit = 100
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.MaxPayloadBytes = limit },
+	})
+
+	tests := []struct {
+		size int
+		code codes.Code
+	}{
+		{size: limit - 1, code: codes.OK},
+		{size: limit, code: codes.OK},
+		{size: limit + 1, code: codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		_, err := agent.SendLog(&pb.LogRequest{JsonData: jsonOfSize(tt.size), Pipelines: []string{"p1"}})
+		if got := status.Code(err); got != tt.code {
+			t.Errorf("json_data of %d bytes: code = %v, want %v (err %v)", tt.size, got, tt.code, err)
+		}
+	}
+	if n := agent.RecordCount(); n != 2 {
+		t.Errorf("records = %d, want 2", n)
+	}
+}
+
+func TestMaxPayloadBytesEnforcedByTransport(t *testing.T) {
+	const limit = 100
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.MaxPayloadBytes = limit },
+	})
+	logs := tools.CaptureLogs(t)
+
+	// Both messages are past the transport limit (limit plus 64 KiB of
+	// headroom); the second one only because of a field other than json_data
+	oversized := []*pb.LogRequest{
+		{JsonData: jsonOfSize(128 << 10), Pipelines: []string{"p1"}},
+		{JsonData: jsonOfSize(limit), Pipelines: []string{strings.Repeat("p", 128<<10)}},
+	}
+	for i, req := range oversized {
+		_, err := agent.SendLog(req)
+		if status.Code(err) != codes.ResourceExhausted || !strings.Contains(err.Error(), "larger than max") {
+			t.Errorf("message %d: err = %v, want ResourceExhausted from the gRPC transport", i, err)
+		}
+	}
+	// The interceptor never saw them: gRPC refused them before unmarshalling
+	if n := len(logs.Events("payload_too_large")); n != 0 {
+		t.Errorf("payload_too_large entries = %d, want 0", n)
+	}
+	if n := agent.RecordCount(); n != 0 {
+		t.Errorf("records = %d, want 0", n)
+	}
+}
+
+func TestMaxPayloadBytesInStream(t *testing.T) {
+	const limit = 100
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.MaxPayloadBytes = limit },
+	})
+	resp, err := agent.StreamLogs([]*pb.LogRequest{
+		{JsonData: jsonOfSize(limit), Pipelines: []string{"p1"}},
+		{JsonData: jsonOfSize(limit + 1), Pipelines: []string{"p1"}},
+		{JsonData: jsonOfSize(8), Pipelines: []string{"p1"}},
+	})
+	if err != nil {
+		t.Fatalf("StreamLogs: %v", err)
+	}
+	if resp.ReceivedCount != 3 || resp.FailedCount != 1 {
+		t.Errorf("stream summary = %+v, want 3 received and 1 failed", resp)
+	}
+	if n := agent.RecordCount(); n != 2 {
+		t.Errorf("records = %d, want 2", n)
+	}
+}
+
+func TestSendLogPipelineLimits(t *testing.T) {
+	logs := tools.CaptureLogs(t)
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.MaxPipelinesPerRequest = 3 },
+	})
+
+	for _, tc := range []struct {
+		pipelines []string
+		wantMsg   string // empty when the request is accepted
+	}{
+		{[]string{"a", "b", "c"}, ""},
+		{[]string{"a", "b", "c", "d"}, "too_many_pipelines"},
+		{nil, "no_pipelines"},
+	} {
+		_, err := agent.SendLog(&pb.LogRequest{JsonData: `{}`, Pipelines: tc.pipelines})
+		if tc.wantMsg == "" {
+			if err != nil {
+				t.Errorf("SendLog with %d pipelines: %v", len(tc.pipelines), err)
+			}
+			continue
+		}
+		if st := status.Convert(err); st.Code() != codes.InvalidArgument || st.Message() != tc.wantMsg {
+			t.Errorf("SendLog with %d pipelines = %v, want InvalidArgument %s", len(tc.pipelines), err, tc.wantMsg)
+		}
+	}
+
+	entries := logs.Events("too_many_pipelines")
+	if len(entries) != 1 {
+		t.Fatalf("too_many_pipelines entries = %d, want 1", len(entries))
+	}
+	e := entries[0]
+	if e["pipeline_count"] != float64(4) || e["limit"] != float64(3) {
+		t.Errorf("too_many_pipelines = %v, want pipeline_count 4 and limit 3", e)
+	}
+	if ua, _ := e["user_agent"].(string); !strings.HasPrefix(ua, "grpc-go/") {
+		t.Errorf("too_many_pipelines user_agent = %q, want the client's", ua)
+	}
+	if _, ok := e["peer"]; !ok {
+		t.Errorf("too_many_pipelines lacks the peer address: %v", e)
+	}
+	if n := agent.RecordCount(); n != 1 {
+		t.Errorf("stored records = %d, want only the accepted one", n)
+	}
+}
@@ -5,47 +5,115 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	pb "github.com/datanadhi/echopost/logagentpb"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 )
 
+// grpcKeepaliveMinTime is the shortest client keepalive ping interval
+// accepted; clients pinging more often are disconnected.
+const grpcKeepaliveMinTime = 10 * time.Second
+
+// grpcEnvelopeBytes is added to MaxPayloadBytes for the transport limit, to
+// leave room for pipelines, the API key and other fields besides json_data.
+const grpcEnvelopeBytes = 64 << 10
+
 // server implements the gRPC LogAgent service.
 // Each agent runs a local gRPC server that receives logs from SDKs
 // and writes them into Pebble for temporary storage.
 type server struct {
 	pb.UnimplementedLogAgentServer
 	config *ServerConfig
+	// stopping is closed when the gRPC server shuts down, to end the Connect
+	// streams GracefulStop would otherwise wait for (nil outside StartGRPCServer)
+	stopping <-chan struct{}
+}
+
+// unaryInterceptors returns the interceptors run, in order, around every unary
+// call: on the gRPC server and for requests to the HTTP ingest server.
+func (c *ServerConfig) unaryInterceptors() []grpc.UnaryServerInterceptor {
+	interceptors := []grpc.UnaryServerInterceptor{recoveryInterceptor, loggingInterceptor}
+	if c.MaxPayloadBytes > 0 {
+		interceptors = append(interceptors, payloadSizeInterceptor(c.MaxPayloadBytes))
+	}
+	if c.DefaultRPCDeadline > 0 {
+		interceptors = append(interceptors, deadlineInterceptor(c.DefaultRPCDeadline))
+	}
+	return interceptors
+}
+
+// streamInterceptors returns the interceptors run, in order, around every
+// streaming call. Payload size is checked per message inside StreamLogs.
+func (c *ServerConfig) streamInterceptors() []grpc.StreamServerInterceptor {
+	return []grpc.StreamServerInterceptor{streamRecoveryInterceptor, streamLoggingInterceptor}
 }
 
 // StartGRPCServer starts a local gRPC server bound to a Unix socket.
 // It listens for log messages sent by SDKs or client applications.
 // The server is gracefully stopped when the provided context is cancelled.
+// With SocketAbstract on Linux the socket lives in the abstract namespace,
+// so there is no file to clean up or chmod.
 func (c *ServerConfig) StartGRPCServer(ctx context.Context, wg *sync.WaitGroup) error {
-	// Clean up any stale socket file before binding
-	_ = os.Remove(c.SocketPath)
+	addr := c.SocketPath
+	if c.abstractSocket() {
+		addr = "\x00" + c.SocketPath
+	} else {
+		if c.SocketAbstract {
+			LogJsonLevel(LevelWarn, "socket_abstract_unsupported", map[string]any{"socket": c.SocketPath})
+		}
+		// Clean up any stale socket file before binding
+		_ = os.Remove(c.SocketPath)
+	}
 
 	// Start Unix socket listener
-	lis, err := net.Listen("unix", c.SocketPath)
+	lis, err := net.Listen("unix", addr)
 	if err != nil {
-		LogJson("grpc_listen_error", map[string]any{"error": err.Error()})
+		LogJsonLevel(LevelError, "grpc_listen_error", map[string]any{"error": err.Error()})
 		return err
 	}
 
 	// Ensure socket is world-accessible (SDKs may run as different users)
-	_ = os.Chmod(c.SocketPath, 0777)
+	if !c.abstractSocket() {
+		_ = os.Chmod(c.SocketPath, 0777)
+	}
 
 	// Create and register the gRPC server
-	s := grpc.NewServer()
-	pb.RegisterLogAgentServer(s, &server{config: c})
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(connStatsHandler{warnAt: int64(c.MaxGRPCConnectionsWarn)}),
+		// Ping idle connections so crashed SDK clients are dropped; zero
+		// values keep gRPC's defaults
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:             c.GRPCKeepaliveTime,
+			Timeout:          c.GRPCKeepaliveTimeout,
+			MaxConnectionAge: c.GRPCMaxConnectionAge,
+		}),
+		// Let SDKs send their own keepalive pings, even between calls
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             grpcKeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+	}
+	if c.MaxPayloadBytes > 0 {
+		// Two layers: the transport refuses oversized messages before they are
+		// unmarshalled, and the interceptor enforces the exact json_data limit
+		opts = append(opts, grpc.MaxRecvMsgSize(c.MaxPayloadBytes+grpcEnvelopeBytes))
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(c.unaryInterceptors()...),
+		grpc.ChainStreamInterceptor(c.streamInterceptors()...),
+	)
+	s := grpc.NewServer(opts...)
+	pb.RegisterLogAgentServer(s, &server{config: c, stopping: ctx.Done()})
 
 	// Start serving gRPC requests in a background goroutine
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		if err := s.Serve(lis); err != nil {
-			LogJson("grpc_server_error", map[string]any{"error": err.Error()})
+			LogJsonLevel(LevelError, "grpc_server_error", map[string]any{"error": err.Error()})
 		}
 	}()
 
@@ -54,11 +122,25 @@ func (c *ServerConfig) StartGRPCServer(ctx context.Context, wg *sync.WaitGroup)
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
-		LogJson("grpc_server_stopping", nil)
+		LogJsonLevel(LevelInfo, "grpc_server_stopping", nil)
 		s.GracefulStop()
 		_ = lis.Close()
-		LogJson("grpc_server_stopped", nil)
+		LogJsonLevel(LevelInfo, "grpc_server_stopped", nil)
 	}()
 
 	return nil
 }
+
+// abstractSocket reports whether the gRPC socket is bound in the Linux
+// abstract namespace. SocketAbstract is ignored on other platforms.
+func (c *ServerConfig) abstractSocket() bool {
+	return c.SocketAbstract && abstractSocketSupported
+}
+
+// SocketTarget returns the gRPC dial target for the agent's socket.
+func (c *ServerConfig) SocketTarget() string {
+	if c.abstractSocket() {
+		return "unix-abstract:" + c.SocketPath
+	}
+	return "unix:" + c.SocketPath
+}
@@ -0,0 +1,146 @@
+package tools_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+)
+
+func TestBackgroundGoroutinesExitOnCancel(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+
+	resp, err := agent.SendLog(&pb.LogRequest{JsonData: `{"msg":"hi"}`, Pipelines: []string{"p1"}})
+	if err != nil || !resp.Success {
+		t.Fatalf("SendLog = %+v, %v", resp, err)
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if n := agent.RecordCount(); n != 0 {
+		t.Fatalf("records after drain = %d, want 0", n)
+	}
+
+	// startAgent checks that the gRPC server, admin socket and flusher
+	// goroutines are gone once the agent stops
+	agent.Shutdown()
+	select {
+	case <-agent.Done():
+	default:
+		t.Fatal("agent not stopped after Shutdown")
+	}
+}
+
+func TestKeepaliveClosesUnresponsiveClient(t *testing.T) {
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) {
+			c.GRPCKeepaliveTime = time.Second // gRPC's floor for server pings
+			c.GRPCKeepaliveTimeout = 500 * time.Millisecond
+		},
+	})
+	c := agent.Config
+
+	// A client that completes the HTTP/2 handshake and then goes silent,
+	// like a crashed SDK whose socket stays open: server pings are never
+	// answered
+	conn, err := net.Dial("unix", c.SocketPath)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatalf("write preface: %v", err)
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatalf("write settings: %v", err)
+	}
+	silentSince := time.Now()
+
+	pings := 0
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			break
+		}
+		switch f := f.(type) {
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				pings++
+			}
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err := framer.WriteSettingsAck(); err != nil {
+					t.Fatalf("ack settings: %v", err)
+				}
+			}
+		}
+	}
+
+	closedAfter := time.Since(silentSince)
+	if pings == 0 {
+		t.Error("the server closed the connection without sending a keepalive ping")
+	}
+	if limit := c.GRPCKeepaliveTime + 2*c.GRPCKeepaliveTimeout; closedAfter > limit {
+		t.Errorf("connection closed %v after the client went silent, want within %v", closedAfter, limit)
+	}
+	if closedAfter < c.GRPCKeepaliveTime {
+		t.Errorf("connection closed after %v, before the first keepalive ping was due", closedAfter)
+	}
+}
+
+func TestGRPCActiveConnectionsGauge(t *testing.T) {
+	logs := tools.CaptureLogs(t)
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.MaxGRPCConnectionsWarn = 3 },
+	})
+	// The harness keeps one connection; open it before taking the baseline
+	if _, err := agent.SendLog(&pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}}); err != nil {
+		t.Fatalf("SendLog: %v", err)
+	}
+	const gauge = "echopost_grpc_active_connections"
+	base := tools.MetricValue(t, gauge)
+
+	var conns []*grpc.ClientConn
+	for i := 0; i < 4; i++ {
+		conn, err := agent.Dial()
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		conns = append(conns, conn)
+		// Clients connect lazily: one call opens the connection
+		if _, err := pb.NewLogAgentClient(conn).SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}}); err != nil {
+			t.Fatalf("SendLog on connection %d: %v", i, err)
+		}
+	}
+	if got := tools.MetricValue(t, gauge) - base; got != 4 {
+		t.Fatalf("%s grew by %v, want 4", gauge, got)
+	}
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for tools.MetricValue(t, gauge) != base && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := tools.MetricValue(t, gauge) - base; got != 0 {
+		t.Fatalf("%s = %v above the baseline after closing, want 0", gauge, got)
+	}
+
+	// Only transitions above the threshold of 3 are logged
+	if n := len(logs.Events("grpc_connection_opened")); n != 2 {
+		t.Errorf("grpc_connection_opened entries = %d, want 2 (the 4th and 5th)", n)
+	}
+	if n := len(logs.Events("grpc_connection_closed")); n != 2 {
+		t.Errorf("grpc_connection_closed entries = %d, want 2 (down to 4 and 3)", n)
+	}
+}
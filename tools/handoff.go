@@ -0,0 +1,170 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Handoff timing. The old agent's record count must stay unchanged for
+// handoffStableSamples polls in a row before it is asked to shut down.
+const (
+	handoffPollInterval  = 500 * time.Millisecond
+	handoffStableSamples = 3
+	handoffTimeout       = 30 * time.Second
+)
+
+// HandoffFrom takes over from an older agent that uses the same base directory,
+// reached through its admin server at adminAddr (host:port). The old agent is
+// paused, left to settle until its record count is stable, then asked to shut
+// down. HandoffFrom returns once the old agent has released its lock on
+// baseDir, so records still in Pebble are picked up when this agent opens the
+// same DB.
+func HandoffFrom(ctx context.Context, adminAddr, baseDir string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return handoff(ctx, client, "http://"+adminAddr, adminAddr, baseDir)
+}
+
+// HandoffFromSocket is HandoffFrom for an older agent found by its gRPC socket
+// path: the admin endpoints are reached on AdminSocketPath(socketPath), which
+// every agent serves, so the old agent needs no -admin-port.
+func HandoffFromSocket(ctx context.Context, socketPath, baseDir string) error {
+	adminSocket := AdminSocketPath(socketPath)
+	var dialer net.Dialer
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", adminSocket)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	// The host is ignored; every request goes to the admin socket
+	return handoff(ctx, client, "http://localhost", adminSocket, baseDir)
+}
+
+// handoff pauses, drains and stops the old agent whose admin endpoints are at
+// base, then waits for it to release baseDir. from names the old agent in logs.
+func handoff(ctx context.Context, client *http.Client, base, from, baseDir string) error {
+	ctx, cancel := context.WithTimeout(ctx, handoffTimeout)
+	defer cancel()
+
+	if err := adminPost(ctx, client, base+"/pause"); err != nil {
+		return fmt.Errorf("pause old agent: %w", err)
+	}
+	LogJsonLevel(LevelInfo, "handoff_paused", map[string]any{"admin": from})
+
+	count, err := waitForStableRecordCount(ctx, client, base+"/status")
+	if err != nil {
+		return fmt.Errorf("wait for old agent to settle: %w", err)
+	}
+
+	if err := adminPost(ctx, client, base+"/shutdown"); err != nil {
+		return fmt.Errorf("shut down old agent: %w", err)
+	}
+	LogJsonLevel(LevelInfo, "handoff_shutdown_requested", map[string]any{"admin": from, "record_count": count})
+
+	if err := waitForAgentExit(ctx, baseDir); err != nil {
+		return fmt.Errorf("wait for old agent to exit: %w", err)
+	}
+	LogJsonLevel(LevelInfo, "handoff_complete", map[string]any{"admin": from, "record_count": count})
+	return nil
+}
+
+// waitForAgentExit polls baseDir/agent.lock until the old agent has closed its
+// files and released the lock.
+func waitForAgentExit(ctx context.Context, baseDir string) error {
+	f, err := os.OpenFile(filepath.Join(baseDir, "agent.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		err := lockFile(f)
+		if err == nil {
+			return unlockFile(f)
+		}
+		if !errors.Is(err, ErrAgentAlreadyRunning) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(handoffPollInterval):
+		}
+	}
+}
+
+// waitForStableRecordCount polls the old agent's /status until record_count
+// has not changed for handoffStableSamples polls, and returns it.
+func waitForStableRecordCount(ctx context.Context, client *http.Client, url string) (int64, error) {
+	var last int64 = -1
+	stable := 0
+	for {
+		count, err := fetchRecordCount(ctx, client, url)
+		if err != nil {
+			return 0, err
+		}
+		if count == last {
+			stable++
+		} else {
+			last, stable = count, 1
+		}
+		if stable >= handoffStableSamples {
+			return count, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(handoffPollInterval):
+		}
+	}
+}
+
+// fetchRecordCount reads record_count from an admin /status response.
+func fetchRecordCount(ctx context.Context, client *http.Client, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var status struct {
+		RecordCount int64 `json:"record_count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, err
+	}
+	return status.RecordCount, nil
+}
+
+// adminPost sends an empty POST to an admin endpoint and expects 200.
+func adminPost(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
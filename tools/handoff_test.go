@@ -0,0 +1,158 @@
+package tools_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHandoffKeepsRecordsInFlight(t *testing.T) {
+	for _, viaTCP := range []bool{false, true} {
+		name := "socket"
+		if viaTCP {
+			name = "admin_port"
+		}
+		t.Run(name, func(t *testing.T) {
+			opts := testharness.Options{Dir: t.TempDir()}
+			if viaTCP {
+				opts.AdminPort = freePort(t)
+			}
+			old := startAgent(t, opts)
+			logs := tools.CaptureLogs(t)
+
+			// Writers keep sending until the old agent refuses them
+			var acked, refused atomic.Int64
+			var writers sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				writers.Add(1)
+				go func() {
+					defer writers.Done()
+					for {
+						resp, err := old.SendLog(&pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}})
+						if status.Code(err) == codes.Unavailable && strings.Contains(err.Error(), "handing off") {
+							refused.Add(1)
+							return
+						}
+						if err != nil || !resp.Success {
+							t.Errorf("SendLog before the pause = %+v, %v", resp, err)
+							return
+						}
+						acked.Add(1)
+					}
+				}()
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for acked.Load() < 20 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if acked.Load() < 20 {
+				t.Fatalf("only %d logs stored before the handoff", acked.Load())
+			}
+
+			var err error
+			if viaTCP {
+				err = tools.HandoffFrom(context.Background(), fmt.Sprintf("localhost:%d", opts.AdminPort), opts.Dir)
+			} else {
+				err = tools.HandoffFromSocket(context.Background(), old.Config.SocketPath, opts.Dir)
+			}
+			if err != nil {
+				t.Fatalf("handoff: %v", err)
+			}
+			writers.Wait()
+			if refused.Load() != 4 {
+				t.Errorf("writers refused by the paused agent = %d, want 4", refused.Load())
+			}
+			select {
+			case <-old.Done():
+			case <-time.After(time.Second):
+				t.Fatal("old agent still running after the handoff")
+			}
+
+			// The new agent opens the same DB with every acknowledged record
+			agent := startAgent(t, testharness.Options{Dir: opts.Dir})
+			if n := int64(agent.RecordCount()); n != acked.Load() {
+				t.Errorf("records after the handoff = %d, want the %d acknowledged", n, acked.Load())
+			}
+			if agent.Config.RecordCount() != acked.Load() {
+				t.Errorf("RecordCount = %d, want %d", agent.Config.RecordCount(), acked.Load())
+			}
+			done := logs.Events("handoff_complete")
+			if len(done) != 1 || done[0]["record_count"] != float64(acked.Load()) {
+				t.Errorf("handoff_complete entries = %v, want record_count %d", done, acked.Load())
+			}
+		})
+	}
+}
+
+func TestAdminSocketServesAdminEndpoints(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+	path := tools.AdminSocketPath(agent.Config.SocketPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("admin socket: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("admin socket mode = %v, want an owner-only socket", info.Mode())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("http://localhost/status")
+	if err != nil {
+		t.Fatalf("GET /status over the admin socket: %v", err)
+	}
+	var st map[string]any
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("GET /status over the admin socket = %s, %v", resp.Status, err)
+	}
+	if _, ok := st["record_count"]; !ok {
+		t.Errorf("/status lacks record_count: %v", st)
+	}
+
+	resp, err = client.Post("http://localhost/shutdown", "", nil)
+	if err != nil {
+		t.Fatalf("POST /shutdown over the admin socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /shutdown over the admin socket = %s", resp.Status)
+	}
+	select {
+	case <-agent.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent still running after POST /shutdown")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("admin socket after shutdown: %v, want it removed", err)
+	}
+}
+
+func TestHandoffFromSocketWithoutOldAgent(t *testing.T) {
+	dir := t.TempDir()
+	err := tools.HandoffFromSocket(context.Background(), dir+"/missing.sock", dir)
+	if err == nil || !strings.Contains(err.Error(), "pause old agent") {
+		t.Fatalf("HandoffFromSocket with no agent = %v, want a pause error", err)
+	}
+}
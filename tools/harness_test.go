@@ -0,0 +1,182 @@
+package tools_test
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+// startAgent starts a harness agent and checks that it leaves no goroutines
+// behind once the test ends.
+func startAgent(t *testing.T, opts testharness.Options) *testharness.AgentHandle {
+	t.Helper()
+	tools.LeakCheck(t, nil)
+	return testharness.StartTestAgent(t, opts)
+}
+
+// sendLogs sends n logs for pipeline through the agent and fails t on any error.
+func sendLogs(t *testing.T, agent *testharness.AgentHandle, n int, pipeline string) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		resp, err := agent.SendLog(&pb.LogRequest{JsonData: `{"msg":"hello","n":` + strconv.Itoa(i) + `}`, Pipelines: []string{pipeline}})
+		if err != nil || !resp.Success {
+			t.Fatalf("SendLog %d = %+v, %v", i, resp, err)
+		}
+	}
+}
+
+// uploadBody is the JSON body the agent posts to the server for one record.
+type uploadBody struct {
+	Pipelines []string       `json:"pipelines"`
+	LogData   map[string]any `json:"log_data"`
+	Level     string         `json:"level"`
+	Metadata  map[string]any `json:"metadata"`
+}
+
+// uploadedBodies decodes every request the harness server received.
+func uploadedBodies(t *testing.T, agent *testharness.AgentHandle) []uploadBody {
+	t.Helper()
+	var bodies []uploadBody
+	for _, req := range agent.CapturedServerRequests() {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("read captured body: %v", err)
+		}
+		var body uploadBody
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatalf("decode captured body %q: %v", data, err)
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies
+}
+
+func TestHarnessStoresAndUploads(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+	sendLogs(t, agent, 3, "orders")
+
+	if n := agent.RecordCount(); n != 3 {
+		t.Fatalf("records = %d, want 3", n)
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if n := agent.RecordCount(); n != 0 {
+		t.Fatalf("records after drain = %d, want 0", n)
+	}
+
+	bodies := uploadedBodies(t, agent)
+	if len(bodies) != 3 {
+		t.Fatalf("uploads = %d, want 3", len(bodies))
+	}
+	for _, b := range bodies {
+		if len(b.Pipelines) != 1 || b.Pipelines[0] != "orders" || b.LogData["msg"] != "hello" {
+			t.Errorf("unexpected upload %+v", b)
+		}
+	}
+	for _, req := range agent.CapturedServerRequests() {
+		if req.URL.Path != "/log" {
+			t.Errorf("upload path = %s, want /log", req.URL.Path)
+		}
+	}
+}
+
+func TestHarnessServerErrorKeepsRecords(t *testing.T) {
+	agent := startAgent(t, testharness.Options{ServerStatus: 503})
+	sendLogs(t, agent, 2, "orders")
+
+	if err := agent.Drain(); err == nil {
+		t.Fatal("Drain succeeded against a 503 server")
+	}
+	if n := agent.RecordCount(); n != 2 {
+		t.Fatalf("records = %d, want 2", n)
+	}
+}
+
+func TestHarnessRunResetsBetweenSubtests(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+	for _, name := range []string{"first", "second"} {
+		agent.Run(t, name, func(t *testing.T) {
+			if n := agent.RecordCount(); n != 0 {
+				t.Fatalf("records at start = %d, want 0", n)
+			}
+			if n := len(agent.CapturedServerRequests()); n != 0 {
+				t.Fatalf("server requests at start = %d, want 0", n)
+			}
+			sendLogs(t, agent, 5, name)
+			if n := agent.RecordCount(); n != 5 {
+				t.Fatalf("records = %d, want 5", n)
+			}
+		})
+	}
+}
+
+func TestHarnessShutdownTwice(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+	sendLogs(t, agent, 1, "orders")
+	agent.Shutdown()
+	agent.Shutdown()
+	if _, err := agent.SendLog(&pb.LogRequest{JsonData: `{}`, Pipelines: []string{"orders"}}); err == nil {
+		t.Fatal("SendLog succeeded after Shutdown")
+	}
+}
+
+func TestMaxRecordsPerCycleSplitsDrain(t *testing.T) {
+	logs := tools.CaptureLogs(t)
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.MaxRecordsPerCycle = 10 },
+	})
+	sendLogs(t, agent, 100, "orders")
+
+	cycles := 0
+	for agent.RecordCount() > 0 {
+		if cycles == 20 {
+			t.Fatalf("still %d records after %d cycles", agent.RecordCount(), cycles)
+		}
+		before := agent.RecordCount()
+		if err := agent.Drain(); err != nil {
+			t.Fatalf("Drain %d: %v", cycles, err)
+		}
+		cycles++
+		if got := before - agent.RecordCount(); got != 10 {
+			t.Errorf("cycle %d drained %d records, want 10", cycles, got)
+		}
+	}
+	if cycles != 10 {
+		t.Errorf("drained in %d cycles, want 10", cycles)
+	}
+	if n := len(uploadedBodies(t, agent)); n != 100 {
+		t.Errorf("uploads = %d, want 100", n)
+	}
+	if n := len(logs.Events("cycle_limit_reached")); n < 9 {
+		t.Errorf("cycle_limit_reached logged %d times, want at least 9", n)
+	}
+}
+
+func TestUploadRateLimitPacesDrain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes about 10s")
+	}
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.UploadRateLimit = 10 },
+	})
+	sendLogs(t, agent, 100, "orders")
+
+	start := time.Now()
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	// Burst of one, then one every 100ms: 99 waits
+	if elapsed := time.Since(start); elapsed < 9*time.Second || elapsed > 12*time.Second {
+		t.Errorf("100 records at 10/s drained in %v, want about 9.9s", elapsed)
+	}
+	if n := len(uploadedBodies(t, agent)); n != 100 {
+		t.Errorf("uploads = %d, want 100", n)
+	}
+}
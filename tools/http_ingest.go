@@ -0,0 +1,174 @@
+package tools
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// httpIngestMaxBody bounds POST /logs bodies when MaxPayloadBytes is not set
+// (gRPC's default message limit).
+const httpIngestMaxBody = 4 << 20
+
+// sendLogInfo describes HTTP ingest calls to the unary interceptors, which
+// treat them as SendLog calls.
+var sendLogInfo = &grpc.UnaryServerInfo{FullMethod: pb.LogAgent_SendLog_FullMethodName}
+
+// httpLogRequest is the body of POST /logs.
+type httpLogRequest struct {
+	JsonData  string   `json:"json_data"`
+	Pipelines []string `json:"pipelines"`
+	Priority  int32    `json:"priority"`
+	RequestId string   `json:"request_id"`
+	Level     string   `json:"level"`
+}
+
+// StartHTTPIngestServer accepts logs over HTTP on localhost:HTTPIngestPort,
+// for clients that cannot use gRPC. POST /logs takes a JSON body
+// {"json_data": "...", "pipelines": [...]} and the DATANADHI-API-KEY header,
+// which must match the agent's API key. Each request goes through the same
+// interceptors and SendLog handler as a gRPC call; gRPC errors are mapped to
+// HTTP statuses (e.g. ResourceExhausted to 429). The server is shut down when
+// ctx is cancelled.
+func (c *ServerConfig) StartHTTPIngestServer(ctx context.Context, wg *sync.WaitGroup) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /logs", c.handleHTTPIngest)
+
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", c.HTTPIngestPort))
+	if err != nil {
+		LogJsonLevel(LevelError, "http_ingest_listen_error", map[string]any{"error": err.Error()})
+		return err
+	}
+	srv := &http.Server{Handler: mux}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogJsonLevel(LevelError, "http_ingest_server_error", map[string]any{"error": err.Error()})
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+		LogJsonLevel(LevelInfo, "http_ingest_server_stopped", nil)
+	}()
+
+	LogJsonLevel(LevelInfo, "http_ingest_server_started", map[string]any{"addr": lis.Addr().String()})
+	return nil
+}
+
+// handleHTTPIngest serves POST /logs.
+func (c *ServerConfig) handleHTTPIngest(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("DATANADHI-API-KEY")
+	if key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(c.CurrentApiKey())) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]any{"success": false, "message": "unauthorized"})
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, map[string]any{"success": false, "message": "content type must be application/json"})
+		return
+	}
+
+	limit := httpIngestMaxBody
+	if c.MaxPayloadBytes > 0 {
+		limit = c.MaxPayloadBytes + grpcEnvelopeBytes
+	}
+	var body httpLogRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(limit))).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]any{"success": false, "message": "payload_too_large"})
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]any{"success": false, "message": "invalid body: " + err.Error()})
+		return
+	}
+
+	req := &pb.LogRequest{
+		JsonData:  body.JsonData,
+		Pipelines: body.Pipelines,
+		ApiKey:    key,
+		Priority:  body.Priority,
+		RequestId: body.RequestId,
+		Level:     body.Level,
+	}
+
+	// Run SendLog as the gRPC server would, with the client's address as its peer
+	ctx := r.Context()
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: addr})
+	}
+	s := &server{config: c}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return s.SendLog(ctx, req.(*pb.LogRequest))
+	}
+	interceptors := c.unaryInterceptors()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req any) (any, error) {
+			return interceptor(ctx, req, sendLogInfo, next)
+		}
+	}
+
+	out, err := handler(ctx, req)
+	if err != nil {
+		st := status.Convert(err)
+		writeJSON(w, httpStatusFromCode(st.Code()), map[string]any{"success": false, "message": st.Message()})
+		return
+	}
+	resp := out.(*pb.LogResponse)
+	code := http.StatusOK
+	if !resp.Success {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, map[string]any{
+		"success":            resp.Success,
+		"message":            resp.Message,
+		"backpressure_ratio": resp.BackpressureRatio,
+		"retry_after_ms":     resp.RetryAfterMs,
+		"queue_depth":        resp.QueueDepth,
+		"max_queue_depth":    resp.MaxQueueDepth,
+	})
+}
+
+// httpStatusFromCode maps the gRPC codes returned by SendLog to HTTP statuses.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded, codes.Canceled:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
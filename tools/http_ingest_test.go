@@ -0,0 +1,90 @@
+package tools_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+// freePort returns a localhost TCP port that was free a moment ago.
+func freePort(t *testing.T) int {
+	t.Helper()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+func TestHTTPIngestStoresRecords(t *testing.T) {
+	apiKey := strings.Repeat("a1", 16)
+	port := freePort(t)
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) {
+			c.ApiKey = apiKey
+			c.MaxPayloadBytes = 64
+			c.HTTPIngestPort = port
+		},
+	})
+	url := fmt.Sprintf("http://localhost:%d/logs", port)
+	client := &http.Client{}
+	t.Cleanup(client.CloseIdleConnections)
+
+	tests := []struct {
+		name        string
+		apiKey      string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"stored", apiKey, "application/json", `{"json_data":"{\"msg\":\"from http\"}","pipelines":["p1"]}`, http.StatusOK},
+		{"missing key", "", "application/json", `{"json_data":"{}","pipelines":["p1"]}`, http.StatusUnauthorized},
+		{"wrong key", strings.Repeat("b2", 16), "application/json", `{"json_data":"{}","pipelines":["p1"]}`, http.StatusUnauthorized},
+		{"not json", apiKey, "text/plain", `{"json_data":"{}","pipelines":["p1"]}`, http.StatusUnsupportedMediaType},
+		{"malformed body", apiKey, "application/json", `{"json_data":`, http.StatusBadRequest},
+		{"payload over MaxPayloadBytes", apiKey, "application/json", `{"json_data":"{\"pad\":\"` + strings.Repeat("x", 100) + `\"}","pipelines":["p1"]}`, http.StatusTooManyRequests},
+		// Past MaxPayloadBytes plus the 64 KiB allowed for the rest of the request
+		{"body over the limit", apiKey, "application/json", `{"json_data":"{\"pad\":\"` + strings.Repeat("x", 65<<10) + `\"}","pipelines":["p1"]}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.apiKey != "" {
+				req.Header.Set("DATANADHI-API-KEY", tt.apiKey)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("POST /logs: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+
+	// Only the accepted request reached Pebble, and it is uploaded as sent
+	if n := agent.RecordCount(); n != 1 {
+		t.Fatalf("stored records = %d, want 1", n)
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	bodies := uploadedBodies(t, agent)
+	if len(bodies) != 1 {
+		t.Fatalf("uploads = %d, want 1", len(bodies))
+	}
+	if b := bodies[0]; b.LogData["msg"] != "from http" || len(b.Pipelines) != 1 || b.Pipelines[0] != "p1" {
+		t.Errorf("uploaded record = %+v", b)
+	}
+}
@@ -0,0 +1,88 @@
+package tools
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// ExportToCSV writes every record in Pebble to w as CSV for spreadsheet use.
+// The header is received_at, pipelines, then columns; each column is read from
+// the payload using dot notation and left empty when missing. It returns the
+// number of rows written, excluding the header.
+func (c *ServerConfig) ExportToCSV(ctx context.Context, w io.Writer, columns []string) (int, error) {
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		return 0, err
+	}
+	defer closeIter()
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"received_at", "pipelines"}, columns...)); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	row := make([]string, 2+len(columns))
+	for iter.First(); iter.Valid(); iter.Next() {
+		if ctx.Err() != nil {
+			cw.Flush()
+			return count, ctx.Err()
+		}
+
+		var rec logRecord
+		if err := decodeRecord(iter.Value(), &rec); err != nil {
+			LogJsonLevel(LevelError, "pebble_read_error", map[string]any{"error": err.Error(), "key": string(iter.Key())})
+			continue
+		}
+		if rec.SchemaVersion < CurrentSchemaVersion {
+			rec = MigrateRecord(rec, rec.SchemaVersion, CurrentSchemaVersion)
+		}
+		row[0] = rec.ReceivedAt
+		row[1] = strings.Join(rec.Pipelines, ",")
+		for i, col := range columns {
+			row[2+i] = csvCell(lookupField(rec.Payload, col))
+		}
+		if err := cw.Write(row); err != nil {
+			return count, err
+		}
+		count++
+	}
+	cw.Flush()
+	return count, cw.Error()
+}
+
+// lookupField returns the value at path in m, descending into nested maps on
+// each dot. A key containing the dot itself (e.g. from FlattenPayload) wins.
+func lookupField(m map[string]any, path string) (any, bool) {
+	if v, ok := m[path]; ok {
+		return v, true
+	}
+	head, rest, found := strings.Cut(path, ".")
+	if !found {
+		return nil, false
+	}
+	nested, ok := m[head].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return lookupField(nested, rest)
+}
+
+// csvCell formats a payload value for a CSV cell: strings as-is, anything
+// else as JSON, and missing or null values as an empty cell.
+func csvCell(v any, ok bool) string {
+	if !ok || v == nil {
+		return ""
+	}
+	if s, isString := v.(string); isString {
+		return s
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,81 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExportToCSV(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		payload := map[string]any{
+			"level":   "INFO",
+			"message": fmt.Sprintf("msg %d", i),
+			"user":    map[string]any{"id": float64(i)},
+		}
+		if i == 9 {
+			delete(payload, "user") // missing nested key
+			payload["message"] = "has, a comma"
+		}
+		ts := base.Add(time.Duration(i) * time.Second)
+		putRecord(t, c, keyAt(priorityPrefix(PriorityNormal), ts, i), logRecord{
+			SchemaVersion: CurrentSchemaVersion,
+			Payload:       payload,
+			Pipelines:     []string{"p1", "p2"},
+			ReceivedAt:    ts.Format(time.RFC3339Nano),
+		})
+	}
+
+	var out bytes.Buffer
+	n, err := c.ExportToCSV(context.Background(), &out, []string{"level", "message", "user.id", "absent"})
+	if err != nil || n != 10 {
+		t.Fatalf("ExportToCSV = %d, %v; want 10", n, err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	if len(rows) != 11 {
+		t.Fatalf("CSV rows = %d, want a header and 10 records", len(rows))
+	}
+	if want := "[received_at pipelines level message user.id absent]"; fmt.Sprint(rows[0]) != want {
+		t.Errorf("header = %v, want %s", rows[0], want)
+	}
+	for i, row := range rows[1:] {
+		if len(row) != 6 {
+			t.Fatalf("row %d has %d columns, want 6", i, len(row))
+		}
+		want := []string{base.Add(time.Duration(i) * time.Second).Format(time.RFC3339Nano), "p1,p2", "INFO", fmt.Sprintf("msg %d", i), fmt.Sprint(i), ""}
+		if i == 9 {
+			want[3], want[4] = "has, a comma", ""
+		}
+		if fmt.Sprintf("%q", row) != fmt.Sprintf("%q", want) {
+			t.Errorf("row %d = %q, want %q", i, row, want)
+		}
+	}
+}
+
+func TestLookupField(t *testing.T) {
+	payload := map[string]any{
+		"user":    map[string]any{"id": "u1", "tags": []any{"a"}},
+		"flat.id": "f1",
+		"level":   nil,
+	}
+	for path, want := range map[string]string{
+		"user.id":   "u1",
+		"user.tags": `["a"]`,
+		"flat.id":   "f1",
+		"user.none": "",
+		"level":     "",
+		"level.x":   "",
+	} {
+		if got := csvCell(lookupField(payload, path)); got != want {
+			t.Errorf("cell for %q = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// recoveryInterceptor turns a panic inside a handler into a gRPC Internal error
+// so a single bad request cannot take down the whole agent. It must be the
+// first interceptor in the chain so it also covers the other interceptors.
+func recoveryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			grpcPanicsTotal.Inc()
+			LogJsonLevel(LevelError, "grpc_panic", map[string]any{
+				"method":      info.FullMethod,
+				"panic_value": fmt.Sprint(r),
+				"stack":       string(debug.Stack()),
+			})
+			resp, err = nil, status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// loggingInterceptor times every unary call, records it in the latency
+// summary and emits a "grpc_request" line for debugging slow clients.
+func loggingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	elapsed := time.Since(start)
+
+	grpcRequestDuration.WithLabelValues(info.FullMethod).Observe(elapsed.Seconds())
+	LogJsonLevel(LevelDebug, "grpc_request", map[string]any{
+		"method":      info.FullMethod,
+		"duration_ms": float64(elapsed.Microseconds()) / 1000,
+		"error":       err != nil,
+	})
+	return resp, err
+}
+
+// streamRecoveryInterceptor is the streaming counterpart of recoveryInterceptor:
+// a panic in a stream handler ends that stream with Internal instead of
+// crashing the agent.
+func streamRecoveryInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			grpcPanicsTotal.Inc()
+			LogJsonLevel(LevelError, "grpc_panic", map[string]any{
+				"method":      info.FullMethod,
+				"panic_value": fmt.Sprint(r),
+				"stack":       string(debug.Stack()),
+			})
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// streamLoggingInterceptor is the streaming counterpart of loggingInterceptor.
+// The duration covers the whole stream, from the first message to the close.
+func streamLoggingInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	elapsed := time.Since(start)
+
+	grpcRequestDuration.WithLabelValues(info.FullMethod).Observe(elapsed.Seconds())
+	LogJsonLevel(LevelDebug, "grpc_request", map[string]any{
+		"method":      info.FullMethod,
+		"duration_ms": float64(elapsed.Microseconds()) / 1000,
+		"error":       err != nil,
+		"stream":      true,
+	})
+	return err
+}
+
+// payloadSizeInterceptor rejects a LogRequest whose json_data is larger than
+// maxBytes with ResourceExhausted before the handler parses it. It backs up
+// the transport limit set in StartGRPCServer, which allows some headroom for
+// the rest of the message.
+func payloadSizeInterceptor(maxBytes int) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if r, ok := req.(*pb.LogRequest); ok && len(r.JsonData) > maxBytes {
+			fields := clientIdentity(ctx)
+			fields["size"] = len(r.JsonData)
+			fields["limit"] = maxBytes
+			LogJsonLevel(LevelWarn, "payload_too_large", fields)
+			return nil, status.Error(codes.ResourceExhausted, "payload_too_large")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// deadlineInterceptor bounds unary calls from clients that set no deadline, or
+// one later than deadline, so a stalled handler cannot hold its goroutine
+// forever. Shorter client deadlines are kept as they are.
+func deadlineInterceptor(deadline time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if d, ok := ctx.Deadline(); ok && time.Until(d) <= deadline {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, deadline)
+		defer cancel()
+		LogJsonLevel(LevelDebug, "deadline_applied", map[string]any{
+			"method":      info.FullMethod,
+			"deadline_ms": deadline.Milliseconds(),
+		})
+		return handler(ctx, req)
+	}
+}
+
+// connectionCount is the number of gRPC client connections currently open.
+var connectionCount atomic.Int64
+
+// connStatsHandler tracks gRPC connection opens and closes in connectionCount.
+// Above warnAt open connections every transition is logged, which points at
+// SDK clients leaking connections. It also tags each connection with an ID
+// for Connect.
+type connStatsHandler struct {
+	warnAt int64
+}
+
+func (h connStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, connIDKey{}, nextConnID.Add(1))
+}
+
+func (h connStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		if n := connectionCount.Add(1); h.warnAt > 0 && n > h.warnAt {
+			LogJsonLevel(LevelWarn, "grpc_connection_opened", map[string]any{"count": n, "warn_threshold": h.warnAt})
+		}
+	case *stats.ConnEnd:
+		if n := connectionCount.Add(-1); h.warnAt > 0 && n >= h.warnAt {
+			LogJsonLevel(LevelInfo, "grpc_connection_closed", map[string]any{"count": n, "warn_threshold": h.warnAt})
+		}
+	}
+}
+
+func (h connStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h connStatsHandler) HandleRPC(context.Context, stats.RPCStats) {}
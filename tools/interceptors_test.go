@@ -0,0 +1,208 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoggingInterceptorLogsEachCall(t *testing.T) {
+	logs := CaptureLogs(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Service/Logging"}
+
+	ok := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+	fail := func(ctx context.Context, req any) (any, error) { return nil, errors.New("boom") }
+	if resp, err := loggingInterceptor(context.Background(), nil, info, ok); resp != "ok" || err != nil {
+		t.Fatalf("interceptor changed the result: %v, %v", resp, err)
+	}
+	if _, err := loggingInterceptor(context.Background(), nil, info, fail); err == nil {
+		t.Fatal("interceptor dropped the handler error")
+	}
+
+	entries := logs.Events("grpc_request")
+	if len(entries) != 2 {
+		t.Fatalf("grpc_request entries = %d, want 2", len(entries))
+	}
+	for i, wantErr := range []bool{false, true} {
+		e := entries[i]
+		if e["method"] != info.FullMethod || e["error"] != wantErr {
+			t.Errorf("entry %d = %v", i, e)
+		}
+		if d, ok := e["duration_ms"].(float64); !ok || d < 0 {
+			t.Errorf("entry %d duration_ms = %v", i, e["duration_ms"])
+		}
+	}
+	if n := testutil.CollectAndCount(grpcRequestDuration, "echopost_grpc_request_duration_seconds"); n == 0 {
+		t.Error("no latency summary series recorded")
+	}
+}
+
+// panickingServer is a LogAgent whose SendLog panics on its first call only,
+// so a second call can check the connection survived the recovered panic.
+type panickingServer struct {
+	pb.UnimplementedLogAgentServer
+	calls atomic.Int32
+}
+
+func (s *panickingServer) SendLog(ctx context.Context, req *pb.LogRequest) (*pb.LogResponse, error) {
+	if s.calls.Add(1) == 1 {
+		panic("handler exploded")
+	}
+	return &pb.LogResponse{}, nil
+}
+
+func TestRecoveryInterceptorReturnsInternal(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+
+	lis, err := net.Listen("unix", c.SocketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(c.unaryInterceptors()...))
+	pb.RegisterLogAgentServer(s, &panickingServer{})
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	client := dialAgent(t, c)
+	before := testutil.ToFloat64(grpcPanicsTotal)
+
+	_, err = client.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("panicking call: err = %v, want code Internal", err)
+	}
+	// The same connection keeps working: the panic did not reset it
+	if _, err := client.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`}); err != nil {
+		t.Fatalf("call after panic: %v", err)
+	}
+
+	if got := testutil.ToFloat64(grpcPanicsTotal) - before; got != 1 {
+		t.Errorf("echopost_grpc_panics_total grew by %v, want 1", got)
+	}
+	entries := logs.Events("grpc_panic")
+	if len(entries) != 1 {
+		t.Fatalf("grpc_panic entries = %d, want 1", len(entries))
+	}
+	if e := entries[0]; e["method"] != pb.LogAgent_SendLog_FullMethodName || e["panic_value"] != "handler exploded" {
+		t.Errorf("grpc_panic entry = %v", e)
+	}
+}
+
+func TestStreamRecoveryInterceptorReturnsInternal(t *testing.T) {
+	logs := CaptureLogs(t)
+	before := testutil.ToFloat64(grpcPanicsTotal)
+	info := &grpc.StreamServerInfo{FullMethod: pb.LogAgent_StreamLogs_FullMethodName, IsClientStream: true}
+
+	err := streamRecoveryInterceptor(nil, nil, info, func(srv any, ss grpc.ServerStream) error {
+		panic("stream exploded")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("err = %v, want code Internal", err)
+	}
+	if got := testutil.ToFloat64(grpcPanicsTotal) - before; got != 1 {
+		t.Errorf("echopost_grpc_panics_total grew by %v, want 1", got)
+	}
+	entries := logs.Events("grpc_panic")
+	if len(entries) != 1 || entries[0]["method"] != info.FullMethod || entries[0]["panic_value"] != "stream exploded" {
+		t.Errorf("grpc_panic entries = %v", entries)
+	}
+}
+
+func TestStreamInterceptorsRecoverBeforeLogging(t *testing.T) {
+	c := &ServerConfig{}
+	chain := c.streamInterceptors()
+	if len(chain) == 0 {
+		t.Fatal("no stream interceptors")
+	}
+	// recovery must be outermost so it also covers the other interceptors
+	logs := CaptureLogs(t)
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Stream"}
+	err := chain[0](nil, nil, info, func(srv any, ss grpc.ServerStream) error {
+		return chain[1](srv, ss, info, func(any, grpc.ServerStream) error { panic("inner") })
+	})
+	if status.Code(err) != codes.Internal || len(logs.Events("grpc_panic")) != 1 {
+		t.Fatalf("panic below the logging interceptor not recovered: %v", err)
+	}
+}
+
+// deadlineServer records the deadline of each SendLog context it handles.
+type deadlineServer struct {
+	pb.UnimplementedLogAgentServer
+	deadlines chan time.Time
+}
+
+func (s *deadlineServer) SendLog(ctx context.Context, req *pb.LogRequest) (*pb.LogResponse, error) {
+	d, _ := ctx.Deadline()
+	s.deadlines <- d
+	return &pb.LogResponse{}, nil
+}
+
+func TestDeadlineInterceptorAppliesDefault(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.DefaultRPCDeadline = 2 * time.Second
+
+	lis, err := net.Listen("unix", c.SocketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &deadlineServer{deadlines: make(chan time.Time, 1)}
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(c.unaryInterceptors()...))
+	pb.RegisterLogAgentServer(s, srv)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+	client := dialAgent(t, c)
+
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration // 0 = no client deadline
+		want    time.Duration
+		applied bool
+	}{
+		{"no client deadline", 0, c.DefaultRPCDeadline, true},
+		{"longer client deadline", time.Minute, c.DefaultRPCDeadline, true},
+		{"shorter client deadline", 500 * time.Millisecond, 500 * time.Millisecond, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := len(logs.Events("deadline_applied"))
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			if _, err := client.SendLog(ctx, &pb.LogRequest{JsonData: `{}`}); err != nil {
+				t.Fatalf("SendLog: %v", err)
+			}
+			d := <-srv.deadlines
+			if d.IsZero() {
+				t.Fatal("handler context has no deadline")
+			}
+			if got := d.Sub(start); got < tc.want-250*time.Millisecond || got > tc.want+250*time.Millisecond {
+				t.Errorf("handler deadline in %v, want about %v", got, tc.want)
+			}
+
+			entries := logs.Events("deadline_applied")[before:]
+			if !tc.applied {
+				if len(entries) != 0 {
+					t.Errorf("deadline_applied logged for a shorter client deadline: %v", entries)
+				}
+				return
+			}
+			if len(entries) != 1 || entries[0]["method"] != pb.LogAgent_SendLog_FullMethodName || entries[0]["deadline_ms"] != float64(2000) {
+				t.Errorf("deadline_applied entries = %v", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+)
+
+func TestRecordLevel(t *testing.T) {
+	tests := []struct {
+		explicit string
+		payload  map[string]any
+		want     string
+	}{
+		{"", map[string]any{"level": "debug"}, "DEBUG"},
+		{"", map[string]any{"severity": "warning"}, "WARN"},
+		{"", map[string]any{"log_level": "Error"}, "ERROR"},
+		{"", map[string]any{"severity": "ERROR", "level": "info"}, "INFO"}, // level wins
+		{"warn", map[string]any{"level": "debug"}, "WARN"},                 // the request field wins
+		{"", map[string]any{"level": "notice"}, "notice"},                  // unknown names kept as sent
+		{"", map[string]any{"level": 3}, ""},                               // only strings are promoted
+		{"", map[string]any{}, ""},
+	}
+	for _, tt := range tests {
+		if got := recordLevel(tt.explicit, tt.payload); got != tt.want {
+			t.Errorf("recordLevel(%q, %v) = %q, want %q", tt.explicit, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestMinUploadLevelSkipsDebug(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	c.MinUploadLevel = "INFO"
+	s := &server{config: c}
+
+	for _, req := range []*pb.LogRequest{
+		{JsonData: `{"msg":"a","level":"debug"}`},
+		{JsonData: `{"msg":"b","level":"info"}`},
+		{JsonData: `{"msg":"c","severity":"error"}`},
+		{JsonData: `{"msg":"d"}`, Level: "WARN"},
+		{JsonData: `{"msg":"e"}`},
+		{JsonData: `{"msg":"f"}`, Level: "DEBUG"},
+	} {
+		req.Pipelines = []string{"p1"}
+		if resp, err := s.SendLog(context.Background(), req); err != nil || !resp.Success {
+			t.Fatalf("SendLog %s = %+v, %v", req.JsonData, resp, err)
+		}
+	}
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+
+	upload.mu.Lock()
+	got := map[any]any{}
+	for _, body := range upload.bodies {
+		got[body["log_data"].(map[string]any)["msg"]] = body["level"]
+	}
+	upload.mu.Unlock()
+	want := map[any]any{"b": "INFO", "c": "ERROR", "d": "WARN", "e": nil}
+	if len(got) != len(want) {
+		t.Fatalf("uploaded msg -> level = %v, want %v", got, want)
+	}
+	for msg, level := range want {
+		if l, ok := got[msg]; !ok || l != level {
+			t.Errorf("record %v uploaded with level %v (sent %v), want %v", msg, l, ok, level)
+		}
+	}
+	// The skipped DEBUG records are removed all the same
+	if n := len(storedKeys(t, c)); n != 0 {
+		t.Errorf("records after ProcessPebble = %d, want 0", n)
+	}
+}
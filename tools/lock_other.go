@@ -0,0 +1,16 @@
+//go:build !unix
+
+package tools
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable; Pebble's own lock still
+// prevents two agents from opening the same DB.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile is a no-op where flock is unavailable.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build unix
+
+package tools
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAgentLockRejectsSecondAgent(t *testing.T) {
+	logs := CaptureLogs(t)
+	dir := t.TempDir()
+	first := &ServerConfig{}
+	if err := first.CreateRequiredFiles(dir); err != nil {
+		t.Fatalf("first agent: %v", err)
+	}
+
+	second := &ServerConfig{}
+	if err := second.CreateRequiredFiles(dir); !errors.Is(err, ErrAgentAlreadyRunning) {
+		second.CloseFiles()
+		t.Fatalf("second agent = %v, want ErrAgentAlreadyRunning", err)
+	}
+	entries := logs.Events("agent_already_running")
+	if len(entries) != 1 || entries[0]["lock_path"] != filepath.Join(dir, "agent.lock") {
+		t.Errorf("agent_already_running entries = %v", entries)
+	}
+
+	// Once the first agent closes, the directory can be used again
+	first.CloseFiles()
+	third := &ServerConfig{}
+	if err := third.CreateRequiredFiles(dir); err != nil {
+		t.Fatalf("agent after the first closed: %v", err)
+	}
+	third.CloseFiles()
+}
+
+func TestListSessionsMarksRunningAgent(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "session-2020-01-01T00-00-00Z"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	agent := &ServerConfig{}
+	if err := agent.CreateRequiredFiles(dir); err != nil {
+		t.Fatalf("CreateRequiredFiles: %v", err)
+	}
+	t.Cleanup(agent.CloseFiles)
+
+	sessions, err := ListSessions(dir)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("ListSessions returned %d sessions, want 2", len(sessions))
+	}
+	if old := sessions[0]; old.Locked || old.Records != nil {
+		t.Errorf("older session = %+v, want unlocked with records unknown", old)
+	}
+	if running := sessions[1]; !running.Locked || running.Records != nil || running.Session != filepath.Base(agent.sessionPath) {
+		t.Errorf("running session = %+v, want %s locked", running, filepath.Base(agent.sessionPath))
+	}
+}
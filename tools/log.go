@@ -1,47 +1,239 @@
 package tools
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
-// LogJson prints structured logs in JSON format.
+// LogWriter receives every LogJson entry, one JSON object per line. It
+// defaults to stdout; SetQuietMode replaces it with io.Discard and
+// OpenLogFile with a file. Once logging has started it must only be replaced
+// while holding logWriterMu (see rotateLogFile).
+var LogWriter io.Writer = os.Stdout
+
+// logWriterMu guards LogWriter and quietOut against a swap by the log rotator.
+var logWriterMu sync.RWMutex
+
+// quietExcept lists events still written to quietOut in quiet mode.
+var (
+	quietExcept map[string]bool
+	quietOut    io.Writer
+)
+
+// SetQuietMode suppresses all LogJson output except the events in except,
+// which keep going to the previous LogWriter. Call it before anything is logged.
+func SetQuietMode(except []string) {
+	logWriterMu.Lock()
+	defer logWriterMu.Unlock()
+	quietOut = LogWriter
+	quietExcept = make(map[string]bool, len(except))
+	for _, event := range except {
+		quietExcept[event] = true
+	}
+	LogWriter = io.Discard
+}
+
+// LogTimezone is the location used for the "time" field of every log entry.
+// It defaults to UTC; use SetLogTimezone to change it.
+var LogTimezone = time.UTC
+
+// logTimeFormat is the layout of the "time" field, or "unix" for epoch seconds.
+var logTimeFormat = time.RFC3339Nano
+
+// SetLogTimezone changes the time zone of LogJson timestamps. A nil location resets it to UTC.
+func SetLogTimezone(loc *time.Location) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	LogTimezone = loc
+}
+
+// SetLogTimeFormat selects the timestamp format: "rfc3339", "rfc3339nano" or "unix".
+func SetLogTimeFormat(name string) error {
+	switch name {
+	case "rfc3339":
+		logTimeFormat = time.RFC3339
+	case "rfc3339nano", "":
+		logTimeFormat = time.RFC3339Nano
+	case "unix":
+		logTimeFormat = "unix"
+	default:
+		return fmt.Errorf("unknown log time format %q", name)
+	}
+	return nil
+}
+
+// logTimestamp renders the current time using the configured zone and format.
+func logTimestamp() any {
+	now := time.Now().In(LogTimezone)
+	if logTimeFormat == "unix" {
+		return now.Unix()
+	}
+	return now.Format(logTimeFormat)
+}
+
+// startTime and sessionID are attached to every log entry as uptime_ms and
+// session_id. They are set once at startup by StartLogSession.
+var (
+	startTime = time.Now()
+	sessionID string
+)
+
+// StartLogSession resets the uptime clock and tags all later log entries with id.
+// Call it before anything is logged.
+func StartLogSession(id string) {
+	startTime = time.Now()
+	sessionID = id
+}
+
+// NewSessionID returns a random (version 4) UUID identifying one agent run.
+func NewSessionID() string {
+	return newUUIDv4()
+}
+
+// newUUIDv4 returns a random (version 4) UUID from crypto/rand.
+func newUUIDv4() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// logFieldPrefix is prepended to every field name except "time".
+var logFieldPrefix string
+
+// SetLogFieldPrefix namespaces all log fields, built-in and caller-supplied,
+// e.g. "dn_" turns event into dn_event. The time field keeps its name so
+// log shippers can still find the timestamp.
+func SetLogFieldPrefix(prefix string) {
+	logFieldPrefix = prefix
+}
+
+// LogLevel is the severity of a log event. Events below MinLogLevel are dropped.
+type LogLevel int
+
+// Supported log levels, lowest first.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the level name written in the "level" field.
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "INFO"
+	}
+}
+
+// MinLogLevel is the lowest level emitted. It defaults to INFO; use SetMinLogLevel to change it.
+var MinLogLevel = LevelInfo
+
+// ParseLogLevel maps a level name to a LogLevel: DEBUG, INFO, WARN (or
+// WARNING) and ERROR, case-insensitive.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToUpper(name) {
+	case "DEBUG":
+		return LevelDebug, nil
+	case "INFO":
+		return LevelInfo, nil
+	case "WARN", "WARNING":
+		return LevelWarn, nil
+	case "ERROR":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// SetMinLogLevel sets MinLogLevel from a name: DEBUG, INFO, WARN or ERROR (case-insensitive).
+// An empty name selects INFO.
+func SetMinLogLevel(level string) error {
+	if level == "" {
+		MinLogLevel = LevelInfo
+		return nil
+	}
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	MinLogLevel = l
+	return nil
+}
+
+// LogJson logs an event at INFO level. See LogJsonLevel.
+func LogJson(event string, fields map[string]any) {
+	LogJsonLevel(LevelInfo, event, fields)
+}
+
+// LogJsonLevel prints structured logs in JSON format.
 //
 // This function is lightweight and intended for non-fatal, operational logging.
-// Each log entry includes:
-//   - UTC timestamp (RFC3339Nano format)
+// Events below MinLogLevel are skipped. Each log entry includes:
+//   - Timestamp (UTC RFC3339Nano by default, see SetLogTimezone / SetLogTimeFormat)
+//   - Level (DEBUG, INFO, WARN or ERROR)
 //   - Event name
+//   - Agent uptime_ms and session_id (see StartLogSession)
 //   - Any additional context fields
 //
+// Every field but time is prefixed with the value set by SetLogFieldPrefix.
+//
 // Example:
 //
-//	LogJson("pebble_flush_error", map[string]any{
+//	LogJsonLevel(LevelError, "pebble_flush_error", map[string]any{
 //		"error": err.Error(),
 //	})
 //
 // Output (formatted):
 //
-//	{"time":"2025-11-11T10:15:42.458Z","event":"pebble_flush_error","error":"database is locked"}
+//	{"time":"2025-11-11T10:15:42.458Z","level":"ERROR","event":"pebble_flush_error","uptime_ms":5230,"session_id":"9f1c…","error":"database is locked"}
 //
 // Note:
-// This function prints directly to stdout and should be used only for
+// This function prints to LogWriter (stdout by default) and should be used only for
 // lightweight diagnostic output within EchoPost. It is not meant for
 // high-volume application logging.
-func LogJson(event string, fields map[string]any) {
+func LogJsonLevel(level LogLevel, event string, fields map[string]any) {
+	if level < MinLogLevel {
+		return
+	}
+
+	p := logFieldPrefix
 	entry := map[string]any{
-		"time":  time.Now().UTC().Format(time.RFC3339Nano),
-		"event": event,
+		"time":           logTimestamp(),
+		p + "level":      level.String(),
+		p + "event":      event,
+		p + "uptime_ms":  time.Since(startTime).Milliseconds(),
+		p + "session_id": sessionID,
 	}
 
 	// Merge provided context fields into the log entry
 	for k, v := range fields {
-		entry[k] = v
+		entry[p+k] = v
 	}
 
 	// Marshal the entry to JSON
 	data, _ := json.Marshal(entry)
 
-	// Print to stdout (used for lightweight observability)
-	fmt.Println(string(data))
+	// Print to LogWriter (stdout unless quiet mode is on)
+	logWriterMu.RLock()
+	defer logWriterMu.RUnlock()
+	out := LogWriter
+	if quietExcept[event] {
+		out = quietOut
+	}
+	fmt.Fprintln(out, string(data))
 }
@@ -0,0 +1,153 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Archived agent logs are named agent-<period>.log after the hour the file
+// was opened, in LogTimezone.
+const (
+	logArchivePrefix     = "agent-"
+	logArchiveTimeFormat = "2006-01-02T15"
+)
+
+// logFile is the file opened by OpenLogFile, and logFileOpened when it was
+// opened. Both are replaced by rotateLogFile under logWriterMu.
+var (
+	logFile       *os.File
+	logFileOpened time.Time
+)
+
+// OpenLogFile appends agent logs to path instead of stdout. Call it before
+// SetQuietMode so quiet mode keeps the file for its excepted events.
+func OpenLogFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	logWriterMu.Lock()
+	defer logWriterMu.Unlock()
+	logFile, logFileOpened = f, time.Now()
+	LogWriter = f
+	return nil
+}
+
+// StartLogRotator rotates the agent log file at path every interval: the file
+// is renamed to agent-YYYY-MM-DDTHH.log in the same directory, a new file is
+// opened at path and LogWriter switches to it. Archives beyond maxFiles, oldest
+// first, are deleted (0 = keep all). A non-positive interval disables rotation.
+func StartLogRotator(ctx context.Context, wg *sync.WaitGroup, path string, interval time.Duration, maxFiles int) {
+	if interval <= 0 {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		runLogRotator(ctx, path, ticker.C, maxFiles)
+	}()
+}
+
+// runLogRotator rotates the log file at path on every tick until ctx is done.
+func runLogRotator(ctx context.Context, path string, ticks <-chan time.Time, maxFiles int) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticks:
+			if err := rotateLogFile(path, now, maxFiles); err != nil {
+				LogJsonLevel(LevelError, "log_rotate_error", map[string]any{"path": path, "error": err.Error()})
+			}
+		}
+	}
+}
+
+// rotateLogFile archives the current log file and opens a fresh one at path.
+// Writers are blocked only for the rename and swap; the old file is closed
+// after they resume on the new one.
+func rotateLogFile(path string, now time.Time, maxFiles int) error {
+	logWriterMu.Lock()
+	archive := logArchivePath(path, logFileOpened)
+	if err := os.Rename(path, archive); err != nil {
+		logWriterMu.Unlock()
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logWriterMu.Unlock()
+		return err
+	}
+	old := logFile
+	logFile, logFileOpened = f, now
+	if LogWriter == old {
+		LogWriter = f
+	}
+	if quietOut == old {
+		quietOut = f
+	}
+	logWriterMu.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+	removed, err := pruneLogArchives(path, maxFiles)
+	LogJsonLevel(LevelInfo, "log_rotated", map[string]any{"archive": archive, "removed": removed})
+	return err
+}
+
+// logArchivePath returns an unused archive name in the directory of path for
+// a file opened at opened. Several rotations within the same hour get a
+// numeric suffix.
+func logArchivePath(path string, opened time.Time) string {
+	base := filepath.Join(filepath.Dir(path), logArchivePrefix+opened.In(LogTimezone).Format(logArchiveTimeFormat))
+	name := base + ".log"
+	for n := 1; ; n++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d.log", base, n)
+	}
+}
+
+// pruneLogArchives deletes the oldest archives next to path until at most
+// maxFiles remain, and returns how many were removed. The live file at path
+// is never counted, even if its name looks like an archive.
+func pruneLogArchives(path string, maxFiles int) (int, error) {
+	if maxFiles <= 0 {
+		return 0, nil
+	}
+	all, err := filepath.Glob(filepath.Join(filepath.Dir(path), logArchivePrefix+"*.log"))
+	if err != nil {
+		return 0, err
+	}
+	matches := slices.DeleteFunc(all, func(name string) bool { return name == filepath.Clean(path) })
+	if len(matches) <= maxFiles {
+		return 0, nil
+	}
+
+	modTimes := make(map[string]time.Time, len(matches))
+	for _, name := range matches {
+		if info, err := os.Stat(name); err == nil {
+			modTimes[name] = info.ModTime()
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return modTimes[matches[i]].Before(modTimes[matches[j]]) })
+
+	removed := 0
+	for _, name := range matches[:len(matches)-maxFiles] {
+		if err := os.Remove(name); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
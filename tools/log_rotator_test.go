@@ -0,0 +1,76 @@
+package tools
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRotatorRotatesOnEachTick(t *testing.T) {
+	CaptureLogs(t) // restores LogWriter once the test is done
+	restoreLogTime(t)
+	SetLogTimezone(time.UTC)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.log")
+	if err := OpenLogFile(path); err != nil {
+		t.Fatalf("OpenLogFile: %v", err)
+	}
+	t.Cleanup(func() { _ = logFile.Close() })
+	opened := logFileOpened.UTC()
+
+	// The mock clock: each tick is one interval later than the last
+	ticks := make(chan time.Time)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runLogRotator(ctx, path, ticks, 2)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	var archives []string
+	for i := 1; i <= 3; i++ {
+		LogJson("before_tick", map[string]any{"tick": i})
+		// Each archive is named after the hour its file was opened: the
+		// previous tick, or OpenLogFile for the first
+		archive := filepath.Join(dir, logArchivePrefix+opened.Add(time.Duration(i-1)*time.Hour).Format(logArchiveTimeFormat)+".log")
+		archives = append(archives, archive)
+		ticks <- opened.Add(time.Duration(i) * time.Hour)
+		if !waitFor(2*time.Second, func() bool { _, err := os.Stat(archive); return err == nil }) {
+			t.Fatalf("tick %d: archive %s not created", i, archive)
+		}
+	}
+
+	// The third rotation prunes the first archive, keeping 2
+	if !waitFor(2*time.Second, func() bool { _, err := os.Stat(archives[0]); return os.IsNotExist(err) }) {
+		t.Errorf("oldest archive %s was not pruned past 2 files", archives[0])
+	}
+	cancel()
+	<-done
+
+	for _, name := range archives[1:] {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("archive %s: %v", name, err)
+		}
+		if !strings.Contains(string(data), `"before_tick"`) {
+			t.Errorf("archive %s = %q, want the entries logged before its rotation", name, data)
+		}
+	}
+
+	LogJson("after_rotation", nil)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("live log file: %v", err)
+	}
+	if !strings.Contains(string(data), `"after_rotation"`) || strings.Contains(string(data), `"before_tick"`) {
+		t.Errorf("live log file = %q, want only entries from after the last rotation", data)
+	}
+}
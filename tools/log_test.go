@@ -0,0 +1,257 @@
+package tools
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restoreLogTime puts the default UTC RFC3339Nano timestamps back after t.
+func restoreLogTime(t *testing.T) {
+	t.Cleanup(func() {
+		SetLogTimezone(nil)
+		_ = SetLogTimeFormat("")
+	})
+}
+
+func TestLogTimezone(t *testing.T) {
+	restoreLogTime(t)
+	zones := []*time.Location{nil, time.UTC, time.FixedZone("IST", 5*3600+1800), time.FixedZone("NST", -(3*3600 + 1800))}
+	for _, name := range []string{"America/New_York", "Asia/Tokyo", "Europe/Berlin"} {
+		if loc, err := time.LoadLocation(name); err == nil {
+			zones = append(zones, loc)
+		}
+	}
+
+	for _, loc := range zones {
+		logs := CaptureLogs(t)
+		SetLogTimezone(loc)
+		LogJsonLevel(LevelInfo, "tz_check", nil)
+
+		want := loc
+		if want == nil {
+			want = time.UTC
+		}
+		entries := logs.Events("tz_check")
+		if len(entries) != 1 {
+			t.Fatalf("%v: got %d entries", want, len(entries))
+		}
+		raw, _ := entries[0]["time"].(string)
+		ts, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			t.Fatalf("%v: time %q: %v", want, raw, err)
+		}
+		_, gotOffset := ts.Zone()
+		_, wantOffset := ts.In(want).Zone()
+		if gotOffset != wantOffset {
+			t.Errorf("%v: time %q has offset %ds, want %ds", want, raw, gotOffset, wantOffset)
+		}
+		if d := time.Since(ts); d < 0 || d > time.Minute {
+			t.Errorf("%v: time %q is %v away from now", want, raw, d)
+		}
+	}
+}
+
+func TestLogTimeFormat(t *testing.T) {
+	restoreLogTime(t)
+	tests := []struct {
+		format string
+		check  func(v any) bool
+	}{
+		{format: "rfc3339", check: func(v any) bool {
+			s, _ := v.(string)
+			_, err := time.Parse(time.RFC3339, s)
+			return err == nil && len(s) == len("2006-01-02T15:04:05Z")
+		}},
+		{format: "rfc3339nano", check: func(v any) bool {
+			s, _ := v.(string)
+			_, err := time.Parse(time.RFC3339Nano, s)
+			return err == nil
+		}},
+		{format: "unix", check: func(v any) bool {
+			f, ok := v.(float64)
+			return ok && f == float64(int64(f)) && time.Since(time.Unix(int64(f), 0)) < time.Minute
+		}},
+	}
+	for _, tt := range tests {
+		logs := CaptureLogs(t)
+		if err := SetLogTimeFormat(tt.format); err != nil {
+			t.Fatalf("SetLogTimeFormat(%q): %v", tt.format, err)
+		}
+		LogJsonLevel(LevelInfo, "format_check", nil)
+		entries := logs.Events("format_check")
+		if len(entries) != 1 || !tt.check(entries[0]["time"]) {
+			t.Errorf("format %s: entries %v", tt.format, entries)
+		}
+	}
+	if err := SetLogTimeFormat("iso8601"); err == nil {
+		t.Error("SetLogTimeFormat accepted an unknown format")
+	}
+}
+
+func TestMinLogLevelBoundaries(t *testing.T) {
+	levels := []LogLevel{LevelDebug, LevelInfo, LevelWarn, LevelError}
+	for _, min := range levels {
+		t.Run(min.String(), func(t *testing.T) {
+			logs := CaptureLogs(t)
+			if err := SetMinLogLevel(min.String()); err != nil {
+				t.Fatalf("SetMinLogLevel(%s): %v", min, err)
+			}
+			for _, level := range levels {
+				LogJsonLevel(level, "level_check_"+level.String(), nil)
+			}
+			for _, level := range levels {
+				entries := logs.Events("level_check_" + level.String())
+				want := 0
+				if level >= min {
+					want = 1
+				}
+				if len(entries) != want {
+					t.Errorf("%s event at minimum %s: %d entries, want %d", level, min, len(entries), want)
+				}
+				if len(entries) == 1 && entries[0]["level"] != level.String() {
+					t.Errorf("level field = %v, want %s", entries[0]["level"], level)
+				}
+			}
+		})
+	}
+}
+
+func TestSetMinLogLevel(t *testing.T) {
+	t.Cleanup(func() { MinLogLevel = LevelInfo })
+	tests := []struct {
+		name    string
+		want    LogLevel
+		wantErr bool
+	}{
+		{"", LevelInfo, false},
+		{"debug", LevelDebug, false},
+		{"Info", LevelInfo, false},
+		{"WARNING", LevelWarn, false},
+		{"warn", LevelWarn, false},
+		{"ERROR", LevelError, false},
+		{"trace", LevelError, true},
+	}
+	for _, tt := range tests {
+		MinLogLevel = LevelError
+		err := SetMinLogLevel(tt.name)
+		if (err != nil) != tt.wantErr || MinLogLevel != tt.want {
+			t.Errorf("SetMinLogLevel(%q): level %s, err %v; want %s, error %v", tt.name, MinLogLevel, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLogJsonDefaultsToInfo(t *testing.T) {
+	logs := CaptureLogs(t)
+	LogJson("legacy_call", nil)
+	if entries := logs.Events("legacy_call"); len(entries) != 1 || entries[0]["level"] != "INFO" {
+		t.Errorf("LogJson entries = %v, want one INFO entry", entries)
+	}
+}
+
+// restoreLogSession puts the process-wide session ID and start time back after t.
+func restoreLogSession(t *testing.T) {
+	prevStart, prevID := startTime, sessionID
+	t.Cleanup(func() { startTime, sessionID = prevStart, prevID })
+}
+
+func TestLogEntriesCarrySessionAndUptime(t *testing.T) {
+	restoreLogSession(t)
+	logs := CaptureLogs(t)
+	id := NewSessionID()
+	StartLogSession(id)
+	startTime = startTime.Add(-1500 * time.Millisecond)
+
+	LogJson("session_info", nil)
+	LogJsonLevel(LevelDebug, "session_debug", map[string]any{"k": "v"})
+	LogJsonLevel(LevelError, "session_error", map[string]any{"error": "boom"})
+
+	for _, event := range []string{"session_info", "session_debug", "session_error"} {
+		entries := logs.Events(event)
+		if len(entries) != 1 {
+			t.Fatalf("%s entries = %d, want 1", event, len(entries))
+		}
+		if entries[0]["session_id"] != id {
+			t.Errorf("%s session_id = %v, want %s", event, entries[0]["session_id"], id)
+		}
+		if uptime, ok := entries[0]["uptime_ms"].(float64); !ok || uptime < 1500 {
+			t.Errorf("%s uptime_ms = %v, want at least 1500", event, entries[0]["uptime_ms"])
+		}
+	}
+}
+
+// uuidV4Pattern matches a lowercase version 4 UUID.
+var uuidV4Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewSessionIDIsUUIDv4(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := NewSessionID()
+		if !uuidV4Pattern.MatchString(id) {
+			t.Fatalf("NewSessionID() = %q, not a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewSessionID() repeated %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestQuietModeOnlyEmitsExceptions(t *testing.T) {
+	logs := CaptureLogs(t)
+	t.Cleanup(func() { quietExcept, quietOut = nil, nil })
+	SetQuietMode([]string{"agent_started", "pebble_empty_exiting"})
+
+	for _, event := range []string{"agent_started", "health_check_result", "pebble_empty_exiting", "grpc_request"} {
+		LogJsonLevel(LevelWarn, event, nil)
+	}
+	LogJsonLevel(LevelError, "pebble_write_error", map[string]any{"error": "boom"})
+
+	for event, want := range map[string]int{
+		"agent_started":        1,
+		"pebble_empty_exiting": 1,
+		"health_check_result":  0,
+		"grpc_request":         0,
+		"pebble_write_error":   0,
+	} {
+		if got := len(logs.Events(event)); got != want {
+			t.Errorf("%s entries in quiet mode = %d, want %d", event, got, want)
+		}
+	}
+}
+
+func TestLogFieldPrefix(t *testing.T) {
+	logs := CaptureLogs(t)
+	SetLogFieldPrefix("test_")
+	t.Cleanup(func() { SetLogFieldPrefix("") })
+
+	LogJsonLevel(LevelWarn, "prefixed_event", map[string]any{"endpoint": "http://x", "status": 503})
+
+	var entry map[string]any
+	logs.mu.Lock()
+	err := json.Unmarshal(logs.buf.Bytes(), &entry)
+	logs.mu.Unlock()
+	if err != nil {
+		t.Fatalf("decode log entry: %v", err)
+	}
+	for key := range entry {
+		if key != "time" && !strings.HasPrefix(key, "test_") {
+			t.Errorf("field %q is not prefixed", key)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("time field was renamed")
+	}
+	for key, want := range map[string]any{"test_event": "prefixed_event", "test_level": "WARN", "test_endpoint": "http://x", "test_status": float64(503)} {
+		if entry[key] != want {
+			t.Errorf("%s = %v, want %v", key, entry[key], want)
+		}
+	}
+	for _, key := range []string{"test_uptime_ms", "test_session_id"} {
+		if _, ok := entry[key]; !ok {
+			t.Errorf("entry lacks %s: %v", key, entry)
+		}
+	}
+}
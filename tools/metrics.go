@@ -0,0 +1,247 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds every Prometheus metric exported by the agent.
+// A private registry is used so only EchoPost's own series are exposed.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	// grpcRequestDuration tracks per-call latency of the local gRPC service.
+	// The 0.99 objective provides the p99 latency used for debugging slow SDK calls.
+	grpcRequestDuration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "echopost_grpc_request_duration_seconds",
+		Help:       "Latency of gRPC requests handled by the agent.",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	}, []string{"method"})
+
+	// grpcPanicsTotal counts handler panics caught by recoveryInterceptor.
+	grpcPanicsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "echopost_grpc_panics_total",
+		Help: "Number of panics recovered in gRPC handlers.",
+	})
+
+	// uploadRequestsTotal counts upload attempts per endpoint and outcome
+	// (success, failure, retry, error).
+	uploadRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echopost_upload_requests_total",
+		Help: "Upload requests to the main server by endpoint and result.",
+	}, []string{"endpoint", "result"})
+
+	// sampledOutTotal counts records dropped by -sample-rate / per-pipeline rates.
+	sampledOutTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "echopost_sampled_out_total",
+		Help: "Records dropped by sampling before being written to Pebble.",
+	})
+
+	// healthCheckErrorsTotal counts failed health requests by ClassifyNetError class.
+	healthCheckErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "echopost_health_check_errors_total",
+		Help: "Health check requests that failed at the network level, by error class.",
+	}, []string{"class"})
+
+	// healthCheckLatency observes the duration of each health request, failed or not.
+	healthCheckLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "echopost_health_check_latency_seconds",
+		Help:    "Latency of health check requests to the main server.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// healthCheckStatusCode is the HTTP status of the last health check (0 when it failed at the network level).
+	healthCheckStatusCode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "echopost_health_check_status_code",
+		Help: "HTTP status code of the last health check, 0 when no response was received.",
+	})
+
+	// pebbleWriteStallsTotal counts Pebble write stalls (WriteStallBegin events).
+	pebbleWriteStallsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "echopost_pebble_write_stalls_total",
+		Help: "Number of Pebble write stalls observed.",
+	})
+
+	// pebbleOpenIterators reports iterators opened through WrapIter and not yet closed.
+	pebbleOpenIterators = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "echopost_pebble_open_iterators",
+		Help: "Pebble iterators currently open.",
+	}, func() float64 { return float64(openIterators.Load()) })
+
+	// grpcActiveConnections reports gRPC client connections currently open.
+	grpcActiveConnections = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "echopost_grpc_active_connections",
+		Help: "gRPC client connections currently open.",
+	}, func() float64 { return float64(connectionCount.Load()) })
+
+	// diskFreeBytes is the free space on the Pebble filesystem from the last disk monitor check.
+	diskFreeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "echopost_disk_free_bytes",
+		Help: "Bytes available on the filesystem holding the Pebble DB.",
+	})
+
+	// writeVerificationFailuresTotal counts SendLog writes whose read-back did not match.
+	writeVerificationFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "echopost_write_verification_failures_total",
+		Help: "Pebble writes that failed read-back verification (-verify-writes).",
+	})
+
+	// walAlertsTotal counts wal_size_alert events raised by the flusher.
+	walAlertsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "echopost_wal_alerts_total",
+		Help: "Number of times the Pebble WAL exceeded the configured size threshold.",
+	})
+
+	// bloomFilterDegradedTotal counts bloom_filter_degraded events from the bloom filter monitor.
+	bloomFilterDegradedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "echopost_bloom_filter_degraded_total",
+		Help: "Times the estimated bloom filter false positive rate exceeded -bloom-fp-alert.",
+	})
+
+	// tailSubscribers tracks clients currently connected to /tail.
+	tailSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "echopost_tail_subscribers_count",
+		Help: "Clients currently subscribed to the /tail SSE endpoint.",
+	})
+)
+
+// recordAgeCollector exports the latest record age scan as the
+// echopost_record_age_seconds histogram. The histogram describes the records
+// currently in Pebble, so each scan replaces the previous one instead of
+// accumulating observations.
+type recordAgeCollector struct {
+	desc *prometheus.Desc
+
+	mu      sync.Mutex
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+// recordAges holds the last ReportRecordAgeHistogram result.
+var recordAges = &recordAgeCollector{
+	desc: prometheus.NewDesc("echopost_record_age_seconds", "Age of the records currently stored in Pebble, from the last scan.", nil, nil),
+}
+
+// set replaces the exported snapshot. buckets maps upper bounds in seconds to cumulative counts.
+func (r *recordAgeCollector) set(count uint64, sum float64, buckets map[float64]uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count, r.sum, r.buckets = count, sum, buckets
+}
+
+func (r *recordAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.desc
+}
+
+func (r *recordAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buckets == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstHistogram(r.desc, r.count, r.sum, r.buckets)
+}
+
+// queueStatsCollector exports echopost_pebble_queue_depth and
+// echopost_pebble_oldest_record_age_seconds. Both are replaced together by
+// set, so a scrape never sees the depth of one flush cycle with the age of
+// another.
+type queueStatsCollector struct {
+	depthDesc *prometheus.Desc
+	ageDesc   *prometheus.Desc
+
+	mu     sync.Mutex
+	depth  int64
+	oldest float64
+}
+
+// queueStats holds the values from the last flush cycle.
+var queueStats = &queueStatsCollector{
+	depthDesc: prometheus.NewDesc("echopost_pebble_queue_depth", "Records waiting in Pebble, as of the last flush cycle.", nil, nil),
+	ageDesc:   prometheus.NewDesc("echopost_pebble_oldest_record_age_seconds", "Age of the oldest record waiting in Pebble, as of the last flush cycle (0 when empty).", nil, nil),
+}
+
+// set replaces both exported values.
+func (q *queueStatsCollector) set(depth int64, oldest time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.depth, q.oldest = depth, oldest.Seconds()
+}
+
+func (q *queueStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- q.depthDesc
+	ch <- q.ageDesc
+}
+
+func (q *queueStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(q.depthDesc, prometheus.GaugeValue, float64(q.depth))
+	ch <- prometheus.MustNewConstMetric(q.ageDesc, prometheus.GaugeValue, q.oldest)
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		grpcRequestDuration,
+		grpcPanicsTotal,
+		uploadRequestsTotal,
+		sampledOutTotal,
+		healthCheckErrorsTotal,
+		healthCheckLatency,
+		healthCheckStatusCode,
+		pebbleWriteStallsTotal,
+		pebbleOpenIterators,
+		tailSubscribers,
+		walAlertsTotal,
+		bloomFilterDegradedTotal,
+		recordAges,
+		grpcActiveConnections,
+		diskFreeBytes,
+		writeVerificationFailuresTotal,
+		queueStats,
+	)
+}
+
+// StartMetricsServer exposes the Prometheus metrics on localhost:<port>/metrics.
+// The server runs in the background and is shut down when ctx is cancelled.
+func StartMetricsServer(ctx context.Context, wg *sync.WaitGroup, port int) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		LogJsonLevel(LevelError, "metrics_listen_error", map[string]any{"error": err.Error()})
+		return err
+	}
+	srv := &http.Server{Handler: mux}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogJsonLevel(LevelError, "metrics_server_error", map[string]any{"error": err.Error()})
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+		LogJsonLevel(LevelInfo, "metrics_server_stopped", nil)
+	}()
+
+	LogJsonLevel(LevelInfo, "metrics_server_started", map[string]any{"addr": lis.Addr().String()})
+	return nil
+}
@@ -0,0 +1,79 @@
+package tools
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrapeMetrics returns the text exposition of every agent metric, as served
+// on /metrics.
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read /metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestQueueDepthGaugeUpdatedOnFlush(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	queueStats.set(0, 0)
+	sendNumbered(t, c, 0, 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	c.FlushPebbleDBOnInterval(ctx, &wg)
+
+	if !waitFor(3*time.Second, func() bool {
+		return strings.Contains(scrapeMetrics(t), "\nechopost_pebble_queue_depth 50\n")
+	}) {
+		t.Fatalf("/metrics after a flush cycle:\n%s\nwant echopost_pebble_queue_depth 50", scrapeMetrics(t))
+	}
+	if strings.Contains(scrapeMetrics(t), "echopost_pebble_oldest_record_age_seconds 0\n") {
+		t.Error("echopost_pebble_oldest_record_age_seconds is 0 with 50 records waiting")
+	}
+}
+
+func TestOldestRecordTimeAcrossKeyFormats(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	if _, ok := c.oldestRecordTime(); ok {
+		t.Fatal("oldestRecordTime reported a record in an empty Pebble")
+	}
+
+	now := time.Now().UTC()
+	oldest := now.Add(-3 * time.Hour)
+	put := func(prefix string, at time.Time) {
+		putRecord(t, c, keyAt(prefix, at, 0), logRecord{Payload: map[string]any{}, ReceivedAt: at.Format(time.RFC3339Nano)})
+	}
+	// The oldest record sits under a later pipeline, behind a newer one
+	put(pipelineKeyPrefix(PriorityNormal, "a"), now.Add(-time.Hour))
+	put(pipelineKeyPrefix(PriorityNormal, "b"), oldest)
+	put(pipelineKeyPrefix(PriorityHigh, "a"), now.Add(-2*time.Hour))
+	put(priorityPrefix(PriorityNormal), now.Add(-time.Minute))
+	put("", now)
+
+	got, ok := c.oldestRecordTime()
+	if !ok || !got.Equal(oldest) {
+		t.Errorf("oldestRecordTime = %v, %v; want %v", got, ok, oldest)
+	}
+}
@@ -0,0 +1,170 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// CurrentSchemaVersion is the logRecord schema written by this build.
+const CurrentSchemaVersion = 1
+
+// recordMigrations upgrades a record from version N (the key) to N+1.
+// Add an entry here whenever CurrentSchemaVersion is bumped.
+var recordMigrations = map[int]func(logRecord) logRecord{
+	0: migrateV0ToV1,
+}
+
+// MigrateRecord upgrades rec one version at a time from fromVersion to toVersion.
+// Versions without a registered migration are only relabelled.
+func MigrateRecord(rec logRecord, fromVersion, toVersion int) logRecord {
+	for v := fromVersion; v < toVersion; v++ {
+		if migrate, ok := recordMigrations[v]; ok {
+			rec = migrate(rec)
+		}
+		rec.SchemaVersion = v + 1
+	}
+	return rec
+}
+
+// migrateV0ToV1 handles records written before schema versioning. Their
+// layout is unchanged, but older agents could store a null payload or
+// pipeline list, which v1 readers expect to be non-nil.
+func migrateV0ToV1(rec logRecord) logRecord {
+	if rec.Payload == nil {
+		rec.Payload = map[string]any{}
+	}
+	if rec.Pipelines == nil {
+		rec.Pipelines = []string{}
+	}
+	return rec
+}
+
+// KeyFormat identifies a layout of Pebble record keys.
+type KeyFormat int
+
+const (
+	// KeyFormatLegacy is "<unix_nano>_<counter>", written before priorities.
+	KeyFormatLegacy KeyFormat = iota
+	// KeyFormatPriority is "<priority prefix><unix_nano>_<counter>", written
+	// before keys carried the pipeline.
+	KeyFormatPriority
+	// KeyFormatPipeline is "<priority prefix><pipeline>/<unix_nano>_<counter>"
+	// with the pipeline path-escaped (see newRecordKey).
+	KeyFormatPipeline
+)
+
+// CurrentKeyFormat is the record key format written by this build.
+const CurrentKeyFormat = KeyFormatPipeline
+
+// migrateKeysBatchSize bounds how many records MigrateKeyFormat moves per commit.
+const migrateKeysBatchSize = 1000
+
+var (
+	legacyKeyPattern   = regexp.MustCompile(`^\d+_\d+$`)
+	priorityKeyPattern = regexp.MustCompile(`^\d/\d+_\d+$`)
+	pipelineKeyPattern = regexp.MustCompile(`^\d/[^/]*/\d+_\d+$`)
+)
+
+// String returns the name of the format.
+func (f KeyFormat) String() string {
+	switch f {
+	case KeyFormatLegacy:
+		return "legacy"
+	case KeyFormatPriority:
+		return "priority"
+	case KeyFormatPipeline:
+		return "pipeline"
+	}
+	return fmt.Sprintf("KeyFormat(%d)", int(f))
+}
+
+// matches reports whether key is laid out in format f.
+func (f KeyFormat) matches(key []byte) bool {
+	switch f {
+	case KeyFormatLegacy:
+		return legacyKeyPattern.Match(key)
+	case KeyFormatPriority:
+		return priorityKeyPattern.Match(key)
+	case KeyFormatPipeline:
+		return pipelineKeyPattern.Match(key)
+	}
+	return false
+}
+
+// rewrite returns key, which is in format f, laid out in format to. The
+// "<unix_nano>_<counter>" part is kept so records keep their order within a
+// priority and pipeline; the priority and pipeline are taken from the stored
+// record.
+func (f KeyFormat) rewrite(key []byte, to KeyFormat, rec logRecord) []byte {
+	base := string(key)
+	if f != KeyFormatLegacy {
+		base = base[strings.LastIndex(base, "/")+1:]
+	}
+	switch to {
+	case KeyFormatPriority:
+		return []byte(priorityPrefix(rec.Priority) + base)
+	case KeyFormatPipeline:
+		return []byte(pipelineKeyPrefix(rec.Priority, keyPipeline(rec.Pipelines)) + base)
+	}
+	return []byte(base)
+}
+
+// MigrateKeyFormat rewrites every record key in format from to format to,
+// moving each value to its new key and deleting the old one in the same
+// batch. Keys are recognised by their structure, so records already in the
+// to format are left alone and running the migration again is a no-op. It
+// returns the number of records moved.
+func MigrateKeyFormat(db PebbleDB, from, to KeyFormat) (int, error) {
+	if from == to {
+		return 0, nil
+	}
+
+	iter, err := db.NewIter(RecordIterOptions())
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	migrated := 0
+	batch := db.NewBatch()
+	defer func() { batch.Close() }()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if !from.matches(iter.Key()) {
+			continue
+		}
+
+		var rec logRecord
+		if err := decodeRecord(iter.Value(), &rec); err != nil {
+			LogJsonLevel(LevelError, "pebble_read_error", map[string]any{"error": err.Error(), "key": string(iter.Key())})
+			continue
+		}
+		if err := batch.Set(from.rewrite(iter.Key(), to, rec), iter.Value(), nil); err != nil {
+			return migrated, err
+		}
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return migrated, err
+		}
+
+		if int(batch.Count())/2 >= migrateKeysBatchSize {
+			if err := batch.Commit(pebble.Sync); err != nil {
+				return migrated, err
+			}
+			migrated += int(batch.Count()) / 2
+			batch.Close()
+			batch = db.NewBatch()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return migrated, err
+	}
+	if batch.Count() > 0 {
+		if err := batch.Commit(pebble.Sync); err != nil {
+			return migrated, err
+		}
+		migrated += int(batch.Count()) / 2
+	}
+	return migrated, nil
+}
@@ -0,0 +1,178 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// putV0Record stores a record as an agent from before schema versioning wrote
+// it: JSON without schema_version, and with a null payload and pipeline list.
+func putV0Record(t *testing.T, c *ServerConfig, key string) {
+	t.Helper()
+	data := `{"payload":null,"pipelines":null,"received_at":"` + time.Now().Format(time.RFC3339Nano) + `","level":"INFO"}`
+	if err := c.Db.Set([]byte(key), []byte(data), pebble.NoSync); err != nil {
+		t.Fatalf("store %s: %v", key, err)
+	}
+	c.recordsStored(1)
+}
+
+func TestMigrateRecord(t *testing.T) {
+	got := MigrateRecord(logRecord{Level: "INFO"}, 0, CurrentSchemaVersion)
+	want := logRecord{SchemaVersion: CurrentSchemaVersion, Level: "INFO", Payload: map[string]any{}, Pipelines: []string{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MigrateRecord from 0 = %+v, want %+v", got, want)
+	}
+
+	// Versions without a registered migration are only relabelled
+	rec := logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"msg": "x"}}
+	if got := MigrateRecord(rec, CurrentSchemaVersion, CurrentSchemaVersion+2); got.SchemaVersion != CurrentSchemaVersion+2 || got.Payload["msg"] != "x" {
+		t.Errorf("MigrateRecord past the last migration = %+v", got)
+	}
+}
+
+func TestProcessPebbleMigratesV0Records(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(data))
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	c := newTestConfig(t, srv.URL)
+	putV0Record(t, c, newRecordKey(PriorityNormal, nil))
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 {
+		t.Fatalf("uploads = %d, want 1", len(bodies))
+	}
+	var body map[string]any
+	if err := json.Unmarshal([]byte(bodies[0]), &body); err != nil {
+		t.Fatalf("decode upload %q: %v", bodies[0], err)
+	}
+	// Unmigrated, the null payload would be sent as "log_data": null
+	if payload, ok := body["log_data"].(map[string]any); !ok || len(payload) != 0 {
+		t.Errorf("uploaded log_data = %v, want an empty object", body["log_data"])
+	}
+	if !PebbleIsEmpty(c.Db) {
+		t.Error("migrated record was not deleted after upload")
+	}
+}
+
+func TestExportsMigrateV0Records(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	key := newRecordKey(PriorityNormal, nil)
+	putV0Record(t, c, key)
+
+	var out bytes.Buffer
+	if n, err := c.ExportToNDJSON(context.Background(), &out); err != nil || n != 1 {
+		t.Fatalf("ExportToNDJSON = %d, %v; want 1", n, err)
+	}
+	var entry exportEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("decode export %q: %v", out.String(), err)
+	}
+	if entry.Key != key || entry.Record.SchemaVersion != CurrentSchemaVersion || entry.Record.Payload == nil || entry.Record.Pipelines == nil {
+		t.Errorf("exported entry = %+v, want key %s migrated to version %d", entry, key, CurrentSchemaVersion)
+	}
+
+	out.Reset()
+	if n, err := c.ExportToCSV(context.Background(), &out, []string{"msg"}); err != nil || n != 1 {
+		t.Fatalf("ExportToCSV = %d, %v; want 1", n, err)
+	}
+	rows := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(rows) != 2 || !strings.HasSuffix(rows[1], ",,") {
+		t.Errorf("CSV export = %q, want a header and one row with empty pipelines and msg", out.String())
+	}
+}
+
+func TestNewRecordKeyIncludesPipeline(t *testing.T) {
+	for _, tc := range []struct {
+		priority  int32
+		pipelines []string
+		prefix    string
+	}{
+		{PriorityNormal, []string{"orders", "audit"}, priorityPrefix(PriorityNormal) + "orders/"},
+		{PriorityHigh, []string{"team/billing"}, priorityPrefix(PriorityHigh) + "team%2Fbilling/"},
+		{PriorityNormal, nil, priorityPrefix(PriorityNormal) + "/"},
+	} {
+		key := newRecordKey(tc.priority, tc.pipelines)
+		if !strings.HasPrefix(key, tc.prefix) || !KeyFormatPipeline.matches([]byte(key)) {
+			t.Errorf("newRecordKey(%d, %v) = %q, want a %s key under %q", tc.priority, tc.pipelines, key, KeyFormatPipeline, tc.prefix)
+		}
+	}
+}
+
+func TestMigrateKeyFormatToPipeline(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	pipelines := [][]string{{"orders"}, {"team/billing", "audit"}, nil}
+
+	want := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		rec := logRecord{Payload: map[string]any{"n": i}, Pipelines: pipelines[i%3]}
+		if i%4 == 0 {
+			rec.Priority = PriorityHigh
+		}
+		base := fmt.Sprintf("%d_%d", minRecordKeyNano+int64(i), i)
+		putRecord(t, c, base, rec)
+		want[pipelineKeyPrefix(rec.Priority, keyPipeline(rec.Pipelines))+base] = fmt.Sprint(i)
+	}
+	for i := 1000; i < 1010; i++ {
+		rec := logRecord{Payload: map[string]any{"n": i}, Pipelines: []string{"orders"}}
+		base := fmt.Sprintf("%d_%d", minRecordKeyNano+int64(i), i)
+		putRecord(t, c, priorityPrefix(PriorityNormal)+base, rec)
+		want[pipelineKeyPrefix(PriorityNormal, "orders")+base] = fmt.Sprint(i)
+	}
+	current := newRecordKey(PriorityNormal, []string{"orders"})
+	putRecord(t, c, current, logRecord{Payload: map[string]any{"n": "current"}, Pipelines: []string{"orders"}})
+	want[current] = "current"
+
+	if n, err := MigrateKeyFormat(c.Db.DB(), KeyFormatLegacy, KeyFormatPipeline); err != nil || n != 1000 {
+		t.Fatalf("MigrateKeyFormat from legacy = %d, %v; want 1000", n, err)
+	}
+	if n, err := MigrateKeyFormat(c.Db.DB(), KeyFormatPriority, KeyFormatPipeline); err != nil || n != 10 {
+		t.Fatalf("MigrateKeyFormat from priority = %d, %v; want 10", n, err)
+	}
+	for _, from := range []KeyFormat{KeyFormatLegacy, KeyFormatPriority} {
+		if n, err := MigrateKeyFormat(c.Db.DB(), from, KeyFormatPipeline); err != nil || n != 0 {
+			t.Errorf("second MigrateKeyFormat from %s = %d, %v; want a no-op", from, n, err)
+		}
+	}
+
+	keys := storedKeys(t, c)
+	if len(keys) != len(want) {
+		t.Fatalf("records after migration = %d, want %d", len(keys), len(want))
+	}
+	for key, n := range want {
+		data, err := c.Db.Get([]byte(key))
+		if err != nil {
+			t.Errorf("record %s after migration: %v", key, err)
+			continue
+		}
+		var rec logRecord
+		if err := decodeRecord(data, &rec); err != nil || fmt.Sprint(rec.Payload["n"]) != n {
+			t.Errorf("record %s = %+v, %v; want n=%s", key, rec, err, n)
+		}
+		if !KeyFormatPipeline.matches([]byte(key)) {
+			t.Errorf("migrated key %q is not in the %s format", key, KeyFormatPipeline)
+		}
+	}
+}
@@ -1,175 +1,1694 @@
 package tools
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"math/rand"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/datanadhi/echopost/logagentpb"
 
 	"github.com/cockroachdb/pebble"
-	flow "github.com/datanadhi/flowhttp/client"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
+// PebbleDB is the subset of *pebble.DB used by PebbleManager. Production code
+// always runs on a *pebble.DB; the interface lets tests put a wrapper such as
+// the FaultInjectingDB in testing_helpers_test.go in front of it (see
+// PebbleManager.Wrap).
+type PebbleDB interface {
+	Get(key []byte) ([]byte, io.Closer, error)
+	Set(key, value []byte, opts *pebble.WriteOptions) error
+	Delete(key []byte, opts *pebble.WriteOptions) error
+	NewBatch() *pebble.Batch
+	NewIter(opts *pebble.IterOptions) (*pebble.Iterator, error)
+	Flush() error
+	LogData(data []byte, opts *pebble.WriteOptions) error
+	Metrics() *pebble.Metrics
+	Checkpoint(destDir string, opts ...pebble.CheckpointOption) error
+	Close() error
+}
+
+var _ PebbleDB = (*pebble.DB)(nil)
+
 // logRecord represents the structure of each log stored in Pebble.
 // It holds the payload (actual log data), pipeline identifiers, and timestamp.
+// SchemaVersion is 0 for records written before versioning was introduced.
 type logRecord struct {
-	Payload    map[string]any `json:"payload"`
-	Pipelines  []string       `json:"pipelines"`
-	ReceivedAt string         `json:"received_at"`
+	SchemaVersion int               `json:"schema_version"`
+	Payload       map[string]any    `json:"payload"`
+	Pipelines     []string          `json:"pipelines"`
+	ReceivedAt    string            `json:"received_at"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Priority      int32             `json:"priority,omitempty"`
+	Level         string            `json:"level,omitempty"`
+	Delivered     []string          `json:"delivered,omitempty"` // Pipelines already accepted by their endpoint
+}
+
+// pendingPipelines returns the pipelines not yet in Delivered, in order.
+func (r logRecord) pendingPipelines() []string {
+	if len(r.Delivered) == 0 {
+		return r.Pipelines
+	}
+	var pending []string
+	for _, p := range r.Pipelines {
+		if !slices.Contains(r.Delivered, p) {
+			pending = append(pending, p)
+		}
+	}
+	return pending
+}
+
+// Record priorities. Higher values are uploaded first.
+const (
+	PriorityNormal int32 = 0
+	PriorityHigh   int32 = 1
+
+	maxPriority = PriorityHigh
+)
+
+// priorityPrefix returns the key prefix for a priority. The prefix is inverted
+// (high = "0/", normal = "1/") so that Pebble's lexical ordering yields
+// high-priority records first. Keys written before priorities existed have
+// no prefix and sort after every prefixed key.
+func priorityPrefix(priority int32) string {
+	priority = max(PriorityNormal, min(priority, maxPriority))
+	return fmt.Sprintf("%d/", maxPriority-priority)
+}
+
+// pipelineKeyPrefix returns "<priority prefix><pipeline>/", the prefix of the
+// keys of a pipeline's records. The pipeline is path-escaped so it never
+// contains a "/" of its own.
+func pipelineKeyPrefix(priority int32, pipeline string) string {
+	return priorityPrefix(priority) + url.PathEscape(pipeline) + "/"
+}
+
+// keyPipeline returns the pipeline a record is keyed by: the first of its
+// pipelines, or "" when it has none.
+func keyPipeline(pipelines []string) string {
+	if len(pipelines) == 0 {
+		return ""
+	}
+	return pipelines[0]
+}
+
+// newRecordKey builds a Pebble key of the form
+// "<priority prefix><pipeline>/<unix_nano>_<counter>" (KeyFormatPipeline).
+func newRecordKey(priority int32, pipelines []string) string {
+	return fmt.Sprintf("%s%d_%d", pipelineKeyPrefix(priority, keyPipeline(pipelines)), time.Now().UnixNano(), rand.Intn(1000))
 }
 
 // SendLog handles gRPC log requests coming from the SDK or application.
 // It stores incoming logs into Pebble with a unique key, ensuring persistence
-// even if the main server is unreachable.
+// even if the main server is unreachable. Successful responses carry a
+// backpressure hint (see backpressureHint) and the current queue depth so
+// SDKs can slow down early.
 func (s *server) SendLog(ctx context.Context, req *pb.LogRequest) (*pb.LogResponse, error) {
+	s.config.countReceived(req.JsonData)
+	resp, err := s.sendLog(ctx, req)
+	if resp != nil && resp.Success {
+		resp.BackpressureRatio, resp.RetryAfterMs = s.config.backpressureHint()
+		resp.QueueDepth, resp.MaxQueueDepth = s.config.recordCount.Load(), s.config.MaxRecords
+	}
+	return resp, err
+}
+
+// Backpressure hint thresholds: past backpressureSlowdownRatio of MaxRecords
+// the suggested delay grows linearly up to backpressureMaxRetryAfter when full.
+const (
+	backpressureSlowdownRatio = 0.8
+	backpressureMaxRetryAfter = time.Second
+)
+
+// backpressureHint returns the fill ratio of Pebble against MaxRecords and
+// the delay, in milliseconds, the SDK should wait before its next send.
+// Both are 0 when MaxRecords is not set.
+func (c *ServerConfig) backpressureHint() (float64, int64) {
+	if c.MaxRecords <= 0 {
+		return 0, 0
+	}
+	ratio := float64(c.recordCount.Load()) / float64(c.MaxRecords)
+	if ratio <= backpressureSlowdownRatio {
+		return ratio, 0
+	}
+	over := min((ratio-backpressureSlowdownRatio)/(1-backpressureSlowdownRatio), 1)
+	retryAfter := time.Duration(over * float64(backpressureMaxRetryAfter)).Round(time.Millisecond)
+	return ratio, max(retryAfter.Milliseconds(), 1)
+}
+
+// BackpressureDelay is how long an SDK should wait before its next send: its
+// own interval, or the RetryAfterMs suggested in resp when that is longer.
+func BackpressureDelay(resp *pb.LogResponse, interval time.Duration) time.Duration {
+	return max(interval, time.Duration(resp.GetRetryAfterMs())*time.Millisecond)
+}
+
+// sendLog stores one request; SendLog adds the backpressure hint and queue depth.
+func (s *server) sendLog(ctx context.Context, req *pb.LogRequest) (*pb.LogResponse, error) {
+	if err := s.config.checkPipelines(ctx, req.Pipelines); err != nil {
+		return nil, err
+	}
+	if reason := s.config.backpressureReason(); reason != "" {
+		return nil, status.Error(codes.ResourceExhausted, reason+", retry later")
+	}
+	release, err := s.config.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if s.config.dedup != nil && req.RequestId != "" {
+		if !s.config.dedup.claim(req.RequestId) {
+			LogJsonLevel(LevelDebug, "log_duplicate", map[string]any{"request_id": req.RequestId})
+			return &pb.LogResponse{Success: true, Message: "idempotent_duplicate"}, nil
+		}
+	}
+	if req.ChunkTotal > 1 {
+		return s.config.storeChunk(ctx, req)
+	}
+	if s.config.sampledOut(req.Pipelines) {
+		return &pb.LogResponse{Success: true, Message: "sampled_out"}, nil
+	}
+
+	rec := s.config.newLogRecord(ctx, req)
+
+	data, _ := s.config.encodeRecord(rec)
+	key := s.config.recordKey(rec)
+
+	if err := s.config.storeRecord([]byte(key), data, s.config.writeOptionsFor(req.Pipelines)); err != nil {
+		if s.config.InMemoryFallback {
+			s.config.bufferInMemory([]byte(key), rec, err)
+			return &pb.LogResponse{Success: true, Message: "buffered_in_memory"}, nil
+		}
+		logAggregatedError(LevelError, "pebble_write_error", map[string]any{"error": err.Error()})
+		if s.config.dedup != nil && req.RequestId != "" {
+			s.config.dedup.forget(req.RequestId)
+		}
+		return &pb.LogResponse{Success: false, Message: "Db write failed"}, nil
+	}
+	if s.config.VerifyWrites && !s.config.verifyWrite([]byte(key), data) {
+		if s.config.dedup != nil && req.RequestId != "" {
+			s.config.dedup.forget(req.RequestId)
+		}
+		return &pb.LogResponse{Success: false, Message: "Db write verification failed"}, nil
+	}
+
+	s.config.recordsStored(1)
+	LogJsonLevel(LevelDebug, "log_stored", map[string]any{"key": key})
+	if s.config.tail != nil {
+		s.config.tail.publish(rec)
+	}
+	return &pb.LogResponse{Success: true, Message: "stored"}, nil
+}
+
+// verifyWrite reads key back and compares it with the bytes just written.
+// On a mismatch the key is deleted so the corrupted record is never uploaded.
+func (c *ServerConfig) verifyWrite(key, data []byte) bool {
+	stored, err := c.Db.Get(key)
+	if err == nil && bytes.Equal(stored, data) {
+		return true
+	}
+	fields := map[string]any{"key": string(key)}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	if err := c.Db.Delete(key, pebble.Sync); err != nil {
+		fields["delete_error"] = err.Error()
+	}
+	writeVerificationFailuresTotal.Inc()
+	LogJsonLevel(LevelError, "write_verification_failed", fields)
+	return false
+}
+
+// checkPipelines rejects requests without pipelines or with more than
+// MaxPipelinesPerRequest of them, since each pipeline can turn into a
+// separate upload. Violations are logged with the caller's identity.
+func (c *ServerConfig) checkPipelines(ctx context.Context, pipelines []string) error {
+	if len(pipelines) == 0 {
+		return status.Error(codes.InvalidArgument, "no_pipelines")
+	}
+	if c.MaxPipelinesPerRequest > 0 && len(pipelines) > c.MaxPipelinesPerRequest {
+		fields := clientIdentity(ctx)
+		fields["pipeline_count"] = len(pipelines)
+		fields["limit"] = c.MaxPipelinesPerRequest
+		LogJsonLevel(LevelWarn, "too_many_pipelines", fields)
+		return status.Error(codes.InvalidArgument, "too_many_pipelines")
+	}
+	c.warnUnknownPipelines(pipelines)
+	return nil
+}
+
+// warnUnknownPipelines logs pipelines missing from KnownPipelines. The
+// request is still accepted: the list may be stale, and the server has the
+// final say at upload.
+func (c *ServerConfig) warnUnknownPipelines(pipelines []string) {
+	c.knownPipelinesMu.RLock()
+	defer c.knownPipelinesMu.RUnlock()
+	if len(c.knownPipelineSet) == 0 {
+		return
+	}
+	for _, p := range pipelines {
+		if !c.knownPipelineSet[p] {
+			logAggregatedError(LevelWarn, "unknown_pipeline", map[string]any{"pipeline": p})
+		}
+	}
+}
+
+// clientIdentity describes the gRPC caller from its peer address and
+// user-agent metadata, for logging rejected requests.
+func clientIdentity(ctx context.Context) map[string]any {
+	fields := map[string]any{}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields["peer"] = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ua := md.Get("user-agent"); len(ua) > 0 {
+			fields["user_agent"] = ua[0]
+		}
+	}
+	return fields
+}
+
+// streamBatchSize is the number of streamed records committed to Pebble at once.
+const streamBatchSize = 100
+
+// streamRecord is a record StreamLogs has yet to commit.
+type streamRecord struct {
+	key, value []byte
+}
+
+// StreamLogs receives a client stream of log requests over a single call.
+// Records are written in Pebble batches of streamBatchSize and committed again
+// when the client closes the stream; one summary response is sent at the end.
+// Like SendLog, the stream must pass admitIngestion, and each batch commit is
+// a write admitted by beginWrite.
+func (s *server) StreamLogs(stream pb.LogAgent_StreamLogsServer) error {
+	if err := s.config.admitIngestion(stream.Context()); err != nil {
+		return err
+	}
+
+	var received, failed int64
+	var pending []streamRecord
+	syncBatch := false
+
+	// commit writes the pending records once beginWrite admits them. The batch
+	// is built under the gate so that it is applied to the DB of the current
+	// session. When it is refused the stream ends with that error and the
+	// records are not stored.
+	commit := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		release, err := s.config.beginWrite(stream.Context())
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		batch := s.config.Db.NewBatch()
+		defer func() { _ = batch.Close() }()
+		for _, r := range pending {
+			if err := batch.Set(r.key, r.value, nil); err != nil {
+				failed++
+			}
+		}
+		opts := pebble.NoSync
+		if syncBatch {
+			opts = pebble.Sync
+		}
+		if err := s.config.Db.Commit(batch, opts); err != nil {
+			logAggregatedError(LevelError, "pebble_write_error", map[string]any{"error": err.Error(), "batch_size": batch.Count()})
+			failed += int64(batch.Count())
+		} else {
+			s.config.recordsStored(int64(batch.Count()))
+		}
+		pending = pending[:0]
+		syncBatch = false
+		return nil
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = commit()
+			LogJsonLevel(LevelError, "stream_recv_error", map[string]any{"error": err.Error(), "received_count": received})
+			return err
+		}
+		received++
+		s.config.countReceived(req.JsonData)
+		if s.config.MaxPayloadBytes > 0 && len(req.JsonData) > s.config.MaxPayloadBytes {
+			failed++
+			continue
+		}
+		if s.config.backpressureReason() != "" {
+			failed++
+			continue
+		}
+		if s.config.checkPipelines(stream.Context(), req.Pipelines) != nil {
+			failed++
+			continue
+		}
+		if req.ChunkTotal > 1 {
+			// Chunked payloads are only assembled through SendLog
+			failed++
+			continue
+		}
+		if s.config.sampledOut(req.Pipelines) {
+			continue
+		}
+
+		rec := s.config.newLogRecord(stream.Context(), req)
+		data, _ := s.config.encodeRecord(rec)
+		pending = append(pending, streamRecord{key: []byte(s.config.recordKey(rec)), value: data})
+		if s.config.writeOptionsFor(req.Pipelines) == pebble.Sync {
+			syncBatch = true
+		}
+
+		if len(pending) >= streamBatchSize {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+
+	LogJsonLevel(LevelDebug, "log_stream_stored", map[string]any{"received_count": received, "failed_count": failed})
+	return stream.SendAndClose(&pb.StreamLogResponse{ReceivedCount: received, FailedCount: failed})
+}
+
+// ValidateSampleRate rejects sample rates outside (0, 1]. Dropping every
+// record is not a sampling rate, so 0 is refused rather than given a meaning.
+func ValidateSampleRate(rate float64) error {
+	if !(rate > 0 && rate <= 1) {
+		return fmt.Errorf("sample rate must be in (0, 1], got %v", rate)
+	}
+	return nil
+}
+
+// sampledOut decides whether a record is dropped by sampling. The effective
+// rate is the highest PipelineSampleRates override among the record's
+// pipelines, or SampleRate when none of them has an override. SampleRate is
+// only zero when the field is left unset, which keeps everything; rates
+// given on the command line are checked by ValidateSampleRate.
+func (c *ServerConfig) sampledOut(pipelines []string) bool {
+	rate, overridden := 0.0, false
+	for _, p := range pipelines {
+		if r, ok := c.PipelineSampleRates[p]; ok {
+			rate, overridden = max(rate, r), true
+		}
+	}
+	if !overridden {
+		if c.SampleRate <= 0 {
+			return false
+		}
+		rate = c.SampleRate
+	}
+
+	if rate >= 1 || rand.Float64() < rate {
+		return false
+	}
+	sampledOutTotal.Inc()
+	c.stats.dropped.Add(1)
+	return true
+}
+
+// newLogRecord converts an incoming request into the record stored in Pebble.
+// Payloads that are not valid JSON objects are stored as an empty object.
+// EnrichHooks run last, after cloud and connection metadata (see Connect)
+// have been attached.
+func (c *ServerConfig) newLogRecord(ctx context.Context, req *pb.LogRequest) logRecord {
 	var out map[string]any
 	if err := json.Unmarshal([]byte(req.JsonData), &out); err != nil {
 		out = map[string]any{}
 	}
+	level := recordLevel(req.Level, out)
+	if c.FlattenPayload {
+		out = flattenMap(out, "", c.FlattenDepth)
+	}
 	rec := logRecord{
-		Payload:    out,
-		Pipelines:  req.Pipelines,
-		ReceivedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		SchemaVersion: CurrentSchemaVersion,
+		Payload:       out,
+		Pipelines:     req.Pipelines,
+		ReceivedAt:    time.Now().UTC().Format(time.RFC3339Nano),
+		Priority:      req.Priority,
+		Level:         level,
+	}
+	if md := c.CloudMetadata.ToMap(); len(md) > 0 {
+		rec.Metadata = md
+	}
+	if md := connectionMetadata(ctx); len(md) > 0 {
+		if rec.Metadata == nil {
+			rec.Metadata = make(map[string]string, len(md))
+		}
+		maps.Copy(rec.Metadata, md)
+	}
+	for _, enrich := range c.EnrichHooks {
+		enrich(&rec)
 	}
+	return rec
+}
 
-	data, _ := json.Marshal(rec)
-	key := fmt.Sprintf("%d_%d", time.Now().UnixNano(), rand.Intn(1000))
+// levelKeys are the payload fields promoted to logRecord.Level, in order of preference.
+var levelKeys = []string{"level", "severity", "log_level"}
 
-	if err := s.config.Db.Set([]byte(key), data, pebble.NoSync); err != nil {
-		LogJson("pebble_write_error", map[string]any{"error": err.Error()})
-		return &pb.LogResponse{Success: false, Message: "Db write failed"}, nil
+// recordLevel returns the level of a new record: explicit when set, otherwise
+// the first string found under levelKeys in the payload. Known names are
+// normalised to DEBUG, INFO, WARN or ERROR; anything else is kept as sent.
+func recordLevel(explicit string, payload map[string]any) string {
+	level := explicit
+	for _, key := range levelKeys {
+		if level != "" {
+			break
+		}
+		level, _ = payload[key].(string)
 	}
+	if l, err := ParseLogLevel(level); err == nil {
+		return l.String()
+	}
+	return level
+}
 
-	LogJson("log_stored", map[string]any{"key": key})
-	return &pb.LogResponse{Success: true, Message: "stored"}, nil
+// flattenMap merges nested objects into top-level keys joined with dots,
+// e.g. {"a":{"b":1}} becomes {"a.b":1}. Objects deeper than depth levels are
+// kept as-is under their flattened key; arrays are never flattened. Empty
+// objects are kept too, since flattening them would drop their key.
+func flattenMap(m map[string]any, prefix string, depth int) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := v.(map[string]any); ok && len(nested) > 0 && depth > 0 {
+			for fk, fv := range flattenMap(nested, key, depth-1) {
+				out[fk] = fv
+			}
+			continue
+		}
+		out[key] = v
+	}
+	return out
+}
+
+// writeOptionsFor picks the durability of a write. Records for any pipeline listed
+// in SyncPipelines are fsynced immediately; everything else relies on the
+// periodic flusher.
+func (c *ServerConfig) writeOptionsFor(pipelines []string) *pebble.WriteOptions {
+	for _, p := range pipelines {
+		if slices.Contains(c.SyncPipelines, p) {
+			return pebble.Sync
+		}
+	}
+	return pebble.NoSync
 }
 
 // FlushPebbleDB ensures that all in-memory data is written to disk
 // and the write-ahead log (WAL) is synced. This prevents data loss
 // if the agent crashes or is terminated unexpectedly.
-func FlushPebbleDB(db *pebble.DB) {
+func FlushPebbleDB(db *PebbleManager) {
 	if db != nil {
 		if err := db.Flush(); err != nil {
-			LogJson("pebble_flush_error", map[string]any{"error": err.Error()})
+			LogJsonLevel(LevelError, "pebble_flush_error", map[string]any{"error": err.Error()})
 		}
 		if err := db.LogData(nil, pebble.Sync); err != nil {
-			LogJson("pebble_wal_sync_error", map[string]any{"error": err.Error()})
+			LogJsonLevel(LevelError, "pebble_wal_sync_error", map[string]any{"error": err.Error()})
 		}
 	}
 }
 
+// recordsStored adds n new records to recordCount. Each time the count passes
+// a multiple of FlushThresholdRecords the flusher is woken, so a burst of
+// records is not left only in the WAL until the next interval flush.
+func (c *ServerConfig) recordsStored(n int64) {
+	total := c.recordCount.Add(n)
+	threshold := int64(c.FlushThresholdRecords)
+	if threshold <= 0 || total/threshold == (total-n)/threshold {
+		return
+	}
+	select {
+	case c.flushNowChan() <- struct{}{}:
+	default:
+	}
+}
+
+// flushNowChan returns the channel that wakes the flusher early. It is created
+// on first use because SendLog can run before the flusher starts.
+func (c *ServerConfig) flushNowChan() chan struct{} {
+	c.flushNowOnce.Do(func() { c.flushNow = make(chan struct{}, 1) })
+	return c.flushNow
+}
+
+// defaultFlushInterval is used when FlushInterval is unset.
+const defaultFlushInterval = time.Second
+
+// flushInterval returns how often FlushPebbleDBOnInterval flushes Pebble.
+func (c *ServerConfig) flushInterval() time.Duration {
+	if c.FlushInterval > 0 {
+		return c.FlushInterval
+	}
+	return defaultFlushInterval
+}
+
 // FlushPebbleDBOnInterval runs a background goroutine that periodically flushes
-// Pebble to disk every second. It stops automatically when the context is canceled.
+// Pebble to disk every FlushInterval, and early whenever FlushThresholdRecords
+// more records have been stored. It stops automatically when the context is
+// canceled.
 func (c *ServerConfig) FlushPebbleDBOnInterval(ctx context.Context, wg *sync.WaitGroup) {
+	heartbeat := c.watchdog.Heartbeat("pebble_flusher")
+	if c.processNow == nil {
+		c.processNow = make(chan struct{}, 1)
+	}
+	flushNow := c.flushNowChan()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		ticker := time.NewTicker(1 * time.Second)
+		ticker := time.NewTicker(c.flushInterval())
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ctx.Done():
-				LogJson("flusher_stopping", nil)
+				LogJsonLevel(LevelInfo, "flusher_stopping", nil)
 				return
+			case <-flushNow:
+				LogJsonLevel(LevelDebug, "flush_threshold_reached", map[string]any{"threshold": c.FlushThresholdRecords})
+				FlushPebbleDB(c.Db)
 			case <-ticker.C:
 				FlushPebbleDB(c.Db)
+				if c.InMemoryFallback && c.fallback.len() > 0 {
+					c.retryFallbackWrites()
+				}
+				c.updateQueueStats()
+				Beat(heartbeat)
+				if c.recordCountPath != "" {
+					if err := c.SnapshotRecordCount(c.recordCountPath); err != nil {
+						LogJsonLevel(LevelError, "record_count_snapshot_error", map[string]any{"error": err.Error()})
+					}
+				}
+				c.checkWALSize()
+				c.checkProcessTrigger()
 			}
 		}
 	}()
 }
 
-// deleteKeysBatch removes a batch of keys from Pebble in a single atomic operation.
-// It uses a write batch for better efficiency and durability.
-func deleteKeysBatch(db *pebble.DB, keys [][]byte) error {
-	batch := db.NewBatch()
-	defer batch.Close()
+// checkWALSize raises wal_size_alert when the live WAL is larger than
+// WALSizeAlertThresholdMB, a sign the memtable is not flushed fast enough.
+// With WALForceFlushOnAlert the memtable is flushed again right away.
+func (c *ServerConfig) checkWALSize() {
+	if c.WALSizeAlertThresholdMB <= 0 {
+		return
+	}
+	metrics, err := c.Db.Metrics()
+	if err != nil {
+		return
+	}
+	threshold := uint64(c.WALSizeAlertThresholdMB) << 20
+	if metrics.WAL.Size <= threshold {
+		return
+	}
 
-	for _, key := range keys {
-		if err := batch.Delete(key, nil); err != nil {
-			return err
+	walAlertsTotal.Inc()
+	LogJsonLevel(LevelWarn, "wal_size_alert", map[string]any{"wal_size_bytes": metrics.WAL.Size, "threshold_bytes": threshold})
+	if c.WALForceFlushOnAlert {
+		if err := c.Db.Flush(); err != nil {
+			LogJsonLevel(LevelError, "pebble_flush_error", map[string]any{"error": err.Error()})
 		}
 	}
+}
 
-	return batch.Commit(pebble.NoSync)
+// ProcessNow is signalled by the flusher when Pebble grows past
+// ProcessTriggerSizeMB while the server is healthy, so the main loop can start
+// ProcessPebble without waiting out its sleep.
+func (c *ServerConfig) ProcessNow() <-chan struct{} {
+	return c.processNow
 }
 
-// ProcessPebble scans through all stored logs in Pebble and sends them to the main server.
-// It removes logs that were successfully delivered or permanently failed (4xx/5xx <= 500),
-// while retaining those that failed due to transient errors (5xx > 500).
-func (c *ServerConfig) ProcessPebble(ctx context.Context) error {
-	client := flow.NewClient(5 * time.Second)
-	var serverErr error
+// checkProcessTrigger signals processNow when the size threshold is exceeded.
+func (c *ServerConfig) checkProcessTrigger() {
+	if c.ProcessTriggerSizeMB <= 0 || !c.serverHealthy.Load() {
+		return
+	}
+	metrics, err := c.Db.Metrics()
+	if err != nil {
+		return
+	}
+	usage := metrics.DiskSpaceUsage()
+	if usage <= uint64(c.ProcessTriggerSizeMB)<<20 {
+		return
+	}
+	select {
+	case c.processNow <- struct{}{}:
+		LogJsonLevel(LevelInfo, "process_triggered_by_size", map[string]any{"disk_usage_bytes": usage, "threshold_mb": c.ProcessTriggerSizeMB})
+	default:
+	}
+}
 
-	FlushPebbleDB(c.Db)
-	defer FlushPebbleDB(c.Db)
+// backpressureReason returns why ingestion is currently refused, or "" when
+// it is not: a Pebble write stall or low disk space.
+func (c *ServerConfig) backpressureReason() string {
+	switch {
+	case c.pebbleBackpressure.Load():
+		return "pebble write stall"
+	case c.diskLow.Load():
+		return "disk space low"
+	}
+	return ""
+}
+
+// StartWriteStallDetector polls the write stall counters every 500ms.
+// While Pebble is stalling, pebbleBackpressure is set so SendLog rejects new
+// logs with ResourceExhausted; it is cleared once a full interval passes with
+// no stall in progress and no new stalls.
+func (c *ServerConfig) StartWriteStallDetector(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
 
-	iter, err := c.Db.NewIter(nil)
+		last := c.writeStalls.Load()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current := c.writeStalls.Load()
+				stalling := current > last || c.writeStallActive.Load()
+				last = current
+
+				if stalling && !c.pebbleBackpressure.Load() {
+					c.pebbleBackpressure.Store(true)
+					LogJsonLevel(LevelWarn, "write_stall_detected", map[string]any{"write_stalls": current})
+				} else if !stalling && c.pebbleBackpressure.Load() {
+					c.pebbleBackpressure.Store(false)
+					LogJsonLevel(LevelInfo, "write_stall_cleared", nil)
+				}
+			}
+		}
+	}()
+}
+
+// ProcessCursorFile is the name, in baseDir, of the file holding the
+// ProcessPebble cursors, one key per line.
+const ProcessCursorFile = "process-cursor"
+
+// processDeleteBatchSize is the number of handled records ProcessPebble
+// deletes, and advances the cursors past, at a time.
+const processDeleteBatchSize = 1000
+
+// ReadCursor returns the key stored by WriteCursor, or "" when path does not exist.
+func ReadCursor(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer iter.Close()
+	return string(data), nil
+}
 
-	var keys [][]byte
-	count := 0
+// WriteCursor stores key at path. The file is replaced atomically so a crash
+// never leaves a partial key.
+func WriteCursor(path, key string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(key), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
 
-	for iter.First(); iter.Valid(); iter.Next() {
-		// Stop processing if context canceled
-		if ctx.Err() != nil {
-			break
+// cursorPrefix returns the priority prefix of a record key, or "" for a key
+// written before priorities existed. ProcessPebble keeps one cursor per
+// priority prefix.
+func cursorPrefix(key []byte) string {
+	for p := maxPriority; p >= PriorityNormal; p-- {
+		if prefix := priorityPrefix(p); bytes.HasPrefix(key, []byte(prefix)) {
+			return prefix
 		}
+	}
+	return ""
+}
 
-		var rec logRecord
-		if err := json.Unmarshal(iter.Value(), &rec); err != nil {
-			LogJson("pebble_read_error", map[string]any{"error": err.Error()})
-			continue
+// readProcessCursors returns the saved cursor of each priority prefix. The
+// highest priority has none: its records are always scanned from the start.
+func (c *ServerConfig) readProcessCursors() (map[string]string, error) {
+	cursors := map[string]string{}
+	if c.processCursorPath == "" {
+		return cursors, nil
+	}
+	data, err := ReadCursor(c.processCursorPath)
+	if err != nil {
+		return cursors, err
+	}
+	for _, key := range strings.Split(data, "\n") {
+		if prefix := cursorPrefix([]byte(key)); key != "" && prefix != priorityPrefix(maxPriority) {
+			cursors[prefix] = key
 		}
+	}
+	return cursors, nil
+}
 
-		addKey, err := c.sendToServer(rec, client)
-		if err != nil {
-			serverErr = err
-			break
-		}
+// writeProcessCursors saves cursors, one key per line, or removes the cursor
+// file when there are none.
+func (c *ServerConfig) writeProcessCursors(cursors map[string]string) {
+	if c.processCursorPath == "" {
+		return
+	}
+	if len(cursors) == 0 {
+		c.resetProcessCursor()
+		return
+	}
+	keys := slices.Sorted(maps.Values(cursors))
+	if err := WriteCursor(c.processCursorPath, strings.Join(keys, "\n")); err != nil {
+		LogJsonLevel(LevelError, "process_cursor_error", map[string]any{"error": err.Error()})
+	}
+}
 
-		if addKey {
-			count++
-			keyCopy := make([]byte, len(iter.Key()))
-			copy(keyCopy, iter.Key())
-			keys = append(keys, keyCopy)
-		}
+// resetProcessCursor removes the cursor so the next ProcessPebble starts from
+// the first key.
+func (c *ServerConfig) resetProcessCursor() {
+	if c.processCursorPath == "" {
+		return
+	}
+	if err := os.Remove(c.processCursorPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		LogJsonLevel(LevelError, "process_cursor_error", map[string]any{"error": err.Error()})
 	}
+}
 
-	// Delete successfully processed or permanently failed records
-	if len(keys) > 0 {
-		if err := deleteKeysBatch(c.Db, keys); err != nil {
-			LogJson("pebble_delete_error", map[string]any{"error": err.Error()})
-			return err
+// skipToCursor moves iter, whose last move returned valid, past the keys
+// below the cursor of their priority prefix, and reports whether it is still
+// positioned on a key.
+func skipToCursor(iter *pebble.Iterator, valid bool, cursors map[string]string) bool {
+	for valid {
+		cursor, ok := cursors[cursorPrefix(iter.Key())]
+		if !ok || bytes.Compare(iter.Key(), []byte(cursor)) >= 0 {
+			return true
 		}
-		LogJson("pebble_processed", map[string]any{"processed_count": count})
-	} else {
-		LogJson("pebble_processed_none", nil)
+		valid = iter.SeekGE([]byte(cursor))
 	}
+	return false
+}
 
-	return serverErr
+// cursorTracker advances the cursor of each priority prefix over the records
+// of a ProcessPebble pass in the order they were read. Workers finish out of
+// order, so a cursor only moves up to the last key of an unbroken run of
+// removed records: once a record of a prefix is kept, or was not handled, the
+// prefix's cursor stays where it was for the rest of the pass.
+type cursorTracker struct {
+	cursors map[string]string // Cursor per priority prefix
+	stopped map[string]bool   // Prefixes with a kept record in this pass
+	handled map[int]trackedRecord
+	next    int // Sequence number of the next record to apply
 }
 
-// PebbleIsEmpty checks if the Pebble database is empty.
-// Used mainly during agent shutdown to decide whether to delete the DB directory.
-func PebbleIsEmpty(db *pebble.DB) bool {
-	if db == nil {
-		return true
+type trackedRecord struct {
+	key     []byte
+	removed bool
+}
+
+func newCursorTracker(cursors map[string]string) *cursorTracker {
+	return &cursorTracker{
+		cursors: maps.Clone(cursors),
+		stopped: map[string]bool{},
+		handled: map[int]trackedRecord{},
 	}
+}
 
-	iter, err := db.NewIter(nil)
-	if err != nil {
-		return true
+// done records the outcome of the record read with sequence number seq.
+func (t *cursorTracker) done(seq int, key []byte, removed bool) {
+	t.handled[seq] = trackedRecord{key: key, removed: removed}
+	for {
+		r, ok := t.handled[t.next]
+		if !ok {
+			return
+		}
+		delete(t.handled, t.next)
+		t.next++
+
+		prefix := cursorPrefix(r.key)
+		switch {
+		case prefix == priorityPrefix(maxPriority) || t.stopped[prefix]:
+		case !r.removed:
+			t.stopped[prefix] = true
+		default:
+			t.cursors[prefix] = string(r.key)
+		}
 	}
-	defer iter.Close()
+}
 
-	return !iter.First()
+// deleteProcessed deletes keys handled by ProcessPebble and saves the cursors,
+// which only cover keys deleted by now.
+func (c *ServerConfig) deleteProcessed(keys [][]byte, cursors *cursorTracker) error {
+	if err := c.deleteKeysBatch(keys); err != nil {
+		return err
+	}
+	c.writeProcessCursors(cursors.cursors)
+	return nil
+}
+
+// deleteKeysBatch removes a batch of keys from Pebble in a single atomic operation.
+// It uses a write batch for better efficiency; the commit is fsynced when SyncDeletes is set.
+func (c *ServerConfig) deleteKeysBatch(keys [][]byte) error {
+	batch := c.Db.NewBatch()
+	defer batch.Close()
+
+	for _, key := range keys {
+		if err := batch.Delete(key, nil); err != nil {
+			return err
+		}
+	}
+
+	opts := pebble.NoSync
+	if c.SyncDeletes {
+		opts = pebble.Sync
+	}
+	if err := c.Db.Commit(batch, opts); err != nil {
+		return err
+	}
+	c.recordCount.Add(-int64(len(keys)))
+	return nil
+}
+
+// ProcessPebble scans through all stored logs in Pebble and sends them to the main server.
+// It removes logs that were successfully delivered or permanently failed (4xx/5xx <= 500),
+// while retaining those that failed due to transient errors (5xx > 500).
+// Because keys are priority-prefixed, high-priority records are dispatched first.
+// At most MaxRecordsPerCycle records are handled per call when the limit is set,
+// and uploads are paced to UploadRateLimit requests per second when configured.
+// Records are read by a single iterator and uploaded by ProcessConcurrency
+// workers; the first transient error stops further uploads.
+// While it runs, SendLog is held back or rejected according to PausePolicy.
+//
+// Handled records are deleted every processDeleteBatchSize records, and a
+// cursor per priority prefix is saved to baseDir/process-cursor: the last key
+// of the unbroken run of deleted records read from that prefix. A pass cut
+// short by a crash, a transient error or MaxRecordsPerCycle resumes each
+// prefix at its cursor rather than rescanning the deleted range, so records
+// before a cursor wait for the next full pass. High-priority records are
+// always scanned from the start. The cursors are removed once a pass reaches
+// the last key or Pebble is empty.
+// Concurrent calls (main loop and FlushAndWait) run one after the other.
+func (c *ServerConfig) ProcessPebble(ctx context.Context) error {
+	c.processMu.Lock()
+	defer c.processMu.Unlock()
+
+	if c.DryRunProcess.CompareAndSwap(true, false) {
+		_, err := c.dryProcess(ctx)
+		return err
+	}
+
+	c.pauseIngestion()
+	defer c.resumeIngestion()
+
+	requestTimeout := c.RequestTimeout
+	if requestTimeout <= 0 {
+		requestTimeout = 5 * time.Second
+	}
+	client := c.NewHTTPClient(requestTimeout)
+
+	// Optional throttle so a large backlog doesn't trip server-side rate limits
+	var limiter *rate.Limiter
+	if c.UploadRateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(c.UploadRateLimit), 1)
+	}
+
+	// Records held in memory after failed writes go out first
+	if c.InMemoryFallback {
+		if err := c.drainFallback(client); err != nil {
+			return err
+		}
+	}
+
+	FlushPebbleDB(c.Db)
+	defer FlushPebbleDB(c.Db)
+
+	// Expired records are dropped before the scan so none of them is uploaded
+	if _, err := c.ExpireRecords(ctx, time.Now()); err != nil {
+		LogJsonLevel(LevelError, "record_expire_error", map[string]any{"error": err.Error()})
+	}
+
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		return err
+	}
+	defer closeIter()
+
+	cursors := map[string]string{}
+	if PebbleIsEmpty(c.Db) {
+		c.resetProcessCursor()
+	} else if cursors, err = c.readProcessCursors(); err != nil {
+		LogJsonLevel(LevelError, "process_cursor_error", map[string]any{"error": err.Error()})
+		cursors = map[string]string{}
+	}
+	if len(cursors) > 0 {
+		LogJsonLevel(LevelInfo, "process_cursor_resume", map[string]any{"cursors": slices.Sorted(maps.Values(cursors))})
+	}
+	tracker := newCursorTracker(cursors)
+
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	jobs := make(chan uploadJob)
+	results := make(chan uploadResult)
+
+	// Upload workers; a transient error stops the others before their next send
+	var workers sync.WaitGroup
+	for i := 0; i < max(c.ProcessConcurrency, 1); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				if runCtx.Err() != nil {
+					// Reported as kept so the cursor does not pass it
+					results <- uploadResult{seq: job.seq, key: job.key}
+					continue
+				}
+				delivered := len(job.rec.Delivered)
+				ok, err := c.sendToServer(&job.rec, client)
+				if err != nil {
+					stop()
+				}
+				res := uploadResult{seq: job.seq, key: job.key, remove: ok, err: err}
+				if !ok && len(job.rec.Delivered) > delivered {
+					res.partial = &job.rec
+				}
+				results <- res
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	// Read records in key order, from the cursors if any, and hand them to the workers
+	exhausted := false // Set when the iterator reached the last key; read after results is closed
+	go func() {
+		defer close(jobs)
+		dispatched := 0
+		for valid := skipToCursor(iter, iter.First(), cursors); valid; valid = skipToCursor(iter, iter.Next(), cursors) {
+			// Stop processing if context canceled
+			if runCtx.Err() != nil {
+				return
+			}
+			// Expired keys are not uploaded; the next ExpireRecords deletes them
+			if len(c.PipelineTTLs) > 0 && IsKeyExpired(iter.Key()) {
+				continue
+			}
+
+			var rec logRecord
+			if err := decodeRecord(iter.Value(), &rec); err != nil {
+				LogJsonLevel(LevelError, "pebble_read_error", map[string]any{"error": err.Error()})
+				continue
+			}
+			if rec.SchemaVersion < CurrentSchemaVersion {
+				rec = MigrateRecord(rec, rec.SchemaVersion, CurrentSchemaVersion)
+			}
+
+			if limiter != nil {
+				if err := limiter.Wait(runCtx); err != nil {
+					return
+				}
+			}
+
+			keyCopy := make([]byte, len(iter.Key()))
+			copy(keyCopy, iter.Key())
+			select {
+			case jobs <- uploadJob{seq: dispatched, key: keyCopy, rec: rec}:
+			case <-runCtx.Done():
+				return
+			}
+
+			// Yield back to the main loop so health is re-checked between cycles
+			dispatched++
+			if c.MaxRecordsPerCycle > 0 && dispatched >= c.MaxRecordsPerCycle {
+				LogJsonLevel(LevelWarn, "cycle_limit_reached", map[string]any{"processed": dispatched})
+				return
+			}
+		}
+		exhausted = iter.Error() == nil
+	}()
+
+	// Delete successfully processed or permanently failed records as they add up
+	var keys [][]byte
+	var serverErr, deleteErr error
+	count := 0
+	for res := range results {
+		if res.partial != nil {
+			// Remember the endpoints that took the record so a retry skips them
+			c.storeDelivered(res.key, *res.partial)
+		}
+		if res.err != nil {
+			if serverErr == nil {
+				serverErr = res.err
+			}
+			tracker.done(res.seq, res.key, false)
+			continue
+		}
+		if !res.remove || deleteErr != nil {
+			tracker.done(res.seq, res.key, false)
+			continue
+		}
+		tracker.done(res.seq, res.key, true)
+		keys = append(keys, res.key)
+		if len(keys) >= processDeleteBatchSize {
+			if deleteErr = c.deleteProcessed(keys, tracker); deleteErr != nil {
+				stop()
+				continue
+			}
+			count += len(keys)
+			keys = nil
+		}
+	}
+	if deleteErr == nil && len(keys) > 0 {
+		if deleteErr = c.deleteProcessed(keys, tracker); deleteErr == nil {
+			count += len(keys)
+		}
+	}
+	if deleteErr != nil {
+		LogJsonLevel(LevelError, "pebble_delete_error", map[string]any{"error": deleteErr.Error()})
+		return deleteErr
+	}
+
+	if count > 0 {
+		LogJsonLevel(LevelInfo, "pebble_processed", map[string]any{"processed_count": count})
+	} else {
+		LogJsonLevel(LevelDebug, "pebble_processed_none", nil)
+	}
+
+	// A full pass clears the cursors so records before them are revisited
+	if exhausted && serverErr == nil {
+		c.resetProcessCursor()
+	}
+	return serverErr
+}
+
+// dryProcess logs every record ProcessPebble would upload, without sending or
+// deleting anything, and returns how many there are.
+func (c *ServerConfig) dryProcess(ctx context.Context) (int, error) {
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		return 0, err
+	}
+	defer closeIter()
+
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		var rec logRecord
+		if err := decodeRecord(iter.Value(), &rec); err != nil {
+			LogJsonLevel(LevelError, "pebble_read_error", map[string]any{"error": err.Error()})
+			continue
+		}
+		if rec.SchemaVersion < CurrentSchemaVersion {
+			rec = MigrateRecord(rec, rec.SchemaVersion, CurrentSchemaVersion)
+		}
+		payloadKeys := make([]string, 0, len(rec.Payload))
+		for k := range rec.Payload {
+			payloadKeys = append(payloadKeys, k)
+		}
+		slices.Sort(payloadKeys)
+		LogJsonLevel(LevelInfo, "dry_process_record", map[string]any{"pipelines": rec.Pipelines, "payload_keys": payloadKeys})
+		count++
+	}
+	LogJsonLevel(LevelInfo, "dry_process_complete", map[string]any{"record_count": count})
+	return count, nil
+}
+
+// flushRetryDelay is the pause between ProcessPebble passes in FlushAndWait.
+const flushRetryDelay = 200 * time.Millisecond
+
+// FlushAndWait uploads everything stored before returning, for callers that
+// need a synchronous flush (e.g. before the SDK's process exits). It flushes
+// the memtable, then runs ProcessPebble until no records remain, retrying
+// transient upload errors. It returns context.DeadlineExceeded when records
+// are still stored after timeout. Parts of incomplete chunked payloads are
+// not records and are not waited for.
+func (c *ServerConfig) FlushAndWait(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	FlushPebbleDB(c.Db)
+	for {
+		err := c.ProcessPebble(ctx)
+		if !c.hasPendingRecords() {
+			return nil
+		}
+		if ctx.Err() != nil {
+			LogJsonLevel(LevelWarn, "flush_and_wait_timeout", map[string]any{"timeout": timeout.String(), "record_count": c.RecordCount()})
+			return ctx.Err()
+		}
+		if err != nil {
+			LogJsonLevel(LevelDebug, "flush_and_wait_retry", map[string]any{"error": err.Error()})
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(flushRetryDelay):
+		}
+	}
+}
+
+// hasPendingRecords reports whether Pebble or the in-memory fallback still
+// holds records waiting for upload.
+func (c *ServerConfig) hasPendingRecords() bool {
+	if c.FallbackBufferLen() > 0 {
+		return true
+	}
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		return true
+	}
+	defer closeIter()
+	return iter.First()
+}
+
+// uploadJob is one record handed from the ProcessPebble reader to a worker.
+type uploadJob struct {
+	seq int // Order in which the record was read
+	key []byte
+	rec logRecord
+}
+
+// uploadResult reports whether a worker's record can be deleted from Pebble.
+// partial is set when some, but not all, of the record's endpoints accepted it.
+type uploadResult struct {
+	seq     int
+	key     []byte
+	remove  bool
+	err     error
+	partial *logRecord
+}
+
+// storeDelivered rewrites a kept record after a partial fan-out so that its
+// Delivered pipelines survive until the next pass, and across restarts.
+func (c *ServerConfig) storeDelivered(key []byte, rec logRecord) {
+	data, err := c.encodeRecord(rec)
+	if err == nil {
+		err = c.Db.Set(key, data, pebble.NoSync)
+	}
+	if err != nil {
+		LogJsonLevel(LevelError, "pebble_write_error", map[string]any{"key": string(key), "error": err.Error()})
+	}
+}
+
+// PurgeTimeRange deletes every record whose key timestamp falls within [from, to].
+// Below each of timeOrderedPrefixes keys continue with "<unix_nano>_<counter>",
+// so the window maps directly onto one iterator range per prefix without
+// decoding any values. Returns the number of records removed.
+func (c *ServerConfig) PurgeTimeRange(ctx context.Context, from, to time.Time) (int, error) {
+	if to.Before(from) {
+		return 0, fmt.Errorf("purge range end %s is before start %s", to, from)
+	}
+
+	prefixes, err := c.timeOrderedPrefixes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys [][]byte
+	for _, prefix := range prefixes {
+		rangeKeys, err := c.collectKeys(ctx, &pebble.IterOptions{
+			LowerBound: []byte(fmt.Sprintf("%s%d", prefix, from.UnixNano())),
+			UpperBound: []byte(fmt.Sprintf("%s%d_~", prefix, to.UnixNano())),
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range rangeKeys {
+			if timeOrderedUnder(prefix, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if err := c.deleteKeysBatch(keys); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// timeOrderedPrefixes returns every key prefix below which record keys are
+// "<unix_nano>_<counter>", and so sorted by receive time: "" for legacy keys,
+// each priority prefix for keys written before pipelines were added, and
+// "<priority prefix><pipeline>/" for every pipeline with stored records. The
+// pipelines are found by seeking from one to the next rather than reading
+// every key.
+func (c *ServerConfig) timeOrderedPrefixes(ctx context.Context) ([]string, error) {
+	prefixes := []string{""}
+	for p := maxPriority; p >= PriorityNormal; p-- {
+		prefix := priorityPrefix(p)
+		prefixes = append(prefixes, prefix)
+
+		iter, closeIter, err := WrapIter(c.Db, &pebble.IterOptions{
+			LowerBound: []byte(prefix),
+			UpperBound: []byte(strings.TrimSuffix(prefix, "/") + "0"), // '0' follows '/'
+		})
+		if err != nil {
+			return nil, err
+		}
+		for valid := iter.First(); valid; {
+			if ctx.Err() != nil {
+				closeIter()
+				return nil, ctx.Err()
+			}
+			rest := iter.Key()[len(prefix):]
+			end := bytes.IndexByte(rest, '/')
+			if _, expiring := keyExpiry(iter.Key()); end < 0 || expiring {
+				// A key of the priority format, without a pipeline, or an
+				// expiring key (see MakeExpiringKey)
+				valid = iter.Next()
+				continue
+			}
+			pipelinePrefix := prefix + string(rest[:end+1])
+			prefixes = append(prefixes, pipelinePrefix)
+			valid = iter.SeekGE([]byte(strings.TrimSuffix(pipelinePrefix, "/") + "0"))
+		}
+		closeIter()
+	}
+	return prefixes, nil
+}
+
+// timeOrderedUnder reports whether key is prefix followed by
+// "<unix_nano>_<counter>". Ranges built from a legacy or priority prefix can
+// also hold keys of another layout, which must be left alone.
+func timeOrderedUnder(prefix string, key []byte) bool {
+	return bytes.HasPrefix(key, []byte(prefix)) && legacyKeyPattern.Match(key[len(prefix):])
+}
+
+// collectKeys returns a copy of every key within the iterator bounds.
+func (c *ServerConfig) collectKeys(ctx context.Context, opts *pebble.IterOptions) ([][]byte, error) {
+	iter, closeIter, err := WrapIter(c.Db, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeIter()
+
+	var keys [][]byte
+	for iter.First(); iter.Valid(); iter.Next() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		keyCopy := make([]byte, len(iter.Key()))
+		copy(keyCopy, iter.Key())
+		keys = append(keys, keyCopy)
+	}
+	return keys, nil
+}
+
+// exportEntry is a single NDJSON line produced by ExportToNDJSON.
+// The key is kept so an import restores records in their original order.
+type exportEntry struct {
+	Key    string    `json:"key"`
+	Record logRecord `json:"record"`
+}
+
+// ExportToNDJSON writes every record in Pebble to w as one JSON object per line.
+// It is meant as a backup before purging, and returns the number of records written.
+// Records are exported at CurrentSchemaVersion, migrating older ones first.
+func (c *ServerConfig) ExportToNDJSON(ctx context.Context, w io.Writer) (int, error) {
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		return 0, err
+	}
+	defer closeIter()
+
+	enc := json.NewEncoder(w)
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+
+		var rec logRecord
+		if err := decodeRecord(iter.Value(), &rec); err != nil {
+			LogJsonLevel(LevelError, "pebble_read_error", map[string]any{"error": err.Error(), "key": string(iter.Key())})
+			continue
+		}
+		if rec.SchemaVersion < CurrentSchemaVersion {
+			rec = MigrateRecord(rec, rec.SchemaVersion, CurrentSchemaVersion)
+		}
+		if err := enc.Encode(exportEntry{Key: string(iter.Key()), Record: rec}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// ImportFromNDJSON is the counterpart of ExportToNDJSON. Records are written
+// back under their original keys, committed in batches of 1000.
+func (c *ServerConfig) ImportFromNDJSON(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	batch := c.Db.NewBatch()
+	defer func() { _ = batch.Close() }()
+
+	count := 0
+	for {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+
+		var entry exportEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return count, err
+		}
+
+		data, err := c.encodeRecord(entry.Record)
+		if err != nil {
+			return count, err
+		}
+		if err := batch.Set([]byte(entry.Key), data, nil); err != nil {
+			return count, err
+		}
+		count++
+
+		if batch.Count() >= 1000 {
+			if err := c.Db.Commit(batch, pebble.Sync); err != nil {
+				return count, err
+			}
+			c.recordsStored(int64(batch.Count()))
+			_ = batch.Close()
+			batch = c.Db.NewBatch()
+		}
+	}
+
+	if err := c.Db.Commit(batch, pebble.Sync); err != nil {
+		return count, err
+	}
+	c.recordsStored(int64(batch.Count()))
+	return count, nil
+}
+
+// openIterators counts Pebble iterators created by WrapIter and not yet closed.
+// A value that keeps growing points at a leaked iterator.
+var openIterators atomic.Int64
+
+// WrapIter opens an iterator on db and tracks it in openIterators and in db,
+// which keeps the DB the iterator reads open across a reopen (see PebbleManager).
+// The returned closer must be deferred; it closes the iterator exactly once.
+func WrapIter(db *PebbleManager, opts *pebble.IterOptions) (*pebble.Iterator, func(), error) {
+	openIterators.Add(1)
+	iter, release, err := db.openIter(opts)
+	if err != nil {
+		openIterators.Add(-1)
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	return iter, func() {
+		once.Do(func() {
+			_ = iter.Close()
+			release()
+			openIterators.Add(-1)
+		})
+	}, nil
+}
+
+// PebbleIsEmpty checks if the Pebble database is empty.
+// Used mainly during agent shutdown to decide whether to delete the DB directory.
+func PebbleIsEmpty(db *PebbleManager) bool {
+	if db == nil {
+		return true
+	}
+
+	iter, closeIter, err := WrapIter(db, nil)
+	if err != nil {
+		return true
+	}
+	defer closeIter()
+
+	return !iter.First()
+}
+
+// updateQueueStats refreshes the queue depth and oldest record age gauges.
+func (c *ServerConfig) updateQueueStats() {
+	var oldest time.Duration
+	if receivedAt, ok := c.oldestRecordTime(); ok {
+		oldest = max(time.Since(receivedAt), 0)
+	}
+	queueStats.set(c.recordCount.Load(), oldest)
+}
+
+// oldestRecordTime returns the ReceivedAt of the oldest record in Pebble.
+// Keys are time-ordered only below each of timeOrderedPrefixes, so the first
+// record of each of them is read. Under the legacy and priority prefixes,
+// runs of keys of another layout are skipped by seeking past their next "/".
+func (c *ServerConfig) oldestRecordTime() (time.Time, bool) {
+	prefixes, err := c.timeOrderedPrefixes(context.Background())
+	if err != nil {
+		return time.Time{}, false
+	}
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer closeIter()
+
+	var oldest time.Time
+	for _, prefix := range prefixes {
+		valid := iter.SeekGE([]byte(fmt.Sprintf("%s%d", prefix, minRecordKeyNano)))
+		for valid && bytes.HasPrefix(iter.Key(), []byte(prefix)) && !timeOrderedUnder(prefix, iter.Key()) {
+			rest := iter.Key()[len(prefix):]
+			if end := bytes.IndexByte(rest, '/'); end >= 0 {
+				valid = iter.SeekGE(append(slices.Clone(iter.Key()[:len(prefix)+end]), '0')) // '0' follows '/'
+			} else {
+				valid = iter.Next()
+			}
+		}
+		if !valid || !timeOrderedUnder(prefix, iter.Key()) {
+			continue
+		}
+		var rec logRecord
+		if err := decodeRecord(iter.Value(), &rec); err == nil {
+			if t, err := time.Parse(time.RFC3339Nano, rec.ReceivedAt); err == nil && (oldest.IsZero() || t.Before(oldest)) {
+				oldest = t
+			}
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// DefaultRecordAgeBuckets are used when RecordAgeHistogramBuckets is empty.
+var DefaultRecordAgeBuckets = []time.Duration{time.Minute, 5 * time.Minute, time.Hour, 24 * time.Hour}
+
+// ReportRecordAgeHistogram scans every record in Pebble and buckets it by the
+// age of its ReceivedAt. The result is logged as record_age_histogram and
+// exported as echopost_record_age_seconds. Counts are cumulative, so "<5m"
+// includes the records counted under "<1m"; ">=" holds the rest.
+func (c *ServerConfig) ReportRecordAgeHistogram(ctx context.Context) error {
+	buckets := slices.Clone(c.RecordAgeHistogramBuckets)
+	if len(buckets) == 0 {
+		buckets = slices.Clone(DefaultRecordAgeBuckets)
+	}
+	slices.Sort(buckets)
+
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		return err
+	}
+	defer closeIter()
+
+	now := time.Now()
+	counts := make([]uint64, len(buckets))
+	var total uint64
+	var sum float64
+	var oldest time.Duration
+	for iter.First(); iter.Valid(); iter.Next() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var rec logRecord
+		if err := decodeRecord(iter.Value(), &rec); err != nil {
+			continue
+		}
+		receivedAt, err := time.Parse(time.RFC3339Nano, rec.ReceivedAt)
+		if err != nil {
+			continue
+		}
+		age := now.Sub(receivedAt)
+		total++
+		sum += age.Seconds()
+		oldest = max(oldest, age)
+		for i, bound := range buckets {
+			if age < bound {
+				counts[i]++
+			}
+		}
+	}
+
+	fields := map[string]any{"total": total, "oldest_age_seconds": oldest.Seconds()}
+	promBuckets := make(map[float64]uint64, len(buckets))
+	for i, bound := range buckets {
+		fields["<"+shortDuration(bound)] = counts[i]
+		promBuckets[bound.Seconds()] = counts[i]
+	}
+	last := len(buckets) - 1
+	fields[">="+shortDuration(buckets[last])] = total - counts[last]
+
+	recordAges.set(total, sum, promBuckets)
+	LogJsonLevel(LevelInfo, "record_age_histogram", fields)
+	return nil
+}
+
+// shortDuration formats d without trailing zero units, e.g. 1h instead of 1h0m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// StartRecordAgeReporter runs ReportRecordAgeHistogram every RecordAgeInterval
+// until ctx is cancelled.
+func (c *ServerConfig) StartRecordAgeReporter(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(c.RecordAgeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.ReportRecordAgeHistogram(ctx); err != nil && ctx.Err() == nil {
+					LogJsonLevel(LevelError, "record_age_scan_error", map[string]any{"error": err.Error()})
+				}
+			}
+		}
+	}()
+}
+
+// bloomMonitorInterval is how often StartBloomFilterMonitor samples the filter metrics.
+const bloomMonitorInterval = time.Minute
+
+// DefaultBloomFPAlert is the default BloomFPAlert: 5% false positives.
+const DefaultBloomFPAlert = 0.05
+
+// bloomSample is a reading of the cumulative counters used for filter stats.
+type bloomSample struct {
+	hits, misses, found int64
+}
+
+// StartBloomFilterMonitor samples Pebble's bloom filter metrics every
+// bloomMonitorInterval and logs bloom_filter_stats from the change since the
+// last sample. It does nothing when BloomFilterBitsPerKey is 0.
+func (c *ServerConfig) StartBloomFilterMonitor(ctx context.Context, wg *sync.WaitGroup) {
+	if c.BloomFilterBitsPerKey <= 0 {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(bloomMonitorInterval)
+		defer ticker.Stop()
+		c.runBloomFilterMonitor(ctx, ticker.C)
+	}()
+}
+
+// runBloomFilterMonitor checks the bloom filter on every tick until ctx is done.
+func (c *ServerConfig) runBloomFilterMonitor(ctx context.Context, ticks <-chan time.Time) {
+	var last bloomSample
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+			last = c.checkBloomFilter(last)
+		}
+	}
+}
+
+// checkBloomFilter logs the filter stats since prev and returns the new sample.
+//
+// Pebble counts a hit when the filter ruled a table out and a miss when it
+// could not, which includes tables that did hold the key. The false positive
+// rate is therefore estimated: each Get that found its key is taken as one
+// true positive, and the remaining misses as false positives. Lookups served
+// from the memtable make the estimate err low. Above BloomFPAlert,
+// bloom_filter_degraded is logged and counted, pointing at a
+// -bloom-bits-per-key too small for the current level sizes.
+func (c *ServerConfig) checkBloomFilter(prev bloomSample) bloomSample {
+	metrics, err := c.Db.Metrics()
+	if err != nil {
+		LogJsonLevel(LevelError, "pebble_metrics_error", map[string]any{"error": err.Error()})
+		return prev
+	}
+	cur := bloomSample{hits: metrics.Filter.Hits, misses: metrics.Filter.Misses, found: c.Db.lookupsFound.Load()}
+	if cur.hits < prev.hits || cur.misses < prev.misses {
+		// Pebble was reopened and its counters restarted
+		prev = bloomSample{found: prev.found}
+	}
+	hits, misses := cur.hits-prev.hits, cur.misses-prev.misses
+	falsePositives := max(misses-(cur.found-prev.found), 0)
+
+	checks := hits + misses
+	if checks == 0 {
+		LogJsonLevel(LevelDebug, "bloom_filter_stats", map[string]any{"filter_checks": 0})
+		return cur
+	}
+	usefulHitRate := float64(hits) / float64(checks)
+	fpRate := 0.0
+	if negatives := hits + falsePositives; negatives > 0 {
+		fpRate = float64(falsePositives) / float64(negatives)
+	}
+	LogJsonLevel(LevelInfo, "bloom_filter_stats", map[string]any{
+		"filter_checks":       checks,
+		"useful_hit_rate":     usefulHitRate,
+		"false_positive_rate": fpRate,
+	})
+
+	alert := c.BloomFPAlert
+	if alert <= 0 {
+		alert = DefaultBloomFPAlert
+	}
+	if fpRate > alert {
+		bloomFilterDegradedTotal.Inc()
+		LogJsonLevel(LevelWarn, "bloom_filter_degraded", map[string]any{
+			"false_positive_rate": fpRate,
+			"threshold":           alert,
+			"bits_per_key":        c.BloomFilterBitsPerKey,
+		})
+	}
+	return cur
 }
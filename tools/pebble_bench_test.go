@@ -0,0 +1,306 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// BenchmarkSendLogSync compares SendLog throughput for a pipeline written
+// with pebble.NoSync against one listed in SyncPipelines, for a 1 KiB payload.
+func BenchmarkSendLogSync(b *testing.B) {
+	payload := `{"msg":"` + strings.Repeat("x", 1024-10) + `"}`
+	for _, bc := range []struct {
+		name          string
+		syncPipelines []string
+	}{
+		{name: "nosync"},
+		{name: "sync", syncPipelines: []string{"audit"}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := newTestConfig(b, "http://unused.invalid")
+			c.SyncPipelines = bc.syncPipelines
+			s := &server{config: c}
+			req := &pb.LogRequest{JsonData: payload, Pipelines: []string{"audit"}}
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.SendLog(context.Background(), req); err != nil {
+					b.Fatalf("SendLog: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPebbleEncodingSize writes 100,000 records with each
+// -pebble-encoding and reports the size of the flushed Pebble directory.
+func BenchmarkPebbleEncodingSize(b *testing.B) {
+	const records = 100_000
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, encoding := range []string{EncodingJSON, EncodingMsgpack} {
+		b.Run(encoding, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c := newTestConfig(b, "http://unused.invalid")
+				c.PebbleEncoding = encoding
+				b.StartTimer()
+
+				batch := c.Db.NewBatch()
+				for n := 0; n < records; n++ {
+					ts := start.Add(time.Duration(n) * time.Millisecond)
+					data, err := c.encodeRecord(logRecord{
+						SchemaVersion: CurrentSchemaVersion,
+						Payload: map[string]any{
+							"msg":        fmt.Sprintf("request %d handled", n),
+							"status":     200,
+							"latency_ms": float64(n%500) / 3,
+							"user":       map[string]any{"id": n % 1000, "plan": "pro"},
+						},
+						Pipelines:  []string{"api"},
+						ReceivedAt: ts.Format(time.RFC3339Nano),
+						Level:      "INFO",
+					})
+					if err != nil {
+						b.Fatalf("encode: %v", err)
+					}
+					if err := batch.Set([]byte(keyAt(priorityPrefix(PriorityNormal), ts, n)), data, nil); err != nil {
+						b.Fatalf("batch set: %v", err)
+					}
+					if batch.Count() == 1000 {
+						if err := c.Db.Commit(batch, pebble.NoSync); err != nil {
+							b.Fatalf("commit: %v", err)
+						}
+						batch = c.Db.NewBatch()
+					}
+				}
+				if err := c.Db.Commit(batch, pebble.NoSync); err != nil {
+					b.Fatalf("commit: %v", err)
+				}
+				if err := c.Db.Flush(); err != nil {
+					b.Fatalf("flush: %v", err)
+				}
+
+				b.StopTimer()
+				b.ReportMetric(float64(dirSize(c.dbPath)), "db-bytes")
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// processBenchRecords is the number of records drained per ProcessPebble call.
+const processBenchRecords = 200
+
+// BenchmarkProcessConcurrency drains processBenchRecords records per
+// iteration against a server that takes 2ms per upload, with one upload
+// worker and with four.
+func BenchmarkProcessConcurrency(b *testing.B) {
+	CaptureLogs(b) // keep agent logs out of the benchmark results
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+	}))
+	b.Cleanup(srv.Close)
+
+	for _, concurrency := range []int{1, 4} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			c := newTestConfig(b, srv.URL)
+			c.ProcessConcurrency = concurrency
+			rec := logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"msg": "bench"}, Pipelines: []string{"p1"}}
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < processBenchRecords; j++ {
+					putRecord(b, c, newRecordKey(PriorityNormal, nil), rec)
+				}
+				b.StartTimer()
+				if err := c.ProcessPebble(context.Background()); err != nil {
+					b.Fatalf("ProcessPebble: %v", err)
+				}
+			}
+			b.StopTimer()
+			if !PebbleIsEmpty(c.Db) {
+				b.Fatal("records left after ProcessPebble")
+			}
+			b.ReportMetric(float64(b.N*processBenchRecords)/b.Elapsed().Seconds(), "records/s")
+		})
+	}
+}
+
+// BenchmarkBloomFilter writes 100,000 records into flushed sstables, then
+// times 10,000 PebbleIsEmpty calls per iteration with and without bloom
+// filters. The get-missing case times 10,000 lookups of absent keys, the
+// point reads a bloom filter exists to short-circuit.
+func BenchmarkBloomFilter(b *testing.B) {
+	const (
+		records = 100_000
+		calls   = 10_000
+	)
+	CaptureLogs(b)
+	for _, bits := range []int{0, 10} {
+		c := &ServerConfig{BloomFilterBitsPerKey: bits}
+		if err := c.CreateRequiredFiles(b.TempDir()); err != nil {
+			b.Fatalf("create agent files: %v", err)
+		}
+		b.Cleanup(c.CloseFiles)
+
+		start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+		batch := c.Db.NewBatch()
+		for n := 0; n < records; n++ {
+			if err := batch.Set([]byte(keyAt(priorityPrefix(PriorityNormal), start.Add(time.Duration(n)*time.Millisecond), n)), []byte(`{}`), nil); err != nil {
+				b.Fatalf("batch set: %v", err)
+			}
+		}
+		if err := c.Db.Commit(batch, pebble.NoSync); err != nil {
+			b.Fatalf("commit: %v", err)
+		}
+		_ = batch.Close()
+		if err := c.Db.Flush(); err != nil {
+			b.Fatalf("flush: %v", err)
+		}
+
+		b.Run(fmt.Sprintf("bits=%d/is-empty", bits), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < calls; j++ {
+					if PebbleIsEmpty(c.Db) {
+						b.Fatal("PebbleIsEmpty reported a filled DB as empty")
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*calls)/b.Elapsed().Seconds(), "ops/s")
+		})
+		b.Run(fmt.Sprintf("bits=%d/get-missing", bits), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < calls; j++ {
+					key := keyAt(priorityPrefix(PriorityNormal), start.Add(time.Duration(j)*time.Millisecond+time.Microsecond), j)
+					if _, err := c.Db.Get([]byte(key)); !errors.Is(err, pebble.ErrNotFound) {
+						b.Fatalf("Get(%s) = %v, want ErrNotFound", key, err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N*calls)/b.Elapsed().Seconds(), "ops/s")
+		})
+	}
+}
+
+// BenchmarkCompactionStyle writes 1,000,000 records spread over 8 pipelines
+// with each -compaction-style, then reports write throughput, Pebble's write
+// amplification and disk usage once compactions settle, and the read latency
+// of a full scan (the ProcessPebble access pattern) and of point lookups.
+func BenchmarkCompactionStyle(b *testing.B) {
+	const (
+		records   = 1_000_000
+		pipelines = 8
+		gets      = 10_000
+	)
+	CaptureLogs(b)
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	key := func(n int) []byte {
+		prefix := pipelineKeyPrefix(PriorityNormal, fmt.Sprintf("pipeline-%d", n%pipelines))
+		return []byte(keyAt(prefix, start.Add(time.Duration(n)*time.Microsecond), n))
+	}
+	for _, style := range []string{CompactionStyleLevel, CompactionStyleUniversal} {
+		b.Run(style, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c := &ServerConfig{CompactionStyle: style}
+				if err := c.CreateRequiredFiles(b.TempDir()); err != nil {
+					b.Fatalf("create agent files: %v", err)
+				}
+				value, err := c.encodeRecord(logRecord{
+					SchemaVersion: CurrentSchemaVersion,
+					Payload:       map[string]any{"msg": "request handled", "status": 200, "path": "/api/v1/orders", "latency_ms": 12.5},
+					Pipelines:     []string{"pipeline-0"},
+					ReceivedAt:    start.Format(time.RFC3339Nano),
+					Level:         "INFO",
+				})
+				if err != nil {
+					b.Fatalf("encode: %v", err)
+				}
+				b.StartTimer()
+
+				writeStart := time.Now()
+				batch := c.Db.NewBatch()
+				for n := 0; n < records; n++ {
+					if err := batch.Set(key(n), value, nil); err != nil {
+						b.Fatalf("batch set: %v", err)
+					}
+					if batch.Count() == 1000 {
+						if err := c.Db.Commit(batch, pebble.NoSync); err != nil {
+							b.Fatalf("commit: %v", err)
+						}
+						batch = c.Db.NewBatch()
+					}
+				}
+				if err := c.Db.Commit(batch, pebble.NoSync); err != nil {
+					b.Fatalf("commit: %v", err)
+				}
+				if err := c.Db.Flush(); err != nil {
+					b.Fatalf("flush: %v", err)
+				}
+				writeTime := time.Since(writeStart)
+
+				b.StopTimer()
+				metrics := settledMetrics(b, c)
+				b.ReportMetric(records/writeTime.Seconds(), "records/s")
+				total := metrics.Total()
+				b.ReportMetric(total.WriteAmp(), "write-amp")
+				b.ReportMetric(float64(metrics.DiskSpaceUsage()), "disk-bytes")
+
+				scanStart := time.Now()
+				iter, err := c.Db.NewIter(RecordIterOptions())
+				if err != nil {
+					b.Fatalf("new iter: %v", err)
+				}
+				scanned := 0
+				for iter.First(); iter.Valid(); iter.Next() {
+					scanned++
+				}
+				if err := iter.Close(); err != nil {
+					b.Fatalf("scan: %v", err)
+				}
+				if scanned != records {
+					b.Fatalf("scanned %d records, want %d", scanned, records)
+				}
+				b.ReportMetric(float64(time.Since(scanStart).Nanoseconds())/records, "scan-ns/record")
+
+				getStart := time.Now()
+				for j := 0; j < gets; j++ {
+					if _, err := c.Db.Get(key(j * (records / gets))); err != nil {
+						b.Fatalf("get: %v", err)
+					}
+				}
+				b.ReportMetric(float64(time.Since(getStart).Nanoseconds())/gets, "get-ns/op")
+				c.CloseFiles()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// settledMetrics waits for c's pending compactions to finish so write
+// amplification and disk usage compare the styles at rest.
+func settledMetrics(b *testing.B, c *ServerConfig) *pebble.Metrics {
+	b.Helper()
+	deadline := time.Now().Add(time.Minute)
+	for {
+		metrics, err := c.Db.Metrics()
+		if err != nil {
+			b.Fatalf("metrics: %v", err)
+		}
+		if metrics.Compact.NumInProgress == 0 && metrics.Compact.EstimatedDebt == 0 || time.Now().After(deadline) {
+			return metrics
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,326 @@
+package tools
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// defaultMaxReopenAttempts bounds how often PebbleManager reopens the DB for one call.
+const defaultMaxReopenAttempts = 3
+
+// PebbleManager wraps the agent's *pebble.DB. Pebble panics with ErrClosed
+// when a closed DB is used; the manager turns that into an error, reopens the
+// DB (with exponential backoff, up to MaxReopenAttempts times) and retries the
+// call. After Close is called the DB is never reopened.
+//
+// Iterators opened through WrapIter are tracked per DB. A reopen swaps in the
+// new DB right away but closes the old one only once its last tracked
+// iterator is released; until then those iterators keep reading the old DB
+// and never see later writes. Iterators from NewIter are not tracked.
+type PebbleManager struct {
+	MaxReopenAttempts int // Reopen attempts per failed call (0 = 3)
+
+	open    func() (PebbleDB, error)
+	mu      sync.RWMutex
+	db      PebbleDB
+	closed  bool
+	iters   map[PebbleDB]int  // Tracked iterators still open, per DB
+	retired map[PebbleDB]bool // Replaced DBs waiting for their iterators before Close
+
+	lookupsFound atomic.Int64 // Get calls that found their key, see StartBloomFilterMonitor
+}
+
+// OpenPebbleManager opens the DB with open and keeps open for later reopens.
+func OpenPebbleManager(open func() (PebbleDB, error)) (*PebbleManager, error) {
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &PebbleManager{open: open, db: db}, nil
+}
+
+// DB returns the current underlying database. The handle is replaced on reopen,
+// so callers should not keep it.
+func (m *PebbleManager) DB() PebbleDB {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.db
+}
+
+// Set writes a single key.
+func (m *PebbleManager) Set(key, value []byte, opts *pebble.WriteOptions) error {
+	return m.do(func(db PebbleDB) error {
+		return db.Set(key, value, opts)
+	})
+}
+
+// Get returns a copy of the value stored under key.
+func (m *PebbleManager) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := m.do(func(db PebbleDB) error {
+		v, closer, err := db.Get(key)
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	if err == nil {
+		m.lookupsFound.Add(1)
+	}
+	return value, err
+}
+
+// Delete removes a single key.
+func (m *PebbleManager) Delete(key []byte, opts *pebble.WriteOptions) error {
+	return m.do(func(db PebbleDB) error {
+		return db.Delete(key, opts)
+	})
+}
+
+// NewBatch returns a batch on the current DB. Commit it with Commit so a
+// reopen in between is handled.
+func (m *PebbleManager) NewBatch() *pebble.Batch {
+	return m.DB().NewBatch()
+}
+
+// Commit applies batch. If the DB had to be reopened, the batch contents are
+// replayed on the new DB.
+func (m *PebbleManager) Commit(batch *pebble.Batch, opts *pebble.WriteOptions) error {
+	first := true
+	return m.do(func(db PebbleDB) error {
+		if first {
+			first = false
+			return batch.Commit(opts)
+		}
+		replay := db.NewBatch()
+		defer replay.Close()
+		if err := replay.SetRepr(append([]byte(nil), batch.Repr()...)); err != nil {
+			return err
+		}
+		return replay.Commit(opts)
+	})
+}
+
+// NewIter opens an iterator on the current DB. It is not tracked, so a
+// reopen may close the DB under it; prefer WrapIter.
+func (m *PebbleManager) NewIter(opts *pebble.IterOptions) (*pebble.Iterator, error) {
+	var iter *pebble.Iterator
+	err := m.do(func(db PebbleDB) error {
+		var err error
+		iter, err = db.NewIter(opts)
+		return err
+	})
+	return iter, err
+}
+
+// openIter opens an iterator on the current DB and tracks it until release
+// is called, so a reopen in between leaves the DB it reads open.
+func (m *PebbleManager) openIter(opts *pebble.IterOptions) (iter *pebble.Iterator, release func(), err error) {
+	var used PebbleDB
+	err = m.do(func(db PebbleDB) error {
+		m.trackIter(db)
+		defer func() {
+			if iter == nil {
+				m.releaseIter(db)
+			}
+		}()
+		var err error
+		if iter, err = db.NewIter(opts); err == nil {
+			used = db
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return iter, func() { m.releaseIter(used) }, nil
+}
+
+// trackIter counts an iterator about to be opened on db.
+func (m *PebbleManager) trackIter(db PebbleDB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.iters == nil {
+		m.iters = map[PebbleDB]int{}
+	}
+	m.iters[db]++
+}
+
+// releaseIter uncounts an iterator on db and closes db if a reopen retired it
+// and this was its last iterator.
+func (m *PebbleManager) releaseIter(db PebbleDB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.iters[db]--; m.iters[db] > 0 {
+		return
+	}
+	delete(m.iters, db)
+	if m.retired[db] {
+		delete(m.retired, db)
+		closeQuietly(db)
+	}
+}
+
+// Flush flushes the memtable to disk.
+func (m *PebbleManager) Flush() error {
+	return m.do(func(db PebbleDB) error {
+		return db.Flush()
+	})
+}
+
+// LogData writes data to the WAL; with pebble.Sync and nil data it syncs the WAL.
+func (m *PebbleManager) LogData(data []byte, opts *pebble.WriteOptions) error {
+	return m.do(func(db PebbleDB) error {
+		return db.LogData(data, opts)
+	})
+}
+
+// Metrics returns a snapshot of the DB metrics (disk usage, WAL size, ...).
+func (m *PebbleManager) Metrics() (*pebble.Metrics, error) {
+	var metrics *pebble.Metrics
+	err := m.do(func(db PebbleDB) error {
+		metrics = db.Metrics()
+		return nil
+	})
+	return metrics, err
+}
+
+// Checkpoint writes a consistent copy of the DB to dir.
+func (m *PebbleManager) Checkpoint(dir string, opts ...pebble.CheckpointOption) error {
+	return m.do(func(db PebbleDB) error {
+		return db.Checkpoint(dir, opts...)
+	})
+}
+
+// Close closes the DB for good; later calls fail with pebble.ErrClosed.
+func (m *PebbleManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return pebble.ErrClosed
+	}
+	m.closed = true
+	return m.db.Close()
+}
+
+// restart opens a new DB with open on a manager that was closed with Close,
+// so holders of the manager pointer see the new DB (see ServerConfig.Reset).
+func (m *PebbleManager) restart(open func() (PebbleDB, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		return errors.New("pebble manager is still open")
+	}
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	m.open, m.db, m.closed = open, db, false
+	return nil
+}
+
+// do runs fn, reopening the DB and retrying while it fails with ErrClosed.
+func (m *PebbleManager) do(fn func(db PebbleDB) error) error {
+	maxAttempts := m.MaxReopenAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxReopenAttempts
+	}
+	backoff := 100 * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		db, err := m.try(fn)
+		if !errors.Is(err, pebble.ErrClosed) || attempt >= maxAttempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if reopenErr := m.reopen(db); reopenErr != nil {
+			if errors.Is(reopenErr, pebble.ErrClosed) {
+				return err
+			}
+			LogJsonLevel(LevelError, "pebble_reopen_error", map[string]any{"attempt": attempt + 1, "error": reopenErr.Error()})
+		}
+	}
+}
+
+// try runs fn against the current DB, converting an ErrClosed panic into an error.
+// It returns the DB it used so reopen can tell whether someone else already reopened.
+func (m *PebbleManager) try(fn func(db PebbleDB) error) (db PebbleDB, err error) {
+	m.mu.RLock()
+	db, closed := m.db, m.closed
+	m.mu.RUnlock()
+	if closed {
+		return db, pebble.ErrClosed
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if rErr, ok := r.(error); ok && errors.Is(rErr, pebble.ErrClosed) {
+				err = rErr
+				return
+			}
+			panic(r)
+		}
+	}()
+	return db, fn(db)
+}
+
+// reopen replaces stale with a freshly opened DB unless another caller already
+// did so. It refuses once Close has been called.
+func (m *PebbleManager) reopen(stale PebbleDB) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return pebble.ErrClosed
+	}
+	if m.db != stale {
+		return nil
+	}
+
+	if m.iters[stale] > 0 {
+		// Closing now would pull the DB from under open iterators
+		if m.retired == nil {
+			m.retired = map[PebbleDB]bool{}
+		}
+		m.retired[stale] = true
+	} else {
+		closeQuietly(stale)
+	}
+	db, err := m.open()
+	if err != nil {
+		return err
+	}
+	m.db = db
+	LogJsonLevel(LevelWarn, "pebble_reopened", nil)
+	return nil
+}
+
+// Wrap replaces the current DB with wrap(db) and applies wrap to every DB
+// opened later by a reopen. Tests use it to put a fault-injecting DB in front
+// of the real one.
+func (m *PebbleManager) Wrap(wrap func(PebbleDB) PebbleDB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.db = wrap(m.db)
+	open := m.open
+	m.open = func() (PebbleDB, error) {
+		db, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return wrap(db), nil
+	}
+}
+
+// closeQuietly closes db, ignoring the panic Pebble raises for an already closed DB.
+func closeQuietly(db PebbleDB) {
+	defer func() { _ = recover() }()
+	_ = db.Close()
+}
@@ -0,0 +1,151 @@
+package tools
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// closingDB is a PebbleDB that can be made to fail like a DB Pebble closed
+// underneath the agent: while dead is set, Set panics with ErrClosed as
+// Pebble does. It records whether Close was called.
+type closingDB struct {
+	PebbleDB
+	dead   atomic.Bool
+	closed atomic.Bool
+}
+
+func (d *closingDB) Set(key, value []byte, opts *pebble.WriteOptions) error {
+	if d.dead.Load() {
+		panic(pebble.ErrClosed)
+	}
+	return d.PebbleDB.Set(key, value, opts)
+}
+
+func (d *closingDB) Close() error {
+	d.closed.Store(true)
+	return d.PebbleDB.Close()
+}
+
+// newMockManager returns a PebbleManager whose every open creates a fresh
+// in-memory DB, and the DBs it opened so far.
+func newMockManager(t *testing.T) (*PebbleManager, *[]*closingDB) {
+	t.Helper()
+	var opened []*closingDB
+	m, err := OpenPebbleManager(func() (PebbleDB, error) {
+		db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+		if err != nil {
+			return nil, err
+		}
+		d := &closingDB{PebbleDB: db}
+		opened = append(opened, d)
+		return d, nil
+	})
+	if err != nil {
+		t.Fatalf("OpenPebbleManager: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	return m, &opened
+}
+
+func TestPebbleManagerReopensAfterErrClosed(t *testing.T) {
+	logs := CaptureLogs(t)
+	m, opened := newMockManager(t)
+	(*opened)[0].dead.Store(true)
+
+	if err := m.Set([]byte("k"), []byte("v"), pebble.NoSync); err != nil {
+		t.Fatalf("Set after ErrClosed: %v", err)
+	}
+	if len(*opened) != 2 {
+		t.Fatalf("DBs opened = %d, want a reopen", len(*opened))
+	}
+	if !(*opened)[0].closed.Load() {
+		t.Error("the failed DB was not closed")
+	}
+	if v, err := m.Get([]byte("k")); err != nil || string(v) != "v" {
+		t.Errorf("Get after the retried Set = %q, %v", v, err)
+	}
+	if n := len(logs.Events("pebble_reopened")); n != 1 {
+		t.Errorf("pebble_reopened entries = %d, want 1", n)
+	}
+}
+
+func TestPebbleManagerGivesUpAfterMaxReopenAttempts(t *testing.T) {
+	opens := 0
+	m, err := OpenPebbleManager(func() (PebbleDB, error) {
+		opens++
+		db, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+		if err != nil {
+			return nil, err
+		}
+		d := &closingDB{PebbleDB: db}
+		d.dead.Store(true) // every DB fails
+		return d, nil
+	})
+	if err != nil {
+		t.Fatalf("OpenPebbleManager: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	m.MaxReopenAttempts = 2
+
+	if err := m.Set([]byte("k"), []byte("v"), pebble.NoSync); !errors.Is(err, pebble.ErrClosed) {
+		t.Fatalf("Set = %v, want ErrClosed once reopening is exhausted", err)
+	}
+	if opens != 3 {
+		t.Errorf("opens = %d, want the first open and 2 reopens", opens)
+	}
+}
+
+func TestPebbleManagerNeverReopensAfterClose(t *testing.T) {
+	m, opened := newMockManager(t)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set([]byte("k"), []byte("v"), pebble.NoSync); !errors.Is(err, pebble.ErrClosed) {
+		t.Fatalf("Set after Close = %v, want ErrClosed", err)
+	}
+	if len(*opened) != 1 {
+		t.Errorf("DBs opened = %d, want no reopen after Close", len(*opened))
+	}
+}
+
+func TestPebbleManagerReopenKeepsIteratedDBOpen(t *testing.T) {
+	m, opened := newMockManager(t)
+	if err := m.Set([]byte("old"), []byte("1"), pebble.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	iter, closeIter, err := WrapIter(m, nil)
+	if err != nil {
+		t.Fatalf("WrapIter: %v", err)
+	}
+	defer closeIter()
+
+	first := (*opened)[0]
+	first.dead.Store(true)
+	if err := m.Set([]byte("new"), []byte("2"), pebble.NoSync); err != nil {
+		t.Fatalf("Set after ErrClosed: %v", err)
+	}
+	if first.closed.Load() {
+		t.Fatal("reopen closed the DB under an open iterator")
+	}
+
+	// The iterator keeps reading the old DB
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	if len(keys) != 1 || keys[0] != "old" {
+		t.Errorf("iterator keys = %v, want [old]", keys)
+	}
+
+	closeIter()
+	if !first.closed.Load() {
+		t.Error("old DB still open after its last iterator was closed")
+	}
+	if _, err := m.Get([]byte("new")); err != nil {
+		t.Errorf("Get on the reopened DB: %v", err)
+	}
+}
@@ -0,0 +1,543 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// putRecord stores rec under key as SendLog would, counting it in recordCount.
+func putRecord(t testing.TB, c *ServerConfig, key string, rec logRecord) {
+	t.Helper()
+	data, err := c.encodeRecord(rec)
+	if err != nil {
+		t.Fatalf("encode record: %v", err)
+	}
+	if err := c.Db.Set([]byte(key), data, pebble.NoSync); err != nil {
+		t.Fatalf("store %s: %v", key, err)
+	}
+	c.recordsStored(1)
+}
+
+// storedKeys returns every record key in Pebble, in key order.
+func storedKeys(t testing.TB, c *ServerConfig) []string {
+	t.Helper()
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		t.Fatalf("open iterator: %v", err)
+	}
+	defer closeIter()
+
+	var keys []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return keys
+}
+
+// keyAt returns a record key received at ts, under prefix ("" for legacy keys).
+func keyAt(prefix string, ts time.Time, n int) string {
+	return fmt.Sprintf("%s%d_%d", prefix, ts.UnixNano(), n)
+}
+
+func TestPurgeTimeRangeBoundaries(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	from := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	var kept, purged []string
+	prefixes := []string{
+		"", priorityPrefix(PriorityNormal), priorityPrefix(PriorityHigh),
+		pipelineKeyPrefix(PriorityNormal, "p1"), pipelineKeyPrefix(PriorityNormal, ""),
+		pipelineKeyPrefix(PriorityHigh, "team/billing"), pipelineKeyPrefix(PriorityNormal, "1"),
+	}
+	for _, prefix := range prefixes {
+		kept = append(kept,
+			keyAt(prefix, from.Add(-time.Nanosecond), 0),
+			keyAt(prefix, to.Add(time.Nanosecond), 0),
+		)
+		purged = append(purged,
+			keyAt(prefix, from, 0),
+			keyAt(prefix, from.Add(30*time.Minute), 7),
+			keyAt(prefix, to, 999),
+		)
+	}
+	for _, key := range append(slices.Clone(kept), purged...) {
+		putRecord(t, c, key, logRecord{Payload: map[string]any{"key": key}, Pipelines: []string{"p1"}})
+	}
+
+	n, err := c.PurgeTimeRange(context.Background(), from, to)
+	if err != nil {
+		t.Fatalf("PurgeTimeRange: %v", err)
+	}
+	if n != len(purged) {
+		t.Errorf("purged %d records, want %d", n, len(purged))
+	}
+
+	got := storedKeys(t, c)
+	slices.Sort(kept)
+	if !slices.Equal(got, kept) {
+		t.Errorf("remaining keys = %v, want %v", got, kept)
+	}
+	if c.RecordCount() != int64(len(kept)) {
+		t.Errorf("RecordCount = %d, want %d", c.RecordCount(), len(kept))
+	}
+}
+
+func TestPurgeTimeRangeRejectsReversedRange(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	now := time.Now()
+	if _, err := c.PurgeTimeRange(context.Background(), now, now.Add(-time.Second)); err == nil {
+		t.Fatal("PurgeTimeRange accepted an end before the start")
+	}
+}
+
+func TestExportImportNDJSONRoundtrip(t *testing.T) {
+	for _, encoding := range []string{EncodingJSON, EncodingMsgpack} {
+		t.Run(encoding, func(t *testing.T) {
+			src := newTestConfig(t, "http://unused.invalid")
+			src.PebbleEncoding = encoding
+			start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+			const n = 250
+			for i := 0; i < n; i++ {
+				putRecord(t, src, keyAt(priorityPrefix(PriorityNormal), start.Add(time.Duration(i)*time.Second), i), logRecord{
+					SchemaVersion: CurrentSchemaVersion,
+					Payload:       map[string]any{"msg": "hello", "n": i, "nested": map[string]any{"ok": i%2 == 0}},
+					Pipelines:     []string{"p1", "p2"},
+					ReceivedAt:    start.Add(time.Duration(i) * time.Second).Format(time.RFC3339Nano),
+					Metadata:      map[string]string{"host": "test"},
+					Priority:      PriorityNormal,
+					Level:         "INFO",
+				})
+			}
+
+			var first bytes.Buffer
+			if got, err := src.ExportToNDJSON(context.Background(), &first); err != nil || got != n {
+				t.Fatalf("ExportToNDJSON = %d, %v; want %d", got, err, n)
+			}
+
+			dst := newTestConfig(t, "http://unused.invalid")
+			dst.PebbleEncoding = encoding
+			if got, err := dst.ImportFromNDJSON(context.Background(), bytes.NewReader(first.Bytes())); err != nil || got != n {
+				t.Fatalf("ImportFromNDJSON = %d, %v; want %d", got, err, n)
+			}
+			if dst.RecordCount() != n {
+				t.Errorf("RecordCount after import = %d, want %d", dst.RecordCount(), n)
+			}
+
+			var second bytes.Buffer
+			if _, err := dst.ExportToNDJSON(context.Background(), &second); err != nil {
+				t.Fatalf("second ExportToNDJSON: %v", err)
+			}
+			if !bytes.Equal(first.Bytes(), second.Bytes()) {
+				t.Error("records changed across export and import")
+			}
+		})
+	}
+}
+
+func TestWriteOptionsForSyncPipelines(t *testing.T) {
+	c := &ServerConfig{SyncPipelines: []string{"audit"}}
+	tests := []struct {
+		pipelines []string
+		want      *pebble.WriteOptions
+	}{
+		{pipelines: nil, want: pebble.NoSync},
+		{pipelines: []string{"app"}, want: pebble.NoSync},
+		{pipelines: []string{"app", "audit"}, want: pebble.Sync},
+	}
+	for _, tt := range tests {
+		if got := c.writeOptionsFor(tt.pipelines); got != tt.want {
+			t.Errorf("writeOptionsFor(%v) sync = %v, want %v", tt.pipelines, got.Sync, tt.want.Sync)
+		}
+	}
+}
+
+func TestFlattenMap(t *testing.T) {
+	const deep = `{"a":{"b":{"c":{"d":{"e":1}}}},"list":[{"x":1},2],"top":"v","empty":{}}`
+	tests := []struct {
+		name  string
+		depth int
+		want  string
+	}{
+		{name: "default depth", depth: 3, want: `{"a.b.c.d":{"e":1},"list":[{"x":1},2],"top":"v","empty":{}}`},
+		{name: "one level", depth: 1, want: `{"a.b":{"c":{"d":{"e":1}}},"list":[{"x":1},2],"top":"v","empty":{}}`},
+		{name: "fully flat", depth: 10, want: `{"a.b.c.d.e":1,"list":[{"x":1},2],"top":"v","empty":{}}`},
+		{name: "disabled", depth: 0, want: deep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in, want map[string]any
+			if err := json.Unmarshal([]byte(deep), &in); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if got := flattenMap(in, "", tt.depth); !reflect.DeepEqual(got, want) {
+				t.Errorf("flattenMap(depth %d) = %v, want %v", tt.depth, got, want)
+			}
+		})
+	}
+}
+
+func TestFlattenPayloadInNewLogRecord(t *testing.T) {
+	c := &ServerConfig{FlattenPayload: true, FlattenDepth: 3}
+	rec := c.newLogRecord(context.Background(), &pb.LogRequest{
+		JsonData: `{"level":"warn","http":{"req":{"method":"GET","headers":{"ua":{"name":"curl"}}}}}`,
+	})
+	want := map[string]any{"level": "warn", "http.req.method": "GET", "http.req.headers.ua": map[string]any{"name": "curl"}}
+	if !reflect.DeepEqual(rec.Payload, want) {
+		t.Errorf("payload = %v, want %v", rec.Payload, want)
+	}
+	if rec.Level != LevelWarn.String() {
+		t.Errorf("level = %q, want %q read before flattening", rec.Level, LevelWarn.String())
+	}
+}
+
+func TestDecodeRecordReadsBothEncodings(t *testing.T) {
+	rec := logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"msg": "hi"}, Pipelines: []string{"p1"}, Level: "INFO"}
+	for _, encoding := range []string{EncodingJSON, EncodingMsgpack} {
+		data, err := (&ServerConfig{PebbleEncoding: encoding}).encodeRecord(rec)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", encoding, err)
+		}
+		if (data[0] == '{') != (encoding == EncodingJSON) {
+			t.Errorf("%s: record starts with %q", encoding, data[0])
+		}
+		var got logRecord
+		if err := decodeRecord(data, &got); err != nil {
+			t.Fatalf("%s: decode: %v", encoding, err)
+		}
+		if got.Payload["msg"] != "hi" || !slices.Equal(got.Pipelines, rec.Pipelines) || got.Level != rec.Level {
+			t.Errorf("%s: decoded %+v, want %+v", encoding, got, rec)
+		}
+	}
+}
+
+func TestWrapIterCloserIsIdempotent(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	before := openIterators.Load()
+
+	_, closeIter, err := WrapIter(c.Db, nil)
+	if err != nil {
+		t.Fatalf("WrapIter: %v", err)
+	}
+	if got := openIterators.Load() - before; got != 1 {
+		t.Fatalf("open iterators after WrapIter = %d, want 1", got)
+	}
+	closeIter()
+	closeIter()
+	if got := openIterators.Load() - before; got != 0 {
+		t.Errorf("open iterators after closing twice = %d, want 0", got)
+	}
+}
+
+func TestIteratorsClosedAfterEachOperation(t *testing.T) {
+	status := http.StatusOK
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	setStatus := func(code int) {
+		mu.Lock()
+		status = code
+		mu.Unlock()
+	}
+
+	c := newTestConfig(t, srv.URL)
+	c.RecordTTL = time.Hour
+	fill := func() {
+		now := time.Now()
+		for i := 0; i < 5; i++ {
+			putRecord(t, c, keyAt(priorityPrefix(PriorityNormal), now.Add(time.Duration(i)), i), logRecord{
+				SchemaVersion: CurrentSchemaVersion,
+				Payload:       map[string]any{"msg": "iter"},
+				Pipelines:     []string{"p1"},
+				ReceivedAt:    now.Format(time.RFC3339Nano),
+			})
+		}
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ops := []struct {
+		name string
+		run  func()
+	}{
+		{"PebbleIsEmpty", func() { PebbleIsEmpty(c.Db) }},
+		{"hasPendingRecords", func() { c.hasPendingRecords() }},
+		{"oldestRecordTime", func() { c.oldestRecordTime() }},
+		{"ReportRecordAgeHistogram", func() { _ = c.ReportRecordAgeHistogram(context.Background()) }},
+		{"ReportRecordAgeHistogram cancelled", func() { _ = c.ReportRecordAgeHistogram(cancelled) }},
+		{"ExportToNDJSON", func() { _, _ = c.ExportToNDJSON(context.Background(), io.Discard) }},
+		{"ExportToNDJSON cancelled", func() { _, _ = c.ExportToNDJSON(cancelled, io.Discard) }},
+		{"ExportToCSV", func() { _, _ = c.ExportToCSV(context.Background(), io.Discard, []string{"msg"}) }},
+		{"ExpireRecords cancelled", func() { _, _ = c.ExpireRecords(cancelled, time.Now().Add(2*time.Hour)) }},
+		{"dryProcess", func() { _, _ = c.dryProcess(context.Background()) }},
+		{"ProcessPebble server error", func() { setStatus(http.StatusInternalServerError); _ = c.ProcessPebble(context.Background()) }},
+		{"ProcessPebble cancelled", func() { _ = c.ProcessPebble(cancelled) }},
+		{"ProcessPebble", func() { setStatus(http.StatusOK); _ = c.ProcessPebble(context.Background()) }},
+		{"PurgeTimeRange", func() {
+			fill()
+			_, _ = c.PurgeTimeRange(context.Background(), time.Unix(0, 0), time.Now().Add(time.Hour))
+		}},
+		{"ExpireRecords", func() { fill(); _, _ = c.ExpireRecords(context.Background(), time.Now().Add(2*time.Hour)) }},
+	}
+
+	fill()
+	before := openIterators.Load()
+	for _, op := range ops {
+		op.run()
+		if got := openIterators.Load() - before; got != 0 {
+			t.Errorf("%s left %d iterators open", op.name, got)
+		}
+	}
+	if got := testutil.ToFloat64(pebbleOpenIterators); got != float64(openIterators.Load()) {
+		t.Errorf("echopost_pebble_open_iterators = %v, want %d", got, openIterators.Load())
+	}
+}
+
+func TestProcessConcurrencyUploadsEveryRecordOnce(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			LogData map[string]any `json:"log_data"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		seen[fmt.Sprint(body.LogData["n"])]++
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	c := newTestConfig(t, srv.URL)
+	c.ProcessConcurrency = 4
+	const n = 100
+	for i := 0; i < n; i++ {
+		putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"n": i}, Pipelines: []string{"p1"}})
+	}
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != n {
+		t.Errorf("distinct records uploaded = %d, want %d", len(seen), n)
+	}
+	for record, count := range seen {
+		if count != 1 {
+			t.Errorf("record %s uploaded %d times", record, count)
+		}
+	}
+	if keys := storedKeys(t, c); len(keys) != 0 {
+		t.Errorf("records left after upload: %d", len(keys))
+	}
+	if c.RecordCount() != 0 {
+		t.Errorf("RecordCount = %d, want 0", c.RecordCount())
+	}
+}
+
+// fillPebble stores n records with a 64 KiB payload each.
+func fillPebble(t *testing.T, c *ServerConfig, n int) {
+	t.Helper()
+	blob := strings.Repeat("x", 64<<10)
+	for i := 0; i < n; i++ {
+		putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"blob": blob}, Pipelines: []string{"p1"}})
+	}
+}
+
+func TestProcessTriggerFiresPastSizeThreshold(t *testing.T) {
+	logs := CaptureLogs(t)
+	health := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, health.URL)
+	c.ProcessTriggerSizeMB = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	c.FlushPebbleDBOnInterval(ctx, &wg)
+
+	// Below the threshold nothing is signalled
+	fillPebble(t, c, 4)
+	if !c.IsHealthSuccess(c.NewHTTPClient(time.Second)) {
+		t.Fatal("health check failed")
+	}
+	select {
+	case <-c.ProcessNow():
+		t.Fatal("ProcessNow signalled below the size threshold")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// Past it, the flusher signals on its next pass
+	fillPebble(t, c, 32)
+	select {
+	case <-c.ProcessNow():
+	case <-time.After(3 * time.Second):
+		t.Fatal("ProcessNow not signalled past the size threshold")
+	}
+	entries := logs.Events("process_triggered_by_size")
+	if len(entries) == 0 || entries[0]["threshold_mb"] != float64(1) {
+		t.Errorf("process_triggered_by_size entries = %v", entries)
+	}
+}
+
+func TestProcessTriggerWaitsForHealthyServer(t *testing.T) {
+	health := newUploadCapture(t, http.StatusServiceUnavailable)
+	c := newTestConfig(t, health.URL)
+	c.ProcessTriggerSizeMB = 1
+	c.processNow = make(chan struct{}, 1)
+	fillPebble(t, c, 32)
+	FlushPebbleDB(c.Db)
+
+	c.checkProcessTrigger()
+	select {
+	case <-c.ProcessNow():
+		t.Fatal("ProcessNow signalled before any health check passed")
+	default:
+	}
+	c.IsHealthSuccess(c.NewHTTPClient(time.Second))
+	c.checkProcessTrigger()
+	select {
+	case <-c.ProcessNow():
+		t.Fatal("ProcessNow signalled while the server is unhealthy")
+	default:
+	}
+}
+
+func TestWALSizeAlertFiresPastThreshold(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.WALSizeAlertThresholdMB = 1
+	before := testutil.ToFloat64(walAlertsTotal)
+
+	fillPebble(t, c, 8) // 512 KiB
+	c.checkWALSize()
+	if n := len(logs.Events("wal_size_alert")); n != 0 {
+		t.Fatalf("wal_size_alert below the threshold: %d entries", n)
+	}
+
+	fillPebble(t, c, 16) // 1.5 MiB in total
+	c.checkWALSize()
+	entries := logs.Events("wal_size_alert")
+	if len(entries) != 1 {
+		t.Fatalf("wal_size_alert entries = %d, want 1", len(entries))
+	}
+	if size, _ := entries[0]["wal_size_bytes"].(float64); size <= 1<<20 || entries[0]["threshold_bytes"] != float64(1<<20) {
+		t.Errorf("wal_size_alert = %v, want a size past threshold_bytes 1048576", entries[0])
+	}
+	if got := testutil.ToFloat64(walAlertsTotal) - before; got != 1 {
+		t.Errorf("echopost_wal_alerts_total grew by %v, want 1", got)
+	}
+}
+
+func TestWALForceFlushOnAlertShrinksWAL(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.WALSizeAlertThresholdMB = 1
+	c.WALForceFlushOnAlert = true
+
+	fillPebble(t, c, 24)
+	c.checkWALSize()
+	c.checkWALSize()
+	if n := len(logs.Events("wal_size_alert")); n != 1 {
+		t.Fatalf("wal_size_alert entries = %d, want 1: the forced flush should have emptied the WAL", n)
+	}
+	metrics, err := c.Db.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.WAL.Size > 1<<20 {
+		t.Errorf("WAL size after the forced flush = %d, want below the threshold", metrics.WAL.Size)
+	}
+}
+
+func TestFlushThresholdRecordsFlushesBeforeTheInterval(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.FlushThresholdRecords = 50
+	// Far beyond the test's runtime, so any flush seen is the threshold's
+	c.FlushInterval = time.Hour
+	flushCount := func() int64 {
+		metrics, err := c.Db.Metrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metrics.Flush.Count
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	c.FlushPebbleDBOnInterval(ctx, &wg)
+	flushes := flushCount()
+
+	sendNumbered(t, c, 0, 49)
+	time.Sleep(100 * time.Millisecond)
+	if n := len(logs.Events("flush_threshold_reached")); n != 0 {
+		t.Fatalf("flush_threshold_reached entries below the threshold = %d, want 0", n)
+	}
+
+	sendNumbered(t, c, 49, 50)
+	if !waitFor(5*time.Second, func() bool { return flushCount() > flushes }) {
+		t.Fatal("no flush after FlushThresholdRecords records")
+	}
+	if n := len(logs.Events("flush_threshold_reached")); n != 1 {
+		t.Errorf("flush_threshold_reached entries = %d, want 1", n)
+	}
+}
+
+func TestRecordsStoredTriggersOnCrossingAMultiple(t *testing.T) {
+	c := &ServerConfig{FlushThresholdRecords: 10}
+	triggered := func() bool {
+		select {
+		case <-c.flushNowChan():
+			return true
+		default:
+			return false
+		}
+	}
+	for _, tc := range []struct {
+		n    int64
+		want bool
+	}{
+		{9, false}, // 9
+		{1, true},  // 10
+		{5, false}, // 15
+		{12, true}, // 27: a batch past 20
+		{3, true},  // 30
+		{25, true}, // 55: one trigger for several multiples
+		{4, false}, // 59
+	} {
+		c.recordsStored(tc.n)
+		if got := triggered(); got != tc.want {
+			t.Errorf("after storing %d (count %d) triggered = %v, want %v", tc.n, c.recordCount.Load(), got, tc.want)
+		}
+	}
+}
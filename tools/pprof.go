@@ -0,0 +1,77 @@
+package tools
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+)
+
+// StartPprofServer serves net/http/pprof and expvar (/debug/vars) on
+// localhost:<port>. When token is set, every request must carry
+// "Authorization: Bearer <token>". The server stops when ctx is cancelled.
+func StartPprofServer(ctx context.Context, wg *sync.WaitGroup, port int, token string) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		LogJsonLevel(LevelError, "pprof_listen_error", map[string]any{"error": err.Error()})
+		return err
+	}
+	srv := &http.Server{Handler: requireBearerToken(token, newPprofMux())}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			LogJsonLevel(LevelError, "pprof_server_error", map[string]any{"error": err.Error()})
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+		LogJsonLevel(LevelInfo, "pprof_server_stopped", nil)
+	}()
+
+	LogJsonLevel(LevelInfo, "pprof_server_started", map[string]any{"addr": lis.Addr().String(), "token_required": token != ""})
+	return nil
+}
+
+// newPprofMux routes the pprof and expvar handlers on a private mux. Their
+// packages also register on http.DefaultServeMux when imported, so serving
+// that instead would expose anything else registered there by dependencies.
+func newPprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// requireBearerToken rejects requests without the expected bearer token.
+// An empty token disables the check.
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
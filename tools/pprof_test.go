@@ -0,0 +1,86 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startPprof runs StartPprofServer on a free port and returns its base URL.
+// The server is stopped when the test ends.
+func startPprof(t *testing.T, token string) string {
+	t.Helper()
+	logs := CaptureLogs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	if err := StartPprofServer(ctx, &wg, 0, token); err != nil {
+		t.Fatalf("StartPprofServer: %v", err)
+	}
+	started := logs.Events("pprof_server_started")
+	if len(started) != 1 {
+		t.Fatalf("pprof_server_started entries = %d, want 1", len(started))
+	}
+	return "http://" + started[0]["addr"].(string)
+}
+
+func pprofGet(t *testing.T, url, token string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPprofServerServesProfiles(t *testing.T) {
+	base := startPprof(t, "")
+	for path, want := range map[string]int{
+		"/debug/pprof/goroutine?debug=1": http.StatusOK,
+		"/debug/pprof/":                  http.StatusOK,
+		"/debug/vars":                    http.StatusOK,
+		"/metrics":                       http.StatusNotFound,
+	} {
+		if got := pprofGet(t, base+path, ""); got != want {
+			t.Errorf("GET %s = %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestPprofServerRequiresToken(t *testing.T) {
+	base := startPprof(t, "s3cret")
+	url := base + "/debug/pprof/goroutine"
+	for token, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "s3cret": http.StatusOK} {
+		if got := pprofGet(t, url, token); got != want {
+			t.Errorf("GET with token %q = %d, want %d", token, got, want)
+		}
+	}
+}
+
+// registerDefaultMuxProbe adds a handler to http.DefaultServeMux, as a
+// dependency might. Registering the same pattern twice panics, so it runs once.
+var registerDefaultMuxProbe = sync.OnceFunc(func() {
+	http.HandleFunc("/echopost-default-mux-probe", func(w http.ResponseWriter, r *http.Request) {})
+})
+
+func TestPprofServerIgnoresDefaultServeMux(t *testing.T) {
+	registerDefaultMuxProbe()
+	base := startPprof(t, "")
+	if got := pprofGet(t, base+"/echopost-default-mux-probe", ""); got != http.StatusNotFound {
+		t.Errorf("handler on http.DefaultServeMux answered with %d, want 404", got)
+	}
+}
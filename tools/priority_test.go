@@ -0,0 +1,92 @@
+package tools_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+func TestHighPriorityRecordsUploadFirst(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+
+	// Interleave priorities so key order, not arrival order, decides
+	var wantHigh []string
+	for i := 0; i < 10; i++ {
+		priority := tools.PriorityNormal
+		if i%3 == 0 {
+			priority = tools.PriorityHigh
+			wantHigh = append(wantHigh, strconv.Itoa(i))
+		}
+		req := &pb.LogRequest{JsonData: `{"n":"` + strconv.Itoa(i) + `"}`, Pipelines: []string{"p1"}, Priority: priority}
+		if _, err := agent.SendLog(req); err != nil {
+			t.Fatalf("SendLog %d: %v", i, err)
+		}
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	bodies := uploadedBodies(t, agent)
+	if len(bodies) != 10 {
+		t.Fatalf("uploads = %d, want 10", len(bodies))
+	}
+	for i, want := range wantHigh {
+		if got := bodies[i].LogData["n"]; got != want {
+			t.Errorf("upload %d = record %v, want high-priority record %s", i, got, want)
+		}
+	}
+	for i, b := range bodies[len(wantHigh):] {
+		if n, _ := strconv.Atoi(b.LogData["n"].(string)); n%3 == 0 {
+			t.Errorf("high-priority record %d uploaded after normal ones (position %d)", n, len(wantHigh)+i)
+		}
+	}
+}
+
+func TestHighPriorityRecordsWithPipelineTTLUploadFirst(t *testing.T) {
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.PipelineTTLs = map[string]time.Duration{"p1": time.Hour} },
+	})
+
+	// Expiring keys sort by expiry, which follows arrival order; only the
+	// priority prefix puts the high-priority records first
+	for i := 0; i < 6; i++ {
+		priority := tools.PriorityNormal
+		if i >= 3 {
+			priority = tools.PriorityHigh
+		}
+		req := &pb.LogRequest{JsonData: `{"n":"` + strconv.Itoa(i) + `"}`, Pipelines: []string{"p1"}, Priority: priority}
+		if _, err := agent.SendLog(req); err != nil {
+			t.Fatalf("SendLog %d: %v", i, err)
+		}
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	bodies := uploadedBodies(t, agent)
+	if len(bodies) != 6 {
+		t.Fatalf("uploads = %d, want 6", len(bodies))
+	}
+	for i, want := range []string{"3", "4", "5", "0", "1", "2"} {
+		if got := bodies[i].LogData["n"]; got != want {
+			t.Errorf("upload %d = record %v, want record %s", i, got, want)
+		}
+	}
+}
+
+func TestPebbleIsEmptySeesEveryPriority(t *testing.T) {
+	agent := startAgent(t, testharness.Options{})
+	if !tools.PebbleIsEmpty(agent.Config.Db) {
+		t.Fatal("new agent is not empty")
+	}
+	if _, err := agent.SendLog(&pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}, Priority: tools.PriorityHigh}); err != nil {
+		t.Fatalf("SendLog: %v", err)
+	}
+	if tools.PebbleIsEmpty(agent.Config.Db) {
+		t.Fatal("PebbleIsEmpty ignores high-priority records")
+	}
+}
@@ -0,0 +1,165 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingServer accepts uploads and records the "n" field of each one.
+// While failN is non-negative, the upload with that n is answered with 503
+// once the three uploads read after it have arrived, so they complete first.
+type countingServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	seen  []int
+	failN int
+	later chan struct{}
+}
+
+func newCountingServer(t *testing.T, failN int) *countingServer {
+	t.Helper()
+	s := &countingServer{failN: failN, later: make(chan struct{}, 3)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			LogData struct{ N int } `json:"log_data"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		n := body.LogData.N
+		s.mu.Lock()
+		s.seen = append(s.seen, n)
+		failN := s.failN
+		s.mu.Unlock()
+
+		switch {
+		case n == failN:
+			for i := 0; i < cap(s.later); i++ {
+				select {
+				case <-s.later:
+				case <-time.After(2 * time.Second):
+				}
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case failN >= 0 && n > failN:
+			select {
+			case s.later <- struct{}{}:
+			default:
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *countingServer) uploads() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.seen)
+}
+
+func TestProcessCursorResumesAfterCrashWithoutSkippingFailures(t *testing.T) {
+	logs := CaptureLogs(t)
+	dir := t.TempDir()
+	srv := newCountingServer(t, 5)
+	c := restartAgent(t, dir)
+	c.ServerHost = srv.URL
+	c.ProcessConcurrency = 4
+
+	prefix := pipelineKeyPrefix(PriorityNormal, "p1")
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	var keys []string
+	for n := 0; n < 20; n++ {
+		keys = append(keys, keyAt(prefix, start.Add(time.Duration(n)*time.Second), 0))
+		putRecord(t, c, keys[n], logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"n": n}, Pipelines: []string{"p1"}})
+	}
+
+	// Record 5 fails while records read after it are delivered
+	if err := c.ProcessPebble(context.Background()); err == nil {
+		t.Fatal("ProcessPebble hid the 503 for record 5")
+	}
+	if stored := storedKeys(t, c); !slices.Contains(stored, keys[5]) {
+		t.Fatal("record 5 was deleted after a transient failure")
+	}
+	cursor, err := ReadCursor(c.processCursorPath)
+	if err != nil {
+		t.Fatalf("ReadCursor: %v", err)
+	}
+	if cursor == "" || cursor >= keys[5] {
+		t.Fatalf("cursor = %q, want a key before record 5 (%s)", cursor, keys[5])
+	}
+
+	// The agent crashes and restarts; the next pass resumes at the cursor
+	c.CloseFiles()
+	c = restartAgent(t, dir)
+	t.Cleanup(c.CloseFiles)
+	c.ServerHost = srv.URL
+	srv.mu.Lock()
+	srv.failN = -1
+	srv.mu.Unlock()
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble after restart: %v", err)
+	}
+
+	resumed := logs.Events("process_cursor_resume")
+	if len(resumed) != 1 || !slices.Equal(resumed[0]["cursors"].([]any), []any{cursor}) {
+		t.Errorf("process_cursor_resume entries = %v, want one from %q", resumed, cursor)
+	}
+	if stored := storedKeys(t, c); len(stored) != 0 {
+		t.Errorf("records left = %v, want none", stored)
+	}
+	counts := map[int]int{}
+	for _, n := range srv.uploads() {
+		counts[n]++
+	}
+	if counts[5] != 2 {
+		t.Errorf("record 5 uploaded %d times, want a retry after the failure", counts[5])
+	}
+	for n := range 20 {
+		if counts[n] == 0 {
+			t.Errorf("record %d never uploaded", n)
+		}
+	}
+	if _, err := os.Stat(c.processCursorPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("cursor file left after a full pass: %v", err)
+	}
+}
+
+func TestProcessCursorPerPriorityPrefix(t *testing.T) {
+	srv := newCountingServer(t, -1)
+	c := newTestConfig(t, srv.URL)
+
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	prefixes := []string{priorityPrefix(PriorityHigh), pipelineKeyPrefix(PriorityNormal, "p1"), ""}
+	var cursors []string
+	for i, prefix := range prefixes {
+		for j := 0; j < 4; j++ {
+			key := keyAt(prefix, start.Add(time.Duration(j)*time.Second), 0)
+			putRecord(t, c, key, logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"n": i*10 + j}, Pipelines: []string{"p1"}})
+			if j == 1 {
+				cursors = append(cursors, key)
+			}
+		}
+	}
+	// A cursor for each prefix, as left by an interrupted pass
+	if err := WriteCursor(c.processCursorPath, strings.Join(cursors, "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	// High priority is rescanned from its start; the others resume at their cursor
+	want := []int{0, 1, 2, 3, 11, 12, 13, 21, 22, 23}
+	if got := srv.uploads(); !slices.Equal(got, want) {
+		t.Errorf("uploaded %v, want %v", got, want)
+	}
+}
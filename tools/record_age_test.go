@@ -0,0 +1,89 @@
+package tools
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRecordAgeHistogramBuckets(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	now := time.Now()
+	for i, age := range []time.Duration{30 * time.Second, 2 * time.Minute, 10 * time.Minute, 2 * time.Hour, 3 * 24 * time.Hour} {
+		putRecord(t, c, keyAt(priorityPrefix(PriorityNormal), now, i), logRecord{
+			SchemaVersion: CurrentSchemaVersion,
+			Payload:       map[string]any{},
+			ReceivedAt:    now.Add(-age).Format(time.RFC3339Nano),
+		})
+	}
+
+	if err := c.ReportRecordAgeHistogram(context.Background()); err != nil {
+		t.Fatalf("ReportRecordAgeHistogram: %v", err)
+	}
+	entries := logs.Events("record_age_histogram")
+	if len(entries) != 1 {
+		t.Fatalf("record_age_histogram entries = %d, want 1", len(entries))
+	}
+	// Buckets are cumulative
+	for bucket, want := range map[string]float64{"<1m": 1, "<5m": 2, "<1h": 3, "<24h": 4, ">=24h": 1, "total": 5} {
+		if got := entries[0][bucket]; got != want {
+			t.Errorf("%s = %v, want %v", bucket, got, want)
+		}
+	}
+	if oldest, _ := entries[0]["oldest_age_seconds"].(float64); oldest < (72 * time.Hour).Seconds() {
+		t.Errorf("oldest_age_seconds = %v, want about 3 days", oldest)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(recordAges)
+	families, err := reg.Gather()
+	if err != nil || len(families) != 1 {
+		t.Fatalf("gather echopost_record_age_seconds = %v, %v", families, err)
+	}
+	hist := families[0].GetMetric()[0].GetHistogram()
+	if hist.GetSampleCount() != 5 {
+		t.Errorf("histogram count = %d, want 5", hist.GetSampleCount())
+	}
+	want := map[float64]uint64{60: 1, 300: 2, 3600: 3, 86400: 4}
+	for _, b := range hist.GetBucket() {
+		if b.GetCumulativeCount() != want[b.GetUpperBound()] {
+			t.Errorf("bucket le=%v = %d, want %d", b.GetUpperBound(), b.GetCumulativeCount(), want[b.GetUpperBound()])
+		}
+	}
+}
+
+func TestRecordAgeHistogramCustomBuckets(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.RecordAgeHistogramBuckets = []time.Duration{time.Hour, 10 * time.Second} // sorted before use
+	now := time.Now()
+	putRecord(t, c, keyAt(priorityPrefix(PriorityNormal), now, 0), logRecord{SchemaVersion: CurrentSchemaVersion, ReceivedAt: now.Add(-time.Minute).Format(time.RFC3339Nano)})
+
+	if err := c.ReportRecordAgeHistogram(context.Background()); err != nil {
+		t.Fatalf("ReportRecordAgeHistogram: %v", err)
+	}
+	entry := logs.Events("record_age_histogram")[0]
+	for bucket, want := range map[string]float64{"<10s": 0, "<1h": 1, ">=1h": 0} {
+		if got := entry[bucket]; got != want {
+			t.Errorf("%s = %v, want %v", bucket, got, want)
+		}
+	}
+}
+
+func TestShortDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		10 * time.Second:          "10s",
+		time.Minute:               "1m",
+		90 * time.Second:          "1m30s",
+		time.Hour:                 "1h",
+		24 * time.Hour:            "24h",
+		time.Hour + 5*time.Minute: "1h5m",
+	} {
+		if got := shortDuration(d); got != want {
+			t.Errorf("shortDuration(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
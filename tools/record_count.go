@@ -0,0 +1,109 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recordCountSnapshot is the on-disk form written by SnapshotRecordCount.
+type recordCountSnapshot struct {
+	RecordCount int64  `json:"record_count"`
+	WrittenAt   string `json:"written_at"`
+}
+
+// RecordCount returns the number of records currently stored in Pebble.
+// It is restored at startup and kept up to date by every write and delete;
+// imports that overwrite existing keys can make it drift until the next scan.
+func (c *ServerConfig) RecordCount() int64 {
+	return c.recordCount.Load()
+}
+
+// SnapshotRecordCount writes the current record count to path as JSON.
+// The file is replaced atomically so a crash never leaves a partial snapshot.
+func (c *ServerConfig) SnapshotRecordCount(path string) error {
+	data, err := json.Marshal(recordCountSnapshot{
+		RecordCount: c.recordCount.Load(),
+		WrittenAt:   time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadRecordCount returns the count stored at path if the snapshot is at
+// least as new as every file in dbPath, i.e. nothing was written to Pebble
+// after it. It must run before Pebble is opened, since opening the DB
+// touches its files.
+func loadRecordCount(path, dbPath string) (int64, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	newest, err := newestModTime(dbPath)
+	if err != nil || newest.After(info.ModTime()) {
+		return 0, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	var snap recordCountSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil || snap.RecordCount < 0 {
+		return 0, false
+	}
+	return snap.RecordCount, true
+}
+
+// newestModTime returns the latest modification time of any file under dir.
+// A missing dir yields the zero time.
+func newestModTime(dir string) (time.Time, error) {
+	var newest time.Time
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	return newest, err
+}
+
+// restoreRecordCount initialises recordCount after Pebble is opened, from the
+// snapshot when fresh or from a full scan otherwise.
+func (c *ServerConfig) restoreRecordCount(snapshot int64, fresh bool) error {
+	source := "snapshot"
+	if !fresh {
+		source = "scan"
+		iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+		if err != nil {
+			return err
+		}
+		snapshot = 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			snapshot++
+		}
+		closeIter()
+	}
+	c.recordCount.Store(snapshot)
+	LogJsonLevel(LevelInfo, "record_count_restored", map[string]any{"record_count": snapshot, "source": source})
+	return nil
+}
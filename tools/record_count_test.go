@@ -0,0 +1,107 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// restartAgent opens a new ServerConfig on dir, as a restarted agent would.
+// The caller closes it.
+func restartAgent(t *testing.T, dir string) *ServerConfig {
+	t.Helper()
+	c := &ServerConfig{ServerHost: "http://unused.invalid"}
+	if err := c.CreateRequiredFiles(dir); err != nil {
+		t.Fatalf("create agent files: %v", err)
+	}
+	return c
+}
+
+func TestRecordCountRestoredFromSnapshot(t *testing.T) {
+	logs := CaptureLogs(t)
+	dir := t.TempDir()
+	c := restartAgent(t, dir)
+	sendNumbered(t, c, 0, 7)
+	c.CloseFiles()
+
+	// Rewrite the snapshot with a count a scan would never produce: if it is
+	// used, Pebble was not scanned
+	snapshotPath := filepath.Join(dir, "pebble-record-count.json")
+	var snap recordCountSnapshot
+	data, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	if err := json.Unmarshal(data, &snap); err != nil || snap.RecordCount != 7 {
+		t.Fatalf("snapshot = %s, %v; want record_count 7", data, err)
+	}
+	if err := os.WriteFile(snapshotPath, []byte(`{"record_count":42}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c = restartAgent(t, dir)
+	defer c.CloseFiles()
+	if got := c.RecordCount(); got != 42 {
+		t.Fatalf("RecordCount after restart = %d, want the snapshot's 42 without a scan", got)
+	}
+	entries := logs.Events("record_count_restored")
+	if last := entries[len(entries)-1]; last["source"] != "snapshot" {
+		t.Errorf("record_count_restored = %v, want source snapshot", last)
+	}
+}
+
+func TestRecordCountScansWhenSnapshotIsStale(t *testing.T) {
+	logs := CaptureLogs(t)
+	dir := t.TempDir()
+	c := restartAgent(t, dir)
+	sendNumbered(t, c, 0, 5)
+	c.CloseFiles()
+
+	// Pebble written after the snapshot, as after a crash between snapshots
+	snapshotPath := filepath.Join(dir, "pebble-record-count.json")
+	old := time.Now().Add(-time.Hour)
+	if err := os.WriteFile(snapshotPath, []byte(`{"record_count":42}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(snapshotPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	c = restartAgent(t, dir)
+	defer c.CloseFiles()
+	if got := c.RecordCount(); got != 5 {
+		t.Fatalf("RecordCount after restart = %d, want 5 from a scan", got)
+	}
+	entries := logs.Events("record_count_restored")
+	if last := entries[len(entries)-1]; last["source"] != "scan" {
+		t.Errorf("record_count_restored = %v, want source scan", last)
+	}
+}
+
+func TestRecordCountTracksWritesAndDeletes(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	sendNumbered(t, c, 0, 4)
+	if got := c.RecordCount(); got != 4 {
+		t.Fatalf("RecordCount after 4 writes = %d", got)
+	}
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	if got := c.RecordCount(); got != 0 {
+		t.Fatalf("RecordCount after upload = %d, want 0", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "count.json")
+	sendNumbered(t, c, 0, 2)
+	if err := c.SnapshotRecordCount(path); err != nil {
+		t.Fatalf("SnapshotRecordCount: %v", err)
+	}
+	if count, fresh := loadRecordCount(path, filepath.Join(t.TempDir(), "missing")); !fresh || count != 2 {
+		t.Errorf("loadRecordCount = %d, %v; want 2, fresh", count, fresh)
+	}
+}
@@ -0,0 +1,100 @@
+package tools_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+func TestResetWaitsForWritesInFlight(t *testing.T) {
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) { c.ProcessConcurrency = 8 },
+	})
+	logs := tools.CaptureLogs(t)
+	oldSessions, err := filepath.Glob(filepath.Join(agent.Dir(), "session-*"))
+	if err != nil || len(oldSessions) != 1 {
+		t.Fatalf("sessions before Reset = %v, %v; want one", oldSessions, err)
+	}
+
+	// SendLog and StreamLogs writers keep going across the Reset; every
+	// record the agent accepts must end up uploaded or in the new DB
+	var accepted atomic.Int64
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(2)
+		go func() {
+			defer writers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				case <-time.After(5 * time.Millisecond):
+				}
+				resp, err := agent.SendLog(&pb.LogRequest{JsonData: fmt.Sprintf(`{"n":%d}`, i), Pipelines: []string{"p1"}})
+				if err == nil && resp.Success {
+					accepted.Add(1)
+				}
+			}
+		}()
+		go func() {
+			defer writers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(5 * time.Millisecond):
+				}
+				reqs := make([]*pb.LogRequest, 10)
+				for i := range reqs {
+					reqs[i] = &pb.LogRequest{JsonData: fmt.Sprintf(`{"s":%d}`, i), Pipelines: []string{"p1"}}
+				}
+				// Fewer than streamBatchSize records: one commit, all or nothing
+				if resp, err := agent.StreamLogs(reqs); err == nil {
+					accepted.Add(resp.ReceivedCount - resp.FailedCount)
+				}
+			}
+		}()
+	}
+
+	// Sessions are named by the second they start in
+	time.Sleep(1100 * time.Millisecond)
+	if err := agent.Config.Reset(context.Background(), agent.Dir()); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	writers.Wait()
+
+	resets := logs.Events("agent_reset")
+	if len(resets) != 1 {
+		t.Fatalf("agent_reset entries = %d, want 1", len(resets))
+	}
+	newSession, _ := resets[0]["session_path"].(string)
+	if newSession == "" || newSession == oldSessions[0] {
+		t.Fatalf("session path after Reset = %q, want a new one (was %s)", newSession, oldSessions[0])
+	}
+	for _, name := range []string{"agent-success.log", "agent-failure.log"} {
+		if _, err := os.Stat(filepath.Join(newSession, name)); err != nil {
+			t.Errorf("new session file %s: %v", name, err)
+		}
+	}
+
+	uploaded := len(agent.CapturedServerRequests())
+	stored := agent.RecordCount()
+	if uploaded == 0 {
+		t.Fatal("no records drained by Reset")
+	}
+	if got := int64(uploaded + stored); got != accepted.Load() {
+		t.Errorf("uploaded %d + stored in the new DB %d = %d, want every accepted record (%d)", uploaded, stored, got, accepted.Load())
+	}
+}
@@ -0,0 +1,159 @@
+package tools_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+// endpoint is an upload server that records the pipelines of every request
+// and answers with the next status in statuses (200 once they run out).
+type endpoint struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	received [][]string
+}
+
+func newEndpoint(t *testing.T, statuses ...int) *endpoint {
+	t.Helper()
+	e := &endpoint{statuses: statuses}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body uploadBody
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		e.mu.Lock()
+		e.received = append(e.received, body.Pipelines)
+		status := http.StatusOK
+		if len(e.statuses) > 0 {
+			status, e.statuses = e.statuses[0], e.statuses[1:]
+		}
+		e.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *endpoint) requests() [][]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.received)
+}
+
+func TestPipelineEndpointsRouteRecords(t *testing.T) {
+	// Check for leaks only after the endpoints have closed their connections
+	tools.LeakCheck(t, nil)
+	a, b := newEndpoint(t), newEndpoint(t)
+	agent := testharness.StartTestAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) {
+			c.PipelineEndpoints = map[string]string{"a": a.URL + "/log", "b": b.URL + "/log"}
+		},
+	})
+
+	for _, pipelines := range [][]string{{"a"}, {"b"}, {"other"}, {"a", "b", "other"}} {
+		if _, err := agent.SendLog(&pb.LogRequest{JsonData: `{}`, Pipelines: pipelines}); err != nil {
+			t.Fatalf("SendLog %v: %v", pipelines, err)
+		}
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	wantA := [][]string{{"a"}, {"a"}}
+	wantB := [][]string{{"b"}, {"b"}}
+	if got := a.requests(); !slices.EqualFunc(got, wantA, slices.Equal) {
+		t.Errorf("endpoint a received %v, want %v", got, wantA)
+	}
+	if got := b.requests(); !slices.EqualFunc(got, wantB, slices.Equal) {
+		t.Errorf("endpoint b received %v, want %v", got, wantB)
+	}
+	var gotDefault [][]string
+	for _, body := range uploadedBodies(t, agent) {
+		gotDefault = append(gotDefault, body.Pipelines)
+	}
+	if wantDefault := [][]string{{"other"}, {"other"}}; !slices.EqualFunc(gotDefault, wantDefault, slices.Equal) {
+		t.Errorf("default endpoint received %v, want %v", gotDefault, wantDefault)
+	}
+}
+
+func TestFanOutRetriesOnlyFailedEndpoints(t *testing.T) {
+	tools.LeakCheck(t, nil)
+	a := newEndpoint(t)
+	b := newEndpoint(t, http.StatusServiceUnavailable)
+	agent := testharness.StartTestAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) {
+			c.PipelineEndpoints = map[string]string{"a": a.URL + "/log", "b": b.URL + "/log"}
+		},
+	})
+	if _, err := agent.SendLog(&pb.LogRequest{JsonData: `{}`, Pipelines: []string{"a", "b"}}); err != nil {
+		t.Fatalf("SendLog: %v", err)
+	}
+
+	if err := agent.Drain(); err == nil {
+		t.Fatal("first Drain hid the 503 from endpoint b")
+	}
+	if n := agent.RecordCount(); n != 1 {
+		t.Fatalf("records after partial delivery = %d, want 1", n)
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("second Drain: %v", err)
+	}
+	if n := agent.RecordCount(); n != 0 {
+		t.Fatalf("records after retry = %d, want 0", n)
+	}
+
+	if n := len(a.requests()); n != 1 {
+		t.Errorf("endpoint a received the record %d times, want once", n)
+	}
+	if n := len(b.requests()); n != 2 {
+		t.Errorf("endpoint b received the record %d times, want twice", n)
+	}
+}
+
+func TestPipelineApiKeysSelectUploadKey(t *testing.T) {
+	agent := startAgent(t, testharness.Options{
+		Configure: func(c *tools.ServerConfig) {
+			c.ApiKey = "global-key"
+			c.PipelineApiKeys = map[string]string{"billing": "billing-key", "analytics": "analytics-key"}
+		},
+	})
+	for _, pipelines := range [][]string{{"billing"}, {"analytics"}, {"other"}, {"billing", "analytics"}} {
+		if _, err := agent.SendLog(&pb.LogRequest{JsonData: `{}`, Pipelines: pipelines}); err != nil {
+			t.Fatalf("SendLog %v: %v", pipelines, err)
+		}
+	}
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	// The record for both pipelines is fanned out, one request per key
+	keys := map[string][][]string{}
+	for _, req := range agent.CapturedServerRequests() {
+		var body uploadBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Fatalf("decode upload: %v", err)
+		}
+		key := req.Header.Get("DATANADHI-API-KEY")
+		keys[key] = append(keys[key], body.Pipelines)
+	}
+	want := map[string][][]string{
+		"billing-key":   {{"billing"}, {"billing"}},
+		"analytics-key": {{"analytics"}, {"analytics"}},
+		"global-key":    {{"other"}},
+	}
+	for key, pipelines := range want {
+		if got := keys[key]; !slices.EqualFunc(got, pipelines, slices.Equal) {
+			t.Errorf("uploads with %s = %v, want %v", key, got, pipelines)
+		}
+	}
+	if len(keys) != len(want) {
+		t.Errorf("API keys used = %v, want only %v", keys, want)
+	}
+}
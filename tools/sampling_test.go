@@ -0,0 +1,60 @@
+package tools
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValidateSampleRate(t *testing.T) {
+	for _, rate := range []float64{0.0001, 0.5, 1} {
+		if err := ValidateSampleRate(rate); err != nil {
+			t.Errorf("ValidateSampleRate(%v) = %v", rate, err)
+		}
+	}
+	for _, rate := range []float64{0, -0.1, 1.01, math.NaN(), math.Inf(1)} {
+		if err := ValidateSampleRate(rate); err == nil {
+			t.Errorf("ValidateSampleRate(%v) accepted an invalid rate", rate)
+		}
+	}
+}
+
+func TestSampleRateHalfKeepsAboutHalf(t *testing.T) {
+	const calls = 10_000
+	tests := []struct {
+		name   string
+		config *ServerConfig
+	}{
+		{name: "global", config: &ServerConfig{SampleRate: 0.5}},
+		{name: "pipeline override", config: &ServerConfig{SampleRate: 1, PipelineSampleRates: map[string]float64{"p1": 0.5}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(sampledOutTotal)
+			dropped := 0
+			for i := 0; i < calls; i++ {
+				if tt.config.sampledOut([]string{"p1"}) {
+					dropped++
+				}
+			}
+			// Binomial(10000, 0.5) has a standard deviation of 50; allow 5 of them
+			if dropped < calls/2-250 || dropped > calls/2+250 {
+				t.Errorf("dropped %d of %d records at rate 0.5", dropped, calls)
+			}
+			if got := testutil.ToFloat64(sampledOutTotal) - before; got != float64(dropped) {
+				t.Errorf("sampled-out counter grew by %v, want %d", got, dropped)
+			}
+		})
+	}
+}
+
+func TestSampleRateOneKeepsAll(t *testing.T) {
+	for _, c := range []*ServerConfig{{}, {SampleRate: 1}, {SampleRate: 0.01, PipelineSampleRates: map[string]float64{"p1": 1}}} {
+		for i := 0; i < 1000; i++ {
+			if c.sampledOut([]string{"p1"}) {
+				t.Fatalf("record dropped with SampleRate %v and overrides %v", c.SampleRate, c.PipelineSampleRates)
+			}
+		}
+	}
+}
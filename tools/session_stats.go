@@ -0,0 +1,38 @@
+package tools
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// sessionStats counts what the agent did during this run, for the
+// session_summary event logged at shutdown.
+type sessionStats struct {
+	received      atomic.Int64 // LogRequests received over SendLog and StreamLogs
+	bytesReceived atomic.Int64 // Sum of json_data sizes of received LogRequests
+	sent          atomic.Int64 // Uploads accepted by the server (2xx)
+	bytesSent     atomic.Int64 // Body sizes of accepted uploads
+	failed        atomic.Int64 // Uploads permanently rejected by the server (3xx–500)
+	dropped       atomic.Int64 // Records discarded without upload: sampled out, below MinUploadLevel, past RecordTTL or evicted from the fallback buffer
+}
+
+// countReceived records one received LogRequest.
+func (c *ServerConfig) countReceived(jsonData string) {
+	c.stats.received.Add(1)
+	c.stats.bytesReceived.Add(int64(len(jsonData)))
+}
+
+// LogSessionSummary logs session_summary with the counts of this run. A record
+// fanned out to several endpoints counts once per endpoint in records_sent and
+// records_failed. It is called once at shutdown, after background tasks stop.
+func (c *ServerConfig) LogSessionSummary() {
+	LogJsonLevel(LevelInfo, "session_summary", map[string]any{
+		"records_received":         c.stats.received.Load(),
+		"records_sent":             c.stats.sent.Load(),
+		"records_failed":           c.stats.failed.Load(),
+		"records_dropped":          c.stats.dropped.Load(),
+		"bytes_received":           c.stats.bytesReceived.Load(),
+		"bytes_sent":               c.stats.bytesSent.Load(),
+		"session_duration_seconds": time.Since(startTime).Seconds(),
+	})
+}
@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+)
+
+func TestSessionSummaryCountsASession(t *testing.T) {
+	logs := CaptureLogs(t)
+	var bytesSent atomic.Int64
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bytesSent.Add(int64(len(body)))
+	}))
+	t.Cleanup(ok.Close)
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(rejecting.Close)
+
+	c := newTestConfig(t, ok.URL)
+	c.MinUploadLevel = "info"
+	c.PipelineEndpoints = map[string]string{"rejected": rejecting.URL + "/log"}
+
+	s := &server{config: c}
+	reqs := []*pb.LogRequest{
+		{JsonData: `{"n":1}`, Pipelines: []string{"p1"}},
+		{JsonData: `{"n":2}`, Pipelines: []string{"p1"}},
+		{JsonData: `{"n":3,"level":"debug"}`, Pipelines: []string{"p1"}},
+		{JsonData: `{"n":4}`, Pipelines: []string{"rejected"}},
+	}
+	var bytesReceived int
+	for _, req := range reqs {
+		if _, err := s.SendLog(context.Background(), req); err != nil {
+			t.Fatalf("SendLog: %v", err)
+		}
+		bytesReceived += len(req.JsonData)
+	}
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	c.LogSessionSummary()
+
+	entries := logs.Events("session_summary")
+	if len(entries) != 1 {
+		t.Fatalf("session_summary entries = %d, want 1", len(entries))
+	}
+	e := entries[0]
+	for field, want := range map[string]float64{
+		"records_received": 4,
+		"records_sent":     2,
+		"records_failed":   1,
+		"records_dropped":  1,
+		"bytes_received":   float64(bytesReceived),
+		"bytes_sent":       float64(bytesSent.Load()),
+	} {
+		if e[field] != want {
+			t.Errorf("%s = %v, want %v", field, e[field], want)
+		}
+	}
+	if d, ok := e["session_duration_seconds"].(float64); !ok || d <= 0 {
+		t.Errorf("session_duration_seconds = %v, want a positive duration", e["session_duration_seconds"])
+	}
+}
@@ -0,0 +1,128 @@
+package tools
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sessionDirFormat is the timestamp in session-<time> directory names.
+const sessionDirFormat = "2006-01-02T15-04-05Z"
+
+// SessionInfo describes one session directory under a base directory.
+type SessionInfo struct {
+	Session   string `json:"session"`    // Directory name, session-<time>
+	Created   string `json:"created"`    // Start time from the name, RFC3339 ("" if unparsable)
+	Records   *int   `json:"records"`    // Pebble records received while this session ran (nil while locked)
+	SizeBytes int64  `json:"size_bytes"` // Total size of the session's log files
+	Locked    bool   `json:"locked"`     // A running agent holds the base directory and this is its session
+
+	created time.Time
+}
+
+// ListSessions reports every session-* directory under baseDir, oldest
+// first. All sessions share baseDir/pebble, so each record is attributed to
+// the latest session that started at or before its received_at; records
+// older than every remaining session are not counted. Pebble is opened
+// read-only; while an agent is running it holds Pebble's lock, so records are
+// left nil for every session.
+func ListSessions(baseDir string) ([]SessionInfo, error) {
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []SessionInfo
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "session-") {
+			continue
+		}
+		info := SessionInfo{Session: entry.Name()}
+		if created, err := time.Parse(sessionDirFormat, strings.TrimPrefix(entry.Name(), "session-")); err == nil {
+			info.created = created
+			info.Created = created.Format(time.RFC3339)
+		}
+		info.SizeBytes = dirSize(filepath.Join(baseDir, entry.Name()))
+		sessions = append(sessions, info)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].created.Before(sessions[j].created) })
+
+	if len(sessions) > 0 && baseDirLocked(baseDir) {
+		sessions[len(sessions)-1].Locked = true
+		return sessions, nil
+	}
+
+	counts := make([]int, len(sessions))
+	for i := range sessions {
+		sessions[i].Records = &counts[i]
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "pebble")); errors.Is(err, fs.ErrNotExist) {
+		return sessions, nil
+	}
+	config := ServerConfig{}
+	if err := config.OpenDB(baseDir, true); err != nil {
+		return sessions, err
+	}
+	defer config.Db.Close()
+	return sessions, config.countSessionRecords(sessions)
+}
+
+// countSessionRecords increments Records on each session from the received_at of
+// every record in Pebble. sessions must be sorted by start time.
+func (c *ServerConfig) countSessionRecords(sessions []SessionInfo) error {
+	iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+	if err != nil {
+		return err
+	}
+	defer closeIter()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		var rec logRecord
+		if err := decodeRecord(iter.Value(), &rec); err != nil {
+			continue
+		}
+		receivedAt, err := time.Parse(time.RFC3339Nano, rec.ReceivedAt)
+		if err != nil {
+			continue
+		}
+		// Index of the first session that started after the record arrived
+		i := sort.Search(len(sessions), func(i int) bool { return sessions[i].created.After(receivedAt) })
+		if i > 0 {
+			*sessions[i-1].Records++
+		}
+	}
+	return nil
+}
+
+// baseDirLocked reports whether a running agent holds baseDir/agent.lock.
+func baseDirLocked(baseDir string) bool {
+	f, err := os.OpenFile(filepath.Join(baseDir, "agent.lock"), os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return errors.Is(err, ErrAgentAlreadyRunning)
+	}
+	_ = unlockFile(f)
+	return false
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
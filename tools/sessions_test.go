@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListSessionsCountsRecordsPerSession(t *testing.T) {
+	base := t.TempDir()
+	for name, size := range map[string]int{"session-2025-03-01T12-00-00Z": 25, "session-2025-03-01T10-00-00Z": 10} {
+		if err := os.Mkdir(filepath.Join(base, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(base, name, "success.log"), []byte(strings.Repeat("x", size)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &ServerConfig{}
+	if err := c.OpenDB(base, false); err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, hour := range []int{9, 10, 11, 12, 13, 14} { // the 9:00 record predates both sessions
+		at := day.Add(time.Duration(hour)*time.Hour + 30*time.Minute)
+		putRecord(t, c, keyAt(pipelineKeyPrefix(PriorityNormal, "p1"), at, i), logRecord{ReceivedAt: at.Format(time.RFC3339Nano)})
+	}
+	if err := c.Db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := ListSessions(base)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	want := []string{
+		`{"session":"session-2025-03-01T10-00-00Z","created":"2025-03-01T10:00:00Z","records":2,"size_bytes":10,"locked":false}`,
+		`{"session":"session-2025-03-01T12-00-00Z","created":"2025-03-01T12:00:00Z","records":3,"size_bytes":25,"locked":false}`,
+	}
+	if len(sessions) != len(want) {
+		t.Fatalf("ListSessions returned %d sessions, want %d", len(sessions), len(want))
+	}
+	for i, s := range sessions {
+		got, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want[i] {
+			t.Errorf("session %d = %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestListSessionsWithoutPebble(t *testing.T) {
+	base := t.TempDir()
+	if err := os.Mkdir(filepath.Join(base, "session-2025-03-01T10-00-00Z"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := ListSessions(base)
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Records == nil || *sessions[0].Records != 0 {
+		t.Errorf("ListSessions = %+v, want one session with 0 records", sessions)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build linux
+
+package tools
+
+// abstractSocketSupported reports whether SocketAbstract can be honoured.
+// Only Linux has the abstract Unix socket namespace.
+const abstractSocketSupported = true
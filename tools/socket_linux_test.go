@@ -0,0 +1,63 @@
+//go:build linux
+
+package tools
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+)
+
+func TestAbstractSocketAcceptsConnections(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.SocketAbstract = true
+	if c.SocketTarget() != "unix-abstract:"+c.SocketPath {
+		t.Fatalf("SocketTarget = %q, want the abstract namespace", c.SocketTarget())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	if err := c.StartGRPCServer(ctx, &wg); err != nil {
+		t.Fatalf("StartGRPCServer: %v", err)
+	}
+
+	resp, err := dialAgent(t, c).SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}})
+	if err != nil || !resp.Success {
+		t.Fatalf("SendLog over the abstract socket = %+v, %v", resp, err)
+	}
+	if n := len(storedKeys(t, c)); n != 1 {
+		t.Errorf("records stored = %d, want 1", n)
+	}
+	// The kernel owns the name: nothing is created on the filesystem
+	if _, err := os.Lstat(c.SocketPath); !os.IsNotExist(err) {
+		t.Errorf("socket file at %s: %v, want none", c.SocketPath, err)
+	}
+}
+
+func TestAbstractSocketSkipsSocketFileCleanup(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.SocketAbstract = true
+	// A file at the same path belongs to someone else and must survive
+	if err := os.WriteFile(c.SocketPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := c.StartGRPCServer(ctx, &wg); err != nil {
+		t.Fatalf("StartGRPCServer: %v", err)
+	}
+	cancel()
+	wg.Wait()
+
+	if _, err := os.Stat(c.SocketPath); err != nil {
+		t.Errorf("file at the socket path removed: %v", err)
+	}
+}
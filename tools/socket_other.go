@@ -0,0 +1,7 @@
+//go:build !linux
+
+package tools
+
+// abstractSocketSupported reports whether SocketAbstract can be honoured.
+// Other platforms fall back to a filesystem socket.
+const abstractSocketSupported = false
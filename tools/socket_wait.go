@@ -0,0 +1,56 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// WaitForSocket backoff bounds.
+const (
+	socketWaitInitialDelay = 10 * time.Millisecond
+	socketWaitMaxDelay     = time.Second
+)
+
+// WaitForSocket blocks until a Unix socket exists at socketPath, polling with
+// exponential backoff, and returns an error if none appears within timeout.
+// SDK wrappers call it before dialing so a client started alongside the agent
+// does not fail while the agent is still opening Pebble. It cannot see
+// abstract sockets (-socket-abstract), which have no file.
+//
+// Once the socket exists, dial it with a backoff so the connection is
+// re-established if the agent restarts:
+//
+//	conn, err := grpc.NewClient("unix:"+socketPath,
+//		grpc.WithTransportCredentials(insecure.NewCredentials()),
+//		grpc.WithConnectParams(grpc.ConnectParams{
+//			Backoff:           backoff.Config{BaseDelay: 100 * time.Millisecond, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 5 * time.Second},
+//			MinConnectTimeout: 2 * time.Second,
+//		}),
+//	)
+//
+// Clients still on grpc.Dial with grpc.WithBlock should add
+// grpc.WithReturnConnectionError so a failed dial reports the last connection
+// error rather than only "context deadline exceeded". grpc.WithBackoffConfig is
+// the older form of the Backoff setting above; both options are deprecated in
+// grpc-go in favour of NewClient and WithConnectParams.
+func WaitForSocket(socketPath string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := socketWaitInitialDelay
+	for {
+		info, err := os.Stat(socketPath)
+		if err == nil && info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if err == nil {
+				return fmt.Errorf("%s exists but is not a socket", socketPath)
+			}
+			return fmt.Errorf("socket %s not ready after %s: %w", socketPath, timeout, err)
+		}
+		time.Sleep(min(delay, remaining))
+		delay = min(delay*2, socketWaitMaxDelay)
+	}
+}
@@ -0,0 +1,65 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+)
+
+func TestWaitForSocketConnectsToLateAgent(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+
+	// The agent binds its socket 500ms after the client starts waiting
+	started := make(chan error, 1)
+	time.AfterFunc(500*time.Millisecond, func() { started <- c.StartGRPCServer(ctx, &wg) })
+
+	start := time.Now()
+	if err := WaitForSocket(c.SocketPath, 5*time.Second); err != nil {
+		t.Fatalf("WaitForSocket: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("WaitForSocket returned after %v, before the socket existed", elapsed)
+	}
+	if err := <-started; err != nil {
+		t.Fatalf("StartGRPCServer: %v", err)
+	}
+	resp, err := dialAgent(t, c).SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p1"}})
+	if err != nil || !resp.Success {
+		t.Fatalf("SendLog after WaitForSocket = %+v, %v", resp, err)
+	}
+}
+
+func TestWaitForSocketTimesOut(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now()
+	err := WaitForSocket(filepath.Join(dir, "missing.sock"), 300*time.Millisecond)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("WaitForSocket on a missing socket = %v, want a not-exist error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("WaitForSocket gave up after %v, want about 300ms", elapsed)
+	}
+
+	// A regular file at the path is not mistaken for the socket
+	path := filepath.Join(dir, "file.sock")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitForSocket(path, 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("WaitForSocket on a regular file = %v, want a not-a-socket error", err)
+	}
+}
@@ -0,0 +1,48 @@
+package tools_test
+
+import (
+	"strconv"
+	"testing"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+	"github.com/datanadhi/echopost/tools/testharness"
+)
+
+func TestStreamLogsStoresThousandRecords(t *testing.T) {
+	logs := tools.CaptureLogs(t)
+	agent := startAgent(t, testharness.Options{})
+
+	reqs := make([]*pb.LogRequest, 1000)
+	for i := range reqs {
+		reqs[i] = &pb.LogRequest{JsonData: `{"n":` + strconv.Itoa(i) + `}`, Pipelines: []string{"stream"}}
+	}
+	resp, err := agent.StreamLogs(reqs)
+	if err != nil {
+		t.Fatalf("StreamLogs: %v", err)
+	}
+	if resp.ReceivedCount != 1000 || resp.FailedCount != 0 {
+		t.Fatalf("StreamLogs = %+v, want 1000 received and 0 failed", resp)
+	}
+	if n := agent.RecordCount(); n != 1000 {
+		t.Fatalf("records = %d, want 1000", n)
+	}
+
+	// The stream went through the stream interceptor chain
+	var streamed bool
+	for _, e := range logs.Events("grpc_request") {
+		if e["method"] == pb.LogAgent_StreamLogs_FullMethodName && e["stream"] == true {
+			streamed = true
+		}
+	}
+	if !streamed {
+		t.Error("no grpc_request entry logged for the stream")
+	}
+
+	if err := agent.Drain(); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if n := len(uploadedBodies(t, agent)); n != 1000 {
+		t.Errorf("uploads = %d, want 1000", n)
+	}
+}
@@ -0,0 +1,298 @@
+// Package testharness starts a real EchoPost agent inside a test process.
+// The agent runs against a temp directory and an httptest server standing in
+// for the Data Nadhi server, so tests can exercise the full gRPC -> Pebble ->
+// upload path without external dependencies.
+//
+// Sub-tests can share one agent through AgentHandle.Run, which resets it to a
+// fresh session and empty Pebble DB before each one.
+package testharness
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+	"github.com/datanadhi/echopost/tools"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Options tweaks the agent started by StartTestAgent.
+type Options struct {
+	ServerStatus int                                 // Status returned by the fake server (0 = 200)
+	Configure    func(*tools.ServerConfig)           // Optional hook run before the agent starts
+	WrapDB       func(tools.PebbleDB) tools.PebbleDB // Optional wrapper put in front of Pebble, e.g. a fault injector
+	Dir          string                              // Base directory (empty = a new temp dir), e.g. to restart an agent on another one's DB
+	AdminPort    int                                 // Also serve the admin endpoints on this localhost port (0 = admin socket only)
+}
+
+// capturedRequest is a server request with its body read into memory.
+type capturedRequest struct {
+	req  *http.Request
+	body []byte
+}
+
+// AgentHandle controls a running test agent.
+type AgentHandle struct {
+	Config *tools.ServerConfig
+
+	dir     string
+	opts    Options
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stopped chan struct{} // Closed once the agent has stopped and closed its files
+	conn    *grpc.ClientConn
+	client  pb.LogAgentClient
+	http    *httptest.Server
+	status  atomic.Int32 // Current fake server status, see SetServerStatus
+
+	mu       sync.Mutex
+	captured []capturedRequest
+
+	shutdownOnce sync.Once
+}
+
+// StartTestAgent starts the gRPC server, admin socket and Pebble flusher in a
+// temp directory, plus the HTTP ingest server when Configure sets
+// HTTPIngestPort, as main does. Shutdown is registered with t.Cleanup, so
+// callers never leak resources.
+func StartTestAgent(t testing.TB, opts Options) *AgentHandle {
+	t.Helper()
+
+	h := &AgentHandle{opts: opts, stopped: make(chan struct{})}
+	h.SetServerStatus(opts.ServerStatus)
+	h.http = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		h.mu.Lock()
+		h.captured = append(h.captured, capturedRequest{req: r.Clone(context.Background()), body: body})
+		h.mu.Unlock()
+		w.WriteHeader(int(h.status.Load()))
+	}))
+
+	h.Config = &tools.ServerConfig{
+		ServerHost:          h.http.URL,
+		HealthCheckInterval: 100 * time.Millisecond,
+		PostFlushInterval:   100 * time.Millisecond,
+		HealthCheckTimeout:  time.Second,
+	}
+	if opts.Configure != nil {
+		opts.Configure(h.Config)
+	}
+
+	// Create the temp dir first: cleanups run last-in first-out, so Shutdown
+	// closes Pebble before the directory is removed
+	h.dir = opts.Dir
+	if h.dir == "" {
+		h.dir = t.TempDir()
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	t.Cleanup(h.Shutdown)
+
+	// The agent stops when its context is cancelled, by Shutdown or by the
+	// admin /shutdown endpoint, and then closes its files as main does
+	go func() {
+		<-h.ctx.Done()
+		h.wg.Wait()
+		if h.Config.Db != nil {
+			h.Config.CloseFiles()
+		}
+		close(h.stopped)
+	}()
+
+	if err := h.Config.CreateRequiredFiles(h.dir); err != nil {
+		t.Fatalf("create agent files: %v", err)
+	}
+	h.wrapDB()
+	if err := h.Config.StartGRPCServer(h.ctx, &h.wg); err != nil {
+		t.Fatalf("start gRPC server: %v", err)
+	}
+	if h.Config.HTTPIngestPort > 0 {
+		if err := h.Config.StartHTTPIngestServer(h.ctx, &h.wg); err != nil {
+			t.Fatalf("start HTTP ingest server: %v", err)
+		}
+	}
+	if err := h.Config.StartAdminSocket(h.ctx, &h.wg, h.cancel); err != nil {
+		t.Fatalf("start admin socket: %v", err)
+	}
+	if opts.AdminPort > 0 {
+		if err := h.Config.StartAdminServer(h.ctx, &h.wg, opts.AdminPort, h.cancel); err != nil {
+			t.Fatalf("start admin server: %v", err)
+		}
+	}
+	h.Config.FlushPebbleDBOnInterval(h.ctx, &h.wg)
+
+	conn, err := grpc.NewClient(h.Config.SocketTarget(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	h.conn = conn
+	h.client = pb.NewLogAgentClient(conn)
+	return h
+}
+
+// wrapDB puts Options.WrapDB in front of the current Pebble DB, if set.
+// Reset opens a new DB, so it is called again after each one.
+func (h *AgentHandle) wrapDB() {
+	if h.opts.WrapDB != nil {
+		h.Config.Db.Wrap(h.opts.WrapDB)
+	}
+}
+
+// Dir returns the agent's base directory.
+func (h *AgentHandle) Dir() string {
+	return h.dir
+}
+
+// Done returns a channel closed once the agent has stopped and closed its
+// files, including its lock.
+func (h *AgentHandle) Done() <-chan struct{} {
+	return h.stopped
+}
+
+// Dial opens another client connection to the agent, for tests that need
+// more than one; the caller closes it.
+func (h *AgentHandle) Dial() (*grpc.ClientConn, error) {
+	return grpc.NewClient(h.Config.SocketTarget(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// Reset uploads the stored records to the fake server, then starts a new
+// session with an empty Pebble DB (see ServerConfig.Reset) and forgets the
+// captured server requests. The gRPC connection stays usable.
+func (h *AgentHandle) Reset() error {
+	if err := h.Config.Reset(h.ctx, h.dir); err != nil {
+		return err
+	}
+	h.wrapDB()
+	h.mu.Lock()
+	h.captured = nil
+	h.mu.Unlock()
+	return nil
+}
+
+// Run resets the agent and runs f as a sub-test of t, so sub-tests sharing
+// the agent never see each other's records or server requests.
+func (h *AgentHandle) Run(t *testing.T, name string, f func(t *testing.T)) bool {
+	t.Helper()
+	if err := h.Reset(); err != nil {
+		t.Fatalf("reset agent before %s: %v", name, err)
+	}
+	return t.Run(name, f)
+}
+
+// SendLog sends req to the agent over its Unix socket.
+func (h *AgentHandle) SendLog(req *pb.LogRequest) (*pb.LogResponse, error) {
+	ctx, cancel := context.WithTimeout(h.ctx, 2*time.Second)
+	defer cancel()
+	return h.client.SendLog(ctx, req)
+}
+
+// StreamLogs sends reqs to the agent in one StreamLogs call and returns the
+// summary sent when the stream is closed.
+func (h *AgentHandle) StreamLogs(reqs []*pb.LogRequest) (*pb.StreamLogResponse, error) {
+	ctx, cancel := context.WithTimeout(h.ctx, 10*time.Second)
+	defer cancel()
+	stream, err := h.client.StreamLogs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range reqs {
+		if err := stream.Send(req); err != nil {
+			// The server ended the stream; CloseAndRecv returns its status
+			break
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+// Connect opens a Connect stream on the harness connection and returns once
+// the agent has registered req. Later SendLog calls are tagged with it until
+// disconnect closes the stream and returns the agent's response.
+func (h *AgentHandle) Connect(req *pb.ConnectRequest) (disconnect func() (*pb.ConnectResponse, error), err error) {
+	ctx, cancel := context.WithCancel(h.ctx)
+	stream, err := h.client.Connect(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := stream.Send(req); err != nil {
+		// The server ended the stream; CloseAndRecv returns its status
+		_, err = stream.CloseAndRecv()
+		cancel()
+		return nil, err
+	}
+	timeout := time.AfterFunc(2*time.Second, cancel)
+	defer timeout.Stop()
+	if _, err := stream.Header(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return func() (*pb.ConnectResponse, error) {
+		defer cancel()
+		return stream.CloseAndRecv()
+	}, nil
+}
+
+// Drain runs one ProcessPebble pass against the fake server.
+func (h *AgentHandle) Drain() error {
+	return h.Config.ProcessPebble(h.ctx)
+}
+
+// RecordCount returns the number of records currently stored in Pebble.
+func (h *AgentHandle) RecordCount() int {
+	iter, closeIter, err := tools.WrapIter(h.Config.Db, tools.RecordIterOptions())
+	if err != nil {
+		return 0
+	}
+	defer closeIter()
+
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		count++
+	}
+	return count
+}
+
+// SetServerStatus changes the status the fake server answers every request
+// with (0 = 200), e.g. to take the server down and bring it back.
+func (h *AgentHandle) SetServerStatus(status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	h.status.Store(int32(status))
+}
+
+// CapturedServerRequests returns every request the fake server received,
+// in arrival order. Each returned request has a fresh, readable Body.
+func (h *AgentHandle) CapturedServerRequests() []http.Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	reqs := make([]http.Request, 0, len(h.captured))
+	for _, c := range h.captured {
+		r := c.req.Clone(context.Background())
+		r.Body = io.NopCloser(bytes.NewReader(c.body))
+		reqs = append(reqs, *r)
+	}
+	return reqs
+}
+
+// Shutdown stops the agent and frees its resources. It is safe to call more than once.
+func (h *AgentHandle) Shutdown() {
+	h.shutdownOnce.Do(func() {
+		h.cancel()
+		if h.conn != nil {
+			_ = h.conn.Close()
+		}
+		<-h.stopped
+		h.http.Close()
+	})
+}
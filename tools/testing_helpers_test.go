@@ -0,0 +1,207 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/cockroachdb/pebble"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Goroutine leak check bounds used by LeakCheck.
+const (
+	leakCheckSlack   = 2
+	leakCheckTimeout = 2 * time.Second
+)
+
+// LeakCheck fails t when goroutines started during the test outlive it. It
+// records runtime.NumGoroutine now; when the test ends it calls after (for
+// example cancel and wg.Wait, may be nil) and waits up to 2s for the count to
+// return to within 2 of that baseline. Cleanups run last-in first-out, so
+// call it before starting the agent under test to check after its shutdown.
+func LeakCheck(t testing.TB, after func()) {
+	t.Helper()
+	baseline := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		if after != nil {
+			after()
+		}
+		deadline := time.Now().Add(leakCheckTimeout)
+		for {
+			n := runtime.NumGoroutine()
+			if n <= baseline+leakCheckSlack {
+				return
+			}
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Errorf("goroutine leak: %d goroutines running, baseline %d\n%s", n, baseline, buf)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+// newTestConfig returns a ServerConfig with its session and Pebble DB in a
+// temp directory, uploading to serverHost. The files are closed when the test ends.
+func newTestConfig(t testing.TB, serverHost string) *ServerConfig {
+	t.Helper()
+	c := &ServerConfig{
+		ServerHost:          serverHost,
+		HealthCheckInterval: 100 * time.Millisecond,
+		PostFlushInterval:   100 * time.Millisecond,
+		HealthCheckTimeout:  time.Second,
+	}
+	if err := c.CreateRequiredFiles(t.TempDir()); err != nil {
+		t.Fatalf("create agent files: %v", err)
+	}
+	t.Cleanup(c.CloseFiles)
+	return c
+}
+
+// dialAgent connects a gRPC client to c's socket; the connection is closed
+// when the test ends.
+func dialAgent(t testing.TB, c *ServerConfig) pb.LogAgentClient {
+	t.Helper()
+	conn, err := grpc.NewClient(c.SocketTarget(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return pb.NewLogAgentClient(conn)
+}
+
+// MetricValue returns the value of the unlabelled gauge or counter name from
+// the agent's metrics registry, or -1 when it is not registered.
+func MetricValue(t testing.TB, name string) float64 {
+	t.Helper()
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != name || len(f.GetMetric()) == 0 {
+			continue
+		}
+		m := f.GetMetric()[0]
+		if m.GetGauge() != nil {
+			return m.GetGauge().GetValue()
+		}
+		return m.GetCounter().GetValue()
+	}
+	return -1
+}
+
+// LogCapture collects the agent log entries written while a test runs.
+type LogCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *LogCapture) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+// Events returns the captured entries for event, in the order they were logged.
+func (l *LogCapture) Events(event string) []map[string]any {
+	l.mu.Lock()
+	data := bytes.Clone(l.buf.Bytes())
+	l.mu.Unlock()
+
+	var entries []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry map[string]any
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry["event"] == event {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// CaptureLogs sends agent logs of every level to a LogCapture until the test ends.
+func CaptureLogs(t testing.TB) *LogCapture {
+	t.Helper()
+	capture := &LogCapture{}
+	logWriterMu.Lock()
+	prevWriter, prevLevel := LogWriter, MinLogLevel
+	LogWriter, MinLogLevel = capture, LevelDebug
+	logWriterMu.Unlock()
+	t.Cleanup(func() {
+		logWriterMu.Lock()
+		LogWriter, MinLogLevel = prevWriter, prevLevel
+		logWriterMu.Unlock()
+	})
+	return capture
+}
+
+// ErrInjected is returned by a FaultInjectingDB call that was set up to fail.
+var ErrInjected = errors.New("tools: injected fault")
+
+// FaultInjector arms one-shot failures of Pebble calls. Each Inject method
+// makes the next matching call fail with ErrInjected; later calls succeed.
+type FaultInjector interface {
+	InjectFlushError() // Next Flush fails
+	InjectSetError()   // Next Set fails (batch commits are not affected)
+	InjectIterError()  // Next NewIter fails
+}
+
+// FaultInjectingDB is a PebbleDB that forwards every call to the real DB
+// except those armed through FaultInjector. Install it with
+// PebbleManager.Wrap, or with testharness.Options.WrapDB.
+type FaultInjectingDB struct {
+	PebbleDB
+
+	flushErr atomic.Bool
+	setErr   atomic.Bool
+	iterErr  atomic.Bool
+}
+
+var (
+	_ PebbleDB      = (*FaultInjectingDB)(nil)
+	_ FaultInjector = (*FaultInjectingDB)(nil)
+)
+
+// NewFaultInjectingDB wraps db with no faults armed.
+func NewFaultInjectingDB(db PebbleDB) *FaultInjectingDB {
+	return &FaultInjectingDB{PebbleDB: db}
+}
+
+func (f *FaultInjectingDB) InjectFlushError() { f.flushErr.Store(true) }
+func (f *FaultInjectingDB) InjectSetError()   { f.setErr.Store(true) }
+func (f *FaultInjectingDB) InjectIterError()  { f.iterErr.Store(true) }
+
+func (f *FaultInjectingDB) Flush() error {
+	if f.flushErr.CompareAndSwap(true, false) {
+		return ErrInjected
+	}
+	return f.PebbleDB.Flush()
+}
+
+func (f *FaultInjectingDB) Set(key, value []byte, opts *pebble.WriteOptions) error {
+	if f.setErr.CompareAndSwap(true, false) {
+		return ErrInjected
+	}
+	return f.PebbleDB.Set(key, value, opts)
+}
+
+func (f *FaultInjectingDB) NewIter(opts *pebble.IterOptions) (*pebble.Iterator, error) {
+	if f.iterErr.CompareAndSwap(true, false) {
+		return nil, ErrInjected
+	}
+	return f.PebbleDB.NewIter(opts)
+}
@@ -0,0 +1,66 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutBoundsUploads(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits on a server that takes 3s to answer")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(3 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	for _, tc := range []struct {
+		timeout  time.Duration
+		uploaded bool
+	}{
+		{2 * time.Second, false},
+		{4 * time.Second, true},
+	} {
+		t.Run(tc.timeout.String(), func(t *testing.T) {
+			c := newTestConfig(t, srv.URL)
+			c.RequestTimeout = tc.timeout
+			c.DialTimeout = 500 * time.Millisecond // far below both: only the request timeout applies
+			sendNumbered(t, c, 0, 1)
+
+			start := time.Now()
+			_ = c.ProcessPebble(context.Background())
+			elapsed := time.Since(start)
+
+			if uploaded := PebbleIsEmpty(c.Db); uploaded != tc.uploaded {
+				t.Fatalf("record uploaded = %v with a %v request timeout, want %v", uploaded, tc.timeout, tc.uploaded)
+			}
+			if !tc.uploaded && elapsed >= 3*time.Second {
+				t.Errorf("upload gave up after %v, want the %v request timeout", elapsed, tc.timeout)
+			}
+		})
+	}
+}
+
+func TestDialTimeoutBoundsConnect(t *testing.T) {
+	c := &ServerConfig{DialTimeout: 200 * time.Millisecond}
+	client := c.NewHTTPClient(10 * time.Second)
+
+	// A non-routable address never completes the TCP handshake
+	start := time.Now()
+	_, err := client.Get("http://10.255.255.1:81/", nil, nil)
+	if err == nil {
+		t.Fatal("request to a non-routable address succeeded")
+	}
+	if ClassifyNetError(err) != "timeout" {
+		t.Skipf("the address is rejected here instead of dropped: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("connect gave up after %v, want the 200ms dial timeout", elapsed)
+	}
+}
@@ -0,0 +1,105 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	flow "github.com/datanadhi/flowhttp/client"
+)
+
+// tokenRetryInterval bounds the wait before retrying a failed token refresh.
+const tokenRetryInterval = 30 * time.Second
+
+// CurrentApiKey returns ApiKey. Once StartTokenRefresher runs it changes at
+// runtime, so uploads and other requests must read it through here.
+func (c *ServerConfig) CurrentApiKey() string {
+	c.apiKeyMu.RLock()
+	defer c.apiKeyMu.RUnlock()
+	return c.ApiKey
+}
+
+// RefreshApiKey exchanges RefreshToken for a short-lived access token at
+// POST TokenEndpoint and makes it the ApiKey. The endpoint receives
+// {"refresh_token": "..."} and answers {"access_token": "...", "expires_in": seconds};
+// expires_in is optional. On failure ApiKey is left unchanged.
+func (c *ServerConfig) RefreshApiKey(ctx context.Context, client *flow.Client) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reqBody, _ := json.Marshal(map[string]string{"refresh_token": c.RefreshToken})
+	resp, err := client.Post(c.TokenEndpoint, nil, nil, bytes.NewReader(reqBody), "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decode token response: %w", err)
+	}
+	if body.AccessToken == "" {
+		return errors.New("token response has no access_token")
+	}
+
+	var expiry time.Time
+	if body.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	c.apiKeyMu.Lock()
+	c.ApiKey, c.apiKeyExpiry = body.AccessToken, expiry
+	c.apiKeyMu.Unlock()
+	return nil
+}
+
+// StartTokenRefresher renews ApiKey from TokenEndpoint every
+// TokenRefreshInterval. A failed refresh keeps the current token and is
+// retried after tokenRetryInterval; once that token has expired each failure
+// is logged as token_expired. The first token is fetched by main before
+// startup continues.
+func (c *ServerConfig) StartTokenRefresher(ctx context.Context, wg *sync.WaitGroup, client *flow.Client) {
+	if c.TokenEndpoint == "" || c.TokenRefreshInterval <= 0 {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		timer := time.NewTimer(c.TokenRefreshInterval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			next := c.TokenRefreshInterval
+			if err := c.RefreshApiKey(ctx, client); err != nil {
+				next = min(next, tokenRetryInterval)
+				c.apiKeyMu.RLock()
+				expiry := c.apiKeyExpiry
+				c.apiKeyMu.RUnlock()
+				if !expiry.IsZero() && time.Now().After(expiry) {
+					LogJsonLevel(LevelError, "token_expired", map[string]any{"error": err.Error(), "expired_at": expiry.UTC().Format(time.RFC3339)})
+				} else {
+					LogJsonLevel(LevelWarn, "token_refresh_error", map[string]any{"error": err.Error(), "retry_in": next.String()})
+				}
+			} else {
+				LogJsonLevel(LevelInfo, "token_refreshed", map[string]any{"next_refresh": next.String()})
+			}
+			timer.Reset(next)
+		}
+	}()
+}
@@ -0,0 +1,114 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenServer issues access tokens "tok-1", "tok-2", ... for the refresh
+// token "refresh-me", and answers 503 while failing is set.
+type tokenServer struct {
+	*httptest.Server
+	issued  atomic.Int32
+	failing atomic.Bool
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	t.Helper()
+	s := &tokenServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil || body.RefreshToken != "refresh-me" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if s.failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": fmt.Sprintf("tok-%d", s.issued.Add(1)), "expires_in": 3600})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestTokenRefresherRenewsUploadKey(t *testing.T) {
+	// Check for leaks only after the servers have closed their connections
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	logs := CaptureLogs(t)
+	tokens := newTokenServer(t)
+	keys := make(chan string, 1)
+	upload := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("DATANADHI-API-KEY")
+	}))
+	t.Cleanup(upload.Close)
+
+	c := newTestConfig(t, upload.URL)
+	c.TokenEndpoint = tokens.URL
+	c.RefreshToken = "refresh-me"
+	c.TokenRefreshInterval = 100 * time.Millisecond
+	client := c.NewHTTPClient(time.Second)
+
+	// main fetches the first token before startup continues
+	if err := c.RefreshApiKey(context.Background(), client); err != nil {
+		t.Fatalf("RefreshApiKey: %v", err)
+	}
+	if got := c.CurrentApiKey(); got != "tok-1" {
+		t.Fatalf("CurrentApiKey = %q, want tok-1", got)
+	}
+
+	c.StartTokenRefresher(ctx, &wg, client)
+	if !waitFor(2*time.Second, func() bool { return c.CurrentApiKey() == "tok-2" }) {
+		t.Fatalf("CurrentApiKey = %q after TokenRefreshInterval, want tok-2", c.CurrentApiKey())
+	}
+
+	// A failed refresh keeps the current token
+	tokens.failing.Store(true)
+	if !waitFor(2*time.Second, func() bool { return len(logs.Events("token_refresh_error")) > 0 }) {
+		t.Fatal("no token_refresh_error logged while the endpoint fails")
+	}
+	current := c.CurrentApiKey()
+	if current == "" || current != fmt.Sprintf("tok-%d", tokens.issued.Load()) {
+		t.Fatalf("CurrentApiKey = %q after failed refreshes, want the last issued token", current)
+	}
+
+	putRecord(t, c, newRecordKey(PriorityNormal, nil), logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{}, Pipelines: []string{"p1"}})
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	if got := <-keys; got != current {
+		t.Errorf("upload API key = %q, want the refreshed token %q", got, current)
+	}
+	if n := len(logs.Events("token_refreshed")); n == 0 {
+		t.Error("no token_refreshed logged")
+	}
+}
+
+func TestRefreshApiKeyKeepsKeyOnFailure(t *testing.T) {
+	tokens := newTokenServer(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.ApiKey = "current"
+	c.TokenEndpoint = tokens.URL
+	c.RefreshToken = "wrong"
+
+	if err := c.RefreshApiKey(context.Background(), c.NewHTTPClient(time.Second)); err == nil {
+		t.Fatal("RefreshApiKey succeeded with a rejected refresh token")
+	}
+	if got := c.CurrentApiKey(); got != "current" {
+		t.Errorf("CurrentApiKey = %q, want it unchanged", got)
+	}
+}
@@ -0,0 +1,244 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// minRecordKeyNano is a lower bound for the timestamp in every record key
+// (2001-09-09). Starting the unprefixed legacy range here keeps it clear of
+// the single-digit priority prefixes such as "1/".
+const minRecordKeyNano = int64(1e18)
+
+// expiringKeyPattern matches keys built by MakeExpiringKey, with or without
+// the priority prefix recordKey adds, and captures their expiry.
+var expiringKeyPattern = regexp.MustCompile(`^(?:\d/)?(\d{19})/[^/]*/\d+$`)
+
+// MakeExpiringKey returns the key "<expire_unix_nano>/<pipeline>/<seq>" of a
+// record that expires ttl from now. The expiry is written with 19 digits so
+// expiring keys sort by it, and the pipeline is path-escaped as in
+// KeyFormatPipeline. recordKey puts the priority prefix in front, so
+// high-priority records with a TTL are still uploaded first; without it an
+// expiring key sorts after every priority-prefixed key.
+func MakeExpiringKey(pipeline string, ttl time.Duration, seq int64) []byte {
+	return fmt.Appendf(nil, "%019d/%s/%d", time.Now().Add(ttl).UnixNano(), url.PathEscape(pipeline), seq)
+}
+
+// keyExpiry returns the expiry of a key built by MakeExpiringKey, or false
+// for keys of any other format.
+func keyExpiry(key []byte) (int64, bool) {
+	m := expiringKeyPattern.FindSubmatch(key)
+	if m == nil {
+		return 0, false
+	}
+	expiry, err := strconv.ParseInt(string(m[1]), 10, 64)
+	return expiry, err == nil
+}
+
+// IsKeyExpired reports whether key was built by MakeExpiringKey and its expiry
+// has passed. Keys of other formats never expire by key; RecordTTL covers them.
+func IsKeyExpired(key []byte) bool {
+	expiry, ok := keyExpiry(key)
+	return ok && expiry < time.Now().UnixNano()
+}
+
+// LoadPipelineTTLs reads a JSON file mapping pipeline names to durations such
+// as "15m", for -pipeline-ttl.
+func LoadPipelineTTLs(path string) (map[string]time.Duration, error) {
+	var raw map[string]string
+	if err := LoadJSONFile(path, &raw); err != nil {
+		return nil, err
+	}
+	ttls := make(map[string]time.Duration, len(raw))
+	for pipeline, s := range raw {
+		ttl, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %q: %w", pipeline, err)
+		}
+		ttls[pipeline] = ttl
+	}
+	return ttls, nil
+}
+
+// recordKey returns the key of a new record: its priority prefix followed by
+// an expiring key when its pipeline has a TTL in PipelineTTLs, otherwise
+// newRecordKey.
+func (c *ServerConfig) recordKey(rec logRecord) string {
+	pipeline := keyPipeline(rec.Pipelines)
+	if ttl, ok := c.PipelineTTLs[pipeline]; ok {
+		return priorityPrefix(rec.Priority) + string(MakeExpiringKey(pipeline, ttl, c.expiringSeq.Add(1)))
+	}
+	return newRecordKey(rec.Priority, rec.Pipelines)
+}
+
+// ExpireRecords drops, when PipelineTTLs is set, every record whose expiring
+// key (see MakeExpiringKey) has passed its expiry, and, when RecordTTL is set,
+// every other record received more than RecordTTL before now. Without
+// PipelineTTLs, expiring keys left by an earlier run are uploaded like any
+// other record.
+//
+// Expired keys are removed with range tombstones wherever keys of one layout
+// are contiguous, and Pebble reclaims the space during compaction. Below each
+// priority prefix expiring keys sort by expiry, so the expired ones form a
+// single range, split only around other keys sharing it. Below each pipeline prefix record keys start
+// with their receive time, so each pipeline's expired records form one range
+// too. Legacy and priority-format keys, which share their ranges with other
+// layouts, are deleted one by one. Values are never decoded. Returns the
+// number of records removed.
+func (c *ServerConfig) ExpireRecords(ctx context.Context, now time.Time) (int, error) {
+	batch := c.Db.NewBatch()
+	defer batch.Close()
+
+	var expired, tombstones int
+	if len(c.PipelineTTLs) > 0 {
+		var err error
+		if expired, tombstones, err = c.deleteExpiredKeys(ctx, batch, now); err != nil {
+			return 0, err
+		}
+	}
+
+	if c.RecordTTL > 0 {
+		cutoff := now.Add(-c.RecordTTL).UnixNano()
+		prefixes, err := c.timeOrderedPrefixes(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, prefix := range prefixes {
+			lower := []byte(fmt.Sprintf("%s%d", prefix, minRecordKeyNano))
+			upper := []byte(fmt.Sprintf("%s%d", prefix, cutoff))
+			opts := &pebble.IterOptions{LowerBound: lower, UpperBound: upper}
+			if strings.Count(prefix, "/") < 2 {
+				keys, err := c.collectKeys(ctx, opts)
+				if err != nil {
+					return 0, err
+				}
+				for _, key := range keys {
+					if !timeOrderedUnder(prefix, key) {
+						continue
+					}
+					if err := batch.Delete(key, nil); err != nil {
+						return 0, err
+					}
+					expired++
+				}
+				continue
+			}
+
+			n, err := c.countKeys(ctx, opts)
+			if err != nil {
+				return 0, err
+			}
+			if n == 0 {
+				continue
+			}
+			if err := batch.DeleteRange(lower, upper, nil); err != nil {
+				return 0, err
+			}
+			expired += n
+			tombstones++
+		}
+	}
+	if expired == 0 {
+		return 0, nil
+	}
+
+	opts := pebble.NoSync
+	if c.SyncDeletes {
+		opts = pebble.Sync
+	}
+	if err := c.Db.Commit(batch, opts); err != nil {
+		return 0, err
+	}
+	c.recordCount.Add(-int64(expired))
+	c.stats.dropped.Add(int64(expired))
+	LogJsonLevel(LevelWarn, "records_expired", map[string]any{"count": expired, "range_tombstones": tombstones, "ttl": c.RecordTTL.String()})
+	return expired, nil
+}
+
+// deleteExpiredKeys adds to batch range tombstones over the expiring keys
+// whose expiry is before now, and returns how many keys and tombstones that
+// is. Below each priority prefix, and below none for keys written without
+// one, the expired keys lie under "<prefix><now>/". Priority-format and legacy
+// keys received in the same span, and pipelines named with digits, sort among
+// them, so a tombstone ends at each such key and the next one starts after
+// it. New keys never fall inside a tombstone: expiring keys are written with
+// a future expiry, and other keys received now sort after "<prefix><now>/".
+func (c *ServerConfig) deleteExpiredKeys(ctx context.Context, batch *pebble.Batch, now time.Time) (keys, tombstones int, err error) {
+	prefixes := []string{""}
+	for p := maxPriority; p >= PriorityNormal; p-- {
+		prefixes = append(prefixes, priorityPrefix(p))
+	}
+	for _, prefix := range prefixes {
+		upper := fmt.Appendf(nil, "%s%019d/", prefix, now.UnixNano())
+		iter, closeIter, err := WrapIter(c.Db, &pebble.IterOptions{
+			LowerBound: fmt.Appendf(nil, "%s%d", prefix, minRecordKeyNano),
+			UpperBound: upper,
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var start []byte // First key of the current run of expired keys
+		endRun := func(end []byte) error {
+			if start == nil {
+				return nil
+			}
+			tombstones++
+			err := batch.DeleteRange(start, end, nil)
+			start = nil
+			return err
+		}
+		for iter.First(); iter.Valid(); iter.Next() {
+			if ctx.Err() != nil {
+				closeIter()
+				return 0, 0, ctx.Err()
+			}
+			if _, ok := keyExpiry(iter.Key()); !ok {
+				if err := endRun(slices.Clone(iter.Key())); err != nil {
+					closeIter()
+					return 0, 0, err
+				}
+				continue
+			}
+			if start == nil {
+				start = slices.Clone(iter.Key())
+			}
+			keys++
+		}
+		err = iter.Error()
+		closeIter()
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := endRun(upper); err != nil {
+			return 0, 0, err
+		}
+	}
+	return keys, tombstones, nil
+}
+
+// countKeys returns the number of keys within the iterator bounds.
+func (c *ServerConfig) countKeys(ctx context.Context, opts *pebble.IterOptions) (int, error) {
+	iter, closeIter, err := WrapIter(c.Db, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer closeIter()
+
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,327 @@
+package tools
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestExpireRecordsAcrossKeyFormats(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.RecordTTL = time.Hour
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var kept, expired []string
+	for _, prefix := range []string{
+		"", priorityPrefix(PriorityHigh),
+		pipelineKeyPrefix(PriorityNormal, "orders"), pipelineKeyPrefix(PriorityNormal, ""),
+		pipelineKeyPrefix(PriorityHigh, "team/billing"),
+	} {
+		expired = append(expired, keyAt(prefix, now.Add(-2*time.Hour), 0), keyAt(prefix, now.Add(-time.Hour-time.Nanosecond), 1))
+		kept = append(kept, keyAt(prefix, now.Add(-time.Hour), 2), keyAt(prefix, now, 3))
+	}
+	for _, key := range append(slices.Clone(kept), expired...) {
+		putRecord(t, c, key, logRecord{Payload: map[string]any{}, Pipelines: []string{"orders"}})
+	}
+
+	n, err := c.ExpireRecords(context.Background(), now)
+	if err != nil {
+		t.Fatalf("ExpireRecords: %v", err)
+	}
+	if n != len(expired) {
+		t.Errorf("expired %d records, want %d", n, len(expired))
+	}
+	got := storedKeys(t, c)
+	slices.Sort(kept)
+	if !slices.Equal(got, kept) {
+		t.Errorf("remaining keys = %v, want %v", got, kept)
+	}
+	if c.RecordCount() != int64(len(kept)) {
+		t.Errorf("RecordCount = %d, want %d", c.RecordCount(), len(kept))
+	}
+}
+
+func TestMakeExpiringKey(t *testing.T) {
+	before := time.Now()
+	key := MakeExpiringKey("team/billing", time.Hour, 7)
+	after := time.Now()
+
+	m := regexp.MustCompile(`^(\d{19})/team%2Fbilling/7$`).FindSubmatch(key)
+	if m == nil {
+		t.Fatalf("MakeExpiringKey = %q, want <expire_unix_nano>/team%%2Fbilling/7", key)
+	}
+	expiry, _ := strconv.ParseInt(string(m[1]), 10, 64)
+	if expiry < before.Add(time.Hour).UnixNano() || expiry > after.Add(time.Hour).UnixNano() {
+		t.Errorf("expiry = %d, want an hour from now", expiry)
+	}
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"expired", string(MakeExpiringKey("orders", -time.Second, 1)), true},
+		{"not yet expired", string(MakeExpiringKey("orders", time.Hour, 2)), false},
+		{"empty pipeline", string(MakeExpiringKey("", -time.Second, 3)), true},
+		{"high priority expired", priorityPrefix(PriorityHigh) + string(MakeExpiringKey("orders", -time.Second, 4)), true},
+		{"high priority not yet expired", priorityPrefix(PriorityHigh) + string(MakeExpiringKey("orders", time.Hour, 5)), false},
+		{"legacy", keyAt("", now.Add(-time.Hour), 0), false},
+		{"priority", keyAt(priorityPrefix(PriorityHigh), now.Add(-time.Hour), 0), false},
+		{"pipeline", keyAt(pipelineKeyPrefix(PriorityNormal, "orders"), now.Add(-time.Hour), 0), false},
+		{"pipeline named like an expiry", keyAt(pipelineKeyPrefix(PriorityNormal, "1000000000000000000"), now.Add(-time.Hour), 0), false},
+		{"chunk", string(chunkKey("abc", 0)), false},
+	} {
+		if got := IsKeyExpired([]byte(tc.key)); got != tc.want {
+			t.Errorf("IsKeyExpired(%s key %q) = %v, want %v", tc.name, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestExpireRecordsRemovesExpiringKeysWithRangeTombstones(t *testing.T) {
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.PipelineTTLs = map[string]time.Duration{"orders": time.Hour}
+	now := time.Now()
+	rec := logRecord{Payload: map[string]any{}, Pipelines: []string{"orders"}}
+
+	var expired []string
+	for i := int64(0); i < 3; i++ {
+		key := string(MakeExpiringKey("orders", -time.Hour+time.Duration(i)*time.Minute, i))
+		expired = append(expired, key)
+		putRecord(t, c, key, rec)
+	}
+	// Expiring keys keep their priority prefix
+	expired = append(expired,
+		string(MakeExpiringKey("audit", -time.Second, 3)),
+		priorityPrefix(PriorityHigh)+string(MakeExpiringKey("orders", -3*time.Hour, 5)),
+		priorityPrefix(PriorityHigh)+string(MakeExpiringKey("orders", -time.Minute, 6)),
+		priorityPrefix(PriorityNormal)+string(MakeExpiringKey("orders", -time.Minute, 7)),
+	)
+	for _, key := range expired[3:] {
+		putRecord(t, c, key, rec)
+	}
+
+	// A legacy key received between the first unprefixed expiries, and a
+	// priority key between the high-priority ones, sort among them and must
+	// survive, each splitting the expired keys of its prefix into two
+	// tombstones
+	kept := []string{
+		keyAt("", now.Add(-time.Hour+30*time.Second), 0),
+		keyAt(priorityPrefix(PriorityHigh), now.Add(-2*time.Hour), 1),
+		keyAt(pipelineKeyPrefix(PriorityNormal, "orders"), now.Add(-2*time.Hour), 2),
+		string(MakeExpiringKey("orders", time.Hour, 4)),
+		priorityPrefix(PriorityHigh) + string(MakeExpiringKey("orders", time.Hour, 8)),
+	}
+	for _, key := range kept {
+		putRecord(t, c, key, rec)
+	}
+
+	n, err := c.ExpireRecords(context.Background(), now)
+	if err != nil {
+		t.Fatalf("ExpireRecords: %v", err)
+	}
+	if n != len(expired) {
+		t.Errorf("expired %d records, want %d", n, len(expired))
+	}
+	got := storedKeys(t, c)
+	slices.Sort(kept)
+	if !slices.Equal(got, kept) {
+		t.Errorf("remaining keys = %v, want %v", got, kept)
+	}
+	if c.RecordCount() != int64(len(kept)) {
+		t.Errorf("RecordCount = %d, want %d", c.RecordCount(), len(kept))
+	}
+	if got := c.stats.dropped.Load(); got != int64(len(expired)) {
+		t.Errorf("dropped = %d, want %d", got, len(expired))
+	}
+	entries := logs.Events("records_expired")
+	if len(entries) != 1 || entries[0]["count"] != float64(len(expired)) || entries[0]["range_tombstones"] != float64(5) {
+		t.Errorf("records_expired entries = %v, want %d records in 5 range tombstones", entries, len(expired))
+	}
+}
+
+func TestProcessPebbleNeverUploadsExpiredKeys(t *testing.T) {
+	upload := newUploadCapture(t, http.StatusOK)
+	c := newTestConfig(t, upload.URL)
+	c.PipelineTTLs = map[string]time.Duration{"orders": time.Hour}
+	putRecord(t, c, string(MakeExpiringKey("orders", -time.Second, 1)), logRecord{Payload: map[string]any{"n": 1}, Pipelines: []string{"orders"}})
+	putRecord(t, c, string(MakeExpiringKey("orders", time.Hour, 2)), logRecord{Payload: map[string]any{"n": 2}, Pipelines: []string{"orders"}})
+
+	if err := c.ProcessPebble(context.Background()); err != nil {
+		t.Fatalf("ProcessPebble: %v", err)
+	}
+	data := upload.logData()
+	if len(data) != 1 || data[0]["n"] != float64(2) {
+		t.Errorf("uploaded records = %v, want only the unexpired one", data)
+	}
+	if keys := storedKeys(t, c); len(keys) != 0 {
+		t.Errorf("keys left after processing = %v", keys)
+	}
+}
+
+func TestSendLogUsesExpiringKeyForPipelineTTL(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.PipelineTTLs = map[string]time.Duration{"p1": time.Hour}
+	sendNumbered(t, c, 0, 2)
+	s := &server{config: c}
+	if _, err := s.SendLog(context.Background(), &pb.LogRequest{JsonData: `{}`, Pipelines: []string{"p2"}}); err != nil {
+		t.Fatalf("SendLog: %v", err)
+	}
+
+	keys := storedKeys(t, c)
+	var expiring int
+	for _, key := range keys {
+		if _, ok := keyExpiry([]byte(key)); ok {
+			expiring++
+			if IsKeyExpired([]byte(key)) {
+				t.Errorf("key %q already expired", key)
+			}
+		}
+	}
+	if len(keys) != 3 || expiring != 2 {
+		t.Errorf("stored keys = %v, want 2 expiring keys for p1 and one for p2", keys)
+	}
+}
+
+func TestRecordKeyKeepsPriorityForPipelineTTL(t *testing.T) {
+	c := newTestConfig(t, "http://unused.invalid")
+	c.PipelineTTLs = map[string]time.Duration{"orders": time.Hour}
+
+	for _, priority := range []int32{PriorityNormal, PriorityHigh} {
+		key := c.recordKey(logRecord{Pipelines: []string{"orders"}, Priority: priority})
+		if !strings.HasPrefix(key, priorityPrefix(priority)) {
+			t.Errorf("key of a priority %d record = %q, want prefix %q", priority, key, priorityPrefix(priority))
+		}
+		if _, ok := keyExpiry([]byte(key)); !ok {
+			t.Errorf("key of a priority %d record = %q, want an expiring key", priority, key)
+		}
+	}
+}
+
+func TestLoadPipelineTTLs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ttl.json")
+	if err := os.WriteFile(path, []byte(`{"orders": "15m", "audit": "2h"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ttls, err := LoadPipelineTTLs(path)
+	if err != nil {
+		t.Fatalf("LoadPipelineTTLs: %v", err)
+	}
+	if want := map[string]time.Duration{"orders": 15 * time.Minute, "audit": 2 * time.Hour}; !maps.Equal(ttls, want) {
+		t.Errorf("LoadPipelineTTLs = %v, want %v", ttls, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"orders": "soon"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPipelineTTLs(path); err == nil || !strings.Contains(err.Error(), `"orders"`) {
+		t.Errorf("LoadPipelineTTLs with a bad duration = %v, want an error naming the pipeline", err)
+	}
+}
+
+// BenchmarkExpireRecords expires 100,000 records of two pipelines and both
+// priorities, every 100th of which is not yet expired, with ExpireRecords'
+// range tombstones and with a sweep deleting each expired key. It also
+// reports how long the next read takes to skip past the deleted records.
+func BenchmarkExpireRecords(b *testing.B) {
+	const records = 100_000
+	CaptureLogs(b)
+
+	// sweep deletes every expired expiring key one by one
+	sweep := func(c *ServerConfig, now time.Time) (int, error) {
+		iter, closeIter, err := WrapIter(c.Db, RecordIterOptions())
+		if err != nil {
+			return 0, err
+		}
+		defer closeIter()
+		batch := c.Db.NewBatch()
+		defer batch.Close()
+		n := 0
+		for iter.First(); iter.Valid(); iter.Next() {
+			if expiry, ok := keyExpiry(iter.Key()); ok && expiry < now.UnixNano() {
+				if err := batch.Delete(iter.Key(), nil); err != nil {
+					return 0, err
+				}
+				n++
+			}
+		}
+		return n, c.Db.Commit(batch, pebble.NoSync)
+	}
+
+	for _, bc := range []struct {
+		name   string
+		expire func(c *ServerConfig, now time.Time) (int, error)
+	}{
+		{"range_tombstones", func(c *ServerConfig, now time.Time) (int, error) {
+			return c.ExpireRecords(context.Background(), now)
+		}},
+		{"per_key_sweep", sweep},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var expired int
+			var readAfter time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c := newTestConfig(b, "http://unused.invalid")
+				c.PipelineTTLs = map[string]time.Duration{"orders": time.Hour, "audit": time.Hour}
+				value, err := c.encodeRecord(logRecord{SchemaVersion: CurrentSchemaVersion, Payload: map[string]any{"msg": "expiring"}, Pipelines: []string{"orders"}})
+				if err != nil {
+					b.Fatalf("encode: %v", err)
+				}
+				batch := c.Db.NewBatch()
+				for n := 0; n < records; n++ {
+					ttl := -time.Hour + time.Duration(n)*time.Millisecond
+					if n%100 == 0 {
+						ttl = time.Hour
+					}
+					pipeline := []string{"orders", "audit"}[n%2]
+					priority := []int32{PriorityNormal, PriorityHigh}[n/2%2]
+					key := priorityPrefix(priority) + string(MakeExpiringKey(pipeline, ttl, int64(n)))
+					if err := batch.Set([]byte(key), value, nil); err != nil {
+						b.Fatalf("batch set: %v", err)
+					}
+				}
+				if err := c.Db.Commit(batch, pebble.NoSync); err != nil {
+					b.Fatalf("commit: %v", err)
+				}
+				if err := c.Db.Flush(); err != nil {
+					b.Fatalf("flush: %v", err)
+				}
+				now := time.Now()
+				b.StartTimer()
+
+				n, err := bc.expire(c, now)
+				if err != nil {
+					b.Fatalf("expire: %v", err)
+				}
+
+				b.StopTimer()
+				start := time.Now()
+				if PebbleIsEmpty(c.Db) {
+					b.Fatal("unexpired records were removed")
+				}
+				readAfter += time.Since(start)
+				if want := records - records/100; n != want || len(storedKeys(b, c)) != records/100 {
+					b.Fatalf("expired %d records, want %d", n, want)
+				}
+				expired += n
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(expired)/b.Elapsed().Seconds(), "records/s")
+			b.ReportMetric(float64(readAfter.Nanoseconds())/float64(b.N), "first-read-ns")
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	flow "github.com/datanadhi/flowhttp/client"
+)
+
+// ValidationPipeline is the reserved pipeline used for the -validate-server test log.
+const ValidationPipeline = "_validate"
+
+// Reasons reported in a ValidationError.
+const (
+	ValidationServerUnreachable = "server_unreachable"
+	ValidationAuthFailed        = "auth_failed"
+	ValidationInvalidPipeline   = "invalid_pipeline"
+	ValidationUnexpectedStatus  = "unexpected_status"
+)
+
+// ValidationError explains why ValidateServer rejected the server setup.
+type ValidationError struct {
+	Reason string // One of the Validation* reasons
+	Detail string // Human-readable explanation
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Detail)
+}
+
+// ValidateServer checks that the main server is reachable and accepts this
+// agent's API key by running a health check and posting a test log to the
+// reserved ValidationPipeline. It returns a *ValidationError on failure.
+// Pass the production client so TLS and proxy settings are exercised too.
+func (c *ServerConfig) ValidateServer(client *flow.Client) error {
+	health, err := client.Get(c.ServerHost, nil, nil)
+	if err != nil {
+		return &ValidationError{
+			Reason: ValidationServerUnreachable,
+			Detail: fmt.Sprintf("health check to %s failed (%s): %v", c.ServerHost, ClassifyNetError(err), err),
+		}
+	}
+	health.Body.Close()
+	if health.StatusCode != 200 {
+		return &ValidationError{
+			Reason: ValidationServerUnreachable,
+			Detail: fmt.Sprintf("health check to %s returned status %d", c.ServerHost, health.StatusCode),
+		}
+	}
+
+	url := c.routeRecord([]string{ValidationPipeline})[0].url
+	body, _ := json.Marshal(map[string]any{
+		"pipelines": []string{ValidationPipeline},
+		"log_data":  map[string]any{"message": "echopost server validation"},
+	})
+	body, headers, err := c.uploadBody(body, c.CurrentApiKey())
+	if err != nil {
+		return &ValidationError{Reason: ValidationUnexpectedStatus, Detail: err.Error()}
+	}
+	resp, err := client.Post(url, nil, headers, bytes.NewReader(body), "application/json")
+	if err != nil {
+		return &ValidationError{
+			Reason: ValidationServerUnreachable,
+			Detail: fmt.Sprintf("test log to %s failed (%s): %v", url, ClassifyNetError(err), err),
+		}
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		return &ValidationError{
+			Reason: ValidationAuthFailed,
+			Detail: fmt.Sprintf("server rejected the API key (status %d)", resp.StatusCode),
+		}
+	case resp.StatusCode == 400 || resp.StatusCode == 404 || resp.StatusCode == 422:
+		return &ValidationError{
+			Reason: ValidationInvalidPipeline,
+			Detail: fmt.Sprintf("server rejected the %s pipeline at %s (status %d)", ValidationPipeline, url, resp.StatusCode),
+		}
+	default:
+		return &ValidationError{
+			Reason: ValidationUnexpectedStatus,
+			Detail: fmt.Sprintf("test log to %s returned status %d", url, resp.StatusCode),
+		}
+	}
+}
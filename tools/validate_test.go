@@ -0,0 +1,113 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// validationServer mocks the main server for ValidateServer: health checks
+// get healthStatus, test logs get logStatus. It keeps the last test log.
+type validationServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	apiKey    string
+	pipelines []string
+}
+
+func newValidationServer(t *testing.T, healthStatus, logStatus int) *validationServer {
+	t.Helper()
+	v := &validationServer{}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.WriteHeader(healthStatus)
+			return
+		}
+		var body struct {
+			Pipelines []string `json:"pipelines"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		v.mu.Lock()
+		v.apiKey, v.pipelines = r.Header.Get("DATANADHI-API-KEY"), body.Pipelines
+		v.mu.Unlock()
+		w.WriteHeader(logStatus)
+	}))
+	t.Cleanup(v.Close)
+	return v
+}
+
+func TestValidateServer(t *testing.T) {
+	tests := []struct {
+		name         string
+		healthStatus int
+		logStatus    int
+		wantReason   string // "" = validation passes
+	}{
+		{name: "ok", healthStatus: 200, logStatus: 200},
+		{name: "accepted", healthStatus: 200, logStatus: 202},
+		{name: "unhealthy", healthStatus: 503, logStatus: 200, wantReason: ValidationServerUnreachable},
+		{name: "unauthorized", healthStatus: 200, logStatus: 401, wantReason: ValidationAuthFailed},
+		{name: "forbidden", healthStatus: 200, logStatus: 403, wantReason: ValidationAuthFailed},
+		{name: "bad request", healthStatus: 200, logStatus: 400, wantReason: ValidationInvalidPipeline},
+		{name: "unknown pipeline", healthStatus: 200, logStatus: 404, wantReason: ValidationInvalidPipeline},
+		{name: "unprocessable", healthStatus: 200, logStatus: 422, wantReason: ValidationInvalidPipeline},
+		{name: "server error", healthStatus: 200, logStatus: 500, wantReason: ValidationUnexpectedStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newValidationServer(t, tt.healthStatus, tt.logStatus)
+			c := &ServerConfig{ServerHost: srv.URL, ApiKey: "validate-key"}
+			client := c.NewHTTPClient(5 * time.Second)
+			defer client.CloseIdleConnections()
+
+			err := c.ValidateServer(client)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("ValidateServer: %v", err)
+				}
+			} else {
+				var verr *ValidationError
+				if !errors.As(err, &verr) || verr.Reason != tt.wantReason {
+					t.Fatalf("ValidateServer = %v, want reason %s", err, tt.wantReason)
+				}
+			}
+
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if tt.healthStatus == 200 && (srv.apiKey != "validate-key" || !slices.Equal(srv.pipelines, []string{ValidationPipeline})) {
+				t.Errorf("test log sent key %q to pipelines %v, want validate-key to [%s]", srv.apiKey, srv.pipelines, ValidationPipeline)
+			}
+		})
+	}
+}
+
+func TestValidateServerUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	c := &ServerConfig{ServerHost: srv.URL}
+
+	var verr *ValidationError
+	if err := c.ValidateServer(c.NewHTTPClient(time.Second)); !errors.As(err, &verr) || verr.Reason != ValidationServerUnreachable {
+		t.Fatalf("ValidateServer against a closed server = %v, want reason %s", err, ValidationServerUnreachable)
+	}
+}
+
+func TestValidateServerUsesProxy(t *testing.T) {
+	proxy := newRecordingProxy(t)
+	proxyURL, err := ParseProxyURL(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &ServerConfig{ServerHost: "http://upstream.invalid:5000", HTTPProxy: proxyURL}
+	if err := c.ValidateServer(c.NewHTTPClient(time.Second)); err != nil {
+		t.Fatalf("ValidateServer through the proxy: %v", err)
+	}
+	if got := proxy.requests(); len(got) != 2 {
+		t.Errorf("proxied requests = %v, want the health check and the test log", got)
+	}
+}
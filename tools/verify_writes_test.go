@@ -0,0 +1,97 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// corruptingDB is a PebbleDB whose Set reports success while Get returns
+// different bytes, or fails outright when getErr is set, as a faulty disk
+// could. Only reads while corrupt is set are affected.
+type corruptingDB struct {
+	PebbleDB
+	corrupt *atomic.Bool
+	getErr  error
+}
+
+func (d corruptingDB) Get(key []byte) ([]byte, io.Closer, error) {
+	v, closer, err := d.PebbleDB.Get(key)
+	if err != nil || !d.corrupt.Load() {
+		return v, closer, err
+	}
+	if d.getErr != nil {
+		_ = closer.Close()
+		return nil, nil, d.getErr
+	}
+	flipped := append([]byte(nil), v...)
+	flipped[len(flipped)/2] ^= 0xff
+	return flipped, closer, nil
+}
+
+func newVerifyingConfig(t *testing.T, getErr error) (*ServerConfig, *atomic.Bool) {
+	t.Helper()
+	c := newTestConfig(t, "http://unused.invalid")
+	c.VerifyWrites = true
+	corrupt := &atomic.Bool{}
+	c.Db.Wrap(func(db PebbleDB) PebbleDB { return corruptingDB{db, corrupt, getErr} })
+	return c, corrupt
+}
+
+func TestVerifyWritesRejectsCorruptedRecord(t *testing.T) {
+	for name, getErr := range map[string]error{
+		"mismatch":   nil,
+		"read error": errors.New("read: input/output error"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			logs := CaptureLogs(t)
+			c, corrupt := newVerifyingConfig(t, getErr)
+			s := &server{config: c}
+			req := &pb.LogRequest{JsonData: `{"msg":"x"}`, Pipelines: []string{"p1"}}
+			before := testutil.ToFloat64(writeVerificationFailuresTotal)
+
+			corrupt.Store(true)
+			resp, err := s.SendLog(context.Background(), req)
+			if err != nil || resp.Success {
+				t.Fatalf("SendLog with a corrupted read-back = %+v, %v; want Success false", resp, err)
+			}
+			if n := len(storedKeys(t, c)); n != 0 {
+				t.Errorf("records kept after a failed verification = %d, want the key deleted", n)
+			}
+			if c.RecordCount() != 0 {
+				t.Errorf("RecordCount = %d, want 0", c.RecordCount())
+			}
+			if got := testutil.ToFloat64(writeVerificationFailuresTotal) - before; got != 1 {
+				t.Errorf("echopost_write_verification_failures_total grew by %v, want 1", got)
+			}
+			failed := logs.Events("write_verification_failed")
+			if len(failed) != 1 || (getErr != nil) != (failed[0]["error"] != nil) {
+				t.Errorf("write_verification_failed entries = %v", failed)
+			}
+
+			// A healthy read-back stores the record
+			corrupt.Store(false)
+			if resp, err := s.SendLog(context.Background(), req); err != nil || !resp.Success {
+				t.Fatalf("SendLog with a matching read-back = %+v, %v", resp, err)
+			}
+			if n := len(storedKeys(t, c)); n != 1 {
+				t.Errorf("records stored = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestVerifyWritesOffSkipsReadBack(t *testing.T) {
+	c, corrupt := newVerifyingConfig(t, nil)
+	c.VerifyWrites = false
+	corrupt.Store(true)
+	if resp := sendNumbered(t, c, 0, 1)[0]; !resp.Success {
+		t.Fatalf("SendLog without -verify-writes = %+v, want it stored", resp)
+	}
+}
@@ -0,0 +1,121 @@
+package tools
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// watchdogTimeoutFactor is how many intervals may pass without a heartbeat
+// before a component is considered stalled.
+const watchdogTimeoutFactor = 3
+
+// Watchdog cancels the agent context when a background component stops
+// sending heartbeats, so a silently hung goroutine (e.g. a blocked Pebble
+// flush) ends the process and the supervisor can restart it.
+type Watchdog struct {
+	interval time.Duration
+	cancel   context.CancelFunc
+
+	mu         sync.Mutex
+	components map[string]*watchedComponent
+}
+
+// watchedComponent is the heartbeat channel and last beat of one component.
+type watchedComponent struct {
+	heartbeat chan struct{}
+	lastBeat  time.Time
+}
+
+// NewWatchdog returns a watchdog that checks heartbeats every interval and
+// calls cancel once a component misses 3 intervals in a row.
+func NewWatchdog(interval time.Duration, cancel context.CancelFunc) *Watchdog {
+	return &Watchdog{
+		interval:   interval,
+		cancel:     cancel,
+		components: make(map[string]*watchedComponent),
+	}
+}
+
+// Heartbeat registers component and returns the channel it must send to after
+// each successful operation (use Beat for a non-blocking send). A nil
+// watchdog returns a nil channel, on which Beat is a no-op.
+func (w *Watchdog) Heartbeat(component string) chan<- struct{} {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wc, ok := w.components[component]
+	if !ok {
+		wc = &watchedComponent{heartbeat: make(chan struct{}, 1), lastBeat: time.Now()}
+		w.components[component] = wc
+	}
+	return wc.heartbeat
+}
+
+// Beat sends a heartbeat without blocking; a pending unread beat is enough.
+func Beat(heartbeat chan<- struct{}) {
+	select {
+	case heartbeat <- struct{}{}:
+	default:
+	}
+}
+
+// Start checks heartbeats every interval until ctx is cancelled or a
+// component times out.
+func (w *Watchdog) Start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		LogJsonLevel(LevelInfo, "watchdog_started", map[string]any{"interval": w.interval.String()})
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if component, stalled := w.check(now); stalled {
+					LogJsonLevel(LevelError, "watchdog_timeout", map[string]any{
+						"component": component,
+						"timeout":   (watchdogTimeoutFactor * w.interval).String(),
+					})
+					w.cancel()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// check drains pending heartbeats and returns the first component whose last
+// beat is older than the timeout.
+func (w *Watchdog) check(now time.Time) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	timeout := watchdogTimeoutFactor * w.interval
+	for name, wc := range w.components {
+		select {
+		case <-wc.heartbeat:
+			wc.lastBeat = now
+		default:
+		}
+		if now.Sub(wc.lastBeat) > timeout {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// StartWatchdog creates the watchdog for WatchdogInterval and starts it.
+// Components started afterwards register their heartbeats with it; cancel is
+// called when one of them stalls.
+func (c *ServerConfig) StartWatchdog(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) {
+	c.watchdog = NewWatchdog(c.WatchdogInterval, cancel)
+	c.watchdog.Start(ctx, wg)
+}
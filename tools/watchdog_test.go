@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hangingFlushDB blocks every Flush until release is closed, like a Pebble
+// flush stuck on a dead disk.
+type hangingFlushDB struct {
+	PebbleDB
+	release chan struct{}
+}
+
+func (d hangingFlushDB) Flush() error {
+	<-d.release
+	return d.PebbleDB.Flush()
+}
+
+func TestWatchdogFiresForSilentComponent(t *testing.T) {
+	logs := CaptureLogs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+
+	w := NewWatchdog(20*time.Millisecond, cancel)
+	alive := w.Heartbeat("alive")
+	w.Heartbeat("blocked") // registered, never beats
+	go func() {
+		for ctx.Err() == nil {
+			Beat(alive)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	w.Start(ctx, &wg)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog did not cancel the context for a silent component")
+	}
+	wg.Wait()
+	entries := logs.Events("watchdog_timeout")
+	if len(entries) != 1 || entries[0]["component"] != "blocked" {
+		t.Errorf("watchdog_timeout entries = %v, want one for blocked", entries)
+	}
+}
+
+func TestWatchdogQuietWhileComponentsBeat(t *testing.T) {
+	logs := CaptureLogs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	w := NewWatchdog(10*time.Millisecond, cancel)
+	heartbeat := w.Heartbeat("busy")
+	w.Start(ctx, &wg)
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		Beat(heartbeat)
+		time.Sleep(2 * time.Millisecond)
+	}
+	if ctx.Err() != nil || len(logs.Events("watchdog_timeout")) != 0 {
+		t.Fatal("watchdog fired although the component kept beating")
+	}
+}
+
+func TestNilWatchdogHeartbeatIsNoop(t *testing.T) {
+	var w *Watchdog
+	heartbeat := w.Heartbeat("anything")
+	Beat(heartbeat) // must not block
+}
+
+func TestWatchdogCancelsAgentWhenFlusherHangs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for 3 one-second watchdog intervals")
+	}
+	logs := CaptureLogs(t)
+	c := newTestConfig(t, "http://unused.invalid")
+	c.WatchdogInterval = time.Second
+	release := make(chan struct{})
+	c.Db.Wrap(func(db PebbleDB) PebbleDB { return hangingFlushDB{db, release} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		close(release) // let the stuck flusher observe the cancellation
+		wg.Wait()
+	})
+	c.StartWatchdog(ctx, &wg, cancel)
+	c.FlushPebbleDBOnInterval(ctx, &wg)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("watchdog did not cancel the agent while the flusher hung")
+	}
+	entries := logs.Events("watchdog_timeout")
+	if len(entries) != 1 || entries[0]["component"] != "pebble_flusher" {
+		t.Errorf("watchdog_timeout entries = %v, want one for pebble_flusher", entries)
+	}
+}
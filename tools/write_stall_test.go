@@ -0,0 +1,86 @@
+package tools
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/datanadhi/echopost/logagentpb"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// waitFor polls cond every 10ms until it holds or timeout passes.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestWriteStallPausesIngestion(t *testing.T) {
+	c := &ServerConfig{}
+	// Tiny memtables, and L0 that holds back flushes from its first file
+	// until a compaction drains it: writes stall whenever two memtables fill
+	// up before the compaction finishes
+	db, err := OpenPebbleManager(func() (PebbleDB, error) {
+		return pebble.Open(t.TempDir(), &pebble.Options{
+			MemTableSize:                256 << 10,
+			MemTableStopWritesThreshold: 2,
+			L0CompactionThreshold:       1,
+			L0StopWritesThreshold:       1,
+			EventListener:               c.pebbleEventListener(),
+		})
+	})
+	if err != nil {
+		t.Fatalf("open pebble: %v", err)
+	}
+	c.Db = db
+	t.Cleanup(func() { _ = db.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	LeakCheck(t, func() {
+		cancel()
+		wg.Wait()
+	})
+	c.StartWriteStallDetector(ctx, &wg)
+	s := &server{config: c}
+	req := &pb.LogRequest{JsonData: `{"msg":"` + strings.Repeat("x", 1024) + `"}`, Pipelines: []string{"p1"}}
+	before := testutil.ToFloat64(pebbleWriteStallsTotal)
+
+	// Fill the memtables until a write blocks on the stall
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil && !c.pebbleBackpressure.Load() {
+			_, _ = s.SendLog(ctx, req)
+		}
+	}()
+	if !waitFor(5*time.Second, c.pebbleBackpressure.Load) {
+		t.Fatal("backpressure not set during a write stall")
+	}
+	if _, err := s.SendLog(ctx, req); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("SendLog during a stall: err = %v, want ResourceExhausted", err)
+	}
+	if got := testutil.ToFloat64(pebbleWriteStallsTotal) - before; got < 1 {
+		t.Errorf("write stall counter grew by %v, want at least 1", got)
+	}
+
+	// The writer stopped on backpressure, so compactions catch up
+	if !waitFor(5*time.Second, func() bool { return !c.pebbleBackpressure.Load() }) {
+		t.Fatal("backpressure still set after the stall ended")
+	}
+	if _, err := s.SendLog(ctx, req); err != nil {
+		t.Fatalf("SendLog after the stall: %v", err)
+	}
+}